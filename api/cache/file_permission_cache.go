@@ -0,0 +1,161 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package cache
+
+import (
+	"encoding/json"
+	"time"
+	"voltaserve/helper"
+	"voltaserve/infra"
+	"voltaserve/model"
+)
+
+/* Entries outlive their generation only until they expire */
+const filePermissionTTL = time.Hour
+
+/*
+FilePermissionCache resolves the permissions that apply to a file, the ones
+granted on it and the ones inherited from its ancestors. The result of each
+file is cached, so resolving the children of a folder reuses the folder's.
+Entries are keyed by a generation of the workspace, which is bumped whenever
+grants or the tree change, instead of invalidating every descendant.
+*/
+type FilePermissionCache struct {
+	redis     *infra.RedisManager
+	fileCache *FileCache
+	keyPrefix string
+}
+
+func NewFilePermissionCache() *FilePermissionCache {
+	return &FilePermissionCache{
+		redis:     infra.NewRedisManager(),
+		fileCache: NewFileCache(),
+		keyPrefix: "file_permission:",
+	}
+}
+
+func (c *FilePermissionCache) Get(file model.File) ([]*model.FilePermission, error) {
+	key := c.keyPrefix + file.GetWorkspaceID() + ":" + c.getGeneration(file.GetWorkspaceID()) + ":" + file.GetID()
+	value, err := c.redis.Get(key)
+	if err == nil {
+		var res []*model.FilePermission
+		if err = json.Unmarshal([]byte(value), &res); err == nil {
+			return res, nil
+		}
+	}
+	/* The file might come from the search index, whose grants aren't kept up to date */
+	file, err = c.fileCache.Get(file.GetID())
+	if err != nil {
+		return nil, err
+	}
+	var inherited []*model.FilePermission
+	if file.InheritsPermissions() {
+		/* The root of a trashed tree keeps inheriting from where it was trashed from */
+		parentID := file.GetParentID()
+		if parentID == nil {
+			parentID = file.GetTrashParentID()
+		}
+		if parentID != nil {
+			parent, err := c.fileCache.Get(*parentID)
+			if err != nil {
+				return nil, err
+			}
+			if inherited, err = c.Get(parent); err != nil {
+				return nil, err
+			}
+		}
+	}
+	res := resolveFilePermissions(file, inherited)
+	b, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.redis.SetEx(key, string(b), filePermissionTTL); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+/* Makes the cached permissions of every file of the workspace obsolete */
+func (c *FilePermissionCache) Invalidate(workspaceID string) error {
+	if _, err := c.redis.Incr(c.keyPrefix + "generation:" + workspaceID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *FilePermissionCache) getGeneration(workspaceID string) string {
+	value, err := c.redis.Get(c.keyPrefix + "generation:" + workspaceID)
+	if err != nil {
+		return "0"
+	}
+	return value
+}
+
+/*
+A grant on the file wins over the inherited one of the same user or group,
+unless it's only giving access to the path of a shared file.
+*/
+func resolveFilePermissions(file model.File, parent []*model.FilePermission) []*model.FilePermission {
+	res := make([]*model.FilePermission, 0)
+	inherited := make(map[string]*model.FilePermission)
+	for _, p := range parent {
+		if p.IsInheritable {
+			inherited[principalKey(p)] = p
+		}
+	}
+	own := make([]*model.FilePermission, 0)
+	for _, p := range file.GetUserPermissions() {
+		own = append(own, &model.FilePermission{
+			UserID:        helper.ToPtr(p.GetUserID()),
+			Value:         p.GetValue(),
+			SourceID:      file.GetID(),
+			IsInheritable: p.IsInheritable(),
+		})
+	}
+	for _, p := range file.GetGroupPermissions() {
+		own = append(own, &model.FilePermission{
+			GroupID:       helper.ToPtr(p.GetGroupID()),
+			Value:         p.GetValue(),
+			SourceID:      file.GetID(),
+			IsInheritable: p.IsInheritable(),
+		})
+	}
+	granted := make(map[string]bool)
+	for _, p := range own {
+		if _, ok := inherited[principalKey(p)]; ok && !p.IsInheritable {
+			continue
+		}
+		granted[principalKey(p)] = true
+		res = append(res, p)
+	}
+	for _, p := range parent {
+		if !p.IsInheritable || granted[principalKey(p)] {
+			continue
+		}
+		res = append(res, &model.FilePermission{
+			UserID:        p.UserID,
+			GroupID:       p.GroupID,
+			Value:         p.Value,
+			SourceID:      p.SourceID,
+			IsInherited:   true,
+			IsInheritable: true,
+		})
+	}
+	return res
+}
+
+func principalKey(p *model.FilePermission) string {
+	if p.UserID != nil {
+		return "user:" + *p.UserID
+	}
+	return "group:" + *p.GroupID
+}
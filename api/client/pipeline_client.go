@@ -36,17 +36,41 @@ const (
 	PipelineInsights  = "insights"
 	PipelineMosaic    = "mosaic"
 	PipelineWatermark = "watermark"
+	PipelineDiff      = "diff"
+)
+
+/* Payload of the diff pipeline, object keys are left out for snapshots that don't have them */
+const (
+	DiffPayloadID             = "diffId"
+	DiffPayloadBaseSnapshotID = "baseSnapshotId"
+	DiffPayloadText           = "text"
+	DiffPayloadBaseText       = "baseText"
+	DiffPayloadPreview        = "preview"
+	DiffPayloadBasePreview    = "basePreview"
+	/* The objects of the base snapshot can be in another bucket, e.g. when it predates the blob store */
+	DiffPayloadBaseBucket = "baseBucket"
 )
 
 type PipelineRunOptions struct {
-	PipelineID *string           `json:"pipelineId,omitempty"`
-	TaskID     string            `json:"taskId"`
-	SnapshotID string            `json:"snapshotId"`
-	Bucket     string            `json:"bucket"`
-	Key        string            `json:"key"`
-	Payload    map[string]string `json:"payload,omitempty"`
+	PipelineID  *string           `json:"pipelineId,omitempty"`
+	TaskID      string            `json:"taskId"`
+	SnapshotID  string            `json:"snapshotId"`
+	Bucket      string            `json:"bucket"`
+	Key         string            `json:"key"`
+	Payload     map[string]string `json:"payload,omitempty"`
+	Priority    string            `json:"priority,omitempty"`
+	UserID      string            `json:"userId,omitempty"`
+	WorkspaceID string            `json:"workspaceId,omitempty"`
+	/* What the content was detected as when it was stored */
+	ContentType string `json:"contentType,omitempty"`
+	Extension   string `json:"extension,omitempty"`
 }
 
+const (
+	PipelinePriorityInteractive = "interactive"
+	PipelinePriorityBulk        = "bulk"
+)
+
 func (cl *PipelineClient) Run(opts *PipelineRunOptions) error {
 	body, err := json.Marshal(opts)
 	if err != nil {
@@ -70,3 +94,31 @@ func (cl *PipelineClient) Run(opts *PipelineRunOptions) error {
 	}
 	return nil
 }
+
+type PipelineCancelOptions struct {
+	TaskID string `json:"taskId"`
+}
+
+func (cl *PipelineClient) Cancel(opts *PipelineCancelOptions) error {
+	body, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/v2/pipelines/cancel?api_key=%s", cl.config.ConversionURL, cl.config.Security.APIKey), bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request failed with status %d", resp.StatusCode)
+	}
+	if err := resp.Body.Close(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -12,11 +12,14 @@ package client
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"strconv"
 	"voltaserve/config"
 	"voltaserve/log"
 )
@@ -31,6 +34,7 @@ func NewWatermarkClient() *WatermarkClient {
 	}
 }
 
+/* The fields left nil fall back to the defaults of the watermark service */
 type WatermarkCreateOptions struct {
 	Path      string
 	S3Key     string
@@ -39,6 +43,14 @@ type WatermarkCreateOptions struct {
 	DateTime  string
 	Username  string
 	Workspace string
+	Values    []string
+	Text      *string
+	Color     *string
+	Opacity   *float64
+	Angle     *float64
+	Position  *string
+	Tiled     *bool
+	FontSize  *float64
 }
 
 func (cl *WatermarkClient) Create(opts WatermarkCreateOptions) error {
@@ -78,6 +90,42 @@ func (cl *WatermarkClient) Create(opts WatermarkCreateOptions) error {
 	if err = mw.WriteField("workspace", opts.Workspace); err != nil {
 		return err
 	}
+	if len(opts.Values) > 0 {
+		values, err := json.Marshal(opts.Values)
+		if err != nil {
+			return err
+		}
+		if err = mw.WriteField("values", base64.StdEncoding.EncodeToString(values)); err != nil {
+			return err
+		}
+	}
+	fields := make(map[string]string)
+	if opts.Text != nil {
+		fields["text"] = *opts.Text
+	}
+	if opts.Color != nil {
+		fields["color"] = *opts.Color
+	}
+	if opts.Opacity != nil {
+		fields["opacity"] = strconv.FormatFloat(*opts.Opacity, 'f', -1, 64)
+	}
+	if opts.Angle != nil {
+		fields["angle"] = strconv.FormatFloat(*opts.Angle, 'f', -1, 64)
+	}
+	if opts.Position != nil {
+		fields["position"] = *opts.Position
+	}
+	if opts.Tiled != nil {
+		fields["tiled"] = strconv.FormatBool(*opts.Tiled)
+	}
+	if opts.FontSize != nil {
+		fields["font_size"] = strconv.FormatFloat(*opts.FontSize, 'f', -1, 64)
+	}
+	for key, value := range fields {
+		if err = mw.WriteField(key, value); err != nil {
+			return err
+		}
+	}
 	if err := mw.Close(); err != nil {
 		return err
 	}
@@ -34,8 +34,13 @@ type Config struct {
 }
 
 type LimitsConfig struct {
-	FileUploadMB     int
-	FileProcessingMB map[string]int
+	FileUploadMB       int
+	FileProcessingMB   map[string]int
+	UploadSessionHours int
+	TrashRetentionDays int
+	ExtractMaxEntries  int
+	ExtractMaxSizeMB   int
+	ExtractMaxRatio    int
 }
 
 type DefaultsConfig struct {
@@ -65,6 +70,8 @@ type S3Config struct {
 	SecretKey string
 	Region    string
 	Secure    bool
+	/* Shared by all workspaces, holds the originals addressed by their content */
+	BlobBucket string
 }
 
 type SecurityConfig struct {
@@ -147,6 +154,7 @@ func readS3(config *Config) {
 	config.S3.AccessKey = os.Getenv("S3_ACCESS_KEY")
 	config.S3.SecretKey = os.Getenv("S3_SECRET_KEY")
 	config.S3.Region = os.Getenv("S3_REGION")
+	config.S3.BlobBucket = os.Getenv("S3_BLOB_BUCKET")
 	if len(os.Getenv("S3_SECURE")) > 0 {
 		v, err := strconv.ParseBool(os.Getenv("S3_SECURE"))
 		if err != nil {
@@ -202,6 +210,46 @@ func readLimits(config *Config) {
 		}
 		config.Limits.FileUploadMB = int(v)
 	}
+	config.Limits.UploadSessionHours = 24
+	if len(os.Getenv("LIMITS_UPLOAD_SESSION_HOURS")) > 0 {
+		v, err := strconv.ParseInt(os.Getenv("LIMITS_UPLOAD_SESSION_HOURS"), 10, 32)
+		if err != nil {
+			panic(err)
+		}
+		config.Limits.UploadSessionHours = int(v)
+	}
+	config.Limits.TrashRetentionDays = 30
+	if len(os.Getenv("LIMITS_TRASH_RETENTION_DAYS")) > 0 {
+		v, err := strconv.ParseInt(os.Getenv("LIMITS_TRASH_RETENTION_DAYS"), 10, 32)
+		if err != nil {
+			panic(err)
+		}
+		config.Limits.TrashRetentionDays = int(v)
+	}
+	config.Limits.ExtractMaxEntries = 10000
+	if len(os.Getenv("LIMITS_EXTRACT_MAX_ENTRIES")) > 0 {
+		v, err := strconv.ParseInt(os.Getenv("LIMITS_EXTRACT_MAX_ENTRIES"), 10, 32)
+		if err != nil {
+			panic(err)
+		}
+		config.Limits.ExtractMaxEntries = int(v)
+	}
+	config.Limits.ExtractMaxSizeMB = 10000
+	if len(os.Getenv("LIMITS_EXTRACT_MAX_SIZE_MB")) > 0 {
+		v, err := strconv.ParseInt(os.Getenv("LIMITS_EXTRACT_MAX_SIZE_MB"), 10, 32)
+		if err != nil {
+			panic(err)
+		}
+		config.Limits.ExtractMaxSizeMB = int(v)
+	}
+	config.Limits.ExtractMaxRatio = 100
+	if len(os.Getenv("LIMITS_EXTRACT_MAX_RATIO")) > 0 {
+		v, err := strconv.ParseInt(os.Getenv("LIMITS_EXTRACT_MAX_RATIO"), 10, 32)
+		if err != nil {
+			panic(err)
+		}
+		config.Limits.ExtractMaxRatio = int(v)
+	}
 	if len(os.Getenv("LIMITS_FILE_PROCESSING_MB")) > 0 {
 		raw := os.Getenv("LIMITS_FILE_PROCESSING_MB")
 		parts := strings.Split(raw, ",")
@@ -209,6 +209,16 @@ func NewTaskIsRunningError(err error) *ErrorResponse {
 	)
 }
 
+func NewTaskHasFailedError(err error) *ErrorResponse {
+	return NewErrorResponse(
+		"task_has_failed",
+		http.StatusBadRequest,
+		"Task has failed.",
+		"Task has already failed, dismiss it instead.",
+		err,
+	)
+}
+
 func NewTaskBelongsToAnotherUserError(err error) *ErrorResponse {
 	return NewErrorResponse(
 		"task_belongs_to_another_user",
@@ -330,6 +340,26 @@ func NewInvalidQueryParamError(param string) *ErrorResponse {
 	)
 }
 
+func NewMissingHeaderError(header string) *ErrorResponse {
+	return NewErrorResponse(
+		"missing_header",
+		http.StatusBadRequest,
+		fmt.Sprintf("Header '%s' is required.", header),
+		MsgInvalidRequest,
+		nil,
+	)
+}
+
+func NewInvalidHeaderError(header string) *ErrorResponse {
+	return NewErrorResponse(
+		"invalid_header",
+		http.StatusBadRequest,
+		fmt.Sprintf("Header '%s' is invalid.", header),
+		MsgInvalidRequest,
+		nil,
+	)
+}
+
 func NewStorageLimitExceededError() *ErrorResponse {
 	return NewErrorResponse(
 		"storage_limit_exceeded",
@@ -563,3 +593,369 @@ func NewPathVariablesAndBodyParametersNotConsistent() *ErrorResponse {
 		nil,
 	)
 }
+
+func NewUploadNotFoundError(err error) *ErrorResponse {
+	return NewErrorResponse(
+		"upload_not_found",
+		http.StatusNotFound,
+		"Upload not found.",
+		MsgResourceNotFound,
+		err,
+	)
+}
+
+func NewUploadOffsetMismatchError(expected int64, actual int64) *ErrorResponse {
+	return NewErrorResponse(
+		"upload_offset_mismatch",
+		http.StatusConflict,
+		fmt.Sprintf("Upload offset mismatch, expected %d, got %d.", expected, actual),
+		"The upload is out of sync, please resume it from the current offset.",
+		nil,
+	)
+}
+
+func NewUploadChecksumMismatchError() *ErrorResponse {
+	return NewErrorResponse(
+		"upload_checksum_mismatch",
+		460,
+		"Upload checksum mismatch.",
+		"The chunk was corrupted in transit, please send it again.",
+		nil,
+	)
+}
+
+func NewUploadChecksumAlgorithmNotSupportedError(algorithm string) *ErrorResponse {
+	return NewErrorResponse(
+		"upload_checksum_algorithm_not_supported",
+		http.StatusBadRequest,
+		fmt.Sprintf("Checksum algorithm '%s' is not supported.", algorithm),
+		MsgInvalidRequest,
+		nil,
+	)
+}
+
+func NewUploadChunkTooSmallError(minSize int64) *ErrorResponse {
+	return NewErrorResponse(
+		"upload_chunk_too_small",
+		http.StatusBadRequest,
+		fmt.Sprintf("Chunks other than the last one must be at least %d bytes.", minSize),
+		MsgInvalidRequest,
+		nil,
+	)
+}
+
+func NewUploadChunkExceedsSizeError() *ErrorResponse {
+	return NewErrorResponse(
+		"upload_chunk_exceeds_size",
+		http.StatusRequestEntityTooLarge,
+		"Chunk exceeds the declared upload size.",
+		MsgInvalidRequest,
+		nil,
+	)
+}
+
+func NewUploadIncompleteError(upload model.Upload) *ErrorResponse {
+	return NewErrorResponse(
+		"upload_incomplete",
+		http.StatusBadRequest,
+		fmt.Sprintf("Upload (%s) has %d of %d bytes.", upload.GetID(), upload.GetOffset(), upload.GetSize()),
+		"The upload is not complete yet.",
+		nil,
+	)
+}
+
+func NewUploadLockedError() *ErrorResponse {
+	return NewErrorResponse(
+		"upload_locked",
+		http.StatusLocked,
+		"Upload is locked by another request.",
+		"Another chunk of this upload is being written, please try again.",
+		nil,
+	)
+}
+
+func NewShareLinkNotFoundError(err error) *ErrorResponse {
+	return NewErrorResponse(
+		"share_link_not_found",
+		http.StatusNotFound,
+		"Share link not found.",
+		"This link doesn't exist or has been revoked.",
+		err,
+	)
+}
+
+func NewShareLinkExpiredError() *ErrorResponse {
+	return NewErrorResponse(
+		"share_link_expired",
+		http.StatusGone,
+		"Share link expired.",
+		"This link has expired.",
+		nil,
+	)
+}
+
+func NewShareLinkPasswordRequiredError() *ErrorResponse {
+	return NewErrorResponse(
+		"share_link_password_required",
+		http.StatusUnauthorized,
+		"Share link requires a password.",
+		"This link is protected by a password.",
+		nil,
+	)
+}
+
+func NewShareLinkPasswordInvalidError() *ErrorResponse {
+	return NewErrorResponse(
+		"share_link_password_invalid",
+		http.StatusUnauthorized,
+		"Share link password is invalid.",
+		"The password is incorrect.",
+		nil,
+	)
+}
+
+func NewShareLinkUnlockRateLimitedError() *ErrorResponse {
+	return NewErrorResponse(
+		"share_link_unlock_rate_limited",
+		http.StatusTooManyRequests,
+		"Too many unlock attempts for share link.",
+		"Too many attempts, please try again later.",
+		nil,
+	)
+}
+
+func NewShareLinkDownloadLimitReachedError() *ErrorResponse {
+	return NewErrorResponse(
+		"share_link_download_limit_reached",
+		http.StatusForbidden,
+		"Share link download limit reached.",
+		"This link has reached its download limit.",
+		nil,
+	)
+}
+
+func NewShareLinkPreviewOnlyError() *ErrorResponse {
+	return NewErrorResponse(
+		"share_link_preview_only",
+		http.StatusForbidden,
+		"Share link only allows previews.",
+		"This link only allows viewing the file.",
+		nil,
+	)
+}
+
+func NewFileNotInShareLinkError() *ErrorResponse {
+	return NewErrorResponse(
+		"file_not_in_share_link",
+		http.StatusNotFound,
+		"File is not part of the share link.",
+		MsgResourceNotFound,
+		nil,
+	)
+}
+
+func NewInvalidExpireTimeError() *ErrorResponse {
+	return NewErrorResponse(
+		"invalid_expire_time",
+		http.StatusBadRequest,
+		"Expire time must be an RFC 3339 time in the future.",
+		MsgInvalidRequest,
+		nil,
+	)
+}
+
+func NewFileNotInTrashError(file model.File) *ErrorResponse {
+	return NewErrorResponse(
+		"file_not_in_trash",
+		http.StatusBadRequest,
+		fmt.Sprintf("File '%s' (%s) is not in the trash.", file.GetName(), file.GetID()),
+		fmt.Sprintf("Item '%s' is not in the trash.", file.GetName()),
+		nil,
+	)
+}
+
+func NewRestoreTargetRequiredError(file model.File) *ErrorResponse {
+	return NewErrorResponse(
+		"restore_target_required",
+		http.StatusConflict,
+		fmt.Sprintf("The original location of file '%s' (%s) is no longer available, a target is required.", file.GetName(), file.GetID()),
+		fmt.Sprintf("The original location of '%s' is no longer available, choose where to restore it.", file.GetName()),
+		nil,
+	)
+}
+
+func NewSnapshotDiffNotFoundError(err error) *ErrorResponse {
+	return NewErrorResponse(
+		"snapshot_diff_not_found",
+		http.StatusNotFound,
+		"Snapshot diff not found.",
+		MsgResourceNotFound,
+		err,
+	)
+}
+
+func NewBlobNotFoundError(err error) *ErrorResponse {
+	return NewErrorResponse(
+		"blob_not_found",
+		http.StatusNotFound,
+		"Blob not found.",
+		MsgResourceNotFound,
+		err,
+	)
+}
+
+func NewSnapshotsNotOfSameFileError() *ErrorResponse {
+	return NewErrorResponse(
+		"snapshots_not_of_same_file",
+		http.StatusBadRequest,
+		"Snapshots must be versions of the same file.",
+		"Only versions of the same file can be compared.",
+		nil,
+	)
+}
+
+func NewArchiveFormatNotSupportedError() *ErrorResponse {
+	return NewErrorResponse(
+		"archive_format_not_supported",
+		http.StatusBadRequest,
+		"Only ZIP, tar, tar.gz and 7z archives can be extracted.",
+		"This file is not an archive that can be extracted.",
+		nil,
+	)
+}
+
+func NewArchiveEntryPathInvalidError(entryPath string) *ErrorResponse {
+	return NewErrorResponse(
+		"archive_entry_path_invalid",
+		http.StatusBadRequest,
+		fmt.Sprintf("Archive entry '%s' points outside of the archive.", entryPath),
+		"The archive contains unsafe paths and can't be extracted.",
+		nil,
+	)
+}
+
+func NewArchiveLimitExceededError(reason string) *ErrorResponse {
+	return NewErrorResponse(
+		"archive_limit_exceeded",
+		http.StatusBadRequest,
+		fmt.Sprintf("Archive exceeds the extraction limits: %s.", reason),
+		"The archive is too large to be extracted.",
+		nil,
+	)
+}
+
+func NewWatermarkTemplateNotFoundError(err error) *ErrorResponse {
+	return NewErrorResponse(
+		"watermark_template_not_found",
+		http.StatusNotFound,
+		"Watermark template not found.",
+		MsgResourceNotFound,
+		err,
+	)
+}
+
+func NewInvalidWatermarkTemplateError(reason string) *ErrorResponse {
+	return NewErrorResponse(
+		"invalid_watermark_template",
+		http.StatusBadRequest,
+		fmt.Sprintf("Watermark template is invalid: %s.", reason),
+		MsgInvalidRequest,
+		nil,
+	)
+}
+
+func NewRoleNotFoundError(err error) *ErrorResponse {
+	return NewErrorResponse(
+		"role_not_found",
+		http.StatusNotFound,
+		"Role not found.",
+		MsgResourceNotFound,
+		err,
+	)
+}
+
+func NewRoleIsGrantedError() *ErrorResponse {
+	return NewErrorResponse(
+		"role_is_granted",
+		http.StatusBadRequest,
+		"Role is still granted on some files.",
+		"This role is in use, revoke it from the files that use it first.",
+		nil,
+	)
+}
+
+func NewInvalidCapabilityError(capability string) *ErrorResponse {
+	return NewErrorResponse(
+		"invalid_capability",
+		http.StatusBadRequest,
+		fmt.Sprintf("Capability '%s' doesn't exist.", capability),
+		MsgInvalidRequest,
+		nil,
+	)
+}
+
+func NewInvalidPermissionError(permission string) *ErrorResponse {
+	return NewErrorResponse(
+		"invalid_permission",
+		http.StatusBadRequest,
+		fmt.Sprintf("Permission '%s' is neither a built-in role nor a role of the organization.", permission),
+		MsgInvalidRequest,
+		nil,
+	)
+}
+
+func NewPermissionExceedsOwnError(userID string, file model.File, permission string) *ErrorResponse {
+	return NewErrorResponse(
+		"permission_exceeds_own",
+		http.StatusForbidden,
+		fmt.Sprintf(
+			"User '%s' cannot grant the permission '%s' for the file '%s' (%s), it allows more than their own.",
+			userID, permission, file.GetName(), file.GetID(),
+		),
+		fmt.Sprintf("Sorry, you can't grant more than your own permissions for the item '%s'.", file.GetName()),
+		nil,
+	)
+}
+
+func NewAssigneeExceedsOwnPermissionError(userID string, file model.File) *ErrorResponse {
+	return NewErrorResponse(
+		"assignee_exceeds_own_permission",
+		http.StatusForbidden,
+		fmt.Sprintf(
+			"User '%s' cannot change the permission of someone who can do more than them on the file '%s' (%s).",
+			userID, file.GetName(), file.GetID(),
+		),
+		fmt.Sprintf("Sorry, you can't change the permissions of someone who can do more than you on the item '%s'.", file.GetName()),
+		nil,
+	)
+}
+
+func NewCannotRemoveLastRemainingOwnerOfFileError(file model.File) *ErrorResponse {
+	return NewErrorResponse(
+		"cannot_remove_last_owner_of_file",
+		http.StatusBadRequest,
+		fmt.Sprintf("Cannot remove the last remaining owner of file '%s' (%s).", file.GetName(), file.GetID()),
+		fmt.Sprintf("The item '%s' needs to keep at least one owner.", file.GetName()),
+		nil,
+	)
+}
+
+func NewWatermarkRequiredError(file model.File) *ErrorResponse {
+	return NewErrorResponse(
+		"watermark_required",
+		http.StatusForbidden,
+		fmt.Sprintf("File '%s' (%s) can only be downloaded watermarked, which its type doesn't support.", file.GetName(), file.GetID()),
+		fmt.Sprintf("Sorry, the item '%s' can't be downloaded.", file.GetName()),
+		nil,
+	)
+}
+
+func NewCannotGrantPermissionToSelfError() *ErrorResponse {
+	return NewErrorResponse(
+		"cannot_grant_permission_to_self",
+		http.StatusBadRequest,
+		"Cannot grant a permission to oneself.",
+		"You can't grant permissions to yourself.",
+		nil,
+	)
+}
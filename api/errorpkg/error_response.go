@@ -10,7 +10,11 @@
 
 package errorpkg
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
 
 type ErrorResponse struct {
 	Code        string `json:"code"`
@@ -39,3 +43,9 @@ func (err ErrorResponse) Error() string {
 func (err ErrorResponse) Unwrap() error {
 	return err.Err
 }
+
+/* Whether err is, or wraps, one of the *_not_found errors */
+func IsNotFound(err error) bool {
+	var res *ErrorResponse
+	return errors.As(err, &res) && res.Status == http.StatusNotFound
+}
@@ -11,51 +11,116 @@
 package guard
 
 import (
+	"slices"
 	"voltaserve/cache"
 	"voltaserve/errorpkg"
 	"voltaserve/log"
 	"voltaserve/model"
 )
 
+/*
+FileGuard checks capabilities, which come from the roles the user holds on the
+file, directly or through a group, granted on the file or inherited from an
+ancestor. A role is either built-in or one of the custom roles of the organization.
+*/
 type FileGuard struct {
-	groupCache *cache.GroupCache
+	groupCache          *cache.GroupCache
+	roleCache           *cache.RoleCache
+	filePermissionCache *cache.FilePermissionCache
 }
 
 func NewFileGuard() *FileGuard {
 	return &FileGuard{
-		groupCache: cache.NewGroupCache(),
+		groupCache:          cache.NewGroupCache(),
+		roleCache:           cache.NewRoleCache(),
+		filePermissionCache: cache.NewFilePermissionCache(),
 	}
 }
 
-func (g *FileGuard) IsAuthorized(userID string, file model.File, permission string) bool {
-	for _, p := range file.GetUserPermissions() {
-		if p.GetUserID() == userID && model.IsEquivalentPermission(p.GetValue(), permission) {
-			return true
+func (g *FileGuard) IsAuthorized(userID string, file model.File, capability string) bool {
+	return slices.Contains(g.GetCapabilities(userID, file), capability)
+}
+
+/* Trashed files are only reachable through the trash, which uses IsAuthorized */
+func (g *FileGuard) Authorize(userID string, file model.File, capability string) error {
+	if file.IsTrashed() {
+		return errorpkg.NewFileNotFoundError(nil)
+	}
+	capabilities := g.GetCapabilities(userID, file)
+	if !slices.Contains(capabilities, capability) {
+		err := errorpkg.NewFilePermissionError(userID, file, capability)
+		if slices.Contains(capabilities, model.CapabilityRead) {
+			return err
+		} else {
+			return errorpkg.NewOrganizationNotFoundError(err)
 		}
 	}
-	for _, p := range file.GetGroupPermissions() {
-		g, err := g.groupCache.Get(p.GetGroupID())
+	return nil
+}
+
+/* The union of the capabilities of every role the user holds on the file */
+func (g *FileGuard) GetCapabilities(userID string, file model.File) []string {
+	var roles []string
+	for _, p := range g.GetPermissions(file) {
+		if p.UserID != nil {
+			if *p.UserID == userID {
+				roles = append(roles, p.Value)
+			}
+			continue
+		}
+		group, err := g.groupCache.Get(*p.GroupID)
 		if err != nil {
 			log.GetLogger().Error(err)
-			return false
+			continue
 		}
-		for _, u := range g.GetUsers() {
-			if u == userID && model.IsEquivalentPermission(p.GetValue(), permission) {
-				return true
-			}
+		if slices.Contains(group.GetUsers(), userID) {
+			roles = append(roles, p.Value)
 		}
 	}
-	return false
+	return g.getCapabilities(roles)
 }
 
-func (g *FileGuard) Authorize(userID string, file model.File, permission string) error {
-	if !g.IsAuthorized(userID, file, permission) {
-		err := errorpkg.NewFilePermissionError(userID, file, permission)
-		if g.IsAuthorized(userID, file, model.PermissionViewer) {
-			return err
-		} else {
-			return errorpkg.NewOrganizationNotFoundError(err)
+/* The capabilities of the role the group holds on the file, not the ones its members hold otherwise */
+func (g *FileGuard) GetGroupCapabilities(groupID string, file model.File) []string {
+	var roles []string
+	for _, p := range g.GetPermissions(file) {
+		if p.GroupID != nil && *p.GroupID == groupID {
+			roles = append(roles, p.Value)
 		}
 	}
-	return nil
+	return g.getCapabilities(roles)
+}
+
+func (g *FileGuard) getCapabilities(roles []string) []string {
+	res := make([]string, 0)
+	for _, role := range roles {
+		for _, c := range g.getRoleCapabilities(role) {
+			if !slices.Contains(res, c) {
+				res = append(res, c)
+			}
+		}
+	}
+	return res
+}
+
+/* The permissions that apply to the file, none if they can't be resolved */
+func (g *FileGuard) GetPermissions(file model.File) []*model.FilePermission {
+	res, err := g.filePermissionCache.Get(file)
+	if err != nil {
+		log.GetLogger().Error(err)
+		return nil
+	}
+	return res
+}
+
+func (g *FileGuard) getRoleCapabilities(role string) []string {
+	if model.IsBuiltinRole(role) {
+		return model.GetBuiltinCapabilities(role)
+	}
+	res, err := g.roleCache.Get(role)
+	if err != nil {
+		log.GetLogger().Error(err)
+		return nil
+	}
+	return res.GetCapabilities()
 }
@@ -18,3 +18,12 @@ func Includes(arr []string, str string) bool {
 	}
 	return false
 }
+
+/* Splits the array in consecutive chunks of at most size elements */
+func Chunk(arr []string, size int) [][]string {
+	var res [][]string
+	for i := 0; i < len(arr); i += size {
+		res = append(res, arr[i:min(i+size, len(arr))])
+	}
+	return res
+}
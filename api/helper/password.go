@@ -0,0 +1,62 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package helper
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+/* Same format as the IdP, '<key>:<salt>' in hex, derived with scrypt */
+func HashPassword(password string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	salt := hex.EncodeToString(b)
+	key, err := scrypt.Key([]byte(password), []byte(salt), 16384, 8, 1, 64)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key) + ":" + salt, nil
+}
+
+func VerifyPassword(password string, hash string) bool {
+	key, salt, ok := strings.Cut(hash, ":")
+	if !ok {
+		return false
+	}
+	newKey, err := scrypt.Key([]byte(password), []byte(salt), 16384, 8, 1, 64)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(newKey)), []byte(key)) == 1
+}
+
+/* A random URL safe secret, meant to be handed out once and stored hashed */
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func HashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -13,190 +13,247 @@ package infra
 import (
 	"archive/zip"
 	"encoding/json"
+	"io"
+	"mime"
+	"os"
 	"path/filepath"
 	"strings"
 	"voltaserve/config"
+
+	"github.com/gabriel-vasile/mimetype"
 )
 
-type FileIdentifier struct {
-	config *config.Config
+var PDFExtensions = []string{
+	".pdf",
 }
 
-func NewFileIdentifier() *FileIdentifier {
-	return &FileIdentifier{
-		config: config.GetConfig(),
-	}
+var OfficeExtensions = []string{
+	".xls",
+	".doc",
+	".ppt",
+	".xlsx",
+	".docx",
+	".pptx",
+	".odt",
+	".ott",
+	".ods",
+	".ots",
+	".odp",
+	".otp",
+	".odg",
+	".otg",
+	".odf",
+	".odc",
+	".rtf",
 }
 
-func (fi *FileIdentifier) IsPDF(path string) bool {
-	return strings.ToLower(filepath.Ext(path)) == ".pdf"
+var PlainTextExtensions = []string{
+	".txt",
+	".html",
+	".js",
+	".jsx",
+	".ts",
+	".tsx",
+	".css",
+	".sass",
+	".scss",
+	".go",
+	".py",
+	".rb",
+	".java",
+	".c",
+	".h",
+	".cpp",
+	".hpp",
+	".json",
+	".yml",
+	".yaml",
+	".toml",
+	".md",
 }
 
-func (fi *FileIdentifier) IsOffice(path string) bool {
-	extensions := []string{
-		".xls",
-		".doc",
-		".ppt",
-		".xlsx",
-		".docx",
-		".pptx",
-		".odt",
-		".ott",
-		".ods",
-		".ots",
-		".odp",
-		".otp",
-		".odg",
-		".otg",
-		".odf",
-		".odc",
-		".rtf",
-	}
-	extension := filepath.Ext(path)
+var ImageExtensions = []string{
+	".xpm",
+	".png",
+	".jpg",
+	".jpeg",
+	".jp2",
+	".gif",
+	".webp",
+	".tiff",
+	".bmp",
+	".ico",
+	".heif",
+	".heic",
+	".xcf",
+	".svg",
+}
+
+var VideoExtensions = []string{
+	".ogv",
+	".mpeg",
+	".mov",
+	".mqv",
+	".mp4",
+	".webm",
+	".3gp",
+	".3g2",
+	".avi",
+	".flv",
+	".mkv",
+	".asf",
+	".m4v",
+}
+
+var AudioExtensions = []string{
+	".oga",
+	".ogg",
+	".mp3",
+	".flac",
+	".midi",
+	".ape",
+	".mpc",
+	".amr",
+	".wav",
+	".aiff",
+	".au",
+	".aac",
+	".voc",
+	".m4a",
+	".qcp",
+}
+
+var GLBExtensions = []string{
+	".glb",
+}
+
+var ZIPExtensions = []string{
+	".zip",
+	".zipx",
+}
+
+/* Compares the path's extension case-insensitively */
+func HasExtension(path string, extensions []string) bool {
+	extension := strings.ToLower(filepath.Ext(path))
 	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
+		if extension == v {
 			return true
 		}
 	}
 	return false
 }
 
-func (fi *FileIdentifier) IsPlainText(path string) bool {
-	extensions := []string{
-		".txt",
-		".html",
-		".js",
-		"jsx",
-		".ts",
-		".tsx",
-		".css",
-		".sass",
-		".scss",
-		".go",
-		".py",
-		".rb",
-		".java",
-		".c",
-		".h",
-		".cpp",
-		".hpp",
-		".json",
-		".yml",
-		".yaml",
-		".toml",
-		".md",
-	}
-	extension := filepath.Ext(path)
-	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
-			return true
-		}
+/* Number of bytes at the start of a file that content detection looks at */
+const DetectionHeaderSize = 3072
+
+type FileType struct {
+	MIME string
+	/* Matches the content, with the leading dot */
+	Extension string
+	/* The content contradicts the extension of the path */
+	Mismatch bool
+}
+
+/*
+Content types that are too generic to contradict an extension, with the
+extensions they're compatible with, nil meaning any. Source code is just
+text/plain and a DOCX is a ZIP archive, for example. The first match wins.
+*/
+var ambiguousMIMETypes = []struct {
+	mime       string
+	extensions []string
+}{
+	{mime: "application/octet-stream", extensions: nil},
+	{mime: "text/plain", extensions: nil},
+	{mime: "application/x-ole-storage", extensions: OfficeExtensions},
+	{mime: "application/zip", extensions: append(append([]string{}, OfficeExtensions...), ZIPExtensions...)},
+}
+
+type FileIdentifier struct {
+	config *config.Config
+}
+
+func NewFileIdentifier() *FileIdentifier {
+	return &FileIdentifier{
+		config: config.GetConfig(),
 	}
-	return false
 }
 
-func (fi *FileIdentifier) IsImage(path string) bool {
-	extensions := []string{
-		".xpm",
-		".png",
-		".jpg",
-		".jpeg",
-		".jp2",
-		".gif",
-		".webp",
-		".tiff",
-		".bmp",
-		".ico",
-		".heif",
-		".xcf",
-		".svg",
+/*
+Detects the file type from the magic bytes at the start of the content,
+the extension of the path is only used as a hint when the content is
+ambiguous.
+*/
+func (fi *FileIdentifier) Detect(header []byte, path string) FileType {
+	m := mimetype.Detect(header)
+	extension := strings.ToLower(filepath.Ext(path))
+	for _, t := range ambiguousMIMETypes {
+		if m.Is(t.mime) && extension != "" && (t.extensions == nil || HasExtension(extension, t.extensions)) {
+			res := FileType{MIME: m.String(), Extension: extension}
+			if byExtension := mime.TypeByExtension(extension); byExtension != "" {
+				res.MIME = byExtension
+			}
+			return res
+		}
 	}
-	extension := filepath.Ext(path)
-	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
-			return true
+	byExtension := mime.TypeByExtension(extension)
+	/* The root of the hierarchy matches everything, so it's left out */
+	for p := m; p != nil && !p.Is("application/octet-stream"); p = p.Parent() {
+		if p.Extension() == extension || (byExtension != "" && p.Is(byExtension)) {
+			return FileType{MIME: m.String(), Extension: extension}
 		}
 	}
-	return false
+	return FileType{
+		MIME:      m.String(),
+		Extension: m.Extension(),
+		Mismatch:  extension != "" || m.Extension() != "",
+	}
 }
 
-func (fi *FileIdentifier) IsVideo(path string) bool {
-	extensions := []string{
-		".ogv",
-		".mpeg",
-		".mov",
-		".mqv",
-		".mp4",
-		".webm",
-		".3gp",
-		".3g2",
-		".avi",
-		".flv",
-		".mkv",
-		".asf",
-		".m4v",
+func (fi *FileIdentifier) DetectFromFile(path string) (FileType, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileType{}, err
 	}
-	extension := filepath.Ext(path)
-	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
-			return true
-		}
+	defer f.Close()
+	header := make([]byte, DetectionHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return FileType{}, err
 	}
-	return false
+	return fi.Detect(header[:n], path), nil
+}
+
+func (fi *FileIdentifier) IsPDF(path string) bool {
+	return HasExtension(path, PDFExtensions)
+}
+
+func (fi *FileIdentifier) IsOffice(path string) bool {
+	return HasExtension(path, OfficeExtensions)
+}
+
+func (fi *FileIdentifier) IsPlainText(path string) bool {
+	return HasExtension(path, PlainTextExtensions)
+}
+
+func (fi *FileIdentifier) IsImage(path string) bool {
+	return HasExtension(path, ImageExtensions)
+}
+
+func (fi *FileIdentifier) IsVideo(path string) bool {
+	return HasExtension(path, VideoExtensions)
 }
 
 func (fi *FileIdentifier) IsAudio(path string) bool {
-	extensions := []string{
-		".oga",
-		".ogg",
-		".mp3",
-		".flac",
-		".midi",
-		".ape",
-		".mpc",
-		".amr",
-		".wav",
-		".aiff",
-		".au",
-		".aac",
-		"voc",
-		".m4a",
-		".qcp",
-	}
-	extension := filepath.Ext(path)
-	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
-			return true
-		}
-	}
-	return false
+	return HasExtension(path, AudioExtensions)
 }
 
 func (fi *FileIdentifier) IsGLB(path string) bool {
-	extensions := []string{
-		".glb",
-	}
-	extension := filepath.Ext(path)
-	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
-			return true
-		}
-	}
-	return false
+	return HasExtension(path, GLBExtensions)
 }
 
 func (fi *FileIdentifier) IsZIP(path string) bool {
-	extensions := []string{
-		".zip",
-		".zipx",
-	}
-	extension := filepath.Ext(path)
-	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
-			return true
-		}
-	}
-	return false
+	return HasExtension(path, ZIPExtensions)
 }
 
 type GLTF struct {
@@ -245,25 +302,27 @@ func (fi *FileIdentifier) IsGLTF(path string) (bool, error) {
 	return hasGLTF && (!hasBin || (hasBin && gltfFile != nil)), nil
 }
 
-func (fi *FileIdentifier) GetProcessingLimitMB(path string) int {
+/* The limit depends on what the content is, not on what the extension claims */
+func (fi *FileIdentifier) GetProcessingLimitMB(path string, fileType FileType) int {
 	var res int
-	if fi.IsAudio(path) {
+	extension := fileType.Extension
+	if fi.IsAudio(extension) {
 		res = fi.config.Limits.GetFileProcessingMB(config.FileTypeAudio)
-	} else if fi.IsImage(path) {
+	} else if fi.IsImage(extension) {
 		res = fi.config.Limits.GetFileProcessingMB(config.FileTypeImage)
-	} else if fi.IsOffice(path) {
+	} else if fi.IsOffice(extension) {
 		res = fi.config.Limits.GetFileProcessingMB(config.FileTypeOffice)
-	} else if fi.IsPDF(path) {
+	} else if fi.IsPDF(extension) {
 		res = fi.config.Limits.GetFileProcessingMB(config.FileTypePDF)
-	} else if fi.IsPlainText(path) {
+	} else if fi.IsPlainText(extension) {
 		res = fi.config.Limits.GetFileProcessingMB(config.FileTypePlainText)
-	} else if fi.IsVideo(path) {
+	} else if fi.IsVideo(extension) {
 		res = fi.config.Limits.GetFileProcessingMB(config.FileTypeVideo)
-	} else if fi.IsGLB(path) {
+	} else if fi.IsGLB(extension) {
 		res = fi.config.Limits.GetFileProcessingMB(config.FileTypeGLB)
-	} else if fi.IsZIP(path) {
+	} else if fi.IsZIP(extension) {
 		res = fi.config.Limits.GetFileProcessingMB(config.FileTypeZIP)
-	} else if ok, err := fi.IsGLTF(path); ok && err != nil {
+	} else if ok, err := fi.IsGLTF(path); err == nil && ok {
 		res = fi.config.Limits.GetFileProcessingMB(config.FileTypeGLTF)
 	} else {
 		res = fi.config.Limits.GetFileProcessingMB(config.FileTypeEverythingElse)
@@ -0,0 +1,202 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package infra
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+	"voltaserve/log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+)
+
+/*
+ObjectServer streams S3 objects to HTTP responses, the data goes from S3 to
+the client as it's read, nothing is buffered beyond what the transport needs.
+*/
+type ObjectServer struct {
+	s3 *S3Manager
+}
+
+type ObjectServeOptions struct {
+	Bucket string
+	Key    string
+	/* Falls back to the content type stored in S3 */
+	ContentType string
+	Filename    string
+}
+
+func NewObjectServer() *ObjectServer {
+	return &ObjectServer{
+		s3: NewS3Manager(),
+	}
+}
+
+/* Supports conditional requests with If-None-Match, If-Modified-Since and If-Range, and multiple ranges */
+func (s *ObjectServer) Serve(c *fiber.Ctx, opts ObjectServeOptions) error {
+	info, err := s.s3.StatObject(opts.Key, opts.Bucket, minio.StatObjectOptions{})
+	if err != nil {
+		return err
+	}
+	etag := "\"" + strings.Trim(info.ETag, "\"") + "\""
+	lastModified := info.LastModified.UTC().Truncate(time.Second)
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = info.ContentType
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Set("Accept-Ranges", "bytes")
+	c.Set("ETag", etag)
+	c.Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	/* Downloads require authentication, let only the browser cache them, and revalidate every time */
+	c.Set("Cache-Control", "private, no-cache")
+	if opts.Filename != "" {
+		c.Set("Content-Disposition", fmt.Sprintf("filename=\"%s\"", opts.Filename))
+	}
+	if s.isNotModified(c, etag, lastModified) {
+		return c.SendStatus(http.StatusNotModified)
+	}
+	var ranges []ByteRange
+	if c.Get("Range") != "" && s.isRangeApplicable(c.Get("If-Range"), etag, lastModified) {
+		ranges, err = ParseRange(c.Get("Range"), info.Size)
+		if errors.Is(err, ErrRangeNotSatisfiable) {
+			c.Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+			return c.SendStatus(http.StatusRequestedRangeNotSatisfiable)
+		}
+	}
+	isHead := c.Method() == fiber.MethodHead
+	/* Makes sure every read is of the version we sent the headers for */
+	getOpts := func() minio.GetObjectOptions {
+		res := minio.GetObjectOptions{}
+		_ = res.SetMatchETag(strings.Trim(info.ETag, "\""))
+		return res
+	}
+	switch len(ranges) {
+	case 0:
+		c.Set("Content-Type", contentType)
+		if isHead {
+			c.Response().Header.SetContentLength(int(info.Size))
+			return nil
+		}
+		reader, err := s.s3.GetObjectReader(opts.Key, opts.Bucket, getOpts())
+		if err != nil {
+			return err
+		}
+		return c.SendStream(reader, int(info.Size))
+	case 1:
+		r := ranges[0]
+		c.Status(http.StatusPartialContent)
+		c.Set("Content-Type", contentType)
+		c.Set("Content-Range", r.ContentRange(info.Size))
+		if isHead {
+			c.Response().Header.SetContentLength(int(r.Length()))
+			return nil
+		}
+		readerOpts := getOpts()
+		if err := readerOpts.SetRange(r.Start, r.End); err != nil {
+			return err
+		}
+		reader, err := s.s3.GetObjectReader(opts.Key, opts.Bucket, readerOpts)
+		if err != nil {
+			return err
+		}
+		return c.SendStream(reader, int(r.Length()))
+	default:
+		pr, pw := io.Pipe()
+		mw := multipart.NewWriter(pw)
+		c.Status(http.StatusPartialContent)
+		c.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		if isHead {
+			return nil
+		}
+		go func() {
+			pw.CloseWithError(s.writeRanges(mw, opts, contentType, info.Size, ranges, getOpts))
+		}()
+		/* The length is unknown upfront, the response is chunked */
+		return c.SendStream(pr, -1)
+	}
+}
+
+func (s *ObjectServer) writeRanges(mw *multipart.Writer, opts ObjectServeOptions, contentType string, size int64, ranges []ByteRange, getOpts func() minio.GetObjectOptions) error {
+	for _, r := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {contentType},
+			"Content-Range": {r.ContentRange(size)},
+		})
+		if err != nil {
+			return err
+		}
+		readerOpts := getOpts()
+		if err := readerOpts.SetRange(r.Start, r.End); err != nil {
+			return err
+		}
+		reader, err := s.s3.GetObjectReader(opts.Key, opts.Bucket, readerOpts)
+		if err != nil {
+			log.GetLogger().Error(err)
+			return err
+		}
+		_, err = io.Copy(part, reader)
+		if closeErr := reader.Close(); closeErr != nil {
+			log.GetLogger().Error(closeErr)
+		}
+		if err != nil {
+			/* Most likely the client went away */
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func (s *ObjectServer) isNotModified(c *fiber.Ctx, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := c.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			/* Weak comparison, as required for If-None-Match */
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		/* If-Modified-Since is ignored when If-None-Match is present */
+		return false
+	}
+	if ifModifiedSince := c.Get("If-Modified-Since"); ifModifiedSince != "" {
+		t, err := http.ParseTime(ifModifiedSince)
+		if err == nil && !lastModified.After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+/* A Range is honored only if the client's copy is the current one, otherwise the whole object is sent */
+func (s *ObjectServer) isRangeApplicable(ifRange string, etag string, lastModified time.Time) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") || strings.HasPrefix(ifRange, "W/") {
+		/* Strong comparison, a weak validator never matches */
+		return ifRange == etag
+	}
+	t, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	return t.Equal(lastModified)
+}
@@ -11,65 +11,111 @@
 package infra
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
-
-	"github.com/gofiber/fiber/v2"
-	"github.com/minio/minio-go/v7"
 )
 
-const (
-	MaxRangeSize     = 250 * 1024 * 1024 // 250 MB
-	DefaultChunkSize = 250 * 1024 * 1024 // Default size to serve for open-ended ranges
-)
+/* Requests with more ranges than this get the whole object instead */
+const MaxRangeCount = 16
+
+var ErrRangeNotSatisfiable = errors.New("range not satisfiable")
 
-type RangeInterval struct {
-	Start    int64
-	End      int64
-	FileSize int64
+type ByteRange struct {
+	Start int64
+	End   int64
 }
 
-func NewRangeInterval(header string, fileSize int64) *RangeInterval {
-	ri := &RangeInterval{FileSize: fileSize}
-	if header != "" {
-		parts := strings.Split(header, "=")
-		if len(parts) == 2 {
-			ranges := strings.Split(parts[1], "-")
-			ri.Start, _ = strconv.ParseInt(ranges[0], 10, 64)
-			if len(ranges) > 1 && ranges[1] != "" {
-				ri.End, _ = strconv.ParseInt(ranges[1], 10, 64)
-			} else {
-				// Indicates an open-ended range
-				ri.End = 0
-			}
-		}
-	}
-	ri.adjustRange()
-	return ri
+func (r ByteRange) Length() int64 {
+	return r.End - r.Start + 1
 }
 
-func (ri *RangeInterval) adjustRange() {
-	/* For open-ended ranges, serve 250 MB */
-	if ri.End == 0 {
-		ri.End = ri.Start + DefaultChunkSize - 1
+func (r ByteRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End, size)
+}
+
+/*
+Parses a Range header as per RFC 9110, overlapping and adjacent ranges are
+merged. Returns nil when the header should be ignored, in which case the
+whole object is served, and ErrRangeNotSatisfiable when none of the ranges
+fall within the object.
+*/
+func ParseRange(header string, size int64) ([]ByteRange, error) {
+	unit, spec, ok := strings.Cut(header, "=")
+	if !ok || strings.TrimSpace(unit) != "bytes" {
+		return nil, nil
 	}
-	/* Ensure the end is within file size limits */
-	if ri.End >= ri.FileSize {
-		ri.End = ri.FileSize - 1
+	var res []ByteRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, nil
+		}
+		var r ByteRange
+		if first == "" {
+			/* Suffix range, e.g. 'bytes=-500' is the last 500 bytes */
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = ByteRange{Start: size - n, End: size - 1}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r = ByteRange{Start: start, End: end}
+		}
+		res = append(res, r)
 	}
-	/* Ensure the range size is within limits for closed ranges */
-	if ri.End-ri.Start+1 > MaxRangeSize && ri.End != 0 {
-		ri.End = ri.Start + MaxRangeSize - 1
+	if len(res) == 0 {
+		return nil, ErrRangeNotSatisfiable
 	}
+	if len(res) > MaxRangeCount {
+		return nil, nil
+	}
+	return mergeRanges(res), nil
 }
 
-func (ri RangeInterval) ApplyToMinIOGetObjectOptions(opts *minio.GetObjectOptions) {
-	opts.SetRange(ri.Start, ri.End)
-}
-
-func (ri RangeInterval) ApplyToFiberContext(ctx *fiber.Ctx) {
-	ctx.Set("Accept-Ranges", "bytes")
-	ctx.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", ri.Start, ri.End, ri.FileSize))
-	ctx.Set("Content-Length", fmt.Sprintf("%d", ri.End-ri.Start+1))
+func mergeRanges(ranges []ByteRange) []ByteRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Start < ranges[j].Start
+	})
+	res := []ByteRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &res[len(res)-1]
+		if r.Start <= last.End+1 {
+			if r.End > last.End {
+				last.End = r.End
+			}
+		} else {
+			res = append(res, r)
+		}
+	}
+	return res
 }
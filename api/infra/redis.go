@@ -13,6 +13,7 @@ package infra
 import (
 	"context"
 	"strings"
+	"time"
 	"voltaserve/config"
 
 	"github.com/redis/go-redis/v9"
@@ -46,6 +47,63 @@ func (mgr *RedisManager) Set(key string, value interface{}) error {
 	return nil
 }
 
+/* The key is removed once the expiration has passed */
+func (mgr *RedisManager) SetEx(key string, value interface{}, expiration time.Duration) error {
+	if err := mgr.Connect(); err != nil {
+		return err
+	}
+	if mgr.clusterClient != nil {
+		if _, err := mgr.clusterClient.Set(context.Background(), key, value, expiration).Result(); err != nil {
+			return err
+		}
+	} else {
+		if _, err := mgr.client.Set(context.Background(), key, value, expiration).Result(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Sets the key only if it doesn't exist, returns whether it was set */
+func (mgr *RedisManager) SetNX(key string, value interface{}, expiration time.Duration) (bool, error) {
+	if err := mgr.Connect(); err != nil {
+		return false, err
+	}
+	if mgr.clusterClient != nil {
+		return mgr.clusterClient.SetNX(context.Background(), key, value, expiration).Result()
+	} else {
+		return mgr.client.SetNX(context.Background(), key, value, expiration).Result()
+	}
+}
+
+/* Increments the counter, a missing key counts as zero */
+func (mgr *RedisManager) Incr(key string) (int64, error) {
+	if err := mgr.Connect(); err != nil {
+		return 0, err
+	}
+	if mgr.clusterClient != nil {
+		return mgr.clusterClient.Incr(context.Background(), key).Result()
+	} else {
+		return mgr.client.Incr(context.Background(), key).Result()
+	}
+}
+
+func (mgr *RedisManager) Expire(key string, expiration time.Duration) error {
+	if err := mgr.Connect(); err != nil {
+		return err
+	}
+	if mgr.clusterClient != nil {
+		if _, err := mgr.clusterClient.Expire(context.Background(), key, expiration).Result(); err != nil {
+			return err
+		}
+	} else {
+		if _, err := mgr.client.Expire(context.Background(), key, expiration).Result(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (mgr *RedisManager) Get(key string) (string, error) {
 	if err := mgr.Connect(); err != nil {
 		return "", err
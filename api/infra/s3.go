@@ -15,6 +15,7 @@ import (
 	"context"
 	"io"
 	"strings"
+	"time"
 	"voltaserve/config"
 	"voltaserve/errorpkg"
 
@@ -101,7 +102,8 @@ func (mgr *S3Manager) GetObject(objectName string, bucketName string, opts minio
 	return &buf, &written, nil
 }
 
-func (mgr *S3Manager) GetObjectWithBuffer(objectName string, bucketName string, buf *bytes.Buffer, opts minio.GetObjectOptions) (*int64, error) {
+/* The caller must close the reader, data is fetched from S3 as it's read */
+func (mgr *S3Manager) GetObjectReader(objectName string, bucketName string, opts minio.GetObjectOptions) (io.ReadCloser, error) {
 	if err := mgr.Connect(); err != nil {
 		return nil, err
 	}
@@ -109,11 +111,7 @@ func (mgr *S3Manager) GetObjectWithBuffer(objectName string, bucketName string,
 	if err != nil {
 		return nil, err
 	}
-	written, err := io.Copy(io.Writer(buf), reader)
-	if err != nil {
-		return nil, nil
-	}
-	return &written, nil
+	return reader, nil
 }
 
 func (mgr *S3Manager) GetText(objectName string, bucketName string, opts minio.GetObjectOptions) (string, error) {
@@ -143,6 +141,105 @@ func (mgr *S3Manager) RemoveObject(objectName string, bucketName string, opts mi
 	return nil
 }
 
+func (mgr *S3Manager) RemoveObjectsWithPrefix(prefix string, bucketName string) error {
+	if err := mgr.Connect(); err != nil {
+		return err
+	}
+	objectCh := mgr.client.ListObjects(context.Background(), bucketName, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+	/* The channel is drained so that the removal doesn't block, the first error is returned */
+	var res error
+	for e := range mgr.client.RemoveObjects(context.Background(), bucketName, objectCh, minio.RemoveObjectsOptions{}) {
+		if e.Err != nil && res == nil {
+			res = e.Err
+		}
+	}
+	return res
+}
+
+/* Leaves the objects under the prefix that were modified since then alone */
+func (mgr *S3Manager) RemoveObjectsWithPrefixModifiedBefore(prefix string, bucketName string, before time.Time) error {
+	if err := mgr.Connect(); err != nil {
+		return err
+	}
+	listCh := mgr.client.ListObjects(context.Background(), bucketName, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+	objectCh := make(chan minio.ObjectInfo)
+	var listErr error
+	go func() {
+		defer close(objectCh)
+		for o := range listCh {
+			if o.Err != nil {
+				listErr = o.Err
+				continue
+			}
+			if o.LastModified.Before(before) {
+				objectCh <- o
+			}
+		}
+	}()
+	var res error
+	for e := range mgr.client.RemoveObjects(context.Background(), bucketName, objectCh, minio.RemoveObjectsOptions{}) {
+		if e.Err != nil && res == nil {
+			res = e.Err
+		}
+	}
+	if res == nil {
+		res = listErr
+	}
+	return res
+}
+
+/* Copies on the server side, objects larger than 5 GiB are copied in parts */
+func (mgr *S3Manager) CopyObject(srcObjectName string, srcBucketName string, dstObjectName string, dstBucketName string) error {
+	if err := mgr.Connect(); err != nil {
+		return err
+	}
+	if _, err := mgr.client.ComposeObject(
+		context.Background(),
+		minio.CopyDestOptions{Bucket: dstBucketName, Object: dstObjectName},
+		minio.CopySrcOptions{Bucket: srcBucketName, Object: srcObjectName},
+	); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mgr *S3Manager) NewMultipartUpload(objectName string, bucketName string, opts minio.PutObjectOptions) (string, error) {
+	if err := mgr.Connect(); err != nil {
+		return "", err
+	}
+	return minio.Core{Client: mgr.client}.NewMultipartUpload(context.Background(), bucketName, objectName, opts)
+}
+
+func (mgr *S3Manager) PutObjectPart(objectName string, bucketName string, uploadID string, partNumber int, data io.Reader, size int64) (minio.ObjectPart, error) {
+	if err := mgr.Connect(); err != nil {
+		return minio.ObjectPart{}, err
+	}
+	return minio.Core{Client: mgr.client}.PutObjectPart(context.Background(), bucketName, objectName, uploadID, partNumber, data, size, minio.PutObjectPartOptions{})
+}
+
+func (mgr *S3Manager) CompleteMultipartUpload(objectName string, bucketName string, uploadID string, parts []minio.CompletePart) error {
+	if err := mgr.Connect(); err != nil {
+		return err
+	}
+	if _, err := (minio.Core{Client: mgr.client}).CompleteMultipartUpload(context.Background(), bucketName, objectName, uploadID, parts, minio.PutObjectOptions{}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mgr *S3Manager) AbortMultipartUpload(objectName string, bucketName string, uploadID string) error {
+	if err := mgr.Connect(); err != nil {
+		return err
+	}
+	return minio.Core{Client: mgr.client}.AbortMultipartUpload(context.Background(), bucketName, objectName, uploadID)
+}
+
 func (mgr *S3Manager) CreateBucket(bucketName string) error {
 	if err := mgr.Connect(); err != nil {
 		return err
@@ -11,6 +11,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"strings"
@@ -22,6 +23,8 @@ import (
 	"voltaserve/errorpkg"
 	"voltaserve/helper"
 	"voltaserve/router"
+	"voltaserve/runtime"
+	"voltaserve/service"
 
 	jwtware "github.com/gofiber/contrib/jwt"
 	"github.com/joho/godotenv"
@@ -45,13 +48,30 @@ func main() {
 
 	cfg := config.GetConfig()
 
+	repairAggregates := flag.Bool("repair-aggregates", false, "Recompute the sizes and counts of all files and folders, then exit")
+	syncFileCache := flag.Bool("sync-file-cache", false, "Cache all files again along with their grants, then exit")
+	flag.Parse()
+	if *repairAggregates {
+		if err := service.NewStorageService().RepairAggregates(); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if *syncFileCache {
+		if err := service.NewFileService().SyncCache(); err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	app := fiber.New(fiber.Config{
 		ErrorHandler: errorpkg.ErrorHandler,
 		BodyLimit:    int(helper.MegabyteToByte(cfg.Limits.FileUploadMB)),
 	})
 
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: strings.Join(cfg.Security.CORSOrigins, ","),
+		AllowOrigins:  strings.Join(cfg.Security.CORSOrigins, ","),
+		ExposeHeaders: "Accept-Ranges,Content-Range,ETag,Last-Modified,Location,Tus-Resumable,Tus-Version,Tus-Extension,Tus-Checksum-Algorithm,Upload-Offset,Upload-Length,Upload-Expires",
 	}))
 
 	v2 := app.Group("v2")
@@ -83,6 +103,13 @@ func main() {
 	tasks := router.NewTaskRouter()
 	tasks.AppendNonJWTRoutes(tasksGroup)
 
+	snapshotDiffsGroup := v2.Group("snapshot_diffs")
+	snapshotDiffs := router.NewSnapshotDiffRouter()
+	snapshotDiffs.AppendNonJWTRoutes(snapshotDiffsGroup)
+
+	shares := router.NewShareRouter()
+	shares.AppendNonJWTRoutes(v2.Group("shares"))
+
 	app.Use(jwtware.New(jwtware.Config{
 		SigningKey: jwtware.SigningKey{Key: []byte(cfg.Security.JWTSigningKey)},
 	}))
@@ -93,6 +120,7 @@ func main() {
 	mosaic.AppendRoutes(mosaicGroup)
 	watermark.AppendRoutes(watermarkGroup)
 	tasks.AppendRoutes(tasksGroup)
+	snapshotDiffs.AppendRoutes(snapshotDiffsGroup)
 
 	invitations := router.NewInvitationRouter()
 	invitations.AppendRoutes(v2.Group("invitations"))
@@ -112,6 +140,23 @@ func main() {
 	users := router.NewUserRouter()
 	users.AppendRoutes(v2.Group("users"))
 
+	uploads := router.NewUploadRouter()
+	uploads.AppendRoutes(v2.Group("uploads"))
+
+	shareLinks := router.NewShareLinkRouter()
+	shareLinks.AppendRoutes(v2.Group("share_links"))
+
+	roles := router.NewRoleRouter()
+	roles.AppendRoutes(v2.Group("roles"))
+
+	watermarkTemplates := router.NewWatermarkTemplateRouter()
+	watermarkTemplates.AppendRoutes(v2.Group("watermark_templates"))
+
+	trash := router.NewTrashRouter()
+	trash.AppendRoutes(v2.Group("trash"))
+
+	runtime.NewScheduler().Start()
+
 	if err := app.Listen(fmt.Sprintf(":%d", cfg.Port)); err != nil {
 		panic(err)
 	}
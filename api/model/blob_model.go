@@ -0,0 +1,28 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package model
+
+/*
+An original stored once for all the snapshots with the same content, it's
+addressed by the SHA-256 checksum of its content and its extension, as the
+extension decides how the content is processed.
+*/
+type Blob interface {
+	GetID() string
+	GetChecksum() string
+	GetExtension() string
+	GetBucket() string
+	GetKey() string
+	GetSize() int64
+	GetRefCount() int64
+	GetCreateTime() string
+	GetUpdateTime() *string
+}
@@ -27,6 +27,13 @@ type File interface {
 	GetGroupPermissions() []CoreGroupPermission
 	GetText() *string
 	GetSnapshotID() *string
+	GetTrashTime() *string
+	GetTrashParentID() *string
+	GetSize() int64
+	GetFileCount() int64
+	GetFolderCount() int64
+	IsTrashed() bool
+	InheritsPermissions() bool
 	SetID(string)
 	SetParentID(*string)
 	SetWorkspaceID(string)
@@ -0,0 +1,38 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package model
+
+/*
+Syncs the search index and the cache of the files with their current state
+in the database, so processing an event is idempotent and the order in which
+events are processed doesn't matter.
+*/
+const OutboxEventFileSync = "file_sync"
+
+/* Only refreshes the cache, for changes the search index doesn't care about like folder sizes */
+const OutboxEventFileCacheSync = "file_cache_sync"
+
+type OutboxEvent interface {
+	GetID() string
+	GetType() string
+	GetPayload() []byte
+	GetAttempts() int
+	GetLastError() *string
+	GetClaimTime() *string
+	GetProcessTime() *string
+	GetRetryTime() *string
+	GetDeadTime() *string
+	GetCreateTime() string
+}
+
+type OutboxFileSyncPayload struct {
+	FileIDs []string `json:"fileIds"`
+}
@@ -21,6 +21,7 @@ type UserPermission interface {
 	GetUserID() string
 	GetResourceID() string
 	GetPermission() string
+	IsInheritable() bool
 	GetCreateTime() string
 	SetID(string)
 	SetUserID(string)
@@ -34,6 +35,7 @@ type GroupPermission interface {
 	GetGroupID() string
 	GetResourceID() string
 	GetPermission() string
+	IsInheritable() bool
 	GetCreateTime() string
 	SetID(string)
 	SetGroupID(string)
@@ -45,11 +47,28 @@ type GroupPermission interface {
 type CoreUserPermission interface {
 	GetUserID() string
 	GetValue() string
+	IsInheritable() bool
 }
 
 type CoreGroupPermission interface {
 	GetGroupID() string
 	GetValue() string
+	IsInheritable() bool
+}
+
+/*
+A permission that applies to a file, either granted on the file itself or
+inherited from the closest ancestor it's granted on. Exactly one of UserID and
+GroupID is set.
+*/
+type FilePermission struct {
+	UserID      *string `json:"userId,omitempty"`
+	GroupID     *string `json:"groupId,omitempty"`
+	Value       string  `json:"value"`
+	SourceID    string  `json:"sourceId"`
+	IsInherited bool    `json:"isInherited"`
+	/* Whether it's passed down to the children, grants giving access to the path of a shared file aren't */
+	IsInheritable bool `json:"isInheritable"`
 }
 
 func GteViewerPermission(permission string) bool {
@@ -0,0 +1,103 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package model
+
+import "slices"
+
+/* What a permission on a file allows its holder to do */
+const (
+	CapabilityRead           = "read"
+	CapabilityDownload       = "download"
+	CapabilityUpload         = "upload"
+	CapabilityRename         = "rename"
+	CapabilityMove           = "move"
+	CapabilityDelete         = "delete"
+	CapabilityShare          = "share"
+	CapabilityComment        = "comment"
+	CapabilityManageVersions = "manage_versions"
+	CapabilityRunInsights    = "run_insights"
+)
+
+var Capabilities = []string{
+	CapabilityRead,
+	CapabilityDownload,
+	CapabilityUpload,
+	CapabilityRename,
+	CapabilityMove,
+	CapabilityDelete,
+	CapabilityShare,
+	CapabilityComment,
+	CapabilityManageVersions,
+	CapabilityRunInsights,
+}
+
+/*
+The capabilities of the built-in roles, which are also the permissions of
+workspaces, groups and organizations. A custom role is referred to by its ID
+wherever a permission is stored.
+*/
+var builtinRoles = map[string][]string{
+	PermissionViewer: {
+		CapabilityRead,
+		CapabilityDownload,
+	},
+	PermissionEditor: {
+		CapabilityRead,
+		CapabilityDownload,
+		CapabilityUpload,
+		CapabilityRename,
+		CapabilityMove,
+		CapabilityComment,
+		CapabilityRunInsights,
+	},
+	PermissionOwner: Capabilities,
+}
+
+type Role interface {
+	GetID() string
+	GetOrganizationID() string
+	GetName() string
+	GetCapabilities() []string
+	GetCreateTime() string
+	GetUpdateTime() *string
+}
+
+func IsBuiltinRole(permission string) bool {
+	_, ok := builtinRoles[permission]
+	return ok
+}
+
+/* Returns nil if the permission isn't a built-in role */
+func GetBuiltinCapabilities(permission string) []string {
+	return builtinRoles[permission]
+}
+
+func IsCapability(capability string) bool {
+	return slices.Contains(Capabilities, capability)
+}
+
+/* The highest built-in role whose capabilities are all part of the given ones, empty if none */
+func GetPermissionForCapabilities(capabilities []string) string {
+	res := ""
+	for _, permission := range []string{PermissionViewer, PermissionEditor, PermissionOwner} {
+		covered := true
+		for _, c := range builtinRoles[permission] {
+			if !slices.Contains(capabilities, c) {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			res = permission
+		}
+	}
+	return res
+}
@@ -0,0 +1,53 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package model
+
+const (
+	ShareLinkModeDownload = "download"
+	ShareLinkModePreview  = "preview"
+)
+
+const (
+	ShareLinkActionView             = "view"
+	ShareLinkActionList             = "list"
+	ShareLinkActionUnlock           = "unlock"
+	ShareLinkActionDownloadOriginal = "download_original"
+	ShareLinkActionDownloadPreview  = "download_preview"
+	ShareLinkActionDenied           = "denied"
+)
+
+type ShareLink interface {
+	GetID() string
+	GetFileID() string
+	GetUserID() string
+	GetTokenHash() string
+	GetPasswordHash() *string
+	GetMode() string
+	GetMaxDownloads() *int64
+	GetDownloadCount() int64
+	GetExpireTime() string
+	GetRevokeTime() *string
+	GetCreateTime() string
+	GetUpdateTime() *string
+	HasPassword() bool
+	IsRevoked() bool
+	IsExpired() bool
+}
+
+type ShareLinkAccess interface {
+	GetID() string
+	GetShareLinkID() string
+	GetFileID() *string
+	GetAction() string
+	GetIP() string
+	GetUserAgent() string
+	GetCreateTime() string
+}
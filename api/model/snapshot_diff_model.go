@@ -0,0 +1,54 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package model
+
+const (
+	SnapshotDiffMetadataSize        = "size"
+	SnapshotDiffMetadataWidth       = "width"
+	SnapshotDiffMetadataHeight      = "height"
+	SnapshotDiffMetadataLanguage    = "language"
+	SnapshotDiffMetadataContentType = "contentType"
+)
+
+type SnapshotDiff interface {
+	GetID() string
+	GetSnapshotID() string
+	GetBaseSnapshotID() string
+	GetStatus() string
+	GetTaskID() *string
+	GetText() *S3Object
+	GetSummary() *SnapshotDiffSummary
+	GetPages() []SnapshotDiffPage
+	GetMetadata() []SnapshotDiffMetadata
+	GetCreateTime() string
+	GetUpdateTime() *string
+	HasText() bool
+}
+
+type SnapshotDiffSummary struct {
+	LinesAdded   int `json:"linesAdded"`
+	LinesRemoved int `json:"linesRemoved"`
+	PageCount    int `json:"pageCount"`
+	PagesChanged int `json:"pagesChanged"`
+}
+
+type SnapshotDiffPage struct {
+	Number int `json:"number"`
+	/* Ratio of pixels that differ, from 0 to 1 */
+	Changed float64   `json:"changed"`
+	Image   *S3Object `json:"image,omitempty"`
+}
+
+type SnapshotDiffMetadata struct {
+	Field   string      `json:"field"`
+	Base    interface{} `json:"base"`
+	Current interface{} `json:"current"`
+}
@@ -10,11 +10,17 @@
 
 package model
 
+import (
+	"path/filepath"
+	"strings"
+)
+
 const (
 	SnapshotStatusWaiting    = "waiting"
 	SnapshotStatusProcessing = "processing"
 	SnapshotStatusReady      = "ready"
 	SnapshotStatusError      = "error"
+	SnapshotStatusCanceled   = "canceled"
 )
 
 type Snapshot interface {
@@ -29,6 +35,10 @@ type Snapshot interface {
 	GetWatermark() *S3Object
 	GetThumbnail() *S3Object
 	GetTaskID() *string
+	GetBlobID() *string
+	GetLabel() *string
+	GetComment() *string
+	GetUserID() *string
 	HasOriginal() bool
 	HasPreview() bool
 	HasText() bool
@@ -54,13 +64,26 @@ type Snapshot interface {
 	SetStatus(string)
 	SetLanguage(string)
 	SetTaskID(*string)
+	SetBlobID(*string)
+	SetUserID(*string)
 }
 
 type S3Object struct {
-	Bucket string      `json:"bucket"`
-	Key    string      `json:"key"`
-	Size   *int64      `json:"size,omitempty"`
-	Image  *ImageProps `json:"image,omitempty"`
+	Bucket      string      `json:"bucket"`
+	Key         string      `json:"key"`
+	Size        *int64      `json:"size,omitempty"`
+	Image       *ImageProps `json:"image,omitempty"`
+	ContentType string      `json:"contentType,omitempty"`
+	/* Matches the content, empty when the content isn't known, nil when it wasn't detected */
+	Extension *string `json:"extension,omitempty"`
+}
+
+/* What the content was detected as, the key's extension for objects that weren't */
+func (o *S3Object) GetExtension() string {
+	if o.Extension != nil {
+		return *o.Extension
+	}
+	return strings.ToLower(filepath.Ext(o.Key))
 }
 
 type ImageProps struct {
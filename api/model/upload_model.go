@@ -0,0 +1,37 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package model
+
+type Upload interface {
+	GetID() string
+	GetUserID() string
+	GetWorkspaceID() string
+	GetParentID() *string
+	GetFileID() *string
+	GetName() string
+	GetSize() int64
+	GetOffset() int64
+	GetBucket() string
+	GetKey() string
+	GetSnapshotID() string
+	GetS3UploadID() string
+	GetParts() ([]UploadPart, error)
+	GetCompleteTime() *string
+	GetExpireTime() string
+	GetCreateTime() string
+	GetUpdateTime() *string
+}
+
+type UploadPart struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
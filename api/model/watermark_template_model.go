@@ -0,0 +1,60 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package model
+
+const (
+	WatermarkPositionCenter      = "center"
+	WatermarkPositionTop         = "top"
+	WatermarkPositionBottom      = "bottom"
+	WatermarkPositionLeft        = "left"
+	WatermarkPositionRight       = "right"
+	WatermarkPositionTopLeft     = "top_left"
+	WatermarkPositionTopRight    = "top_right"
+	WatermarkPositionBottomLeft  = "bottom_left"
+	WatermarkPositionBottomRight = "bottom_right"
+)
+
+/* Placeholders that can be used in the text of a watermark template */
+const (
+	WatermarkPlaceholderUserEmail      = "{user.email}"
+	WatermarkPlaceholderUserName       = "{user.name}"
+	WatermarkPlaceholderWorkspaceName  = "{workspace.name}"
+	WatermarkPlaceholderFileName       = "{file.name}"
+	WatermarkPlaceholderDate           = "{date}"
+	WatermarkPlaceholderTime           = "{time}"
+	WatermarkPlaceholderClassification = "{classification}"
+)
+
+var WatermarkPlaceholders = []string{
+	WatermarkPlaceholderUserEmail,
+	WatermarkPlaceholderUserName,
+	WatermarkPlaceholderWorkspaceName,
+	WatermarkPlaceholderFileName,
+	WatermarkPlaceholderDate,
+	WatermarkPlaceholderTime,
+	WatermarkPlaceholderClassification,
+}
+
+type WatermarkTemplate interface {
+	GetID() string
+	GetWorkspaceID() string
+	GetName() string
+	GetText() string
+	GetClassification() *string
+	GetFontSize() *float64
+	GetColor() string
+	GetOpacity() float64
+	GetAngle() float64
+	GetPosition() string
+	IsTiled() bool
+	GetCreateTime() string
+	GetUpdateTime() *string
+}
@@ -19,7 +19,30 @@ type Workspace interface {
 	GetUserPermissions() []CoreUserPermission
 	GetGroupPermissions() []CoreGroupPermission
 	GetBucket() string
+	GetRetentionPolicy() *RetentionPolicy
+	GetWatermarkTemplateID() *string
+	IsWatermarkEnforced() bool
 	GetCreateTime() string
 	GetUpdateTime() *string
 	SetName(string)
 }
+
+/*
+A version is kept if any of the rules keeps it, the active version and those
+with a pending task are always kept.
+*/
+type RetentionPolicy struct {
+	/* The most recent versions */
+	KeepLast *int `json:"keepLast,omitempty"`
+	/* Versions younger than this many days */
+	KeepDays *int `json:"keepDays,omitempty"`
+	/* The latest version of each of the most recent days that have versions */
+	KeepDaily *int `json:"keepDaily,omitempty"`
+	/* The latest version of each of the most recent weeks that have versions */
+	KeepWeekly *int `json:"keepWeekly,omitempty"`
+}
+
+/* A policy without rules keeps every version */
+func (p *RetentionPolicy) IsEmpty() bool {
+	return p == nil || (p.KeepLast == nil && p.KeepDays == nil && p.KeepDaily == nil && p.KeepWeekly == nil)
+}
@@ -0,0 +1,203 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package repo
+
+import (
+	"errors"
+	"time"
+	"voltaserve/errorpkg"
+	"voltaserve/infra"
+	"voltaserve/model"
+
+	"gorm.io/gorm"
+)
+
+type blobEntity struct {
+	ID         string  `json:"id" gorm:"column:id"`
+	Checksum   string  `json:"checksum" gorm:"column:checksum"`
+	Extension  string  `json:"extension" gorm:"column:extension"`
+	Bucket     string  `json:"bucket" gorm:"column:bucket"`
+	Key        string  `json:"key" gorm:"column:key"`
+	Size       int64   `json:"size" gorm:"column:size"`
+	RefCount   int64   `json:"refCount" gorm:"column:ref_count"`
+	CreateTime string  `json:"createTime" gorm:"column:create_time"`
+	UpdateTime *string `json:"updateTime,omitempty" gorm:"column:update_time"`
+}
+
+func (*blobEntity) TableName() string {
+	return "blob"
+}
+
+func (b *blobEntity) BeforeCreate(*gorm.DB) (err error) {
+	b.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	return nil
+}
+
+func (b *blobEntity) BeforeSave(*gorm.DB) (err error) {
+	timeNow := time.Now().UTC().Format(time.RFC3339)
+	b.UpdateTime = &timeNow
+	return nil
+}
+
+func (b *blobEntity) GetID() string {
+	return b.ID
+}
+
+func (b *blobEntity) GetChecksum() string {
+	return b.Checksum
+}
+
+func (b *blobEntity) GetExtension() string {
+	return b.Extension
+}
+
+func (b *blobEntity) GetBucket() string {
+	return b.Bucket
+}
+
+func (b *blobEntity) GetKey() string {
+	return b.Key
+}
+
+func (b *blobEntity) GetSize() int64 {
+	return b.Size
+}
+
+func (b *blobEntity) GetRefCount() int64 {
+	return b.RefCount
+}
+
+func (b *blobEntity) GetCreateTime() string {
+	return b.CreateTime
+}
+
+func (b *blobEntity) GetUpdateTime() *string {
+	return b.UpdateTime
+}
+
+type BlobRepo interface {
+	Find(id string) (model.Blob, error)
+	FindByChecksum(checksum string, extension string) (model.Blob, error)
+	Insert(opts BlobInsertOptions) (model.Blob, error)
+	Acquire(id string) (bool, error)
+	Release(id string) (int64, error)
+	DeleteUnreferenced(id string) (bool, error)
+}
+
+func NewBlobRepo() BlobRepo {
+	return newBlobRepo()
+}
+
+type blobRepo struct {
+	db *gorm.DB
+}
+
+func newBlobRepo() *blobRepo {
+	return &blobRepo{
+		db: infra.NewPostgresManager().GetDBOrPanic(),
+	}
+}
+
+func (repo *blobRepo) Find(id string) (model.Blob, error) {
+	var res = blobEntity{}
+	db := repo.db.Where("id = ?", id).First(&res)
+	if db.Error != nil {
+		if errors.Is(db.Error, gorm.ErrRecordNotFound) {
+			return nil, errorpkg.NewBlobNotFoundError(db.Error)
+		} else {
+			return nil, errorpkg.NewInternalServerError(db.Error)
+		}
+	}
+	return &res, nil
+}
+
+/* Returns nil if there is no blob with this content */
+func (repo *blobRepo) FindByChecksum(checksum string, extension string) (model.Blob, error) {
+	var entities []*blobEntity
+	db := repo.db.
+		Where("checksum = ? AND extension = ?", checksum, extension).
+		Limit(1).
+		Find(&entities)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	if len(entities) == 0 {
+		return nil, nil
+	}
+	return entities[0], nil
+}
+
+type BlobInsertOptions struct {
+	ID        string
+	Checksum  string
+	Extension string
+	Bucket    string
+	Key       string
+	Size      int64
+}
+
+/*
+Inserts the blob with one reference, if another blob with the same content
+was inserted in the meantime that one gets the reference and is returned.
+*/
+func (repo *blobRepo) Insert(opts BlobInsertOptions) (model.Blob, error) {
+	db := repo.db.Exec(
+		"INSERT INTO blob (id, checksum, extension, bucket, key, size, ref_count, create_time) "+
+			"VALUES (?, ?, ?, ?, ?, ?, 1, ?) "+
+			"ON CONFLICT (checksum, extension) DO UPDATE SET ref_count = blob.ref_count + 1",
+		opts.ID, opts.Checksum, opts.Extension, opts.Bucket, opts.Key, opts.Size,
+		time.Now().UTC().Format(time.RFC3339),
+	)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	res, err := repo.FindByChecksum(opts.Checksum, opts.Extension)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, errorpkg.NewBlobNotFoundError(nil)
+	}
+	return res, nil
+}
+
+/* Adds a reference, returns false if the blob is gone */
+func (repo *blobRepo) Acquire(id string) (bool, error) {
+	db := repo.db.Exec("UPDATE blob SET ref_count = ref_count + 1 WHERE id = ?", id)
+	if db.Error != nil {
+		return false, db.Error
+	}
+	return db.RowsAffected == 1, nil
+}
+
+/* Removes a reference and returns the references left */
+func (repo *blobRepo) Release(id string) (int64, error) {
+	type Result struct {
+		Result int64
+	}
+	var res Result
+	db := repo.db.
+		Raw("UPDATE blob SET ref_count = ref_count - 1 WHERE id = ? RETURNING ref_count result", id).
+		Scan(&res)
+	if db.Error != nil {
+		return 0, db.Error
+	}
+	return res.Result, nil
+}
+
+/* Returns false if the blob got a reference again in the meantime */
+func (repo *blobRepo) DeleteUnreferenced(id string) (bool, error) {
+	db := repo.db.Exec("DELETE FROM blob WHERE id = ? AND ref_count <= 0", id)
+	if db.Error != nil {
+		return false, db.Error
+	}
+	return db.RowsAffected == 1, nil
+}
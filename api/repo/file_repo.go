@@ -12,6 +12,7 @@ package repo
 
 import (
 	"errors"
+	"sort"
 	"time"
 	"voltaserve/errorpkg"
 	"voltaserve/helper"
@@ -21,14 +22,17 @@ import (
 	"gorm.io/gorm"
 )
 
+/* The methods that change the tree return the IDs of the outbox events to dispatch */
 type FileRepo interface {
 	Insert(opts FileInsertOptions) (model.File, error)
 	Find(id string) (model.File, error)
+	FindByIDs(ids []string) ([]model.File, error)
 	FindChildren(id string) ([]model.File, error)
 	FindPath(id string) ([]model.File, error)
 	FindTree(id string) ([]model.File, error)
 	GetIDsByWorkspace(workspaceID string) ([]string, error)
 	GetIDsBySnapshot(snapshotID string) ([]string, error)
+	GetIDsWithPrunableSnapshots(opts FilePrunableOptions) ([]string, error)
 	MoveSourceIntoTarget(targetID string, sourceID string) error
 	Save(file model.File) error
 	BulkInsert(values []model.File, chunkSize int) error
@@ -38,10 +42,24 @@ type FileRepo interface {
 	GetItemCount(id string) (int64, error)
 	IsGrandChildOf(id string, ancestorID string) (bool, error)
 	GetSize(id string) (int64, error)
-	GrantUserPermission(id string, userID string, permission string) error
-	RevokeUserPermission(tree []model.File, userID string) error
-	GrantGroupPermission(id string, groupID string, permission string) error
-	RevokeGroupPermission(tree []model.File, groupID string) error
+	GetPhysicalSize(ids []string) (int64, error)
+	GetPendingSize(workspaceID string) (int64, error)
+	FoldAggregateDeltas() (int, []string, error)
+	RecomputeAggregates(workspaceID string) (int, []string, error)
+	Copy(opts FileCopyOptions) ([]string, error)
+	Move(targetID string, sourceIDs []string, onProgress func(count int) error) ([]string, error)
+	DeleteTree(id string) ([]string, error)
+	Trash(id string) ([]string, error)
+	Restore(id string, parentID string) ([]string, error)
+	FindTrash(workspaceID string) ([]model.File, error)
+	FindTrashBefore(trashTime string) ([]model.File, error)
+	GetTrashSize(workspaceID string) (int64, error)
+	GrantUserPermission(id string, userID string, permission string) ([]string, []string, error)
+	RevokeUserPermission(id string, userID string) ([]string, []string, error)
+	GrantGroupPermission(id string, groupID string, permission string) ([]string, []string, error)
+	RevokeGroupPermission(id string, groupID string) ([]string, []string, error)
+	BreakPermissionInheritance(id string, inherited []*model.FilePermission) error
+	RestorePermissionInheritance(id string) error
 }
 
 func NewFileRepo() FileRepo {
@@ -53,17 +71,23 @@ func NewFile() model.File {
 }
 
 type fileEntity struct {
-	ID               string                  `json:"id" gorm:"column:id"`
-	WorkspaceID      string                  `json:"workspaceId" gorm:"column:workspace_id"`
-	Name             string                  `json:"name" gorm:"column:name"`
-	Type             string                  `json:"type" gorm:"column:type"`
-	ParentID         *string                 `json:"parentId,omitempty" gorm:"column:parent_id"`
-	UserPermissions  []*UserPermissionValue  `json:"userPermissions" gorm:"-"`
-	GroupPermissions []*GroupPermissionValue `json:"groupPermissions" gorm:"-"`
-	Text             *string                 `json:"text,omitempty" gorm:"-"`
-	SnapshotID       *string                 `json:"snapshotId,omitempty" gorm:"column:snapshot_id"`
-	CreateTime       string                  `json:"createTime" gorm:"column:create_time"`
-	UpdateTime       *string                 `json:"updateTime,omitempty" gorm:"column:update_time"`
+	ID                 string                  `json:"id" gorm:"column:id"`
+	WorkspaceID        string                  `json:"workspaceId" gorm:"column:workspace_id"`
+	Name               string                  `json:"name" gorm:"column:name"`
+	Type               string                  `json:"type" gorm:"column:type"`
+	ParentID           *string                 `json:"parentId,omitempty" gorm:"column:parent_id"`
+	UserPermissions    []*UserPermissionValue  `json:"userPermissions" gorm:"-"`
+	GroupPermissions   []*GroupPermissionValue `json:"groupPermissions" gorm:"-"`
+	Text               *string                 `json:"text,omitempty" gorm:"-"`
+	SnapshotID         *string                 `json:"snapshotId,omitempty" gorm:"column:snapshot_id"`
+	TrashTime          *string                 `json:"trashTime,omitempty" gorm:"column:trash_time"`
+	TrashParentID      *string                 `json:"trashParentId,omitempty" gorm:"column:trash_parent_id"`
+	Size               int64                   `json:"size" gorm:"column:size;->"`
+	FileCount          int64                   `json:"fileCount" gorm:"column:file_count;->"`
+	FolderCount        int64                   `json:"folderCount" gorm:"column:folder_count;->"`
+	InheritPermissions *bool                   `json:"inheritPermissions,omitempty" gorm:"column:inherit_permissions;->"`
+	CreateTime         string                  `json:"createTime" gorm:"column:create_time"`
+	UpdateTime         *string                 `json:"updateTime,omitempty" gorm:"column:update_time"`
 }
 
 func (*fileEntity) TableName() string {
@@ -125,6 +149,40 @@ func (f *fileEntity) GetSnapshotID() *string {
 	return f.SnapshotID
 }
 
+func (f *fileEntity) GetTrashTime() *string {
+	return f.TrashTime
+}
+
+/* Only set on the root of a trashed tree, it's where the tree gets restored */
+func (f *fileEntity) GetTrashParentID() *string {
+	return f.TrashParentID
+}
+
+/*
+For a file, the size of all its versions. For a folder, the sum of the sizes
+of the files below it, at any depth, like the counts.
+*/
+func (f *fileEntity) GetSize() int64 {
+	return f.Size
+}
+
+func (f *fileEntity) GetFileCount() int64 {
+	return f.FileCount
+}
+
+func (f *fileEntity) GetFolderCount() int64 {
+	return f.FolderCount
+}
+
+func (f *fileEntity) IsTrashed() bool {
+	return f.TrashTime != nil
+}
+
+/* Whether the permissions of the parent apply to the file, in addition to its own */
+func (f *fileEntity) InheritsPermissions() bool {
+	return f.InheritPermissions == nil || *f.InheritPermissions
+}
+
 func (f *fileEntity) GetCreateTime() string {
 	return f.CreateTime
 }
@@ -197,8 +255,16 @@ func (repo *fileRepo) Insert(opts FileInsertOptions) (model.File, error) {
 		Type:        opts.Type,
 		ParentID:    opts.ParentID,
 	}
-	if db := repo.db.Create(&file); db.Error != nil {
-		return nil, db.Error
+	if err := repo.db.Transaction(func(tx *gorm.DB) error {
+		if db := tx.Create(&file); db.Error != nil {
+			return db.Error
+		}
+		if opts.ParentID == nil {
+			return nil
+		}
+		return repo.propagate(tx, *opts.ParentID, newFileAggregateRow(&file).totals())
+	}); err != nil {
+		return nil, err
 	}
 	res, err := repo.find(id)
 	if err != nil {
@@ -221,6 +287,23 @@ func (repo *fileRepo) Find(id string) (model.File, error) {
 	return file, nil
 }
 
+/* Returns the files that exist, missing IDs are skipped */
+func (repo *fileRepo) FindByIDs(ids []string) ([]model.File, error) {
+	var entities []*fileEntity
+	db := repo.db.Raw("SELECT * FROM file WHERE id IN (?)", ids).Scan(&entities)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	if err := repo.populateModelFields(entities); err != nil {
+		return nil, err
+	}
+	var res []model.File
+	for _, f := range entities {
+		res = append(res, f)
+	}
+	return res, nil
+}
+
 func (repo *fileRepo) find(id string) (*fileEntity, error) {
 	var res = fileEntity{}
 	db := repo.db.Raw("SELECT * FROM file WHERE id = ?", id).Scan(&res)
@@ -256,9 +339,9 @@ func (repo *fileRepo) FindChildren(id string) ([]model.File, error) {
 func (repo *fileRepo) FindPath(id string) ([]model.File, error) {
 	var entities []*fileEntity
 	if db := repo.db.
-		Raw("WITH RECURSIVE rec (id, name, type, parent_id, workspace_id, create_time, update_time) AS "+
-			"(SELECT f.id, f.name, f.type, f.parent_id, f.workspace_id, f.create_time, f.update_time FROM file f WHERE f.id = ? "+
-			"UNION SELECT f.id, f.name, f.type, f.parent_id, f.workspace_id, f.create_time, f.update_time FROM rec, file f WHERE f.id = rec.parent_id) "+
+		Raw("WITH RECURSIVE rec (id, name, type, parent_id, workspace_id, inherit_permissions, create_time, update_time) AS "+
+			"(SELECT f.id, f.name, f.type, f.parent_id, f.workspace_id, f.inherit_permissions, f.create_time, f.update_time FROM file f WHERE f.id = ? "+
+			"UNION SELECT f.id, f.name, f.type, f.parent_id, f.workspace_id, f.inherit_permissions, f.create_time, f.update_time FROM rec, file f WHERE f.id = rec.parent_id) "+
 			"SELECT * FROM rec", id).
 		Scan(&entities); db.Error != nil {
 		return nil, db.Error
@@ -276,9 +359,9 @@ func (repo *fileRepo) FindPath(id string) ([]model.File, error) {
 func (repo *fileRepo) FindTree(id string) ([]model.File, error) {
 	var entities []*fileEntity
 	db := repo.db.
-		Raw("WITH RECURSIVE rec (id, name, type, parent_id, workspace_id, snapshot_id, create_time, update_time) AS "+
-			"(SELECT f.id, f.name, f.type, f.parent_id, f.workspace_id, f.snapshot_id, f.create_time, f.update_time FROM file f WHERE f.id = ? "+
-			"UNION SELECT f.id, f.name, f.type, f.parent_id, f.workspace_id, f.snapshot_id, f.create_time, f.update_time FROM rec, file f WHERE f.parent_id = rec.id) "+
+		Raw("WITH RECURSIVE rec (id, name, type, parent_id, workspace_id, snapshot_id, trash_time, trash_parent_id, inherit_permissions, create_time, update_time) AS "+
+			"(SELECT f.id, f.name, f.type, f.parent_id, f.workspace_id, f.snapshot_id, f.trash_time, f.trash_parent_id, f.inherit_permissions, f.create_time, f.update_time FROM file f WHERE f.id = ? "+
+			"UNION SELECT f.id, f.name, f.type, f.parent_id, f.workspace_id, f.snapshot_id, f.trash_time, f.trash_parent_id, f.inherit_permissions, f.create_time, f.update_time FROM rec, file f WHERE f.parent_id = rec.id) "+
 			"SELECT rec.* FROM rec ORDER BY create_time ASC", id).
 		Scan(&entities)
 	if db.Error != nil {
@@ -310,6 +393,49 @@ func (repo *fileRepo) GetIDsByWorkspace(workspaceID string) ([]string, error) {
 	return res, nil
 }
 
+type FilePrunableOptions struct {
+	WorkspaceID string
+	/* Files with fewer versions than that have nothing to prune */
+	MinSnapshots int
+	/* Only the versions created by then can be pruned, nil when their age doesn't matter */
+	CreatedBefore *string
+	/* The last ID of the previous page, empty for the first page */
+	AfterID string
+	Limit   int
+}
+
+/*
+Pages through the files of the workspace that have versions the retention
+policy might prune, the ones that aren't active nor labelled. It's a rough cut,
+what is actually pruned is up to the policy.
+*/
+func (repo *fileRepo) GetIDsWithPrunableSnapshots(opts FilePrunableOptions) ([]string, error) {
+	type Value struct {
+		Result string
+	}
+	query := "SELECT f.id result FROM file f " +
+		"WHERE f.workspace_id = ? AND f.type = ? AND f.trash_time IS NULL AND f.id > ? " +
+		"AND (SELECT count(*) FROM snapshot_file sf WHERE sf.file_id = f.id) >= ? " +
+		"AND EXISTS (SELECT 1 FROM snapshot_file sf INNER JOIN snapshot s ON s.id = sf.snapshot_id " +
+		"WHERE sf.file_id = f.id AND sf.label IS NULL AND s.id IS DISTINCT FROM f.snapshot_id "
+	values := []interface{}{opts.WorkspaceID, model.FileTypeFile, opts.AfterID, opts.MinSnapshots}
+	if opts.CreatedBefore != nil {
+		query += "AND s.create_time <= ? "
+		values = append(values, *opts.CreatedBefore)
+	}
+	query += ") ORDER BY f.id LIMIT ?"
+	values = append(values, opts.Limit)
+	var rows []Value
+	if db := repo.db.Raw(query, values...).Scan(&rows); db.Error != nil {
+		return nil, db.Error
+	}
+	res := []string{}
+	for _, r := range rows {
+		res = append(res, r.Result)
+	}
+	return res, nil
+}
+
 func (repo *fileRepo) GetIDsBySnapshot(snapshotID string) ([]string, error) {
 	type Value struct {
 		Result string
@@ -401,16 +527,11 @@ func (repo *fileRepo) GetItemCount(id string) (int64, error) {
 		Result int64
 	}
 	var res Result
-	db := repo.db.
-		Raw("WITH RECURSIVE rec (id, parent_id) AS "+
-			"(SELECT f.id, f.parent_id FROM file f WHERE f.id = ? "+
-			"UNION SELECT f.id, f.parent_id FROM rec, file f WHERE f.parent_id = rec.id) "+
-			"SELECT count(rec.id) as result FROM rec", id).
-		Scan(&res)
+	db := repo.db.Raw("SELECT file_count + folder_count as result FROM file WHERE id = ?", id).Scan(&res)
 	if db.Error != nil {
 		return 0, db.Error
 	}
-	return res.Result - 1, nil
+	return res.Result, nil
 }
 
 func (repo *fileRepo) IsGrandChildOf(id string, ancestorID string) (bool, error) {
@@ -430,16 +551,33 @@ func (repo *fileRepo) IsGrandChildOf(id string, ancestorID string) (bool, error)
 }
 
 func (repo *fileRepo) GetSize(id string) (int64, error) {
+	type Result struct {
+		Result int64
+	}
+	var res Result
+	db := repo.db.Raw("SELECT size as result FROM file WHERE id = ?", id).Scan(&res)
+	if db.Error != nil {
+		return res.Result, db.Error
+	}
+	return res.Result, nil
+}
+
+/*
+Counts each original once however many snapshots of the trees refer to it,
+unlike GetSize which counts what the files would take if stored separately.
+*/
+func (repo *fileRepo) GetPhysicalSize(ids []string) (int64, error) {
 	type Result struct {
 		Result int64
 	}
 	var res Result
 	db := repo.db.
 		Raw("WITH RECURSIVE rec (id, parent_id) AS "+
-			"(SELECT f.id, f.parent_id FROM file f WHERE f.id = ? "+
+			"(SELECT f.id, f.parent_id FROM file f WHERE f.id IN (?) "+
 			"UNION SELECT f.id, f.parent_id FROM rec, file f WHERE f.parent_id = rec.id) "+
-			"SELECT coalesce(sum((s.original->>'size')::int), 0) as result FROM snapshot s, rec "+
-			"LEFT JOIN snapshot_file map ON rec.id = map.file_id WHERE map.snapshot_id = s.id", id).
+			"SELECT coalesce(sum(o.size), 0) as result FROM "+
+			"(SELECT DISTINCT coalesce(s.blob_id, s.id) id, (s.original->>'size')::bigint size FROM snapshot s, rec "+
+			"LEFT JOIN snapshot_file map ON rec.id = map.file_id WHERE map.snapshot_id = s.id) o", ids).
 		Scan(&res)
 	if db.Error != nil {
 		return res.Result, db.Error
@@ -447,106 +585,728 @@ func (repo *fileRepo) GetSize(id string) (int64, error) {
 	return res.Result, nil
 }
 
-func (repo *fileRepo) GrantUserPermission(id string, userID string, permission string) error {
-	/* Grant permission to workspace */
-	db := repo.db.Exec("INSERT INTO userpermission (id, user_id, resource_id, permission) "+
-		"(SELECT ?, ?, w.id, 'viewer' FROM file f "+
-		"INNER JOIN workspace w ON w.id = f.workspace_id AND f.id = ?) "+
-		"ON CONFLICT DO NOTHING",
-		helper.NewID(), userID, id)
-	if db.Error != nil {
-		return db.Error
-	}
+const fileCopyBatchSize = 100
 
-	/* Grant 'viewer' permission to path files */
-	path, err := repo.FindPath(id)
-	if err != nil {
-		return err
-	}
-	for _, f := range path {
-		db := repo.db.Exec("INSERT INTO userpermission (id, user_id, resource_id, permission) "+
-			"VALUES (?, ?, ?, 'viewer') ON CONFLICT DO NOTHING",
-			helper.NewID(), userID, f.GetID())
-		if db.Error != nil {
+type FileCopyOptions struct {
+	TargetID    string
+	Clones      []model.File
+	Permissions []model.UserPermission
+	/* Maps the ID of each clone to the ID of the file it's cloned from */
+	OriginalIDs map[string]string
+	/* Optional, called after each batch of clones, returning an error rolls back the copy */
+	OnProgress func(count int) error
+}
+
+/* Inserts the clones with their permissions and latest snapshots, all or nothing */
+func (repo *fileRepo) Copy(opts FileCopyOptions) ([]string, error) {
+	var events outboxEvents
+	err := repo.db.Transaction(func(tx *gorm.DB) error {
+		var ids []string
+		var topIDs []string
+		for _, f := range opts.Clones {
+			ids = append(ids, f.GetID())
+			if f.GetParentID() != nil && *f.GetParentID() == opts.TargetID {
+				topIDs = append(topIDs, f.GetID())
+			}
+		}
+		for i := 0; i < len(opts.Clones); i += fileCopyBatchSize {
+			batch := opts.Clones[i:min(i+fileCopyBatchSize, len(opts.Clones))]
+			var entities []*fileEntity
+			for _, f := range batch {
+				entities = append(entities, f.(*fileEntity))
+			}
+			if db := tx.Create(entities); db.Error != nil {
+				return db.Error
+			}
+			for _, c := range batch {
+				if db := tx.Exec("INSERT INTO snapshot_file (snapshot_id, file_id, label, comment) SELECT s.id, ?, map.label, map.comment "+
+					"FROM snapshot s LEFT JOIN snapshot_file map ON s.id = map.snapshot_id "+
+					"WHERE map.file_id = ? ORDER BY s.version DESC LIMIT 1", c.GetID(), opts.OriginalIDs[c.GetID()]); db.Error != nil {
+					return db.Error
+				}
+			}
+			if opts.OnProgress != nil {
+				if err := opts.OnProgress(len(batch)); err != nil {
+					return err
+				}
+			}
+		}
+		var permissions []*userPermissionEntity
+		for _, p := range opts.Permissions {
+			permissions = append(permissions, p.(*userPermissionEntity))
+		}
+		if db := tx.CreateInBatches(permissions, fileCopyBatchSize); db.Error != nil {
 			return db.Error
 		}
-	}
+		/*
+		   Clones only get the latest snapshot, so their sizes can't be copied from
+		   the originals. The copied trees are disjoint, so they're computed by chunks.
+		*/
+		var delta fileAggregates
+		for _, chunk := range helper.Chunk(topIDs, fileAggregateChunkSize) {
+			if _, err := repo.recompute(tx, fileTreesScope, chunk); err != nil {
+				return err
+			}
+			var rows []*fileAggregateRow
+			if db := tx.
+				Raw("SELECT id, parent_id, type, size, file_count, folder_count FROM file WHERE id IN (?)", chunk).
+				Scan(&rows); db.Error != nil {
+				return db.Error
+			}
+			for _, r := range rows {
+				delta = delta.add(r.totals())
+			}
+		}
+		if err := repo.propagate(tx, opts.TargetID, delta); err != nil {
+			return err
+		}
+		if db := tx.Exec("UPDATE file SET update_time = ? WHERE id = ?",
+			time.Now().UTC().Format(time.RFC3339), opts.TargetID); db.Error != nil {
+			return db.Error
+		}
+		return events.insert(tx, model.OutboxEventFileSync, model.OutboxFileSyncPayload{
+			FileIDs: append(ids, opts.TargetID),
+		})
+	})
+	return events, err
+}
 
-	/* Grant the requested permission to tree files */
-	tree, err := repo.FindTree(id)
-	if err != nil {
-		return err
+/*
+Moves the sources into the target, all or nothing. onProgress is optional, it's
+called after each source, returning an error rolls back the move.
+*/
+func (repo *fileRepo) Move(targetID string, sourceIDs []string, onProgress func(count int) error) ([]string, error) {
+	var events outboxEvents
+	err := repo.db.Transaction(func(tx *gorm.DB) error {
+		timeNow := time.Now().UTC().Format(time.RFC3339)
+		ids := []string{targetID}
+		for _, id := range sourceIDs {
+			source, err := repo.findAggregateRow(tx, id)
+			if err != nil {
+				return err
+			}
+			if source.ParentID != nil {
+				if err := repo.propagate(tx, *source.ParentID, source.totals().negate()); err != nil {
+					return err
+				}
+			}
+			if db := tx.Exec("UPDATE file SET parent_id = ?, update_time = ? WHERE id = ?", targetID, timeNow, id); db.Error != nil {
+				return db.Error
+			}
+			if err := repo.propagate(tx, targetID, source.totals()); err != nil {
+				return err
+			}
+			treeIDs, err := repo.findTreeIDs(tx, id)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, treeIDs...)
+			if onProgress != nil {
+				if err := onProgress(1); err != nil {
+					return err
+				}
+			}
+		}
+		if db := tx.Exec("UPDATE file SET update_time = ? WHERE id = ?", timeNow, targetID); db.Error != nil {
+			return db.Error
+		}
+		return events.insert(tx, model.OutboxEventFileSync, model.OutboxFileSyncPayload{FileIDs: ids})
+	})
+	return events, err
+}
+
+/*
+Selects the IDs of the tree rooted at the file as 'rec', to prefix the statement
+that works on the tree, so the IDs don't have to be bound as parameters.
+*/
+const fileTreeCTE = "WITH RECURSIVE rec (id) AS " +
+	"(SELECT f.id FROM file f WHERE f.id = ? " +
+	"UNION SELECT f.id FROM rec, file f WHERE f.parent_id = rec.id) "
+
+/* Like fileTreeCTE, without the subtrees that don't inherit the permissions of their parent */
+const fileInheritingTreeCTE = "WITH RECURSIVE rec (id) AS " +
+	"(SELECT f.id FROM file f WHERE f.id = ? " +
+	"UNION SELECT f.id FROM rec, file f WHERE f.parent_id = rec.id AND f.inherit_permissions) "
+
+/* Runs a statement prefixed with fileTreeCTE, returns the IDs it returns */
+func (repo *fileRepo) execOnTree(tx *gorm.DB, id string, query string, values ...interface{}) ([]string, error) {
+	return repo.execWithCTE(tx, fileTreeCTE, id, query, values...)
+}
+
+func (repo *fileRepo) execWithCTE(tx *gorm.DB, cte string, id string, query string, values ...interface{}) ([]string, error) {
+	type Value struct {
+		Result string
+	}
+	var rows []Value
+	if db := tx.Raw(cte+query, append([]interface{}{id}, values...)...).Scan(&rows); db.Error != nil {
+		return nil, db.Error
+	}
+	res := []string{}
+	for _, r := range rows {
+		res = append(res, r.Result)
 	}
-	for _, f := range tree {
-		db := repo.db.Exec("INSERT INTO userpermission (id, user_id, resource_id, permission) "+
-			"VALUES (?, ?, ?, ?) ON CONFLICT (user_id, resource_id) DO UPDATE SET permission = ?",
-			helper.NewID(), userID, f.GetID(), permission, permission)
-		if db.Error != nil {
+	return res, nil
+}
+
+/*
+Moves the tree to the trash, the root is detached from its parent so the tree
+disappears from listings, sizes and paths, yet keeps its structure and permissions.
+*/
+func (repo *fileRepo) Trash(id string) ([]string, error) {
+	var events outboxEvents
+	err := repo.db.Transaction(func(tx *gorm.DB) error {
+		ids, err := repo.execOnTree(tx, id, "UPDATE file SET trash_time = ? WHERE id IN (SELECT id FROM rec) RETURNING id AS result",
+			time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+		/* The tree keeps its sizes, they are what the trash takes */
+		root, err := repo.findAggregateRow(tx, id)
+		if err != nil {
+			return err
+		}
+		if root.ParentID != nil {
+			if err := repo.propagate(tx, *root.ParentID, root.totals().negate()); err != nil {
+				return err
+			}
+		}
+		if db := tx.Exec("UPDATE file SET trash_parent_id = parent_id, parent_id = NULL WHERE id = ?", id); db.Error != nil {
 			return db.Error
 		}
+		return events.insert(tx, model.OutboxEventFileSync, model.OutboxFileSyncPayload{FileIDs: ids})
+	})
+	return events, err
+}
+
+func (repo *fileRepo) Restore(id string, parentID string) ([]string, error) {
+	var events outboxEvents
+	err := repo.db.Transaction(func(tx *gorm.DB) error {
+		if db := tx.Exec("UPDATE file SET parent_id = ?, trash_parent_id = NULL WHERE id = ?", parentID, id); db.Error != nil {
+			return db.Error
+		}
+		root, err := repo.findAggregateRow(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := repo.propagate(tx, parentID, root.totals()); err != nil {
+			return err
+		}
+		ids, err := repo.execOnTree(tx, id, "UPDATE file SET trash_time = NULL WHERE id IN (SELECT id FROM rec) RETURNING id AS result")
+		if err != nil {
+			return err
+		}
+		return events.insert(tx, model.OutboxEventFileSync, model.OutboxFileSyncPayload{FileIDs: ids})
+	})
+	return events, err
+}
+
+/* Deletes the tree with its permissions and snapshot mappings, the snapshots are left dangling */
+func (repo *fileRepo) DeleteTree(id string) ([]string, error) {
+	var events outboxEvents
+	err := repo.db.Transaction(func(tx *gorm.DB) error {
+		root, err := repo.findAggregateRow(tx, id)
+		if err != nil {
+			return err
+		}
+		if root.ParentID != nil {
+			if err := repo.propagate(tx, *root.ParentID, root.totals().negate()); err != nil {
+				return err
+			}
+		}
+		for _, table := range []string{"userpermission", "grouppermission"} {
+			if _, err := repo.execOnTree(tx, id, "DELETE FROM "+table+" WHERE resource_id IN (SELECT id FROM rec)"); err != nil {
+				return err
+			}
+		}
+		if _, err := repo.execOnTree(tx, id, "DELETE FROM snapshot_file WHERE file_id IN (SELECT id FROM rec)"); err != nil {
+			return err
+		}
+		ids, err := repo.execOnTree(tx, id, "DELETE FROM file WHERE id IN (SELECT id FROM rec) RETURNING id AS result")
+		if err != nil {
+			return err
+		}
+		return events.insert(tx, model.OutboxEventFileSync, model.OutboxFileSyncPayload{FileIDs: ids})
+	})
+	return events, err
+}
+
+func (repo *fileRepo) findTreeIDs(tx *gorm.DB, id string) ([]string, error) {
+	type Value struct {
+		Result string
+	}
+	var values []Value
+	db := tx.
+		Raw("WITH RECURSIVE rec (id) AS "+
+			"(SELECT f.id FROM file f WHERE f.id = ? "+
+			"UNION SELECT f.id FROM rec, file f WHERE f.parent_id = rec.id) "+
+			"SELECT id as result FROM rec", id).
+		Scan(&values)
+	if db.Error != nil {
+		return nil, db.Error
 	}
+	res := []string{}
+	for _, v := range values {
+		res = append(res, v.Result)
+	}
+	return res, nil
+}
 
-	return nil
+/*
+Recomputes the sizes and counts of the files of the workspace from scratch,
+repairing whatever the incremental updates got wrong. The pending deltas of
+the workspace are part of the result, so they are dropped. Returns the number
+of files that had to be fixed.
+*/
+func (repo *fileRepo) RecomputeAggregates(workspaceID string) (int, []string, error) {
+	var count int
+	var events outboxEvents
+	err := repo.db.Transaction(func(tx *gorm.DB) error {
+		if db := tx.Exec("DELETE FROM file_aggregate_delta WHERE file_id IN (SELECT id FROM file WHERE workspace_id = ?)",
+			workspaceID); db.Error != nil {
+			return db.Error
+		}
+		changed, err := repo.recompute(tx, fileWorkspaceScope, workspaceID)
+		if err != nil {
+			return err
+		}
+		count = len(changed)
+		for _, chunk := range helper.Chunk(changed, fileAggregateChunkSize) {
+			if err := events.insert(tx, model.OutboxEventFileCacheSync, model.OutboxFileSyncPayload{FileIDs: chunk}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return count, events, err
 }
 
-func (repo *fileRepo) RevokeUserPermission(tree []model.File, userID string) error {
-	for _, f := range tree {
-		db := repo.db.Exec("DELETE FROM userpermission WHERE user_id = ? AND resource_id = ?", userID, f.GetID())
-		if db.Error != nil {
+/* Pending deltas are part of the usage of the workspace until they're folded */
+func (repo *fileRepo) GetPendingSize(workspaceID string) (int64, error) {
+	type Result struct {
+		Result int64
+	}
+	var res Result
+	db := repo.db.
+		Raw("SELECT coalesce(sum(d.size), 0) as result FROM file_aggregate_delta d "+
+			"JOIN file f ON f.id = d.file_id WHERE f.workspace_id = ?", workspaceID).
+		Scan(&res)
+	if db.Error != nil {
+		return res.Result, db.Error
+	}
+	return res.Result, nil
+}
+
+const FileAggregateFoldBatchSize = 1000
+
+/*
+Folds a batch of pending deltas into their files and the ancestors the files
+have now, each file is updated once per batch however many deltas it gets.
+Deltas of files deleted in the meantime are dropped, the deletion took the
+totals of the tree off its ancestors already. Returns the number of deltas
+folded, fewer than a batch means there are none left.
+*/
+func (repo *fileRepo) FoldAggregateDeltas() (int, []string, error) {
+	var count int
+	var events outboxEvents
+	err := repo.db.Transaction(func(tx *gorm.DB) error {
+		type Delta struct {
+			FileID      string
+			Size        int64
+			FileCount   int64
+			FolderCount int64
+		}
+		var deltas []Delta
+		if db := tx.
+			Raw("DELETE FROM file_aggregate_delta WHERE id IN "+
+				"(SELECT id FROM file_aggregate_delta ORDER BY create_time LIMIT ?) "+
+				"RETURNING file_id, size, file_count, folder_count", FileAggregateFoldBatchSize).
+			Scan(&deltas); db.Error != nil {
+			return db.Error
+		}
+		count = len(deltas)
+		if count == 0 {
+			return nil
+		}
+		byFile := make(map[string]fileAggregates)
+		for _, d := range deltas {
+			byFile[d.FileID] = byFile[d.FileID].add(fileAggregates{size: d.Size, fileCount: d.FileCount, folderCount: d.FolderCount})
+		}
+		var fileIDs []string
+		for id := range byFile {
+			fileIDs = append(fileIDs, id)
+		}
+		type Ancestor struct {
+			OriginID string
+			ID       string
+		}
+		var ancestors []Ancestor
+		if db := tx.
+			Raw("WITH RECURSIVE rec (origin_id, id, parent_id) AS "+
+				"(SELECT f.id, f.id, f.parent_id FROM file f WHERE f.id IN (?) "+
+				"UNION ALL SELECT rec.origin_id, f.id, f.parent_id FROM rec, file f WHERE f.id = rec.parent_id) "+
+				"SELECT origin_id, id FROM rec", fileIDs).
+			Scan(&ancestors); db.Error != nil {
 			return db.Error
 		}
+		totals := make(map[string]fileAggregates)
+		for _, a := range ancestors {
+			totals[a.ID] = totals[a.ID].add(byFile[a.OriginID])
+		}
+		var ids []string
+		for id, t := range totals {
+			if t != (fileAggregates{}) {
+				ids = append(ids, id)
+			}
+		}
+		/* Always in the same order, so concurrent folds can't deadlock */
+		sort.Strings(ids)
+		for _, id := range ids {
+			t := totals[id]
+			if db := tx.Exec("UPDATE file SET size = size + ?, file_count = file_count + ?, folder_count = folder_count + ?, "+
+				"update_time = update_time WHERE id = ?",
+				t.size, t.fileCount, t.folderCount, id); db.Error != nil {
+				return db.Error
+			}
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		return events.insert(tx, model.OutboxEventFileCacheSync, model.OutboxFileSyncPayload{FileIDs: ids})
+	})
+	return count, events, err
+}
+
+/* What a tree adds to the aggregates of the folders above it */
+type fileAggregates struct {
+	size        int64
+	fileCount   int64
+	folderCount int64
+}
+
+func (a fileAggregates) add(other fileAggregates) fileAggregates {
+	return fileAggregates{
+		size:        a.size + other.size,
+		fileCount:   a.fileCount + other.fileCount,
+		folderCount: a.folderCount + other.folderCount,
+	}
+}
+
+func (a fileAggregates) negate() fileAggregates {
+	return fileAggregates{size: -a.size, fileCount: -a.fileCount, folderCount: -a.folderCount}
+}
+
+type fileAggregateRow struct {
+	ID          string
+	ParentID    *string
+	Type        string
+	Size        int64
+	FileCount   int64
+	FolderCount int64
+}
+
+func newFileAggregateRow(f *fileEntity) *fileAggregateRow {
+	return &fileAggregateRow{
+		ID:          f.ID,
+		ParentID:    f.ParentID,
+		Type:        f.Type,
+		Size:        f.Size,
+		FileCount:   f.FileCount,
+		FolderCount: f.FolderCount,
+	}
+}
+
+/* The aggregates of the tree rooted at the file, the file included */
+func (r *fileAggregateRow) totals() fileAggregates {
+	res := fileAggregates{size: r.Size, fileCount: r.FileCount, folderCount: r.FolderCount}
+	if r.Type == model.FileTypeFolder {
+		res.folderCount++
+	} else {
+		res.fileCount++
+	}
+	return res
+}
+
+func (repo *fileRepo) findAggregateRow(tx *gorm.DB, id string) (*fileAggregateRow, error) {
+	var res []*fileAggregateRow
+	if db := tx.
+		Raw("SELECT id, parent_id, type, size, file_count, folder_count FROM file WHERE id = ?", id).
+		Scan(&res); db.Error != nil {
+		return nil, db.Error
+	}
+	if len(res) == 0 {
+		return nil, errorpkg.NewFileNotFoundError(nil)
+	}
+	return res[0], nil
+}
+
+/*
+Records that the delta is to be added to the file and its ancestors, in the same
+transaction as the change that caused it. The deltas are folded by
+FoldAggregateDeltas, so that the folders near the root aren't locked by every
+change below them.
+*/
+func (repo *fileRepo) propagate(tx *gorm.DB, id string, delta fileAggregates) error {
+	return insertAggregateDelta(tx, id, delta)
+}
+
+func insertAggregateDelta(tx *gorm.DB, fileID string, delta fileAggregates) error {
+	if delta == (fileAggregates{}) {
+		return nil
+	}
+	if db := tx.Exec("INSERT INTO file_aggregate_delta (file_id, size, file_count, folder_count) VALUES (?, ?, ?, ?)",
+		fileID, delta.size, delta.fileCount, delta.folderCount); db.Error != nil {
+		return db.Error
 	}
 	return nil
 }
 
-func (repo *fileRepo) GrantGroupPermission(id string, groupID string, permission string) error {
-	/* Grant permission to workspace */
-	db := repo.db.Exec("INSERT INTO grouppermission (id, group_id, resource_id, permission) "+
-		"(SELECT ?, ?, w.id, 'viewer' FROM file f "+
-		"INNER JOIN workspace w ON w.id = f.workspace_id AND f.id = ?) "+
-		"ON CONFLICT DO NOTHING",
-		helper.NewID(), groupID, id)
+const fileAggregateChunkSize = 1000
+
+/* Selects the IDs of the trees rooted at the files, for recompute */
+const fileTreesScope = "SELECT f.id FROM file f WHERE f.id IN (?) " +
+	"UNION SELECT f.id FROM scope, file f WHERE f.parent_id = scope.id"
+
+/* Selects the IDs of the files of the workspace, for recompute */
+const fileWorkspaceScope = "SELECT f.id FROM file f WHERE f.workspace_id = ?"
+
+/*
+Computes the aggregates of the files selected by the scope from their versions
+and descendants, the scope must include every descendant of every file. It's
+all done by the database, so the files don't have to be bound as parameters.
+Saves the ones that changed and returns their IDs.
+*/
+func (repo *fileRepo) recompute(tx *gorm.DB, scope string, values ...interface{}) ([]string, error) {
+	type Value struct {
+		Result string
+	}
+	var rows []Value
+	if db := tx.
+		Raw("WITH RECURSIVE scope (id) AS ("+scope+"), "+
+			"own AS (SELECT f.id, f.parent_id, f.type, "+
+			"coalesce(sum((s.original->>'size')::bigint), 0)::bigint AS size "+
+			"FROM file f JOIN scope ON scope.id = f.id "+
+			"LEFT JOIN snapshot_file map ON map.file_id = f.id "+
+			"LEFT JOIN snapshot s ON s.id = map.snapshot_id "+
+			"GROUP BY f.id, f.parent_id, f.type), "+
+			/* Pairs every file with each of its ancestors within the scope */
+			"pairs (ancestor_id, id) AS (SELECT o.parent_id, o.id FROM own o JOIN own p ON p.id = o.parent_id "+
+			"UNION ALL SELECT p.parent_id, pairs.id FROM pairs JOIN own p ON p.id = pairs.ancestor_id "+
+			"JOIN own pp ON pp.id = p.parent_id), "+
+			"agg AS (SELECT o.id, (o.size + coalesce(sum(d.size), 0))::bigint AS size, "+
+			"count(d.id) FILTER (WHERE d.type <> ?) AS file_count, "+
+			"count(d.id) FILTER (WHERE d.type = ?) AS folder_count "+
+			"FROM own o LEFT JOIN pairs ON pairs.ancestor_id = o.id LEFT JOIN own d ON d.id = pairs.id "+
+			"GROUP BY o.id, o.size) "+
+			"UPDATE file SET size = agg.size, file_count = agg.file_count, folder_count = agg.folder_count, "+
+			"update_time = file.update_time FROM agg WHERE file.id = agg.id AND "+
+			"(file.size <> agg.size OR file.file_count <> agg.file_count OR file.folder_count <> agg.folder_count) "+
+			"RETURNING file.id AS result",
+			append(values, model.FileTypeFolder, model.FileTypeFolder)...).
+		Scan(&rows); db.Error != nil {
+		return nil, db.Error
+	}
+	res := []string{}
+	for _, r := range rows {
+		res = append(res, r.Result)
+	}
+	return res, nil
+}
+
+/* Returns the roots of the trashed trees, most recently trashed first */
+func (repo *fileRepo) FindTrash(workspaceID string) ([]model.File, error) {
+	var entities []*fileEntity
+	db := repo.db.
+		Raw("SELECT * FROM file WHERE workspace_id = ? AND trash_parent_id IS NOT NULL ORDER BY trash_time DESC", workspaceID).
+		Scan(&entities)
 	if db.Error != nil {
-		return db.Error
+		return nil, db.Error
+	}
+	if err := repo.populateModelFields(entities); err != nil {
+		return nil, err
+	}
+	var res []model.File
+	for _, f := range entities {
+		res = append(res, f)
+	}
+	return res, nil
+}
+
+func (repo *fileRepo) FindTrashBefore(trashTime string) ([]model.File, error) {
+	var entities []*fileEntity
+	db := repo.db.
+		Raw("SELECT * FROM file WHERE trash_parent_id IS NOT NULL AND trash_time < ?", trashTime).
+		Scan(&entities)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	if err := repo.populateModelFields(entities); err != nil {
+		return nil, err
+	}
+	var res []model.File
+	for _, f := range entities {
+		res = append(res, f)
+	}
+	return res, nil
+}
+
+/* Trashed files still take space until they are purged, the roots of the trashed trees hold their sizes */
+func (repo *fileRepo) GetTrashSize(workspaceID string) (int64, error) {
+	type Result struct {
+		Result int64
+	}
+	var res Result
+	db := repo.db.
+		Raw("SELECT coalesce(sum(size), 0) as result FROM file WHERE workspace_id = ? AND trash_parent_id IS NOT NULL", workspaceID).
+		Scan(&res)
+	if db.Error != nil {
+		return res.Result, db.Error
 	}
+	return res.Result, nil
+}
+
+/*
+Grants the permission on the file only, its tree inherits it at check time. The
+grants of the user below the file are replaced, the ancestors get a 'viewer'
+grant that isn't inherited, so the file can be reached without exposing its
+siblings. Returns the files below that lost their own grant, along with the
+events that cache them again.
+*/
+func (repo *fileRepo) GrantUserPermission(id string, userID string, permission string) ([]string, []string, error) {
+	return repo.grantPermission("userpermission", "user_id", id, userID, permission)
+}
 
-	/* Grant 'viewer' permission to path files */
+/* Revokes the grants of the user on the file and below it, inherited grants are left as is */
+func (repo *fileRepo) RevokeUserPermission(id string, userID string) ([]string, []string, error) {
+	return repo.revokePermission("userpermission", "user_id", id, userID)
+}
+
+func (repo *fileRepo) GrantGroupPermission(id string, groupID string, permission string) ([]string, []string, error) {
+	return repo.grantPermission("grouppermission", "group_id", id, groupID, permission)
+}
+
+func (repo *fileRepo) RevokeGroupPermission(id string, groupID string) ([]string, []string, error) {
+	return repo.revokePermission("grouppermission", "group_id", id, groupID)
+}
+
+func (repo *fileRepo) grantPermission(table string, column string, id string, principalID string, permission string) ([]string, []string, error) {
 	path, err := repo.FindPath(id)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	for _, f := range path {
-		db := repo.db.Exec("INSERT INTO grouppermission (id, group_id, resource_id, permission) "+
-			"VALUES (?, ?, ?, 'viewer') ON CONFLICT DO NOTHING",
-			helper.NewID(), groupID, f.GetID())
-		if db.Error != nil {
+	var changed []string
+	var events outboxEvents
+	err = repo.db.Transaction(func(tx *gorm.DB) error {
+		/* Grant permission to workspace */
+		if db := tx.Exec("INSERT INTO "+table+" (id, "+column+", resource_id, permission) "+
+			"(SELECT ?, ?, w.id, 'viewer' FROM file f "+
+			"INNER JOIN workspace w ON w.id = f.workspace_id AND f.id = ?) "+
+			"ON CONFLICT DO NOTHING",
+			helper.NewID(), principalID, id); db.Error != nil {
 			return db.Error
 		}
+		/* Grant 'viewer' permission to ancestors, without passing it down */
+		for _, f := range path {
+			if f.GetID() == id {
+				continue
+			}
+			if db := tx.Exec("INSERT INTO "+table+" (id, "+column+", resource_id, permission, is_inheritable) "+
+				"VALUES (?, ?, ?, 'viewer', false) ON CONFLICT DO NOTHING",
+				helper.NewID(), principalID, f.GetID()); db.Error != nil {
+				return db.Error
+			}
+		}
+		/*
+		   Replace the grants below the file, they would take precedence over the inherited one. The
+		   subtrees that don't inherit it keep theirs.
+		*/
+		if changed, err = repo.deletePermissions(tx, &events, table, column, principalID, id, false); err != nil {
+			return err
+		}
+		/* Grant the requested permission to the file */
+		if db := tx.Exec("INSERT INTO "+table+" (id, "+column+", resource_id, permission, is_inheritable) "+
+			"VALUES (?, ?, ?, ?, true) ON CONFLICT ("+column+", resource_id) DO UPDATE SET permission = ?, is_inheritable = true",
+			helper.NewID(), principalID, id, permission, permission); db.Error != nil {
+			return db.Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
+	return changed, events, nil
+}
 
-	/* Grant the requested permission to tree files */
-	tree, err := repo.FindTree(id)
-	if err != nil {
+func (repo *fileRepo) revokePermission(table string, column string, id string, principalID string) ([]string, []string, error) {
+	var changed []string
+	var events outboxEvents
+	err := repo.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		changed, err = repo.deletePermissions(tx, &events, table, column, principalID, id, true)
 		return err
+	})
+	if err != nil {
+		return nil, nil, err
 	}
-	for _, f := range tree {
-		db := repo.db.Exec("INSERT INTO grouppermission (id, group_id, resource_id, permission) "+
-			"VALUES (?, ?, ?, ?) ON CONFLICT (group_id, resource_id) DO UPDATE SET permission = ?",
-			helper.NewID(), groupID, f.GetID(), permission, permission)
-		if db.Error != nil {
-			return db.Error
-		}
-	}
+	return changed, events, nil
+}
 
-	return nil
+/*
+Deletes the grants of the principal in the tree of the file, the files that lost
+one have to be cached again. Without the root, only the part of the tree that
+inherits from the root is affected, as the grants below get replaced by the root's.
+*/
+func (repo *fileRepo) deletePermissions(tx *gorm.DB, events *outboxEvents, table string, column string, principalID string, id string, includeRoot bool) ([]string, error) {
+	query := "DELETE FROM " + table + " WHERE " + column + " = ? AND resource_id IN (SELECT id FROM rec) "
+	values := []interface{}{principalID}
+	cte := fileTreeCTE
+	if !includeRoot {
+		query += "AND resource_id <> ? "
+		values = append(values, id)
+		cte = fileInheritingTreeCTE
+	}
+	changed, err := repo.execWithCTE(tx, cte, id, query+"RETURNING resource_id AS result", values...)
+	if err != nil {
+		return nil, err
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	if err := events.insert(tx, model.OutboxEventFileCacheSync, model.OutboxFileSyncPayload{FileIDs: changed}); err != nil {
+		return nil, err
+	}
+	return changed, nil
 }
 
-func (repo *fileRepo) RevokeGroupPermission(tree []model.File, groupID string) error {
-	for _, f := range tree {
-		db := repo.db.Exec("DELETE FROM grouppermission WHERE group_id = ? AND resource_id = ?", groupID, f.GetID())
-		if db.Error != nil {
+/*
+Stops the file from inheriting the permissions of its parent, the inherited ones
+are granted on the file so nobody loses access until they get revoked.
+*/
+func (repo *fileRepo) BreakPermissionInheritance(id string, inherited []*model.FilePermission) error {
+	return repo.db.Transaction(func(tx *gorm.DB) error {
+		if db := tx.Exec("UPDATE file SET inherit_permissions = false, update_time = ? WHERE id = ?",
+			time.Now().UTC().Format(time.RFC3339), id); db.Error != nil {
 			return db.Error
 		}
+		for _, p := range inherited {
+			table, column, principalID := "userpermission", "user_id", p.UserID
+			if p.GroupID != nil {
+				table, column, principalID = "grouppermission", "group_id", p.GroupID
+			}
+			if db := tx.Exec("INSERT INTO "+table+" (id, "+column+", resource_id, permission, is_inheritable) "+
+				"VALUES (?, ?, ?, ?, true) ON CONFLICT ("+column+", resource_id) DO UPDATE SET permission = ?, is_inheritable = true",
+				helper.NewID(), *principalID, id, p.Value, p.Value); db.Error != nil {
+				return db.Error
+			}
+		}
+		return nil
+	})
+}
+
+/* The grants on the file are kept, they take precedence over the inherited ones */
+func (repo *fileRepo) RestorePermissionInheritance(id string) error {
+	if db := repo.db.Exec("UPDATE file SET inherit_permissions = true, update_time = ? WHERE id = ?",
+		time.Now().UTC().Format(time.RFC3339), id); db.Error != nil {
+		return db.Error
 	}
 	return nil
 }
@@ -560,8 +1320,9 @@ func (repo *fileRepo) populateModelFields(entities []*fileEntity) error {
 		}
 		for _, p := range userPermissions {
 			f.UserPermissions = append(f.UserPermissions, &UserPermissionValue{
-				UserID: p.GetUserID(),
-				Value:  p.GetPermission(),
+				UserID:      p.GetUserID(),
+				Value:       p.GetPermission(),
+				Inheritable: helper.ToPtr(p.IsInheritable()),
 			})
 		}
 		f.GroupPermissions = make([]*GroupPermissionValue, 0)
@@ -571,8 +1332,9 @@ func (repo *fileRepo) populateModelFields(entities []*fileEntity) error {
 		}
 		for _, p := range groupPermissions {
 			f.GroupPermissions = append(f.GroupPermissions, &GroupPermissionValue{
-				GroupID: p.GetGroupID(),
-				Value:   p.GetPermission(),
+				GroupID:     p.GetGroupID(),
+				Value:       p.GetPermission(),
+				Inheritable: helper.ToPtr(p.IsInheritable()),
 			})
 		}
 	}
@@ -0,0 +1,220 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package repo
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"voltaserve/helper"
+	"voltaserve/model"
+
+	"github.com/joho/godotenv"
+)
+
+/*
+The tree semantics of the grants live in SQL, so this needs a database with the
+schema, it runs when POSTGRES_URL is set and the rest of ../.env fills the gaps.
+*/
+func newTestFileRepo(t *testing.T) *fileRepo {
+	if os.Getenv("POSTGRES_URL") == "" {
+		t.Skip("POSTGRES_URL is not set")
+	}
+	if err := godotenv.Load("../.env"); err != nil {
+		t.Fatal(err)
+	}
+	return newFileRepo()
+}
+
+type testPermission struct {
+	Value         string
+	IsInheritable bool
+}
+
+/* Builds root/a/a1 and root/b/b1, where "b" doesn't inherit the permissions of "root" */
+func newTestTree(t *testing.T, repo *fileRepo, userID string) map[string]string {
+	orgID, workspaceID := helper.NewID(), helper.NewID()
+	if db := repo.db.Exec("INSERT INTO organization (id, name) VALUES (?, 'test')", orgID); db.Error != nil {
+		t.Fatal(db.Error)
+	}
+	t.Cleanup(func() { repo.db.Exec("DELETE FROM organization WHERE id = ?", orgID) })
+	if db := repo.db.Exec("INSERT INTO workspace (id, name, organization_id, storage_capacity, bucket) VALUES (?, 'test', ?, 0, ?)",
+		workspaceID, orgID, workspaceID); db.Error != nil {
+		t.Fatal(db.Error)
+	}
+	if db := repo.db.Exec("INSERT INTO \"user\" (id, full_name, username, password_hash) VALUES (?, 'test', ?, '')",
+		userID, userID); db.Error != nil {
+		t.Fatal(db.Error)
+	}
+	t.Cleanup(func() { repo.db.Exec("DELETE FROM \"user\" WHERE id = ?", userID) })
+	ids := map[string]string{}
+	for _, f := range []struct {
+		name   string
+		parent string
+		typ    string
+	}{
+		{"root", "", model.FileTypeFolder},
+		{"a", "root", model.FileTypeFolder},
+		{"a1", "a", model.FileTypeFile},
+		{"b", "root", model.FileTypeFolder},
+		{"b1", "b", model.FileTypeFile},
+	} {
+		opts := FileInsertOptions{Name: f.name, WorkspaceID: workspaceID, Type: f.typ}
+		if f.parent != "" {
+			opts.ParentID = helper.ToPtr(ids[f.parent])
+		}
+		file, err := repo.Insert(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[f.name] = file.GetID()
+	}
+	t.Cleanup(func() {
+		var fileIDs []string
+		for _, id := range ids {
+			fileIDs = append(fileIDs, id)
+		}
+		repo.db.Exec("DELETE FROM file_aggregate_delta WHERE file_id IN (?)", fileIDs)
+	})
+	if err := repo.BreakPermissionInheritance(ids["b"], nil); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestGrantAndRevokeUserPermission(t *testing.T) {
+	repo := newTestFileRepo(t)
+	for _, tc := range []struct {
+		name string
+		/* The grants made before, by file name */
+		existing map[string]string
+		action   func(ids map[string]string, userID string) ([]string, []string, error)
+		/* The grants left, by file name */
+		expected map[string]testPermission
+		/* The files that lost their own grant */
+		changed []string
+	}{
+		{
+			name:     "grant replaces the grants of the inheriting subtree only",
+			existing: map[string]string{"a1": model.PermissionEditor, "b": model.PermissionEditor, "b1": model.PermissionViewer},
+			action: func(ids map[string]string, userID string) ([]string, []string, error) {
+				return repo.GrantUserPermission(ids["root"], userID, model.PermissionOwner)
+			},
+			expected: map[string]testPermission{
+				"root": {model.PermissionOwner, true},
+				"b":    {model.PermissionEditor, true},
+				"b1":   {model.PermissionViewer, true},
+			},
+			changed: []string{"a1"},
+		},
+		{
+			name: "grant gives access to the path without passing it down",
+			action: func(ids map[string]string, userID string) ([]string, []string, error) {
+				return repo.GrantUserPermission(ids["a1"], userID, model.PermissionEditor)
+			},
+			expected: map[string]testPermission{
+				"root": {model.PermissionViewer, false},
+				"a":    {model.PermissionViewer, false},
+				"a1":   {model.PermissionEditor, true},
+			},
+		},
+		{
+			name:     "grant upgrades a grant on the path",
+			existing: map[string]string{"a1": model.PermissionViewer},
+			action: func(ids map[string]string, userID string) ([]string, []string, error) {
+				if _, _, err := repo.GrantUserPermission(ids["a1"], userID, model.PermissionViewer); err != nil {
+					return nil, nil, err
+				}
+				return repo.GrantUserPermission(ids["a"], userID, model.PermissionEditor)
+			},
+			expected: map[string]testPermission{
+				"root": {model.PermissionViewer, false},
+				"a":    {model.PermissionEditor, true},
+			},
+			changed: []string{"a1"},
+		},
+		{
+			name:     "revoke deletes the grants of the whole tree",
+			existing: map[string]string{"root": model.PermissionOwner, "a1": model.PermissionEditor, "b1": model.PermissionViewer},
+			action: func(ids map[string]string, userID string) ([]string, []string, error) {
+				return repo.RevokeUserPermission(ids["root"], userID)
+			},
+			expected: map[string]testPermission{},
+			changed:  []string{"root", "a1", "b1"},
+		},
+		{
+			name:     "revoke leaves the grants above",
+			existing: map[string]string{"root": model.PermissionViewer, "b": model.PermissionEditor},
+			action: func(ids map[string]string, userID string) ([]string, []string, error) {
+				return repo.RevokeUserPermission(ids["b"], userID)
+			},
+			expected: map[string]testPermission{
+				"root": {model.PermissionViewer, true},
+			},
+			changed: []string{"b"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			userID := helper.NewID()
+			ids := newTestTree(t, repo, userID)
+			names := map[string]string{}
+			for name, id := range ids {
+				names[id] = name
+			}
+			for name, permission := range tc.existing {
+				if db := repo.db.Exec("INSERT INTO userpermission (id, user_id, resource_id, permission) VALUES (?, ?, ?, ?)",
+					helper.NewID(), userID, ids[name], permission); db.Error != nil {
+					t.Fatal(db.Error)
+				}
+			}
+			changed, events, err := tc.action(ids, userID)
+			t.Cleanup(func() { repo.db.Exec("DELETE FROM outbox WHERE id IN (?)", append(events, "")) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			var changedNames []string
+			for _, id := range changed {
+				changedNames = append(changedNames, names[id])
+			}
+			slices.Sort(changedNames)
+			expectedChanged := slices.Clone(tc.changed)
+			slices.Sort(expectedChanged)
+			if !slices.Equal(changedNames, expectedChanged) {
+				t.Errorf("expected %v to lose their grant, got %v", expectedChanged, changedNames)
+			}
+			type Row struct {
+				ResourceID    string
+				Permission    string
+				IsInheritable bool
+			}
+			var rows []Row
+			if db := repo.db.Raw("SELECT resource_id, permission, is_inheritable FROM userpermission WHERE user_id = ?",
+				userID).Scan(&rows); db.Error != nil {
+				t.Fatal(db.Error)
+			}
+			actual := map[string]testPermission{}
+			for _, r := range rows {
+				/* The grant on the workspace isn't part of the tree */
+				if name, ok := names[r.ResourceID]; ok {
+					actual[name] = testPermission{r.Permission, r.IsInheritable}
+				}
+			}
+			if len(actual) != len(tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, actual)
+			}
+			for name, p := range tc.expected {
+				if actual[name] != p {
+					t.Errorf("expected %v on %s, got %v", p, name, actual[name])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package repo
+
+import (
+	"encoding/json"
+	"time"
+	"voltaserve/helper"
+	"voltaserve/infra"
+	"voltaserve/model"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+type outboxEventEntity struct {
+	ID          string         `json:"id" gorm:"column:id"`
+	Type        string         `json:"type" gorm:"column:type"`
+	Payload     datatypes.JSON `json:"payload" gorm:"column:payload"`
+	Attempts    int            `json:"attempts" gorm:"column:attempts"`
+	LastError   *string        `json:"lastError,omitempty" gorm:"column:last_error"`
+	ClaimTime   *string        `json:"claimTime,omitempty" gorm:"column:claim_time"`
+	ProcessTime *string        `json:"processTime,omitempty" gorm:"column:process_time"`
+	RetryTime   *string        `json:"retryTime,omitempty" gorm:"column:retry_time"`
+	DeadTime    *string        `json:"deadTime,omitempty" gorm:"column:dead_time"`
+	CreateTime  string         `json:"createTime" gorm:"column:create_time"`
+}
+
+func (*outboxEventEntity) TableName() string {
+	return "outbox"
+}
+
+func (o *outboxEventEntity) BeforeCreate(*gorm.DB) (err error) {
+	o.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	return nil
+}
+
+func (o *outboxEventEntity) GetID() string {
+	return o.ID
+}
+
+func (o *outboxEventEntity) GetType() string {
+	return o.Type
+}
+
+func (o *outboxEventEntity) GetPayload() []byte {
+	return o.Payload
+}
+
+func (o *outboxEventEntity) GetAttempts() int {
+	return o.Attempts
+}
+
+func (o *outboxEventEntity) GetLastError() *string {
+	return o.LastError
+}
+
+func (o *outboxEventEntity) GetClaimTime() *string {
+	return o.ClaimTime
+}
+
+func (o *outboxEventEntity) GetProcessTime() *string {
+	return o.ProcessTime
+}
+
+func (o *outboxEventEntity) GetRetryTime() *string {
+	return o.RetryTime
+}
+
+func (o *outboxEventEntity) GetDeadTime() *string {
+	return o.DeadTime
+}
+
+func (o *outboxEventEntity) GetCreateTime() string {
+	return o.CreateTime
+}
+
+type OutboxRepo interface {
+	FindPending(staleClaimTime string, limit int) ([]model.OutboxEvent, error)
+	Claim(id string, staleClaimTime string) (model.OutboxEvent, error)
+	MarkProcessed(id string) error
+	MarkFailed(opts OutboxMarkFailedOptions) error
+	DeleteProcessedBefore(processTime string) error
+}
+
+func NewOutboxRepo() OutboxRepo {
+	return newOutboxRepo()
+}
+
+type outboxRepo struct {
+	db *gorm.DB
+}
+
+func newOutboxRepo() *outboxRepo {
+	return &outboxRepo{
+		db: infra.NewPostgresManager().GetDBOrPanic(),
+	}
+}
+
+/*
+Events are only ever inserted as part of the transaction that makes the
+change they describe, so either both are committed or none is. The ID is
+returned so the caller can process the event once the change is committed.
+*/
+func insertOutboxEvent(tx *gorm.DB, eventType string, payload interface{}) (string, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	event := outboxEventEntity{
+		ID:      helper.NewID(),
+		Type:    eventType,
+		Payload: b,
+	}
+	if db := tx.Create(&event); db.Error != nil {
+		return "", db.Error
+	}
+	return event.ID, nil
+}
+
+/* Collects the IDs of the events inserted by a transaction */
+type outboxEvents []string
+
+func (e *outboxEvents) insert(tx *gorm.DB, eventType string, payload interface{}) error {
+	id, err := insertOutboxEvent(tx, eventType, payload)
+	if err != nil {
+		return err
+	}
+	*e = append(*e, id)
+	return nil
+}
+
+/* Events that are neither processed nor dead, not claimed by a live worker and due for an attempt */
+const outboxPendingCondition = "process_time IS NULL AND dead_time IS NULL " +
+	"AND (claim_time IS NULL OR claim_time < ?) AND (retry_time IS NULL OR retry_time <= ?)"
+
+/* Returns the pending events, whose claim is missing or older than staleClaimTime */
+func (repo *outboxRepo) FindPending(staleClaimTime string, limit int) ([]model.OutboxEvent, error) {
+	var entities []*outboxEventEntity
+	db := repo.db.
+		Where(outboxPendingCondition, staleClaimTime, time.Now().UTC().Format(time.RFC3339)).
+		Order("create_time").
+		Limit(limit).
+		Find(&entities)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	var res []model.OutboxEvent
+	for _, e := range entities {
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+/* Returns nil when the event is not pending, e.g. because another worker got it first */
+func (repo *outboxRepo) Claim(id string, staleClaimTime string) (model.OutboxEvent, error) {
+	timeNow := time.Now().UTC().Format(time.RFC3339)
+	var entities []*outboxEventEntity
+	db := repo.db.
+		Raw("UPDATE outbox SET claim_time = ? WHERE id = ? AND "+outboxPendingCondition+" RETURNING *",
+			timeNow, id, staleClaimTime, timeNow).
+		Scan(&entities)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	if len(entities) == 0 {
+		return nil, nil
+	}
+	return entities[0], nil
+}
+
+func (repo *outboxRepo) MarkProcessed(id string) error {
+	db := repo.db.Exec(
+		"UPDATE outbox SET process_time = ? WHERE id = ?",
+		time.Now().UTC().Format(time.RFC3339), id,
+	)
+	if db.Error != nil {
+		return db.Error
+	}
+	return nil
+}
+
+type OutboxMarkFailedOptions struct {
+	ID      string
+	Message string
+	/* When the event is due for another attempt */
+	RetryTime string
+	/* The event is dead once it failed this many times, it is kept but never retried */
+	MaxAttempts int
+}
+
+/* Releases the claim so the event is retried later, or not at all once it ran out of attempts */
+func (repo *outboxRepo) MarkFailed(opts OutboxMarkFailedOptions) error {
+	db := repo.db.Exec(
+		"UPDATE outbox SET attempts = attempts + 1, last_error = ?, claim_time = NULL, retry_time = ?, "+
+			"dead_time = CASE WHEN attempts + 1 >= ? THEN ? ELSE NULL END WHERE id = ?",
+		opts.Message, opts.RetryTime, opts.MaxAttempts, time.Now().UTC().Format(time.RFC3339), opts.ID,
+	)
+	if db.Error != nil {
+		return db.Error
+	}
+	return nil
+}
+
+func (repo *outboxRepo) DeleteProcessedBefore(processTime string) error {
+	db := repo.db.Exec("DELETE FROM outbox WHERE process_time IS NOT NULL AND process_time < ?", processTime)
+	if db.Error != nil {
+		return db.Error
+	}
+	return nil
+}
@@ -36,11 +36,12 @@ func NewGroupPermission() model.GroupPermission {
 }
 
 type userPermissionEntity struct {
-	ID         string `json:"id" gorm:"column:id"`
-	UserID     string `json:"userId" gorm:"column:user_id"`
-	ResourceID string `json:"resourceId" gorm:"column:resource_id"`
-	Permission string `json:"permission" gorm:"column:permission"`
-	CreateTime string `json:"createTime" gorm:"column:create_time"`
+	ID          string `json:"id" gorm:"column:id"`
+	UserID      string `json:"userId" gorm:"column:user_id"`
+	ResourceID  string `json:"resourceId" gorm:"column:resource_id"`
+	Permission  string `json:"permission" gorm:"column:permission"`
+	Inheritable *bool  `json:"isInheritable,omitempty" gorm:"column:is_inheritable;default:true"`
+	CreateTime  string `json:"createTime" gorm:"column:create_time"`
 }
 
 func (*userPermissionEntity) TableName() string {
@@ -68,6 +69,10 @@ func (u *userPermissionEntity) GetPermission() string {
 	return u.Permission
 }
 
+func (u *userPermissionEntity) IsInheritable() bool {
+	return u.Inheritable == nil || *u.Inheritable
+}
+
 func (u *userPermissionEntity) GetCreateTime() string {
 	return u.CreateTime
 }
@@ -93,11 +98,12 @@ func (u *userPermissionEntity) SetCreateTime(createTime string) {
 }
 
 type groupPermissionEntity struct {
-	ID         string `json:"id" gorm:"column:id"`
-	GroupID    string `json:"groupId" gorm:"column:group_id"`
-	ResourceID string `json:"resourceId" gorm:"column:resource_id"`
-	Permission string `json:"permission" gorm:"column:permission"`
-	CreateTime string `json:"createTime" gorm:"column:create_time"`
+	ID          string `json:"id" gorm:"column:id"`
+	GroupID     string `json:"groupId" gorm:"column:group_id"`
+	ResourceID  string `json:"resourceId" gorm:"column:resource_id"`
+	Permission  string `json:"permission" gorm:"column:permission"`
+	Inheritable *bool  `json:"isInheritable,omitempty" gorm:"column:is_inheritable;default:true"`
+	CreateTime  string `json:"createTime" gorm:"column:create_time"`
 }
 
 func (*groupPermissionEntity) TableName() string {
@@ -125,6 +131,10 @@ func (g *groupPermissionEntity) GetPermission() string {
 	return g.Permission
 }
 
+func (g *groupPermissionEntity) IsInheritable() bool {
+	return g.Inheritable == nil || *g.Inheritable
+}
+
 func (g *groupPermissionEntity) GetCreateTime() string {
 	return g.CreateTime
 }
@@ -150,8 +160,9 @@ func (g *groupPermissionEntity) SetCreateTime(createTime string) {
 }
 
 type UserPermissionValue struct {
-	UserID string `json:"userId,omitempty"`
-	Value  string `json:"value,omitempty"`
+	UserID      string `json:"userId,omitempty"`
+	Value       string `json:"value,omitempty"`
+	Inheritable *bool  `json:"isInheritable,omitempty"`
 }
 
 func (p UserPermissionValue) GetUserID() string {
@@ -162,9 +173,14 @@ func (p UserPermissionValue) GetValue() string {
 	return p.Value
 }
 
+func (p UserPermissionValue) IsInheritable() bool {
+	return p.Inheritable == nil || *p.Inheritable
+}
+
 type GroupPermissionValue struct {
-	GroupID string `json:"groupId,omitempty"`
-	Value   string `json:"value,omitempty"`
+	GroupID     string `json:"groupId,omitempty"`
+	Value       string `json:"value,omitempty"`
+	Inheritable *bool  `json:"isInheritable,omitempty"`
 }
 
 func (p GroupPermissionValue) GetGroupID() string {
@@ -175,6 +191,10 @@ func (p GroupPermissionValue) GetValue() string {
 	return p.Value
 }
 
+func (p GroupPermissionValue) IsInheritable() bool {
+	return p.Inheritable == nil || *p.Inheritable
+}
+
 type permissionRepo struct {
 	db *gorm.DB
 }
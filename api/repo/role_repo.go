@@ -0,0 +1,220 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+	"voltaserve/errorpkg"
+	"voltaserve/infra"
+	"voltaserve/log"
+	"voltaserve/model"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+type RoleRepo interface {
+	Insert(opts RoleInsertOptions) (model.Role, error)
+	Find(id string) (model.Role, error)
+	FindByOrganization(orgID string) ([]model.Role, error)
+	Update(id string, name string, capabilities []string) (model.Role, error)
+	Delete(id string) error
+	IsGranted(id string) (bool, error)
+}
+
+func NewRoleRepo() RoleRepo {
+	return newRoleRepo()
+}
+
+func NewRole() model.Role {
+	return &roleEntity{}
+}
+
+type roleEntity struct {
+	ID             string         `json:"id" gorm:"column:id"`
+	OrganizationID string         `json:"organizationId" gorm:"column:organization_id"`
+	Name           string         `json:"name" gorm:"column:name"`
+	Capabilities   datatypes.JSON `json:"capabilities" gorm:"column:capabilities"`
+	CreateTime     string         `json:"createTime" gorm:"column:create_time"`
+	UpdateTime     *string        `json:"updateTime,omitempty" gorm:"column:update_time"`
+}
+
+func (*roleEntity) TableName() string {
+	return "role"
+}
+
+func (r *roleEntity) BeforeCreate(*gorm.DB) (err error) {
+	r.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	return nil
+}
+
+func (r *roleEntity) BeforeSave(*gorm.DB) (err error) {
+	timeNow := time.Now().UTC().Format(time.RFC3339)
+	r.UpdateTime = &timeNow
+	return nil
+}
+
+func (r *roleEntity) GetID() string {
+	return r.ID
+}
+
+func (r *roleEntity) GetOrganizationID() string {
+	return r.OrganizationID
+}
+
+func (r *roleEntity) GetName() string {
+	return r.Name
+}
+
+func (r *roleEntity) GetCapabilities() []string {
+	res := make([]string, 0)
+	if r.Capabilities.String() == "" {
+		return res
+	}
+	if err := json.Unmarshal([]byte(r.Capabilities.String()), &res); err != nil {
+		log.GetLogger().Error(err)
+	}
+	return res
+}
+
+func (r *roleEntity) GetCreateTime() string {
+	return r.CreateTime
+}
+
+func (r *roleEntity) GetUpdateTime() *string {
+	return r.UpdateTime
+}
+
+func (r *roleEntity) setCapabilities(capabilities []string) error {
+	b, err := json.Marshal(capabilities)
+	if err != nil {
+		return err
+	}
+	return r.Capabilities.UnmarshalJSON(b)
+}
+
+type roleRepo struct {
+	db *gorm.DB
+}
+
+func newRoleRepo() *roleRepo {
+	return &roleRepo{
+		db: infra.NewPostgresManager().GetDBOrPanic(),
+	}
+}
+
+type RoleInsertOptions struct {
+	ID             string
+	OrganizationID string
+	Name           string
+	Capabilities   []string
+}
+
+func (repo *roleRepo) Insert(opts RoleInsertOptions) (model.Role, error) {
+	role := roleEntity{
+		ID:             opts.ID,
+		OrganizationID: opts.OrganizationID,
+		Name:           opts.Name,
+	}
+	if err := role.setCapabilities(opts.Capabilities); err != nil {
+		return nil, err
+	}
+	if db := repo.db.Create(&role); db.Error != nil {
+		return nil, db.Error
+	}
+	res, err := repo.Find(opts.ID)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (repo *roleRepo) find(id string) (*roleEntity, error) {
+	var res = roleEntity{}
+	db := repo.db.Where("id = ?", id).First(&res)
+	if db.Error != nil {
+		if errors.Is(db.Error, gorm.ErrRecordNotFound) {
+			return nil, errorpkg.NewRoleNotFoundError(db.Error)
+		} else {
+			return nil, errorpkg.NewInternalServerError(db.Error)
+		}
+	}
+	return &res, nil
+}
+
+func (repo *roleRepo) Find(id string) (model.Role, error) {
+	res, err := repo.find(id)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (repo *roleRepo) FindByOrganization(orgID string) ([]model.Role, error) {
+	var entities []*roleEntity
+	db := repo.db.
+		Where("organization_id = ?", orgID).
+		Order("name").
+		Find(&entities)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	var res []model.Role
+	for _, e := range entities {
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+func (repo *roleRepo) Update(id string, name string, capabilities []string) (model.Role, error) {
+	role, err := repo.find(id)
+	if err != nil {
+		return nil, err
+	}
+	role.Name = name
+	if err := role.setCapabilities(capabilities); err != nil {
+		return nil, err
+	}
+	if db := repo.db.Save(&role); db.Error != nil {
+		return nil, db.Error
+	}
+	res, err := repo.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (repo *roleRepo) Delete(id string) error {
+	db := repo.db.Exec("DELETE FROM role WHERE id = ?", id)
+	if db.Error != nil {
+		return db.Error
+	}
+	return nil
+}
+
+/* Whether the role is held by a user or a group on any file */
+func (repo *roleRepo) IsGranted(id string) (bool, error) {
+	type Result struct {
+		Result bool
+	}
+	var res Result
+	db := repo.db.
+		Raw("SELECT EXISTS (SELECT 1 FROM userpermission WHERE permission = ?) "+
+			"OR EXISTS (SELECT 1 FROM grouppermission WHERE permission = ?) result", id, id).
+		Scan(&res)
+	if db.Error != nil {
+		return false, db.Error
+	}
+	return res.Result, nil
+}
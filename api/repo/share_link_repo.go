@@ -0,0 +1,325 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package repo
+
+import (
+	"errors"
+	"time"
+	"voltaserve/errorpkg"
+	"voltaserve/infra"
+	"voltaserve/model"
+
+	"gorm.io/gorm"
+)
+
+type shareLinkEntity struct {
+	ID            string  `json:"id" gorm:"column:id"`
+	FileID        string  `json:"fileId" gorm:"column:file_id"`
+	UserID        string  `json:"userId" gorm:"column:user_id"`
+	TokenHash     string  `json:"tokenHash" gorm:"column:token_hash"`
+	PasswordHash  *string `json:"passwordHash,omitempty" gorm:"column:password_hash"`
+	Mode          string  `json:"mode" gorm:"column:mode"`
+	MaxDownloads  *int64  `json:"maxDownloads,omitempty" gorm:"column:max_downloads"`
+	DownloadCount int64   `json:"downloadCount" gorm:"column:download_count"`
+	ExpireTime    string  `json:"expireTime" gorm:"column:expire_time"`
+	RevokeTime    *string `json:"revokeTime,omitempty" gorm:"column:revoke_time"`
+	CreateTime    string  `json:"createTime" gorm:"column:create_time"`
+	UpdateTime    *string `json:"updateTime,omitempty" gorm:"column:update_time"`
+}
+
+func (*shareLinkEntity) TableName() string {
+	return "share_link"
+}
+
+func (s *shareLinkEntity) BeforeCreate(*gorm.DB) (err error) {
+	s.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	return nil
+}
+
+func (s *shareLinkEntity) BeforeSave(*gorm.DB) (err error) {
+	timeNow := time.Now().UTC().Format(time.RFC3339)
+	s.UpdateTime = &timeNow
+	return nil
+}
+
+func (s *shareLinkEntity) GetID() string {
+	return s.ID
+}
+
+func (s *shareLinkEntity) GetFileID() string {
+	return s.FileID
+}
+
+func (s *shareLinkEntity) GetUserID() string {
+	return s.UserID
+}
+
+func (s *shareLinkEntity) GetTokenHash() string {
+	return s.TokenHash
+}
+
+func (s *shareLinkEntity) GetPasswordHash() *string {
+	return s.PasswordHash
+}
+
+func (s *shareLinkEntity) GetMode() string {
+	return s.Mode
+}
+
+func (s *shareLinkEntity) GetMaxDownloads() *int64 {
+	return s.MaxDownloads
+}
+
+func (s *shareLinkEntity) GetDownloadCount() int64 {
+	return s.DownloadCount
+}
+
+func (s *shareLinkEntity) GetExpireTime() string {
+	return s.ExpireTime
+}
+
+func (s *shareLinkEntity) GetRevokeTime() *string {
+	return s.RevokeTime
+}
+
+func (s *shareLinkEntity) GetCreateTime() string {
+	return s.CreateTime
+}
+
+func (s *shareLinkEntity) GetUpdateTime() *string {
+	return s.UpdateTime
+}
+
+func (s *shareLinkEntity) HasPassword() bool {
+	return s.PasswordHash != nil
+}
+
+func (s *shareLinkEntity) IsRevoked() bool {
+	return s.RevokeTime != nil
+}
+
+func (s *shareLinkEntity) IsExpired() bool {
+	expireTime, err := time.Parse(time.RFC3339, s.ExpireTime)
+	if err != nil {
+		return true
+	}
+	return time.Now().After(expireTime)
+}
+
+type shareLinkAccessEntity struct {
+	ID          string  `json:"id" gorm:"column:id"`
+	ShareLinkID string  `json:"shareLinkId" gorm:"column:share_link_id"`
+	FileID      *string `json:"fileId,omitempty" gorm:"column:file_id"`
+	Action      string  `json:"action" gorm:"column:action"`
+	IP          string  `json:"ip" gorm:"column:ip"`
+	UserAgent   string  `json:"userAgent" gorm:"column:user_agent"`
+	CreateTime  string  `json:"createTime" gorm:"column:create_time"`
+}
+
+func (*shareLinkAccessEntity) TableName() string {
+	return "share_link_access"
+}
+
+func (s *shareLinkAccessEntity) BeforeCreate(*gorm.DB) (err error) {
+	s.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	return nil
+}
+
+func (s *shareLinkAccessEntity) GetID() string {
+	return s.ID
+}
+
+func (s *shareLinkAccessEntity) GetShareLinkID() string {
+	return s.ShareLinkID
+}
+
+func (s *shareLinkAccessEntity) GetFileID() *string {
+	return s.FileID
+}
+
+func (s *shareLinkAccessEntity) GetAction() string {
+	return s.Action
+}
+
+func (s *shareLinkAccessEntity) GetIP() string {
+	return s.IP
+}
+
+func (s *shareLinkAccessEntity) GetUserAgent() string {
+	return s.UserAgent
+}
+
+func (s *shareLinkAccessEntity) GetCreateTime() string {
+	return s.CreateTime
+}
+
+type ShareLinkRepo interface {
+	Insert(opts ShareLinkInsertOptions) (model.ShareLink, error)
+	Find(id string) (model.ShareLink, error)
+	FindByTokenHash(tokenHash string) (model.ShareLink, error)
+	FindByFile(fileID string) ([]model.ShareLink, error)
+	Revoke(id string) error
+	IncrementDownloadCount(id string) (bool, error)
+	InsertAccess(opts ShareLinkAccessInsertOptions) error
+	FindAccesses(shareLinkID string) ([]model.ShareLinkAccess, error)
+}
+
+func NewShareLinkRepo() ShareLinkRepo {
+	return newShareLinkRepo()
+}
+
+type shareLinkRepo struct {
+	db *gorm.DB
+}
+
+func newShareLinkRepo() *shareLinkRepo {
+	return &shareLinkRepo{
+		db: infra.NewPostgresManager().GetDBOrPanic(),
+	}
+}
+
+type ShareLinkInsertOptions struct {
+	ID           string
+	FileID       string
+	UserID       string
+	TokenHash    string
+	PasswordHash *string
+	Mode         string
+	MaxDownloads *int64
+	ExpireTime   string
+}
+
+func (repo *shareLinkRepo) Insert(opts ShareLinkInsertOptions) (model.ShareLink, error) {
+	shareLink := shareLinkEntity{
+		ID:           opts.ID,
+		FileID:       opts.FileID,
+		UserID:       opts.UserID,
+		TokenHash:    opts.TokenHash,
+		PasswordHash: opts.PasswordHash,
+		Mode:         opts.Mode,
+		MaxDownloads: opts.MaxDownloads,
+		ExpireTime:   opts.ExpireTime,
+	}
+	if db := repo.db.Create(&shareLink); db.Error != nil {
+		return nil, db.Error
+	}
+	res, err := repo.Find(opts.ID)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (repo *shareLinkRepo) Find(id string) (model.ShareLink, error) {
+	var res = shareLinkEntity{}
+	db := repo.db.Where("id = ?", id).First(&res)
+	if db.Error != nil {
+		if errors.Is(db.Error, gorm.ErrRecordNotFound) {
+			return nil, errorpkg.NewShareLinkNotFoundError(db.Error)
+		} else {
+			return nil, errorpkg.NewInternalServerError(db.Error)
+		}
+	}
+	return &res, nil
+}
+
+func (repo *shareLinkRepo) FindByTokenHash(tokenHash string) (model.ShareLink, error) {
+	var res = shareLinkEntity{}
+	db := repo.db.Where("token_hash = ?", tokenHash).First(&res)
+	if db.Error != nil {
+		if errors.Is(db.Error, gorm.ErrRecordNotFound) {
+			return nil, errorpkg.NewShareLinkNotFoundError(db.Error)
+		} else {
+			return nil, errorpkg.NewInternalServerError(db.Error)
+		}
+	}
+	return &res, nil
+}
+
+func (repo *shareLinkRepo) FindByFile(fileID string) ([]model.ShareLink, error) {
+	var entities []*shareLinkEntity
+	db := repo.db.
+		Where("file_id = ?", fileID).
+		Order("create_time DESC").
+		Find(&entities)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	var res []model.ShareLink
+	for _, e := range entities {
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+func (repo *shareLinkRepo) Revoke(id string) error {
+	db := repo.db.Exec(
+		"UPDATE share_link SET revoke_time = ? WHERE id = ? AND revoke_time IS NULL",
+		time.Now().UTC().Format(time.RFC3339), id,
+	)
+	if db.Error != nil {
+		return db.Error
+	}
+	return nil
+}
+
+/* Counts a download, returns false without counting when the limit is reached */
+func (repo *shareLinkRepo) IncrementDownloadCount(id string) (bool, error) {
+	db := repo.db.Exec(
+		`UPDATE share_link SET download_count = download_count + 1
+		WHERE id = ? AND (max_downloads IS NULL OR download_count < max_downloads)`,
+		id,
+	)
+	if db.Error != nil {
+		return false, db.Error
+	}
+	return db.RowsAffected == 1, nil
+}
+
+type ShareLinkAccessInsertOptions struct {
+	ID          string
+	ShareLinkID string
+	FileID      *string
+	Action      string
+	IP          string
+	UserAgent   string
+}
+
+func (repo *shareLinkRepo) InsertAccess(opts ShareLinkAccessInsertOptions) error {
+	access := shareLinkAccessEntity{
+		ID:          opts.ID,
+		ShareLinkID: opts.ShareLinkID,
+		FileID:      opts.FileID,
+		Action:      opts.Action,
+		IP:          opts.IP,
+		UserAgent:   opts.UserAgent,
+	}
+	if db := repo.db.Create(&access); db.Error != nil {
+		return db.Error
+	}
+	return nil
+}
+
+func (repo *shareLinkRepo) FindAccesses(shareLinkID string) ([]model.ShareLinkAccess, error) {
+	var entities []*shareLinkAccessEntity
+	db := repo.db.
+		Where("share_link_id = ?", shareLinkID).
+		Order("create_time DESC").
+		Find(&entities)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	var res []model.ShareLinkAccess
+	for _, e := range entities {
+		res = append(res, e)
+	}
+	return res, nil
+}
@@ -0,0 +1,382 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+	"voltaserve/errorpkg"
+	"voltaserve/helper"
+	"voltaserve/infra"
+	"voltaserve/log"
+	"voltaserve/model"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+type snapshotDiffEntity struct {
+	ID             string         `json:"id" gorm:"column:id"`
+	SnapshotID     string         `json:"snapshotId" gorm:"column:snapshot_id"`
+	BaseSnapshotID string         `json:"baseSnapshotId" gorm:"column:base_snapshot_id"`
+	Status         string         `json:"status" gorm:"column:status"`
+	TaskID         *string        `json:"taskId,omitempty" gorm:"column:task_id"`
+	Text           datatypes.JSON `json:"text,omitempty" gorm:"column:text"`
+	Summary        datatypes.JSON `json:"summary,omitempty" gorm:"column:summary"`
+	Pages          datatypes.JSON `json:"pages,omitempty" gorm:"column:pages"`
+	Metadata       datatypes.JSON `json:"metadata,omitempty" gorm:"column:metadata"`
+	CreateTime     string         `json:"createTime" gorm:"column:create_time"`
+	UpdateTime     *string        `json:"updateTime,omitempty" gorm:"column:update_time"`
+}
+
+func (*snapshotDiffEntity) TableName() string {
+	return "snapshot_diff"
+}
+
+func (s *snapshotDiffEntity) BeforeCreate(*gorm.DB) (err error) {
+	s.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	return nil
+}
+
+func (s *snapshotDiffEntity) BeforeSave(*gorm.DB) (err error) {
+	timeNow := time.Now().UTC().Format(time.RFC3339)
+	s.UpdateTime = &timeNow
+	return nil
+}
+
+func (s *snapshotDiffEntity) GetID() string {
+	return s.ID
+}
+
+func (s *snapshotDiffEntity) GetSnapshotID() string {
+	return s.SnapshotID
+}
+
+func (s *snapshotDiffEntity) GetBaseSnapshotID() string {
+	return s.BaseSnapshotID
+}
+
+func (s *snapshotDiffEntity) GetStatus() string {
+	return s.Status
+}
+
+func (s *snapshotDiffEntity) GetTaskID() *string {
+	return s.TaskID
+}
+
+func (s *snapshotDiffEntity) GetText() *model.S3Object {
+	if s.Text.String() == "" {
+		return nil
+	}
+	var res = model.S3Object{}
+	if err := json.Unmarshal([]byte(s.Text.String()), &res); err != nil {
+		log.GetLogger().Fatal(err)
+		return nil
+	}
+	return &res
+}
+
+func (s *snapshotDiffEntity) GetSummary() *model.SnapshotDiffSummary {
+	if s.Summary.String() == "" {
+		return nil
+	}
+	var res = model.SnapshotDiffSummary{}
+	if err := json.Unmarshal([]byte(s.Summary.String()), &res); err != nil {
+		log.GetLogger().Fatal(err)
+		return nil
+	}
+	return &res
+}
+
+func (s *snapshotDiffEntity) GetPages() []model.SnapshotDiffPage {
+	if s.Pages.String() == "" {
+		return nil
+	}
+	var res []model.SnapshotDiffPage
+	if err := json.Unmarshal([]byte(s.Pages.String()), &res); err != nil {
+		log.GetLogger().Fatal(err)
+		return nil
+	}
+	return res
+}
+
+func (s *snapshotDiffEntity) GetMetadata() []model.SnapshotDiffMetadata {
+	if s.Metadata.String() == "" {
+		return nil
+	}
+	var res []model.SnapshotDiffMetadata
+	if err := json.Unmarshal([]byte(s.Metadata.String()), &res); err != nil {
+		log.GetLogger().Fatal(err)
+		return nil
+	}
+	return res
+}
+
+func (s *snapshotDiffEntity) GetCreateTime() string {
+	return s.CreateTime
+}
+
+func (s *snapshotDiffEntity) GetUpdateTime() *string {
+	return s.UpdateTime
+}
+
+func (s *snapshotDiffEntity) HasText() bool {
+	return s.GetText() != nil
+}
+
+func (s *snapshotDiffEntity) SetText(m *model.S3Object) {
+	if m == nil {
+		s.Text = nil
+	} else {
+		s.Text = marshalJSON(m)
+	}
+}
+
+func (s *snapshotDiffEntity) SetSummary(m *model.SnapshotDiffSummary) {
+	if m == nil {
+		s.Summary = nil
+	} else {
+		s.Summary = marshalJSON(m)
+	}
+}
+
+func (s *snapshotDiffEntity) SetPages(pages []model.SnapshotDiffPage) {
+	if pages == nil {
+		s.Pages = nil
+	} else {
+		s.Pages = marshalJSON(pages)
+	}
+}
+
+func (s *snapshotDiffEntity) SetMetadata(metadata []model.SnapshotDiffMetadata) {
+	if metadata == nil {
+		s.Metadata = nil
+	} else {
+		s.Metadata = marshalJSON(metadata)
+	}
+}
+
+func marshalJSON(v interface{}) datatypes.JSON {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.GetLogger().Fatal(err)
+		return nil
+	}
+	return datatypes.JSON(b)
+}
+
+type SnapshotDiffRepo interface {
+	Insert(opts SnapshotDiffInsertOptions) (model.SnapshotDiff, bool, error)
+	Restart(id string, opts SnapshotDiffRestartOptions) (bool, error)
+	Find(id string) (model.SnapshotDiff, error)
+	FindBySnapshots(snapshotID string, baseSnapshotID string) (model.SnapshotDiff, error)
+	FindAllForSnapshot(snapshotID string) ([]model.SnapshotDiff, error)
+	Update(id string, opts SnapshotDiffUpdateOptions) error
+	Delete(id string) error
+}
+
+func NewSnapshotDiffRepo() SnapshotDiffRepo {
+	return newSnapshotDiffRepo()
+}
+
+type snapshotDiffRepo struct {
+	db *gorm.DB
+}
+
+func newSnapshotDiffRepo() *snapshotDiffRepo {
+	return &snapshotDiffRepo{
+		db: infra.NewPostgresManager().GetDBOrPanic(),
+	}
+}
+
+type SnapshotDiffInsertOptions struct {
+	ID             string
+	SnapshotID     string
+	BaseSnapshotID string
+	Status         string
+	TaskID         *string
+	Metadata       []model.SnapshotDiffMetadata
+}
+
+/*
+Inserts the diff unless one already exists for the same pair of snapshots, in
+which case the existing diff is returned. The returned flag tells whether the
+row was inserted by this call.
+*/
+func (repo *snapshotDiffRepo) Insert(opts SnapshotDiffInsertOptions) (model.SnapshotDiff, bool, error) {
+	diff := snapshotDiffEntity{
+		ID:             opts.ID,
+		SnapshotID:     opts.SnapshotID,
+		BaseSnapshotID: opts.BaseSnapshotID,
+		Status:         opts.Status,
+		TaskID:         opts.TaskID,
+		CreateTime:     time.Now().UTC().Format(time.RFC3339),
+	}
+	diff.SetMetadata(opts.Metadata)
+	var ids []string
+	db := repo.db.
+		Raw(`INSERT INTO snapshot_diff (id, snapshot_id, base_snapshot_id, status, task_id, metadata, create_time)
+             VALUES (?, ?, ?, ?, ?, ?, ?)
+             ON CONFLICT (snapshot_id, base_snapshot_id) DO NOTHING
+             RETURNING id`,
+			diff.ID, diff.SnapshotID, diff.BaseSnapshotID, diff.Status, diff.TaskID, diff.Metadata, diff.CreateTime).
+		Scan(&ids)
+	if db.Error != nil {
+		return nil, false, db.Error
+	}
+	if len(ids) == 0 {
+		res, err := repo.FindBySnapshots(opts.SnapshotID, opts.BaseSnapshotID)
+		if err != nil {
+			return nil, false, err
+		}
+		return res, false, nil
+	}
+	res, err := repo.Find(opts.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	return res, true, nil
+}
+
+type SnapshotDiffRestartOptions struct {
+	Status      string
+	Metadata    []model.SnapshotDiffMetadata
+	StaleBefore string
+}
+
+/*
+Resets a diff that failed, or that has been pending since before StaleBefore,
+so it can be computed again. The returned flag is false when the diff is no
+longer in such a state, meaning that another request restarted it first.
+*/
+func (repo *snapshotDiffRepo) Restart(id string, opts SnapshotDiffRestartOptions) (bool, error) {
+	diff := snapshotDiffEntity{}
+	diff.SetMetadata(opts.Metadata)
+	var ids []string
+	db := repo.db.
+		Raw(`UPDATE snapshot_diff
+             SET status = ?, task_id = NULL, text = NULL, summary = NULL, pages = NULL, metadata = ?, update_time = ?
+             WHERE id = ? AND (
+               status = ? OR
+               (status IN (?, ?) AND COALESCE(update_time, create_time) < ?)
+             )
+             RETURNING id`,
+			opts.Status, diff.Metadata, time.Now().UTC().Format(time.RFC3339), id,
+			model.SnapshotStatusError, model.SnapshotStatusWaiting, model.SnapshotStatusProcessing, opts.StaleBefore).
+		Scan(&ids)
+	if db.Error != nil {
+		return false, db.Error
+	}
+	return len(ids) > 0, nil
+}
+
+func (repo *snapshotDiffRepo) find(id string) (*snapshotDiffEntity, error) {
+	var res = snapshotDiffEntity{}
+	db := repo.db.Where("id = ?", id).First(&res)
+	if db.Error != nil {
+		if errors.Is(db.Error, gorm.ErrRecordNotFound) {
+			return nil, errorpkg.NewSnapshotDiffNotFoundError(db.Error)
+		} else {
+			return nil, errorpkg.NewInternalServerError(db.Error)
+		}
+	}
+	return &res, nil
+}
+
+func (repo *snapshotDiffRepo) Find(id string) (model.SnapshotDiff, error) {
+	res, err := repo.find(id)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (repo *snapshotDiffRepo) FindBySnapshots(snapshotID string, baseSnapshotID string) (model.SnapshotDiff, error) {
+	var res = snapshotDiffEntity{}
+	db := repo.db.
+		Where("snapshot_id = ? AND base_snapshot_id = ?", snapshotID, baseSnapshotID).
+		First(&res)
+	if db.Error != nil {
+		if errors.Is(db.Error, gorm.ErrRecordNotFound) {
+			return nil, errorpkg.NewSnapshotDiffNotFoundError(db.Error)
+		} else {
+			return nil, errorpkg.NewInternalServerError(db.Error)
+		}
+	}
+	return &res, nil
+}
+
+/* Returns the diffs where the snapshot is on either side */
+func (repo *snapshotDiffRepo) FindAllForSnapshot(snapshotID string) ([]model.SnapshotDiff, error) {
+	var entities []*snapshotDiffEntity
+	db := repo.db.
+		Where("snapshot_id = ? OR base_snapshot_id = ?", snapshotID, snapshotID).
+		Find(&entities)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	var res []model.SnapshotDiff
+	for _, e := range entities {
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+type SnapshotDiffUpdateOptions struct {
+	Fields  []string
+	Status  *string
+	TaskID  *string
+	Text    *model.S3Object
+	Summary *model.SnapshotDiffSummary
+	Pages   []model.SnapshotDiffPage
+}
+
+const (
+	SnapshotDiffFieldStatus  = "status"
+	SnapshotDiffFieldTaskID  = "taskId"
+	SnapshotDiffFieldText    = "text"
+	SnapshotDiffFieldSummary = "summary"
+	SnapshotDiffFieldPages   = "pages"
+)
+
+func (repo *snapshotDiffRepo) Update(id string, opts SnapshotDiffUpdateOptions) error {
+	diff, err := repo.find(id)
+	if err != nil {
+		return err
+	}
+	if helper.Includes(opts.Fields, SnapshotDiffFieldStatus) && opts.Status != nil {
+		diff.Status = *opts.Status
+	}
+	if helper.Includes(opts.Fields, SnapshotDiffFieldTaskID) {
+		diff.TaskID = opts.TaskID
+	}
+	if helper.Includes(opts.Fields, SnapshotDiffFieldText) {
+		diff.SetText(opts.Text)
+	}
+	if helper.Includes(opts.Fields, SnapshotDiffFieldSummary) {
+		diff.SetSummary(opts.Summary)
+	}
+	if helper.Includes(opts.Fields, SnapshotDiffFieldPages) {
+		diff.SetPages(opts.Pages)
+	}
+	if db := repo.db.Save(&diff); db.Error != nil {
+		return db.Error
+	}
+	return nil
+}
+
+func (repo *snapshotDiffRepo) Delete(id string) error {
+	if db := repo.db.Exec("DELETE FROM snapshot_diff WHERE id = ?", id); db.Error != nil {
+		return db.Error
+	}
+	return nil
+}
@@ -30,12 +30,16 @@ type SnapshotRepo interface {
 	FindAllForFile(fileID string) ([]model.Snapshot, error)
 	FindAllDangling() ([]model.Snapshot, error)
 	FindAllPrevious(fileID string, version int64) ([]model.Snapshot, error)
+	FindProcessedForBlob(blobID string) (model.Snapshot, error)
 	GetIDsForFile(fileID string) ([]string, error)
+	GetIDsByWorkspace(workspaceID string) ([]string, error)
 	Insert(snapshot model.Snapshot) error
 	Save(snapshot model.Snapshot) error
 	Delete(id string) error
 	Update(id string, opts SnapshotUpdateOptions) error
-	MapWithFile(id string, fileID string) error
+	MapWithFile(id string, fileID string, opts SnapshotMapOptions) error
+	FindForFile(id string, fileID string) (model.Snapshot, error)
+	UpdateMapping(id string, fileID string, opts SnapshotMappingUpdateOptions) error
 	DeleteMappingsForFile(fileID string) error
 	DeleteAllDangling() error
 	GetLatestVersionForFile(fileID string) (int64, error)
@@ -66,6 +70,10 @@ type snapshotEntity struct {
 	Status     string         `json:"status,omitempty" gorm:"column,status"`
 	Language   *string        `json:"language,omitempty" gorm:"column:language"`
 	TaskID     *string        `json:"taskID,omitempty" gorm:"column:task_id"`
+	BlobID     *string        `json:"blobId,omitempty" gorm:"column:blob_id"`
+	Label      *string        `json:"label,omitempty" gorm:"column:label;->"`
+	Comment    *string        `json:"comment,omitempty" gorm:"column:comment;->"`
+	UserID     *string        `json:"userId,omitempty" gorm:"column:user_id"`
 	CreateTime string         `json:"createTime" gorm:"column:create_time"`
 	UpdateTime *string        `json:"updateTime,omitempty" gorm:"column:update_time"`
 }
@@ -201,6 +209,22 @@ func (s *snapshotEntity) GetTaskID() *string {
 	return s.TaskID
 }
 
+func (s *snapshotEntity) GetBlobID() *string {
+	return s.BlobID
+}
+
+func (s *snapshotEntity) GetLabel() *string {
+	return s.Label
+}
+
+func (s *snapshotEntity) GetComment() *string {
+	return s.Comment
+}
+
+func (s *snapshotEntity) GetUserID() *string {
+	return s.UserID
+}
+
 func (s *snapshotEntity) SetID(id string) {
 	s.ID = id
 }
@@ -341,6 +365,14 @@ func (s *snapshotEntity) SetTaskID(taskID *string) {
 	s.TaskID = taskID
 }
 
+func (s *snapshotEntity) SetBlobID(blobID *string) {
+	s.BlobID = blobID
+}
+
+func (s *snapshotEntity) SetUserID(userID *string) {
+	s.UserID = userID
+}
+
 func (s *snapshotEntity) HasOriginal() bool {
 	return s.Original != nil
 }
@@ -392,8 +424,12 @@ func newSnapshotRepo() *snapshotRepo {
 }
 
 func (repo *snapshotRepo) find(id string) (*snapshotEntity, error) {
+	return repo.findInTx(repo.db, id)
+}
+
+func (repo *snapshotRepo) findInTx(tx *gorm.DB, id string) (*snapshotEntity, error) {
 	var res snapshotEntity
-	if db := repo.db.Where("id = ?", id).First(&res); db.Error != nil {
+	if db := tx.Where("id = ?", id).First(&res); db.Error != nil {
 		if errors.Is(db.Error, gorm.ErrRecordNotFound) {
 			return nil, errorpkg.NewSnapshotNotFoundError(db.Error)
 		} else {
@@ -483,7 +519,12 @@ func (repo *snapshotRepo) Update(id string, opts SnapshotUpdateOptions) error {
 	if err != nil {
 		return err
 	}
+	previousSize := snapshot.originalSize()
 	if helper.Includes(opts.Fields, SnapshotFieldOriginal) {
+		/* Pipelines don't know what the upload was detected as */
+		if opts.Original != nil && opts.Original.Extension == nil && snapshot.GetOriginal() != nil {
+			opts.Original.Extension = snapshot.GetOriginal().Extension
+		}
 		snapshot.SetOriginal(opts.Original)
 	}
 	if helper.Includes(opts.Fields, SnapshotFieldPreview) {
@@ -516,15 +557,87 @@ func (repo *snapshotRepo) Update(id string, opts SnapshotUpdateOptions) error {
 	if helper.Includes(opts.Fields, SnapshotFieldTaskID) {
 		snapshot.SetTaskID(opts.TaskID)
 	}
-	if db := repo.db.Save(&snapshot); db.Error != nil {
-		return db.Error
+	return repo.db.Transaction(func(tx *gorm.DB) error {
+		if db := tx.Save(&snapshot); db.Error != nil {
+			return db.Error
+		}
+		/* The files the snapshot is mapped to change size along with its original */
+		if delta := snapshot.originalSize() - previousSize; delta != 0 {
+			if db := tx.Exec("INSERT INTO file_aggregate_delta (file_id, size) "+
+				"SELECT file_id, ? FROM snapshot_file WHERE snapshot_id = ?", delta, id); db.Error != nil {
+				return db.Error
+			}
+		}
+		return nil
+	})
+}
+
+/* What the snapshot adds to the size of the files it's mapped to */
+func (s *snapshotEntity) originalSize() int64 {
+	original := s.GetOriginal()
+	if original != nil && original.Size != nil {
+		return *original.Size
 	}
-	return nil
+	return 0
 }
 
-func (repo *snapshotRepo) MapWithFile(id string, fileID string) error {
-	if db := repo.db.Exec("INSERT INTO snapshot_file (snapshot_id, file_id) VALUES (?, ?)", id, fileID); db.Error != nil {
-		return db.Error
+/* Labels and comments describe the version within a file, copies of the file get their own */
+type SnapshotMapOptions struct {
+	Label   *string
+	Comment *string
+}
+
+/* The file grows by the size of the original, in the same transaction */
+func (repo *snapshotRepo) MapWithFile(id string, fileID string, opts SnapshotMapOptions) error {
+	return repo.db.Transaction(func(tx *gorm.DB) error {
+		if db := tx.Exec("INSERT INTO snapshot_file (snapshot_id, file_id, label, comment) VALUES (?, ?, ?, ?)",
+			id, fileID, opts.Label, opts.Comment); db.Error != nil {
+			return db.Error
+		}
+		snapshot, err := repo.findInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		return insertAggregateDelta(tx, fileID, fileAggregates{size: snapshot.originalSize()})
+	})
+}
+
+/* Returns the snapshot with the label and comment it has within the file */
+func (repo *snapshotRepo) FindForFile(id string, fileID string) (model.Snapshot, error) {
+	var entities []*snapshotEntity
+	db := repo.db.
+		Raw("SELECT s.*, sf.label, sf.comment FROM snapshot s JOIN snapshot_file sf ON s.id = sf.snapshot_id WHERE s.id = ? AND sf.file_id = ?", id, fileID).
+		Scan(&entities)
+	if db.Error != nil {
+		return nil, errorpkg.NewInternalServerError(db.Error)
+	}
+	if len(entities) == 0 {
+		return nil, errorpkg.NewSnapshotNotFoundError(nil)
+	}
+	return entities[0], nil
+}
+
+type SnapshotMappingUpdateOptions struct {
+	Fields  []string
+	Label   *string
+	Comment *string
+}
+
+const (
+	SnapshotMappingFieldLabel   = "label"
+	SnapshotMappingFieldComment = "comment"
+)
+
+func (repo *snapshotRepo) UpdateMapping(id string, fileID string, opts SnapshotMappingUpdateOptions) error {
+	if helper.Includes(opts.Fields, SnapshotMappingFieldLabel) {
+		if db := repo.db.Exec("UPDATE snapshot_file SET label = ? WHERE snapshot_id = ? AND file_id = ?", opts.Label, id, fileID); db.Error != nil {
+			return db.Error
+		}
+	}
+	if helper.Includes(opts.Fields, SnapshotMappingFieldComment) {
+		if db := repo.db.Exec("UPDATE snapshot_file SET comment = ? WHERE snapshot_id = ? AND file_id = ?", opts.Comment, id, fileID); db.Error != nil {
+			return db.Error
+		}
 	}
 	return nil
 }
@@ -539,7 +652,7 @@ func (repo *snapshotRepo) DeleteMappingsForFile(fileID string) error {
 func (repo *snapshotRepo) findAllForFile(fileID string) ([]*snapshotEntity, error) {
 	var res []*snapshotEntity
 	db := repo.db.
-		Raw("SELECT * FROM snapshot s LEFT JOIN snapshot_file sf ON s.id = sf.snapshot_id WHERE sf.file_id = ? ORDER BY s.version", fileID).
+		Raw("SELECT s.*, sf.label, sf.comment FROM snapshot s JOIN snapshot_file sf ON s.id = sf.snapshot_id WHERE sf.file_id = ? ORDER BY s.version", fileID).
 		Scan(&res)
 	if db.Error != nil {
 		return nil, db.Error
@@ -574,7 +687,7 @@ func (repo *snapshotRepo) FindAllDangling() ([]model.Snapshot, error) {
 
 func (repo *snapshotRepo) FindAllPrevious(fileID string, version int64) ([]model.Snapshot, error) {
 	var entities []*snapshotEntity
-	db := repo.db.Raw("SELECT * FROM snapshot s LEFT JOIN snapshot_file sf ON s.id = sf.snapshot_id WHERE sf.file_id = ? AND s.version < ? ORDER BY s.version DESC", fileID, version).Scan(&entities)
+	db := repo.db.Raw("SELECT s.*, sf.label, sf.comment FROM snapshot s JOIN snapshot_file sf ON s.id = sf.snapshot_id WHERE sf.file_id = ? AND s.version < ? ORDER BY s.version DESC", fileID, version).Scan(&entities)
 	if db.Error != nil {
 		return nil, db.Error
 	}
@@ -585,6 +698,33 @@ func (repo *snapshotRepo) FindAllPrevious(fileID string, version int64) ([]model
 	return res, nil
 }
 
+/* Returns the oldest ready snapshot of the blob, or nil if there is none */
+/*
+Snapshots that skipped the pipeline, because they exceed the processing limit
+or got canceled, are ready as well, so only the ones with artifacts count. The
+one with the most artifacts is preferred.
+*/
+func (repo *snapshotRepo) FindProcessedForBlob(blobID string) (model.Snapshot, error) {
+	var entities []*snapshotEntity
+	db := repo.db.
+		Raw(`SELECT * FROM snapshot
+             WHERE blob_id = ? AND status = ?
+               AND (preview IS NOT NULL OR text IS NOT NULL OR thumbnail IS NOT NULL)
+             ORDER BY (CASE WHEN preview IS NULL THEN 0 ELSE 1 END) +
+                      (CASE WHEN text IS NULL THEN 0 ELSE 1 END) +
+                      (CASE WHEN thumbnail IS NULL THEN 0 ELSE 1 END) DESC,
+                      create_time
+             LIMIT 1`, blobID, model.SnapshotStatusReady).
+		Scan(&entities)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	if len(entities) == 0 {
+		return nil, nil
+	}
+	return entities[0], nil
+}
+
 func (repo *snapshotRepo) GetIDsForFile(fileID string) ([]string, error) {
 	type Value struct {
 		Result string
@@ -603,6 +743,24 @@ func (repo *snapshotRepo) GetIDsForFile(fileID string) ([]string, error) {
 	return res, nil
 }
 
+func (repo *snapshotRepo) GetIDsByWorkspace(workspaceID string) ([]string, error) {
+	type Value struct {
+		Result string
+	}
+	var values []Value
+	db := repo.db.
+		Raw("SELECT DISTINCT sf.snapshot_id result FROM snapshot_file sf JOIN file f ON f.id = sf.file_id WHERE f.workspace_id = ?", workspaceID).
+		Scan(&values)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	res := []string{}
+	for _, v := range values {
+		res = append(res, v.Result)
+	}
+	return res, nil
+}
+
 func (repo *snapshotRepo) DeleteAllDangling() error {
 	if db := repo.db.Exec("DELETE FROM snapshot WHERE id IN (SELECT s.id FROM (SELECT * FROM snapshot) s LEFT JOIN snapshot_file sf ON s.id = sf.snapshot_id WHERE sf.snapshot_id IS NULL)"); db.Error != nil {
 		return db.Error
@@ -635,7 +793,7 @@ func (repo *snapshotRepo) CountAssociations(id string) (int, error) {
 }
 
 func (repo *snapshotRepo) Attach(sourceFileID string, targetFileID string) error {
-	if db := repo.db.Exec("INSERT INTO snapshot_file (snapshot_id, file_id) SELECT s.id, ? "+
+	if db := repo.db.Exec("INSERT INTO snapshot_file (snapshot_id, file_id, label, comment) SELECT s.id, ?, map.label, map.comment "+
 		"FROM snapshot s LEFT JOIN snapshot_file map ON s.id = map.snapshot_id "+
 		"WHERE map.file_id = ? ORDER BY s.version DESC LIMIT 1", targetFileID, sourceFileID); db.Error != nil {
 		return db.Error
@@ -643,9 +801,21 @@ func (repo *snapshotRepo) Attach(sourceFileID string, targetFileID string) error
 	return nil
 }
 
+/* The file shrinks by the size of the original, in the same transaction */
 func (repo *snapshotRepo) Detach(id string, fileID string) error {
-	if db := repo.db.Exec("DELETE FROM snapshot_file WHERE snapshot_id = ? AND file_id = ?", id, fileID); db.Error != nil {
-		return db.Error
-	}
-	return nil
+	return repo.db.Transaction(func(tx *gorm.DB) error {
+		db := tx.Exec("DELETE FROM snapshot_file WHERE snapshot_id = ? AND file_id = ?", id, fileID)
+		if db.Error != nil {
+			return db.Error
+		}
+		/* Detached already */
+		if db.RowsAffected == 0 {
+			return nil
+		}
+		snapshot, err := repo.findInTx(tx, id)
+		if err != nil {
+			return err
+		}
+		return insertAggregateDelta(tx, fileID, fileAggregates{size: -snapshot.originalSize()})
+	})
 }
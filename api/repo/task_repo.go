@@ -147,7 +147,9 @@ type TaskRepo interface {
 	Find(id string) (model.Task, error)
 	GetIDs() ([]string, error)
 	GetCount(email string) (int64, error)
+	FindRunningOperations() ([]model.Task, error)
 	Save(task model.Task) error
+	UpdatePercentage(id string, percentage int) error
 	Delete(id string) error
 }
 
@@ -252,6 +254,22 @@ func (repo *taskRepo) GetCount(userID string) (int64, error) {
 	return count, nil
 }
 
+/* The running tasks of the operations the API runs itself, see service.TaskPayloadOperation */
+func (repo *taskRepo) FindRunningOperations() ([]model.Task, error) {
+	var entities []*taskEntity
+	db := repo.db.
+		Raw("SELECT * FROM task WHERE status = ? AND payload->>'operation' IS NOT NULL", model.TaskStatusRunning).
+		Scan(&entities)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	var res []model.Task
+	for _, t := range entities {
+		res = append(res, t)
+	}
+	return res, nil
+}
+
 func (repo *taskRepo) Save(task model.Task) error {
 	db := repo.db.Save(task)
 	if db.Error != nil {
@@ -260,6 +278,15 @@ func (repo *taskRepo) Save(task model.Task) error {
 	return nil
 }
 
+/* Only touches the percentage, so it doesn't undo a concurrent change like a cancellation */
+func (repo *taskRepo) UpdatePercentage(id string, percentage int) error {
+	db := repo.db.Exec("UPDATE task SET percentage = ? WHERE id = ?", percentage, id)
+	if db.Error != nil {
+		return db.Error
+	}
+	return nil
+}
+
 func (repo *taskRepo) Delete(id string) error {
 	db := repo.db.Exec("DELETE FROM task WHERE id = ?", id)
 	if db.Error != nil {
@@ -0,0 +1,309 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+	"voltaserve/errorpkg"
+	"voltaserve/infra"
+	"voltaserve/model"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+type uploadEntity struct {
+	ID           string         `json:"id" gorm:"column:id"`
+	UserID       string         `json:"userId" gorm:"column:user_id"`
+	WorkspaceID  string         `json:"workspaceId" gorm:"column:workspace_id"`
+	ParentID     *string        `json:"parentId,omitempty" gorm:"column:parent_id"`
+	FileID       *string        `json:"fileId,omitempty" gorm:"column:file_id"`
+	Name         string         `json:"name" gorm:"column:name"`
+	Size         int64          `json:"size" gorm:"column:size"`
+	Offset       int64          `json:"offset" gorm:"column:byte_offset"`
+	Bucket       string         `json:"bucket" gorm:"column:bucket"`
+	Key          string         `json:"key" gorm:"column:key"`
+	SnapshotID   string         `json:"snapshotId" gorm:"column:snapshot_id"`
+	S3UploadID   string         `json:"s3UploadId" gorm:"column:s3_upload_id"`
+	Parts        datatypes.JSON `json:"parts,omitempty" gorm:"column:parts"`
+	CompleteTime *string        `json:"completeTime,omitempty" gorm:"column:complete_time"`
+	ExpireTime   string         `json:"expireTime" gorm:"column:expire_time"`
+	CreateTime   string         `json:"createTime" gorm:"column:create_time"`
+	UpdateTime   *string        `json:"updateTime,omitempty" gorm:"column:update_time"`
+}
+
+func (*uploadEntity) TableName() string {
+	return "upload"
+}
+
+func (o *uploadEntity) BeforeCreate(*gorm.DB) (err error) {
+	o.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	return nil
+}
+
+func (o *uploadEntity) BeforeSave(*gorm.DB) (err error) {
+	timeNow := time.Now().UTC().Format(time.RFC3339)
+	o.UpdateTime = &timeNow
+	return nil
+}
+
+func (o *uploadEntity) GetID() string {
+	return o.ID
+}
+
+func (o *uploadEntity) GetUserID() string {
+	return o.UserID
+}
+
+func (o *uploadEntity) GetWorkspaceID() string {
+	return o.WorkspaceID
+}
+
+func (o *uploadEntity) GetParentID() *string {
+	return o.ParentID
+}
+
+func (o *uploadEntity) GetFileID() *string {
+	return o.FileID
+}
+
+func (o *uploadEntity) GetName() string {
+	return o.Name
+}
+
+func (o *uploadEntity) GetSize() int64 {
+	return o.Size
+}
+
+func (o *uploadEntity) GetOffset() int64 {
+	return o.Offset
+}
+
+func (o *uploadEntity) GetBucket() string {
+	return o.Bucket
+}
+
+func (o *uploadEntity) GetKey() string {
+	return o.Key
+}
+
+func (o *uploadEntity) GetSnapshotID() string {
+	return o.SnapshotID
+}
+
+func (o *uploadEntity) GetS3UploadID() string {
+	return o.S3UploadID
+}
+
+func (o *uploadEntity) GetParts() ([]model.UploadPart, error) {
+	if o.Parts.String() == "" {
+		return []model.UploadPart{}, nil
+	}
+	res := []model.UploadPart{}
+	if err := json.Unmarshal([]byte(o.Parts.String()), &res); err != nil {
+		return nil, errorpkg.NewInternalServerError(err)
+	}
+	return res, nil
+}
+
+func (o *uploadEntity) GetCompleteTime() *string {
+	return o.CompleteTime
+}
+
+func (o *uploadEntity) GetExpireTime() string {
+	return o.ExpireTime
+}
+
+func (o *uploadEntity) GetCreateTime() string {
+	return o.CreateTime
+}
+
+func (o *uploadEntity) GetUpdateTime() *string {
+	return o.UpdateTime
+}
+
+type UploadRepo interface {
+	Insert(opts UploadInsertOptions) (model.Upload, error)
+	Find(id string) (model.Upload, error)
+	FindExpired() ([]model.Upload, error)
+	GetPendingSizeForWorkspace(workspaceID string) (int64, error)
+	Append(id string, offset int64, part model.UploadPart) (bool, error)
+	MarkComplete(id string) error
+	UpdateFileID(id string, fileID string) error
+	Delete(id string) error
+}
+
+func NewUploadRepo() UploadRepo {
+	return newUploadRepo()
+}
+
+type uploadRepo struct {
+	db *gorm.DB
+}
+
+func newUploadRepo() *uploadRepo {
+	return &uploadRepo{
+		db: infra.NewPostgresManager().GetDBOrPanic(),
+	}
+}
+
+type UploadInsertOptions struct {
+	ID          string
+	UserID      string
+	WorkspaceID string
+	ParentID    *string
+	FileID      *string
+	Name        string
+	Size        int64
+	Bucket      string
+	Key         string
+	SnapshotID  string
+	S3UploadID  string
+	ExpireTime  string
+}
+
+func (repo *uploadRepo) Insert(opts UploadInsertOptions) (model.Upload, error) {
+	upload := uploadEntity{
+		ID:          opts.ID,
+		UserID:      opts.UserID,
+		WorkspaceID: opts.WorkspaceID,
+		ParentID:    opts.ParentID,
+		FileID:      opts.FileID,
+		Name:        opts.Name,
+		Size:        opts.Size,
+		Bucket:      opts.Bucket,
+		Key:         opts.Key,
+		SnapshotID:  opts.SnapshotID,
+		S3UploadID:  opts.S3UploadID,
+		ExpireTime:  opts.ExpireTime,
+	}
+	if db := repo.db.Create(&upload); db.Error != nil {
+		return nil, db.Error
+	}
+	res, err := repo.Find(opts.ID)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (repo *uploadRepo) find(id string) (*uploadEntity, error) {
+	var res = uploadEntity{}
+	db := repo.db.Where("id = ?", id).First(&res)
+	if db.Error != nil {
+		if errors.Is(db.Error, gorm.ErrRecordNotFound) {
+			return nil, errorpkg.NewUploadNotFoundError(db.Error)
+		} else {
+			return nil, errorpkg.NewInternalServerError(db.Error)
+		}
+	}
+	return &res, nil
+}
+
+func (repo *uploadRepo) Find(id string) (model.Upload, error) {
+	res, err := repo.find(id)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (repo *uploadRepo) FindExpired() ([]model.Upload, error) {
+	var entities []*uploadEntity
+	db := repo.db.
+		Where("expire_time < ?", time.Now().UTC().Format(time.RFC3339)).
+		Find(&entities)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	var res []model.Upload
+	for _, e := range entities {
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+/* Bytes that uploads in progress will add to the workspace once finalized */
+func (repo *uploadRepo) GetPendingSizeForWorkspace(workspaceID string) (int64, error) {
+	type Value struct {
+		Result int64
+	}
+	var value Value
+	db := repo.db.
+		Raw("SELECT COALESCE(SUM(size), 0) result FROM upload WHERE workspace_id = ?", workspaceID).
+		Scan(&value)
+	if db.Error != nil {
+		return 0, db.Error
+	}
+	return value.Result, nil
+}
+
+/*
+Records a part and moves the offset forward, only if the offset is still the
+one the part was written at. Returns false when another request got there first.
+*/
+func (repo *uploadRepo) Append(id string, offset int64, part model.UploadPart) (bool, error) {
+	upload, err := repo.find(id)
+	if err != nil {
+		return false, err
+	}
+	if upload.Offset != offset {
+		return false, nil
+	}
+	parts, err := upload.GetParts()
+	if err != nil {
+		return false, err
+	}
+	parts = append(parts, part)
+	b, err := json.Marshal(parts)
+	if err != nil {
+		return false, err
+	}
+	db := repo.db.Exec(
+		"UPDATE upload SET byte_offset = ?, parts = ? WHERE id = ? AND byte_offset = ?",
+		offset+part.Size, string(b), id, offset,
+	)
+	if db.Error != nil {
+		return false, db.Error
+	}
+	return db.RowsAffected == 1, nil
+}
+
+/* Records that the multipart upload was assembled in S3, so a retried finalize skips that step */
+func (repo *uploadRepo) MarkComplete(id string) error {
+	db := repo.db.Exec(
+		"UPDATE upload SET complete_time = ? WHERE id = ?",
+		time.Now().UTC().Format(time.RFC3339), id,
+	)
+	if db.Error != nil {
+		return db.Error
+	}
+	return nil
+}
+
+/* Records the file created by finalize, so a retried finalize adds the snapshot to it */
+func (repo *uploadRepo) UpdateFileID(id string, fileID string) error {
+	db := repo.db.Exec("UPDATE upload SET file_id = ? WHERE id = ?", fileID, id)
+	if db.Error != nil {
+		return db.Error
+	}
+	return nil
+}
+
+func (repo *uploadRepo) Delete(id string) error {
+	db := repo.db.Exec("DELETE FROM upload WHERE id = ?", id)
+	if db.Error != nil {
+		return db.Error
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package repo
+
+import (
+	"errors"
+	"time"
+	"voltaserve/errorpkg"
+	"voltaserve/infra"
+	"voltaserve/model"
+
+	"gorm.io/gorm"
+)
+
+type watermarkTemplateEntity struct {
+	ID             string   `json:"id" gorm:"column:id"`
+	WorkspaceID    string   `json:"workspaceId" gorm:"column:workspace_id"`
+	Name           string   `json:"name" gorm:"column:name"`
+	Text           string   `json:"text" gorm:"column:text"`
+	Classification *string  `json:"classification,omitempty" gorm:"column:classification"`
+	FontSize       *float64 `json:"fontSize,omitempty" gorm:"column:font_size"`
+	Color          string   `json:"color" gorm:"column:color"`
+	Opacity        float64  `json:"opacity" gorm:"column:opacity"`
+	Angle          float64  `json:"angle" gorm:"column:angle"`
+	Position       string   `json:"position" gorm:"column:position"`
+	Tiled          bool     `json:"tiled" gorm:"column:tiled"`
+	CreateTime     string   `json:"createTime" gorm:"column:create_time"`
+	UpdateTime     *string  `json:"updateTime,omitempty" gorm:"column:update_time"`
+}
+
+func (*watermarkTemplateEntity) TableName() string {
+	return "watermark_template"
+}
+
+func (w *watermarkTemplateEntity) BeforeCreate(*gorm.DB) (err error) {
+	w.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	return nil
+}
+
+func (w *watermarkTemplateEntity) BeforeSave(*gorm.DB) (err error) {
+	timeNow := time.Now().UTC().Format(time.RFC3339)
+	w.UpdateTime = &timeNow
+	return nil
+}
+
+func (w *watermarkTemplateEntity) GetID() string {
+	return w.ID
+}
+
+func (w *watermarkTemplateEntity) GetWorkspaceID() string {
+	return w.WorkspaceID
+}
+
+func (w *watermarkTemplateEntity) GetName() string {
+	return w.Name
+}
+
+func (w *watermarkTemplateEntity) GetText() string {
+	return w.Text
+}
+
+func (w *watermarkTemplateEntity) GetClassification() *string {
+	return w.Classification
+}
+
+func (w *watermarkTemplateEntity) GetFontSize() *float64 {
+	return w.FontSize
+}
+
+func (w *watermarkTemplateEntity) GetColor() string {
+	return w.Color
+}
+
+func (w *watermarkTemplateEntity) GetOpacity() float64 {
+	return w.Opacity
+}
+
+func (w *watermarkTemplateEntity) GetAngle() float64 {
+	return w.Angle
+}
+
+func (w *watermarkTemplateEntity) GetPosition() string {
+	return w.Position
+}
+
+func (w *watermarkTemplateEntity) IsTiled() bool {
+	return w.Tiled
+}
+
+func (w *watermarkTemplateEntity) GetCreateTime() string {
+	return w.CreateTime
+}
+
+func (w *watermarkTemplateEntity) GetUpdateTime() *string {
+	return w.UpdateTime
+}
+
+type WatermarkTemplateRepo interface {
+	Insert(opts WatermarkTemplateInsertOptions) (model.WatermarkTemplate, error)
+	Find(id string) (model.WatermarkTemplate, error)
+	FindByWorkspace(workspaceID string) ([]model.WatermarkTemplate, error)
+	Update(id string, opts WatermarkTemplateUpdateOptions) (model.WatermarkTemplate, error)
+	Delete(id string) error
+}
+
+func NewWatermarkTemplateRepo() WatermarkTemplateRepo {
+	return newWatermarkTemplateRepo()
+}
+
+type watermarkTemplateRepo struct {
+	db *gorm.DB
+}
+
+func newWatermarkTemplateRepo() *watermarkTemplateRepo {
+	return &watermarkTemplateRepo{
+		db: infra.NewPostgresManager().GetDBOrPanic(),
+	}
+}
+
+type WatermarkTemplateInsertOptions struct {
+	ID             string
+	WorkspaceID    string
+	Name           string
+	Text           string
+	Classification *string
+	FontSize       *float64
+	Color          string
+	Opacity        float64
+	Angle          float64
+	Position       string
+	Tiled          bool
+}
+
+func (repo *watermarkTemplateRepo) Insert(opts WatermarkTemplateInsertOptions) (model.WatermarkTemplate, error) {
+	template := watermarkTemplateEntity{
+		ID:             opts.ID,
+		WorkspaceID:    opts.WorkspaceID,
+		Name:           opts.Name,
+		Text:           opts.Text,
+		Classification: opts.Classification,
+		FontSize:       opts.FontSize,
+		Color:          opts.Color,
+		Opacity:        opts.Opacity,
+		Angle:          opts.Angle,
+		Position:       opts.Position,
+		Tiled:          opts.Tiled,
+	}
+	if db := repo.db.Create(&template); db.Error != nil {
+		return nil, db.Error
+	}
+	res, err := repo.Find(opts.ID)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (repo *watermarkTemplateRepo) find(id string) (*watermarkTemplateEntity, error) {
+	var res = watermarkTemplateEntity{}
+	db := repo.db.Where("id = ?", id).First(&res)
+	if db.Error != nil {
+		if errors.Is(db.Error, gorm.ErrRecordNotFound) {
+			return nil, errorpkg.NewWatermarkTemplateNotFoundError(db.Error)
+		} else {
+			return nil, errorpkg.NewInternalServerError(db.Error)
+		}
+	}
+	return &res, nil
+}
+
+func (repo *watermarkTemplateRepo) Find(id string) (model.WatermarkTemplate, error) {
+	res, err := repo.find(id)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (repo *watermarkTemplateRepo) FindByWorkspace(workspaceID string) ([]model.WatermarkTemplate, error) {
+	var entities []*watermarkTemplateEntity
+	db := repo.db.
+		Where("workspace_id = ?", workspaceID).
+		Order("name").
+		Find(&entities)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	var res []model.WatermarkTemplate
+	for _, e := range entities {
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+/* Every field is replaced, the service merges the patch with the current values */
+type WatermarkTemplateUpdateOptions struct {
+	Name           string
+	Text           string
+	Classification *string
+	FontSize       *float64
+	Color          string
+	Opacity        float64
+	Angle          float64
+	Position       string
+	Tiled          bool
+}
+
+func (repo *watermarkTemplateRepo) Update(id string, opts WatermarkTemplateUpdateOptions) (model.WatermarkTemplate, error) {
+	template, err := repo.find(id)
+	if err != nil {
+		return nil, err
+	}
+	template.Name = opts.Name
+	template.Text = opts.Text
+	template.Classification = opts.Classification
+	template.FontSize = opts.FontSize
+	template.Color = opts.Color
+	template.Opacity = opts.Opacity
+	template.Angle = opts.Angle
+	template.Position = opts.Position
+	template.Tiled = opts.Tiled
+	if db := repo.db.Save(&template); db.Error != nil {
+		return nil, db.Error
+	}
+	res, err := repo.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+/* Workspaces using the template fall back to the default watermark */
+func (repo *watermarkTemplateRepo) Delete(id string) error {
+	return repo.db.Transaction(func(tx *gorm.DB) error {
+		if db := tx.Exec("UPDATE workspace SET watermark_template_id = NULL WHERE watermark_template_id = ?", id); db.Error != nil {
+			return db.Error
+		}
+		if db := tx.Exec("DELETE FROM watermark_template WHERE id = ?", id); db.Error != nil {
+			return db.Error
+		}
+		return nil
+	})
+}
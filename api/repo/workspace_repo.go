@@ -11,13 +11,16 @@
 package repo
 
 import (
+	"encoding/json"
 	"errors"
 	"time"
 	"voltaserve/errorpkg"
 	"voltaserve/helper"
 	"voltaserve/infra"
+	"voltaserve/log"
 	"voltaserve/model"
 
+	"gorm.io/datatypes"
 	"gorm.io/gorm"
 )
 
@@ -27,9 +30,12 @@ type WorkspaceRepo interface {
 	UpdateName(id string, name string) (model.Workspace, error)
 	UpdateStorageCapacity(id string, storageCapacity int64) (model.Workspace, error)
 	UpdateRootID(id string, rootNodeID string) error
+	UpdateRetentionPolicy(id string, policy *model.RetentionPolicy) (model.Workspace, error)
+	UpdateWatermarkSettings(id string, templateID *string, enforced bool) (model.Workspace, error)
 	Delete(id string) error
 	GetIDs() ([]string, error)
 	GetIDsByOrganization(orgID string) ([]string, error)
+	GetIDsWithRetentionPolicy() ([]string, error)
 	GrantUserPermission(id string, userID string, permission string) error
 }
 
@@ -42,16 +48,19 @@ func NewWorkspace() model.Workspace {
 }
 
 type workspaceEntity struct {
-	ID               string                  `json:"id," gorm:"column:id;size:36"`
-	Name             string                  `json:"name" gorm:"column:name;size:255"`
-	StorageCapacity  int64                   `json:"storageCapacity" gorm:"column:storage_capacity"`
-	RootID           string                  `json:"rootId" gorm:"column:root_id;size:36"`
-	OrganizationID   string                  `json:"organizationId" gorm:"column:organization_id;size:36"`
-	UserPermissions  []*UserPermissionValue  `json:"userPermissions" gorm:"-"`
-	GroupPermissions []*GroupPermissionValue `json:"groupPermissions" gorm:"-"`
-	Bucket           string                  `json:"bucket" gorm:"column:bucket;size:255"`
-	CreateTime       string                  `json:"createTime" gorm:"column:create_time"`
-	UpdateTime       *string                 `json:"updateTime,omitempty" gorm:"column:update_time"`
+	ID                  string                  `json:"id," gorm:"column:id;size:36"`
+	Name                string                  `json:"name" gorm:"column:name;size:255"`
+	StorageCapacity     int64                   `json:"storageCapacity" gorm:"column:storage_capacity"`
+	RootID              string                  `json:"rootId" gorm:"column:root_id;size:36"`
+	OrganizationID      string                  `json:"organizationId" gorm:"column:organization_id;size:36"`
+	UserPermissions     []*UserPermissionValue  `json:"userPermissions" gorm:"-"`
+	GroupPermissions    []*GroupPermissionValue `json:"groupPermissions" gorm:"-"`
+	Bucket              string                  `json:"bucket" gorm:"column:bucket;size:255"`
+	RetentionPolicy     datatypes.JSON          `json:"retentionPolicy,omitempty" gorm:"column:retention_policy"`
+	WatermarkTemplateID *string                 `json:"watermarkTemplateId,omitempty" gorm:"column:watermark_template_id"`
+	WatermarkEnforced   bool                    `json:"watermarkEnforced" gorm:"column:watermark_enforced"`
+	CreateTime          string                  `json:"createTime" gorm:"column:create_time"`
+	UpdateTime          *string                 `json:"updateTime,omitempty" gorm:"column:update_time"`
 }
 
 func (*workspaceEntity) TableName() string {
@@ -109,6 +118,26 @@ func (w *workspaceEntity) GetBucket() string {
 	return w.Bucket
 }
 
+func (w *workspaceEntity) GetRetentionPolicy() *model.RetentionPolicy {
+	if w.RetentionPolicy.String() == "" {
+		return nil
+	}
+	var res = model.RetentionPolicy{}
+	if err := json.Unmarshal([]byte(w.RetentionPolicy.String()), &res); err != nil {
+		log.GetLogger().Fatal(err)
+		return nil
+	}
+	return &res
+}
+
+func (w *workspaceEntity) GetWatermarkTemplateID() *string {
+	return w.WatermarkTemplateID
+}
+
+func (w *workspaceEntity) IsWatermarkEnforced() bool {
+	return w.WatermarkEnforced
+}
+
 func (w *workspaceEntity) GetCreateTime() string {
 	return w.CreateTime
 }
@@ -121,6 +150,21 @@ func (w *workspaceEntity) SetName(name string) {
 	w.Name = name
 }
 
+func (w *workspaceEntity) SetRetentionPolicy(policy *model.RetentionPolicy) {
+	if policy.IsEmpty() {
+		w.RetentionPolicy = nil
+	} else {
+		b, err := json.Marshal(policy)
+		if err != nil {
+			log.GetLogger().Fatal(err)
+			return
+		}
+		if err := w.RetentionPolicy.UnmarshalJSON(b); err != nil {
+			log.GetLogger().Fatal(err)
+		}
+	}
+}
+
 type workspaceRepo struct {
 	db             *gorm.DB
 	permissionRepo *permissionRepo
@@ -228,6 +272,39 @@ func (repo *workspaceRepo) UpdateStorageCapacity(id string, storageCapacity int6
 	return res, nil
 }
 
+func (repo *workspaceRepo) UpdateRetentionPolicy(id string, policy *model.RetentionPolicy) (model.Workspace, error) {
+	workspace, err := repo.find(id)
+	if err != nil {
+		return nil, err
+	}
+	workspace.SetRetentionPolicy(policy)
+	if db := repo.db.Save(&workspace); db.Error != nil {
+		return nil, db.Error
+	}
+	res, err := repo.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (repo *workspaceRepo) UpdateWatermarkSettings(id string, templateID *string, enforced bool) (model.Workspace, error) {
+	workspace, err := repo.find(id)
+	if err != nil {
+		return nil, err
+	}
+	workspace.WatermarkTemplateID = templateID
+	workspace.WatermarkEnforced = enforced
+	if db := repo.db.Save(&workspace); db.Error != nil {
+		return nil, db.Error
+	}
+	res, err := repo.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 func (repo *workspaceRepo) UpdateRootID(id string, rootNodeID string) error {
 	db := repo.db.Exec("UPDATE workspace SET root_id = ? WHERE id = ?", rootNodeID, id)
 	if db.Error != nil {
@@ -286,6 +363,24 @@ func (repo *workspaceRepo) GetIDsByOrganization(orgID string) ([]string, error)
 	return res, nil
 }
 
+func (repo *workspaceRepo) GetIDsWithRetentionPolicy() ([]string, error) {
+	type IDResult struct {
+		Result string
+	}
+	var ids []IDResult
+	db := repo.db.
+		Raw("SELECT id result FROM workspace WHERE retention_policy IS NOT NULL ORDER BY create_time").
+		Scan(&ids)
+	if db.Error != nil {
+		return nil, db.Error
+	}
+	res := []string{}
+	for _, id := range ids {
+		res = append(res, id.Result)
+	}
+	return res, nil
+}
+
 func (repo *workspaceRepo) GrantUserPermission(id string, userID string, permission string) error {
 	db := repo.db.Exec(
 		"INSERT INTO userpermission (id, user_id, resource_id, permission) VALUES (?, ?, ?, ?) ON CONFLICT (user_id, resource_id) DO UPDATE SET permission = ?",
@@ -11,18 +11,18 @@
 package router
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"voltaserve/config"
 	"voltaserve/errorpkg"
 	"voltaserve/helper"
@@ -38,22 +38,22 @@ import (
 
 type FileRouter struct {
 	fileSvc               *service.FileService
+	archiveSvc            *service.ArchiveService
+	extractSvc            *service.ExtractService
 	workspaceSvc          *service.WorkspaceService
 	config                *config.Config
-	bufferPool            sync.Pool
+	objectServer          *infra.ObjectServer
 	accessTokenCookieName string
 }
 
 func NewFileRouter() *FileRouter {
 	return &FileRouter{
-		fileSvc:      service.NewFileService(),
-		workspaceSvc: service.NewWorkspaceService(),
-		config:       config.GetConfig(),
-		bufferPool: sync.Pool{
-			New: func() interface{} {
-				return new(bytes.Buffer)
-			},
-		},
+		fileSvc:               service.NewFileService(),
+		archiveSvc:            service.NewArchiveService(),
+		extractSvc:            service.NewExtractService(),
+		workspaceSvc:          service.NewWorkspaceService(),
+		config:                config.GetConfig(),
+		objectServer:          infra.NewObjectServer(),
 		accessTokenCookieName: "voltaserve_access_token",
 	}
 }
@@ -71,6 +71,7 @@ func (r *FileRouter) AppendRoutes(g fiber.Router) {
 	g.Post("/:id/move", r.Move)
 	g.Patch("/:id/name", r.PatchName)
 	g.Post("/:id/copy", r.Copy)
+	g.Post("/:id/extract", r.Extract)
 	g.Get("/:id/size", r.GetSize)
 	g.Post("/grant_user_permission", r.GrantUserPermission)
 	g.Post("/revoke_user_permission", r.RevokeUserPermission)
@@ -78,12 +79,15 @@ func (r *FileRouter) AppendRoutes(g fiber.Router) {
 	g.Post("/revoke_group_permission", r.RevokeGroupPermission)
 	g.Get("/:id/user_permissions", r.GetUserPermissions)
 	g.Get("/:id/group_permissions", r.GetGroupPermissions)
+	g.Patch("/:id/permission_inheritance", r.PatchPermissionInheritance)
 }
 
 func (r *FileRouter) AppendNonJWTRoutes(g fiber.Router) {
 	g.Get("/:id/original:ext", r.DownloadOriginal)
 	g.Get("/:id/preview:ext", r.DownloadPreview)
 	g.Get("/:id/thumbnail:ext", r.DownloadThumbnail)
+	g.Get("/:id/archive.zip", r.DownloadArchive)
+	g.Get("/archive.zip", r.DownloadSelectionArchive)
 }
 
 // Create godoc
@@ -98,6 +102,8 @@ func (r *FileRouter) AppendNonJWTRoutes(g fiber.Router) {
 //	@Param			workspace_id	query		string	true	"Workspace ID"
 //	@Param			parent_id		query		string	false	"Parent ID"
 //	@Param			name			query		string	false	"Name"
+//	@Param			label			query		string	false	"Label of the version, e.g. Approved"
+//	@Param			comment			query		string	false	"Comment on the version"
 //	@Success		200				{object}	service.File
 //	@Failure		404				{object}	errorpkg.ErrorResponse
 //	@Failure		400				{object}	errorpkg.ErrorResponse
@@ -123,6 +129,10 @@ func (r *FileRouter) Create(c *fiber.Ctx) error {
 	}
 	name := c.Query("name")
 	if fileType == model.FileTypeFile {
+		storeOpts, err := r.parseStoreOptions(c)
+		if err != nil {
+			return err
+		}
 		fh, err := c.FormFile("file")
 		if err != nil {
 			return err
@@ -158,7 +168,7 @@ func (r *FileRouter) Create(c *fiber.Ctx) error {
 				}
 			}
 		}(tmpPath)
-		file, err = r.fileSvc.Store(file.ID, tmpPath, userID)
+		file, err = r.fileSvc.Store(file.ID, tmpPath, *storeOpts, userID)
 		if err != nil {
 			return err
 		}
@@ -189,14 +199,20 @@ func (r *FileRouter) Create(c *fiber.Ctx) error {
 //	@Id				files_patch
 //	@Accept			x-www-form-urlencoded
 //	@Produce		json
-//	@Param			id	path		string	true	"ID"
-//	@Success		200	{object}	service.File
-//	@Failure		404	{object}	errorpkg.ErrorResponse
-//	@Failure		400	{object}	errorpkg.ErrorResponse
-//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Param			id		path		string	true	"ID"
+//	@Param			label	query		string	false	"Label of the version, e.g. Approved"
+//	@Param			comment	query		string	false	"Comment on the version"
+//	@Success		200		{object}	service.File
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		400		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
 //	@Router			/files/{id} [patch]
 func (r *FileRouter) Patch(c *fiber.Ctx) error {
 	userID := GetUserID(c)
+	storeOpts, err := r.parseStoreOptions(c)
+	if err != nil {
+		return err
+	}
 	files, err := r.fileSvc.Find([]string{c.Params("id")}, userID)
 	if err != nil {
 		return err
@@ -225,13 +241,31 @@ func (r *FileRouter) Patch(c *fiber.Ctx) error {
 			}
 		}
 	}(tmpPath)
-	file, err = r.fileSvc.Store(file.ID, tmpPath, userID)
+	file, err = r.fileSvc.Store(file.ID, tmpPath, *storeOpts, userID)
 	if err != nil {
 		return err
 	}
 	return c.JSON(file)
 }
 
+/* Reads the label and comment of the version being uploaded */
+func (r *FileRouter) parseStoreOptions(c *fiber.Ctx) (*service.FileStoreOptions, error) {
+	res := service.FileStoreOptions{}
+	if label := c.Query("label"); label != "" {
+		if err := validator.New().Var(label, "max=64"); err != nil {
+			return nil, errorpkg.NewInvalidQueryParamError("label")
+		}
+		res.Label = &label
+	}
+	if comment := c.Query("comment"); comment != "" {
+		if err := validator.New().Var(comment, "max=1000"); err != nil {
+			return nil, errorpkg.NewInvalidQueryParamError("comment")
+		}
+		res.Comment = &comment
+	}
+	return &res, nil
+}
+
 type FileCreateFolderOptions struct {
 	WorkspaceID string  `json:"workspaceId" validate:"required"`
 	Name        string  `json:"name" validate:"required,max=255"`
@@ -429,12 +463,15 @@ type FileCopyOptions struct {
 // Copy godoc
 //
 //	@Summary		Copy
-//	@Description	Copy
+//	@Description	Copy in the background, the task reports the progress
 //	@Tags			Files
 //	@Id				files_copy
 //	@Produce		json
 //	@Param			id		path		string			true	"ID"
 //	@Param			body	body		FileCopyOptions	true	"Body"
+//	@Param			wait	query		bool			false	"Copy synchronously and return the copies"
+//	@Success		202		{object}	service.Task
+//	@Success		200		{array}		service.File
 //	@Failure		404		{object}	errorpkg.ErrorResponse
 //	@Failure		500		{object}	errorpkg.ErrorResponse
 //	@Router			/files/{id}/copy [post]
@@ -447,11 +484,46 @@ func (r *FileRouter) Copy(c *fiber.Ctx) error {
 	if err := validator.New().Struct(opts); err != nil {
 		return errorpkg.NewRequestBodyValidationError(err)
 	}
-	res, err := r.fileSvc.Copy(c.Params("id"), opts.IDs, userID)
+	if c.QueryBool("wait") {
+		res, err := r.fileSvc.Copy(c.Params("id"), opts.IDs, userID)
+		if err != nil {
+			return err
+		}
+		return c.JSON(res)
+	}
+	res, err := r.fileSvc.CopyAsync(c.Params("id"), opts.IDs, userID)
 	if err != nil {
 		return err
 	}
-	return c.JSON(res)
+	return c.Status(http.StatusAccepted).JSON(res)
+}
+
+// Extract godoc
+//
+//	@Summary		Extract
+//	@Description	Extract a ZIP, tar, tar.gz or 7z archive into a new folder in the background, the task reports the progress
+//	@Tags			Files
+//	@Id				files_extract
+//	@Produce		json
+//	@Param			id		path		string						true	"ID"
+//	@Param			body	body		service.FileExtractOptions	false	"Body"
+//	@Success		202		{object}	service.Task
+//	@Failure		400		{object}	errorpkg.ErrorResponse
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/files/{id}/extract [post]
+func (r *FileRouter) Extract(c *fiber.Ctx) error {
+	opts := new(service.FileExtractOptions)
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(opts); err != nil {
+			return err
+		}
+	}
+	res, err := r.extractSvc.ExtractAsync(c.Params("id"), *opts, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.Status(http.StatusAccepted).JSON(res)
 }
 
 type FileMoveOptions struct {
@@ -461,12 +533,15 @@ type FileMoveOptions struct {
 // Move godoc
 //
 //	@Summary		Move
-//	@Description	Move
+//	@Description	Move in the background, the task reports the progress
 //	@Tags			Files
 //	@Id				files_move
 //	@Produce		json
 //	@Param			id		path		string			true	"ID"
 //	@Param			body	body		FileMoveOptions	true	"Body"
+//	@Param			wait	query		bool			false	"Move synchronously"
+//	@Success		202		{object}	service.Task
+//	@Success		204
 //	@Failure		404		{object}	errorpkg.ErrorResponse
 //	@Failure		500		{object}	errorpkg.ErrorResponse
 //	@Router			/files/{id}/move [post]
@@ -479,10 +554,17 @@ func (r *FileRouter) Move(c *fiber.Ctx) error {
 	if err := validator.New().Struct(opts); err != nil {
 		return errorpkg.NewRequestBodyValidationError(err)
 	}
-	if _, err := r.fileSvc.Move(c.Params("id"), opts.IDs, userID); err != nil {
+	if c.QueryBool("wait") {
+		if _, err := r.fileSvc.Move(c.Params("id"), opts.IDs, userID); err != nil {
+			return err
+		}
+		return c.SendStatus(http.StatusNoContent)
+	}
+	res, err := r.fileSvc.MoveAsync(c.Params("id"), opts.IDs, userID)
+	if err != nil {
 		return err
 	}
-	return c.SendStatus(http.StatusNoContent)
+	return c.Status(http.StatusAccepted).JSON(res)
 }
 
 type FilePatchNameOptions struct {
@@ -525,11 +607,13 @@ type FileDeleteOptions struct {
 // Delete godoc
 //
 //	@Summary		Delete
-//	@Description	Delete
+//	@Description	Move to the trash in the background, the task reports the progress
 //	@Tags			Files
 //	@Id				files_delete
 //	@Produce		json
 //	@Param			body	body		FileDeleteOptions	true	"Body"
+//	@Param			wait	query		bool				false	"Delete synchronously and return the parent IDs"
+//	@Success		202		{object}	service.Task
 //	@Success		200		{array}		string
 //	@Failure		500		{object}	errorpkg.ErrorResponse
 //	@Router			/files [delete]
@@ -542,11 +626,18 @@ func (r *FileRouter) Delete(c *fiber.Ctx) error {
 	if err := validator.New().Struct(opts); err != nil {
 		return errorpkg.NewRequestBodyValidationError(err)
 	}
-	res, err := r.fileSvc.Delete(opts.IDs, userID)
+	if c.QueryBool("wait") {
+		res, err := r.fileSvc.Delete(opts.IDs, userID)
+		if err != nil {
+			return err
+		}
+		return c.JSON(res)
+	}
+	res, err := r.fileSvc.DeleteAsync(opts.IDs, userID)
 	if err != nil {
 		return err
 	}
-	return c.JSON(res)
+	return c.Status(http.StatusAccepted).JSON(res)
 }
 
 // GetSize godoc
@@ -595,7 +686,7 @@ func (r *FileRouter) GetCount(c *fiber.Ctx) error {
 type FileGrantUserPermissionOptions struct {
 	UserID     string   `json:"userId" validate:"required"`
 	IDs        []string `json:"ids" validate:"required"`
-	Permission string   `json:"permission" validate:"required,oneof=viewer editor owner"`
+	Permission string   `json:"permission" validate:"required"`
 }
 
 // GrantUserPermission godoc
@@ -660,7 +751,7 @@ func (r *FileRouter) RevokeUserPermission(c *fiber.Ctx) error {
 type FileGrantGroupPermissionOptions struct {
 	GroupID    string   `json:"groupId" validate:"required"`
 	IDs        []string `json:"ids" validate:"required"`
-	Permission string   `json:"permission" validate:"required,oneof=viewer editor owner"`
+	Permission string   `json:"permission" validate:"required"`
 }
 
 // GrantGroupPermission godoc
@@ -764,6 +855,39 @@ func (r *FileRouter) GetGroupPermissions(c *fiber.Ctx) error {
 	return c.JSON(res)
 }
 
+type FilePatchPermissionInheritanceOptions struct {
+	Inherit *bool `json:"inherit" validate:"required"`
+}
+
+// PatchPermissionInheritance godoc
+//
+//	@Summary		Patch Permission Inheritance
+//	@Description	Break or restore the inheritance of the permissions of the parent
+//	@Tags			Files
+//	@Id				files_patch_permission_inheritance
+//	@Produce		json
+//	@Param			id		path		string									true	"ID"
+//	@Param			body	body		FilePatchPermissionInheritanceOptions	true	"Body"
+//	@Success		200		{object}	service.File
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/files/{id}/permission_inheritance [patch]
+func (r *FileRouter) PatchPermissionInheritance(c *fiber.Ctx) error {
+	userID := GetUserID(c)
+	opts := new(FilePatchPermissionInheritanceOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	res, err := r.fileSvc.PatchPermissionInheritance(c.Params("id"), *opts.Inherit, userID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
 // DownloadOriginal godoc
 //
 //	@Summary		Download Original
@@ -797,24 +921,19 @@ func (r *FileRouter) DownloadOriginal(c *fiber.Ctx) error {
 	if ext == "" {
 		return errorpkg.NewMissingQueryParamError("ext")
 	}
-	buf := r.bufferPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	defer r.bufferPool.Put(buf)
-	res, err := r.fileSvc.DownloadOriginalBuffer(id, c.Get("Range"), buf, userID)
+	res, err := r.fileSvc.DownloadOriginal(id, userID, c.IP())
 	if err != nil {
 		return err
 	}
-	if filepath.Ext(res.Snapshot.GetOriginal().Key) != ext {
+	if filepath.Ext(res.Object.Key) != ext {
 		return errorpkg.NewS3ObjectNotFoundError(nil)
 	}
-	b := res.Buffer.Bytes()
-	c.Set("Content-Type", infra.DetectMimeFromBytes(b))
-	c.Set("Content-Disposition", fmt.Sprintf("filename=\"%s\"", filepath.Base(res.File.GetName())))
-	if res.RangeInterval != nil {
-		res.RangeInterval.ApplyToFiberContext(c)
-		c.Status(http.StatusPartialContent)
-	}
-	return c.Send(b)
+	return r.objectServer.Serve(c, infra.ObjectServeOptions{
+		Bucket:      res.Object.Bucket,
+		Key:         res.Object.Key,
+		ContentType: res.Object.ContentType,
+		Filename:    filepath.Base(res.File.GetName()),
+	})
 }
 
 // DownloadPreview godoc
@@ -850,24 +969,19 @@ func (r *FileRouter) DownloadPreview(c *fiber.Ctx) error {
 	if ext == "" {
 		return errorpkg.NewMissingQueryParamError("ext")
 	}
-	buf := r.bufferPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	defer r.bufferPool.Put(buf)
-	res, err := r.fileSvc.DownloadPreviewBuffer(id, c.Get("Range"), buf, userID)
+	res, err := r.fileSvc.DownloadPreview(id, userID, c.IP())
 	if err != nil {
 		return err
 	}
-	if filepath.Ext(res.Snapshot.GetPreview().Key) != ext {
+	if filepath.Ext(res.Object.Key) != ext {
 		return errorpkg.NewS3ObjectNotFoundError(nil)
 	}
-	b := buf.Bytes()
-	c.Set("Content-Type", infra.DetectMimeFromBytes(b))
-	c.Set("Content-Disposition", fmt.Sprintf("filename=\"%s\"", filepath.Base(res.File.GetName())))
-	if res.RangeInterval != nil {
-		res.RangeInterval.ApplyToFiberContext(c)
-		c.Status(http.StatusPartialContent)
-	}
-	return c.Send(b)
+	return r.objectServer.Serve(c, infra.ObjectServeOptions{
+		Bucket:      res.Object.Bucket,
+		Key:         res.Object.Key,
+		ContentType: res.Object.ContentType,
+		Filename:    filepath.Base(res.File.GetName()),
+	})
 }
 
 // DownloadThumbnail godoc
@@ -916,6 +1030,90 @@ func (r *FileRouter) DownloadThumbnail(c *fiber.Ctx) error {
 	return c.Send(b)
 }
 
+// DownloadArchive godoc
+//
+//	@Summary		Download Archive
+//	@Description	Download a file or folder as a ZIP archive, with what the user can view in it
+//	@Tags			Files
+//	@Id				files_download_archive
+//	@Produce		application/zip
+//	@Param			id				path		string	true	"ID"
+//	@Param			access_token	query		string	true	"Access Token"
+//	@Param			variant			query		string	false	"Variant, original (default) or preview"
+//	@Failure		400				{object}	errorpkg.ErrorResponse
+//	@Failure		404				{object}	errorpkg.ErrorResponse
+//	@Failure		500				{object}	errorpkg.ErrorResponse
+//	@Router			/files/{id}/archive.zip [get]
+func (r *FileRouter) DownloadArchive(c *fiber.Ctx) error {
+	return r.sendArchive(c, []string{c.Params("id")})
+}
+
+// DownloadSelectionArchive godoc
+//
+//	@Summary		Download Selection Archive
+//	@Description	Download several files and folders as one ZIP archive, with what the user can view in it
+//	@Tags			Files
+//	@Id				files_download_selection_archive
+//	@Produce		application/zip
+//	@Param			ids				query		string	true	"IDs, comma separated"
+//	@Param			access_token	query		string	true	"Access Token"
+//	@Param			variant			query		string	false	"Variant, original (default) or preview"
+//	@Failure		400				{object}	errorpkg.ErrorResponse
+//	@Failure		404				{object}	errorpkg.ErrorResponse
+//	@Failure		500				{object}	errorpkg.ErrorResponse
+//	@Router			/files/archive.zip [get]
+func (r *FileRouter) DownloadSelectionArchive(c *fiber.Ctx) error {
+	var ids []string
+	for _, id := range strings.Split(c.Query("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" && !helper.Includes(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return errorpkg.NewMissingQueryParamError("ids")
+	}
+	return r.sendArchive(c, ids)
+}
+
+/* The archive is streamed as it's written, errors past the first byte can only be logged */
+func (r *FileRouter) sendArchive(c *fiber.Ctx, ids []string) error {
+	accessToken := c.Cookies(r.accessTokenCookieName)
+	if accessToken == "" {
+		accessToken = c.Query("access_token")
+		if accessToken == "" {
+			return errorpkg.NewFileNotFoundError(nil)
+		}
+	}
+	userID, err := r.getUserIDFromAccessToken(accessToken)
+	if err != nil {
+		return c.SendStatus(http.StatusNotFound)
+	}
+	archive, err := r.archiveSvc.Prepare(ids, service.ArchiveOptions{
+		Variant: c.Query("variant"),
+		IP:      c.IP(),
+	}, userID)
+	if err != nil {
+		return err
+	}
+	c.Set("Content-Type", "application/zip")
+	c.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archive.Name}))
+	c.Set("Cache-Control", "private, no-store")
+	/* The writer runs after the handler returns, when the request's strings might be reused */
+	for i := range ids {
+		ids[i] = strings.Clone(ids[i])
+	}
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := r.archiveSvc.Write(w, archive); err != nil {
+			log.GetLogger().Errorw(err.Error(), "ids", ids)
+			return
+		}
+		if err := w.Flush(); err != nil {
+			log.GetLogger().Error(err)
+		}
+	})
+	return nil
+}
+
 func (r *FileRouter) getUserIDFromAccessToken(accessToken string) (string, error) {
 	token, err := jwt.Parse(accessToken, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
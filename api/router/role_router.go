@@ -0,0 +1,165 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package router
+
+import (
+	"net/http"
+	"voltaserve/errorpkg"
+	"voltaserve/service"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+type RoleRouter struct {
+	roleSvc *service.RoleService
+}
+
+func NewRoleRouter() *RoleRouter {
+	return &RoleRouter{
+		roleSvc: service.NewRoleService(),
+	}
+}
+
+func (r *RoleRouter) AppendRoutes(g fiber.Router) {
+	g.Post("/", r.Create)
+	g.Get("/", r.List)
+	g.Get("/:id", r.Get)
+	g.Patch("/:id", r.Patch)
+	g.Delete("/:id", r.Delete)
+}
+
+// Create godoc
+//
+//	@Summary		Create
+//	@Description	Create a custom role of an organization, composed of capabilities like read, upload or share
+//	@Tags			Roles
+//	@Id				roles_create
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		service.RoleCreateOptions	true	"Body"
+//	@Success		201		{object}	service.Role
+//	@Failure		400		{object}	errorpkg.ErrorResponse
+//	@Failure		403		{object}	errorpkg.ErrorResponse
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/roles [post]
+func (r *RoleRouter) Create(c *fiber.Ctx) error {
+	opts := new(service.RoleCreateOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	res, err := r.roleSvc.Create(*opts, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.Status(http.StatusCreated).JSON(res)
+}
+
+// List godoc
+//
+//	@Summary		List
+//	@Description	List the built-in roles and the custom roles of an organization
+//	@Tags			Roles
+//	@Id				roles_list
+//	@Produce		json
+//	@Param			organization_id	query		string	true	"Organization ID"
+//	@Success		200				{array}		service.Role
+//	@Failure		403				{object}	errorpkg.ErrorResponse
+//	@Failure		404				{object}	errorpkg.ErrorResponse
+//	@Failure		500				{object}	errorpkg.ErrorResponse
+//	@Router			/roles [get]
+func (r *RoleRouter) List(c *fiber.Ctx) error {
+	orgID := c.Query("organization_id")
+	if orgID == "" {
+		return errorpkg.NewMissingQueryParamError("organization_id")
+	}
+	res, err := r.roleSvc.List(orgID, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// Get godoc
+//
+//	@Summary		Get
+//	@Description	Get
+//	@Tags			Roles
+//	@Id				roles_get
+//	@Produce		json
+//	@Param			id	path		string	true	"ID"
+//	@Success		200	{object}	service.Role
+//	@Failure		403	{object}	errorpkg.ErrorResponse
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/roles/{id} [get]
+func (r *RoleRouter) Get(c *fiber.Ctx) error {
+	res, err := r.roleSvc.Find(c.Params("id"), GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// Patch godoc
+//
+//	@Summary		Patch
+//	@Description	Patch, the change applies right away to every file the role is granted on
+//	@Tags			Roles
+//	@Id				roles_patch
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string									true	"ID"
+//	@Param			body	body		service.RolePatchOptions	true	"Body"
+//	@Success		200		{object}	service.Role
+//	@Failure		400		{object}	errorpkg.ErrorResponse
+//	@Failure		403		{object}	errorpkg.ErrorResponse
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/roles/{id} [patch]
+func (r *RoleRouter) Patch(c *fiber.Ctx) error {
+	opts := new(service.RolePatchOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	res, err := r.roleSvc.Patch(c.Params("id"), *opts, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// Delete godoc
+//
+//	@Summary		Delete
+//	@Description	Delete, a role that's still granted on files can't be deleted
+//	@Tags			Roles
+//	@Id				roles_delete
+//	@Param			id	path	string	true	"ID"
+//	@Success		204
+//	@Failure		400	{object}	errorpkg.ErrorResponse
+//	@Failure		403	{object}	errorpkg.ErrorResponse
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/roles/{id} [delete]
+func (r *RoleRouter) Delete(c *fiber.Ctx) error {
+	if err := r.roleSvc.Delete(c.Params("id"), GetUserID(c)); err != nil {
+		return err
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
@@ -0,0 +1,133 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package router
+
+import (
+	"net/http"
+	"voltaserve/errorpkg"
+	"voltaserve/service"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+type ShareLinkRouter struct {
+	shareLinkSvc *service.ShareLinkService
+}
+
+func NewShareLinkRouter() *ShareLinkRouter {
+	return &ShareLinkRouter{
+		shareLinkSvc: service.NewShareLinkService(),
+	}
+}
+
+func (r *ShareLinkRouter) AppendRoutes(g fiber.Router) {
+	g.Post("/", r.Create)
+	g.Get("/", r.List)
+	g.Delete("/:id", r.Revoke)
+	g.Get("/:id/accesses", r.ListAccesses)
+}
+
+// Create godoc
+//
+//	@Summary		Create
+//	@Description	Create a share link, the token is only returned here
+//	@Tags			ShareLinks
+//	@Id				share_links_create
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		service.ShareLinkCreateOptions	true	"Body"
+//	@Success		201		{object}	service.ShareLink
+//	@Failure		400		{object}	errorpkg.ErrorResponse
+//	@Failure		403		{object}	errorpkg.ErrorResponse
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/share_links [post]
+func (r *ShareLinkRouter) Create(c *fiber.Ctx) error {
+	userID := GetUserID(c)
+	opts := new(service.ShareLinkCreateOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	res, err := r.shareLinkSvc.Create(*opts, userID)
+	if err != nil {
+		return err
+	}
+	return c.Status(http.StatusCreated).JSON(res)
+}
+
+// List godoc
+//
+//	@Summary		List
+//	@Description	List the share links of a file, including revoked and expired ones
+//	@Tags			ShareLinks
+//	@Id				share_links_list
+//	@Produce		json
+//	@Param			file_id	query		string	true	"File ID"
+//	@Success		200		{array}		service.ShareLink
+//	@Failure		403		{object}	errorpkg.ErrorResponse
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/share_links [get]
+func (r *ShareLinkRouter) List(c *fiber.Ctx) error {
+	fileID := c.Query("file_id")
+	if fileID == "" {
+		return errorpkg.NewMissingQueryParamError("file_id")
+	}
+	res, err := r.shareLinkSvc.List(fileID, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// Revoke godoc
+//
+//	@Summary		Revoke
+//	@Description	Revoke
+//	@Tags			ShareLinks
+//	@Id				share_links_revoke
+//	@Param			id	path	string	true	"ID"
+//	@Success		204
+//	@Failure		403	{object}	errorpkg.ErrorResponse
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/share_links/{id} [delete]
+func (r *ShareLinkRouter) Revoke(c *fiber.Ctx) error {
+	if err := r.shareLinkSvc.Revoke(c.Params("id"), GetUserID(c)); err != nil {
+		return err
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
+
+// ListAccesses godoc
+//
+//	@Summary		List Accesses
+//	@Description	List the accesses to a share link, most recent first
+//	@Tags			ShareLinks
+//	@Id				share_links_list_accesses
+//	@Produce		json
+//	@Param			id	path		string	true	"ID"
+//	@Success		200	{array}		service.ShareLinkAccess
+//	@Failure		403	{object}	errorpkg.ErrorResponse
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/share_links/{id}/accesses [get]
+func (r *ShareLinkRouter) ListAccesses(c *fiber.Ctx) error {
+	res, err := r.shareLinkSvc.ListAccesses(c.Params("id"), GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
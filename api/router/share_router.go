@@ -0,0 +1,228 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package router
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"voltaserve/errorpkg"
+	"voltaserve/infra"
+	"voltaserve/service"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+/* Serves share links to anonymous visitors */
+type ShareRouter struct {
+	shareLinkSvc *service.ShareLinkService
+	objectServer *infra.ObjectServer
+}
+
+func NewShareRouter() *ShareRouter {
+	return &ShareRouter{
+		shareLinkSvc: service.NewShareLinkService(),
+		objectServer: infra.NewObjectServer(),
+	}
+}
+
+func (r *ShareRouter) AppendNonJWTRoutes(g fiber.Router) {
+	g.Get("/:token", r.Get)
+	g.Post("/:token/unlock", r.Unlock)
+	g.Get("/:token/files/:id/list", r.List)
+	g.Get("/:token/files/:id/original:ext", r.DownloadOriginal)
+	g.Get("/:token/files/:id/preview:ext", r.DownloadPreview)
+}
+
+type ShareUnlockOptions struct {
+	Password string `json:"password" validate:"required"`
+}
+
+// Get godoc
+//
+//	@Summary		Get
+//	@Description	Get the shared file or folder
+//	@Tags			Shares
+//	@Id				shares_get
+//	@Produce		json
+//	@Param			token			path		string	true	"Token"
+//	@Param			access_token	query		string	false	"Access Token"
+//	@Success		200				{object}	service.Share
+//	@Failure		401				{object}	errorpkg.ErrorResponse
+//	@Failure		404				{object}	errorpkg.ErrorResponse
+//	@Failure		410				{object}	errorpkg.ErrorResponse
+//	@Failure		500				{object}	errorpkg.ErrorResponse
+//	@Router			/shares/{token} [get]
+func (r *ShareRouter) Get(c *fiber.Ctx) error {
+	res, err := r.shareLinkSvc.Get(c.Params("token"), r.getAccessToken(c), r.getAccessContext(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// Unlock godoc
+//
+//	@Summary		Unlock
+//	@Description	Exchange the password of a share link for an access token
+//	@Tags			Shares
+//	@Id				shares_unlock
+//	@Accept			json
+//	@Produce		json
+//	@Param			token	path		string						true	"Token"
+//	@Param			body	body		router.ShareUnlockOptions	true	"Body"
+//	@Success		200		{object}	service.ShareLinkUnlock
+//	@Failure		401		{object}	errorpkg.ErrorResponse
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		410		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/shares/{token}/unlock [post]
+func (r *ShareRouter) Unlock(c *fiber.Ctx) error {
+	opts := new(ShareUnlockOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	res, err := r.shareLinkSvc.Unlock(c.Params("token"), opts.Password, r.getAccessContext(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// List godoc
+//
+//	@Summary		List
+//	@Description	List a folder of the share
+//	@Tags			Shares
+//	@Id				shares_list
+//	@Produce		json
+//	@Param			token			path		string	true	"Token"
+//	@Param			id				path		string	true	"ID"
+//	@Param			access_token	query		string	false	"Access Token"
+//	@Success		200				{array}		service.SharedFile
+//	@Failure		401				{object}	errorpkg.ErrorResponse
+//	@Failure		404				{object}	errorpkg.ErrorResponse
+//	@Failure		410				{object}	errorpkg.ErrorResponse
+//	@Failure		500				{object}	errorpkg.ErrorResponse
+//	@Router			/shares/{token}/files/{id}/list [get]
+func (r *ShareRouter) List(c *fiber.Ctx) error {
+	res, err := r.shareLinkSvc.ListFolder(c.Params("token"), r.getAccessToken(c), c.Params("id"), r.getAccessContext(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// DownloadOriginal godoc
+//
+//	@Summary		Download Original
+//	@Description	Download Original
+//	@Tags			Shares
+//	@Id				shares_download_original
+//	@Param			token			path		string	true	"Token"
+//	@Param			id				path		string	true	"ID"
+//	@Param			ext				path		string	true	"Extension"
+//	@Param			access_token	query		string	false	"Access Token"
+//	@Failure		401				{object}	errorpkg.ErrorResponse
+//	@Failure		403				{object}	errorpkg.ErrorResponse
+//	@Failure		404				{object}	errorpkg.ErrorResponse
+//	@Failure		410				{object}	errorpkg.ErrorResponse
+//	@Failure		500				{object}	errorpkg.ErrorResponse
+//	@Router			/shares/{token}/files/{id}/original{ext} [get]
+func (r *ShareRouter) DownloadOriginal(c *fiber.Ctx) error {
+	res, err := r.shareLinkSvc.DownloadOriginal(c.Params("token"), r.getAccessToken(c), c.Params("id"), r.getDownloadOptions(c), r.getAccessContext(c))
+	if err != nil {
+		return err
+	}
+	return r.serve(c, res)
+}
+
+// DownloadPreview godoc
+//
+//	@Summary		Download Preview
+//	@Description	Download Preview
+//	@Tags			Shares
+//	@Id				shares_download_preview
+//	@Param			token			path		string	true	"Token"
+//	@Param			id				path		string	true	"ID"
+//	@Param			ext				path		string	true	"Extension"
+//	@Param			access_token	query		string	false	"Access Token"
+//	@Failure		401				{object}	errorpkg.ErrorResponse
+//	@Failure		403				{object}	errorpkg.ErrorResponse
+//	@Failure		404				{object}	errorpkg.ErrorResponse
+//	@Failure		410				{object}	errorpkg.ErrorResponse
+//	@Failure		500				{object}	errorpkg.ErrorResponse
+//	@Router			/shares/{token}/files/{id}/preview{ext} [get]
+func (r *ShareRouter) DownloadPreview(c *fiber.Ctx) error {
+	res, err := r.shareLinkSvc.DownloadPreview(c.Params("token"), r.getAccessToken(c), c.Params("id"), r.getDownloadOptions(c), r.getAccessContext(c))
+	if err != nil {
+		return err
+	}
+	return r.serve(c, res)
+}
+
+func (r *ShareRouter) serve(c *fiber.Ctx, res *service.DownloadResult) error {
+	if filepath.Ext(res.Object.Key) != c.Params("ext") {
+		return errorpkg.NewS3ObjectNotFoundError(nil)
+	}
+	return r.objectServer.Serve(c, infra.ObjectServeOptions{
+		Bucket:      res.Object.Bucket,
+		Key:         res.Object.Key,
+		ContentType: res.Object.ContentType,
+		Filename:    filepath.Base(res.File.GetName()),
+	})
+}
+
+/*
+Requests for a part in the middle of the file, like a player seeking, belong to
+a download already counted. Any range that covers the first byte, or that is
+relative to the end, like 'bytes=-500', starts the file over.
+*/
+func (r *ShareRouter) getDownloadOptions(c *fiber.Ctx) service.ShareLinkDownloadOptions {
+	res := service.ShareLinkDownloadOptions{
+		Probe:   c.Method() == fiber.MethodHead,
+		Restart: true,
+	}
+	ranges, ok := strings.CutPrefix(c.Get("Range"), "bytes=")
+	if !ok {
+		/* No range, or a unit we don't know, either way the whole file is served */
+		return res
+	}
+	for _, v := range strings.Split(ranges, ",") {
+		start, _, _ := strings.Cut(strings.TrimSpace(v), "-")
+		if start == "" {
+			return res
+		}
+		if n, err := strconv.ParseInt(start, 10, 64); err != nil || n == 0 {
+			return res
+		}
+	}
+	res.Restart = false
+	return res
+}
+
+func (r *ShareRouter) getAccessToken(c *fiber.Ctx) string {
+	if v, ok := strings.CutPrefix(c.Get("Authorization"), "Bearer "); ok {
+		return v
+	}
+	return c.Query("access_token")
+}
+
+func (r *ShareRouter) getAccessContext(c *fiber.Ctx) service.ShareLinkAccessContext {
+	return service.ShareLinkAccessContext{
+		IP:        c.IP(),
+		UserAgent: c.Get("User-Agent"),
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package router
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"voltaserve/config"
+	"voltaserve/errorpkg"
+	"voltaserve/infra"
+	"voltaserve/service"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+type SnapshotDiffRouter struct {
+	snapshotDiffSvc *service.SnapshotDiffService
+	objectServer    *infra.ObjectServer
+	config          *config.Config
+}
+
+func NewSnapshotDiffRouter() *SnapshotDiffRouter {
+	return &SnapshotDiffRouter{
+		snapshotDiffSvc: service.NewSnapshotDiffService(),
+		objectServer:    infra.NewObjectServer(),
+		config:          config.GetConfig(),
+	}
+}
+
+func (r *SnapshotDiffRouter) AppendRoutes(g fiber.Router) {
+	g.Post("/", r.Create)
+	g.Get("/:id", r.Get)
+	g.Get("/:id/text.diff", r.DownloadText)
+	g.Get("/:id/pages/:page.png", r.DownloadPage)
+}
+
+func (r *SnapshotDiffRouter) AppendNonJWTRoutes(g fiber.Router) {
+	g.Patch("/:id", r.Patch)
+}
+
+// Create godoc
+//
+//	@Summary		Create
+//	@Description	Compare two versions of a file, the comparison is computed once and cached
+//	@Tags			SnapshotDiffs
+//	@Id				snapshot_diffs_create
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		service.SnapshotDiffCreateOptions	true	"Body"
+//	@Success		200		{object}	service.SnapshotDiff
+//	@Failure		400		{object}	errorpkg.ErrorResponse
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/snapshot_diffs [post]
+func (r *SnapshotDiffRouter) Create(c *fiber.Ctx) error {
+	opts := new(service.SnapshotDiffCreateOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	res, err := r.snapshotDiffSvc.Create(*opts, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// Get godoc
+//
+//	@Summary		Get
+//	@Description	Get
+//	@Tags			SnapshotDiffs
+//	@Id				snapshot_diffs_get
+//	@Produce		json
+//	@Param			id	path		string	true	"ID"
+//	@Success		200	{object}	service.SnapshotDiff
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/snapshot_diffs/{id} [get]
+func (r *SnapshotDiffRouter) Get(c *fiber.Ctx) error {
+	res, err := r.snapshotDiffSvc.Find(c.Params("id"), GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// DownloadText godoc
+//
+//	@Summary		Download Text
+//	@Description	Download the unified diff of the text of both versions
+//	@Tags			SnapshotDiffs
+//	@Id				snapshot_diffs_download_text
+//	@Produce		plain
+//	@Param			id	path	string	true	"ID"
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/snapshot_diffs/{id}/text.diff [get]
+func (r *SnapshotDiffRouter) DownloadText(c *fiber.Ctx) error {
+	id := c.Params("id")
+	object, err := r.snapshotDiffSvc.DownloadText(id, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return r.objectServer.Serve(c, infra.ObjectServeOptions{
+		Bucket:      object.Bucket,
+		Key:         object.Key,
+		ContentType: object.ContentType,
+		Filename:    id + filepath.Ext(object.Key),
+	})
+}
+
+// DownloadPage godoc
+//
+//	@Summary		Download Page
+//	@Description	Download the visual diff of a page, changes are shown in red
+//	@Tags			SnapshotDiffs
+//	@Id				snapshot_diffs_download_page
+//	@Produce		png
+//	@Param			id		path	string	true	"ID"
+//	@Param			page	path	int		true	"Page number, starting at 1"
+//	@Failure		400		{object}	errorpkg.ErrorResponse
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/snapshot_diffs/{id}/pages/{page}.png [get]
+func (r *SnapshotDiffRouter) DownloadPage(c *fiber.Ctx) error {
+	id := c.Params("id")
+	page, err := strconv.Atoi(c.Params("page"))
+	if err != nil || page < 1 {
+		return errorpkg.NewInvalidPageParameterError()
+	}
+	object, err := r.snapshotDiffSvc.DownloadPage(id, page, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return r.objectServer.Serve(c, infra.ObjectServeOptions{
+		Bucket:      object.Bucket,
+		Key:         object.Key,
+		ContentType: object.ContentType,
+		Filename:    fmt.Sprintf("%s-%d%s", id, page, filepath.Ext(object.Key)),
+	})
+}
+
+// Patch godoc
+//
+//	@Summary		Patch
+//	@Description	Patch
+//	@Tags			SnapshotDiffs
+//	@Id				snapshot_diffs_patch
+//	@Accept			json
+//	@Produce		json
+//	@Param			api_key	query		string								true	"API Key"
+//	@Param			id		path		string								true	"ID"
+//	@Param			body	body		service.SnapshotDiffPatchOptions	true	"Body"
+//	@Success		200		{object}	service.SnapshotDiff
+//	@Failure		401		{object}	errorpkg.ErrorResponse
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/snapshot_diffs/{id} [patch]
+func (r *SnapshotDiffRouter) Patch(c *fiber.Ctx) error {
+	apiKey := c.Query("api_key")
+	if apiKey == "" {
+		return errorpkg.NewMissingQueryParamError("api_key")
+	}
+	if apiKey != r.config.Security.APIKey {
+		return errorpkg.NewInvalidAPIKeyError()
+	}
+	opts := new(service.SnapshotDiffPatchOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	res, err := r.snapshotDiffSvc.Patch(c.Params("id"), *opts)
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
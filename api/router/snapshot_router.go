@@ -15,6 +15,7 @@ import (
 	"strconv"
 	"voltaserve/config"
 	"voltaserve/errorpkg"
+	"voltaserve/helper"
 	"voltaserve/service"
 
 	"github.com/go-playground/validator/v10"
@@ -37,6 +38,8 @@ func (r *SnapshotRouter) AppendRoutes(g fiber.Router) {
 	g.Get("/", r.List)
 	g.Post("/:id/activate", r.Activate)
 	g.Post("/:id/detach", r.Detach)
+	g.Patch("/:id/label", r.PatchLabel)
+	g.Patch("/:id/comment", r.PatchComment)
 }
 
 func (r *SnapshotRouter) AppendNonJWTRoutes(g fiber.Router) {
@@ -55,6 +58,8 @@ func (r *SnapshotRouter) AppendNonJWTRoutes(g fiber.Router) {
 //	@Param			size		query		string	false	"Size"
 //	@Param			sort_by		query		string	false	"Sort By"
 //	@Param			sort_order	query		string	false	"Sort Order"
+//	@Param			label		query		string	false	"Label"
+//	@Param			is_labelled	query		bool	false	"Is Labelled"
 //	@Success		200			{object}	service.SnapshotList
 //	@Failure		404			{object}	errorpkg.ErrorResponse
 //	@Failure		500			{object}	errorpkg.ErrorResponse
@@ -91,12 +96,23 @@ func (r *SnapshotRouter) List(c *fiber.Ctx) error {
 	if !IsValidSortOrder(sortOrder) {
 		return errorpkg.NewInvalidQueryParamError("sort_order")
 	}
-	res, err := r.snapshotSvc.List(fileId, service.SnapshotListOptions{
+	opts := service.SnapshotListOptions{
 		Page:      uint(page),
 		Size:      uint(size),
 		SortBy:    sortBy,
 		SortOrder: sortOrder,
-	}, GetUserID(c))
+	}
+	if c.Query("label") != "" {
+		opts.Label = helper.ToPtr(c.Query("label"))
+	}
+	if c.Query("is_labelled") != "" {
+		isLabelled, err := strconv.ParseBool(c.Query("is_labelled"))
+		if err != nil {
+			return errorpkg.NewInvalidQueryParamError("is_labelled")
+		}
+		opts.IsLabelled = &isLabelled
+	}
+	res, err := r.snapshotSvc.List(fileId, opts, GetUserID(c))
 	if err != nil {
 		return err
 	}
@@ -157,6 +173,66 @@ func (r *SnapshotRouter) Detach(c *fiber.Ctx) error {
 	return c.SendStatus(http.StatusNoContent)
 }
 
+// PatchLabel godoc
+//
+//	@Summary		Patch Label
+//	@Description	Patch Label, labelled versions are kept by retention policies
+//	@Tags			Snapshots
+//	@Id				snapshots_patch_label
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string								true	"ID"
+//	@Param			body	body		service.SnapshotPatchLabelOptions	true	"Body"
+//	@Success		200		{object}	service.Snapshot
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		400		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/snapshots/{id}/label [patch]
+func (r *SnapshotRouter) PatchLabel(c *fiber.Ctx) error {
+	opts := new(service.SnapshotPatchLabelOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	res, err := r.snapshotSvc.PatchLabel(c.Params("id"), *opts, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// PatchComment godoc
+//
+//	@Summary		Patch Comment
+//	@Description	Patch Comment
+//	@Tags			Snapshots
+//	@Id				snapshots_patch_comment
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string								true	"ID"
+//	@Param			body	body		service.SnapshotPatchCommentOptions	true	"Body"
+//	@Success		200		{object}	service.Snapshot
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		400		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/snapshots/{id}/comment [patch]
+func (r *SnapshotRouter) PatchComment(c *fiber.Ctx) error {
+	opts := new(service.SnapshotPatchCommentOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	res, err := r.snapshotSvc.PatchComment(c.Params("id"), *opts, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
 // Patch godoc
 //
 //	@Summary		Patch
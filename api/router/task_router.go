@@ -39,6 +39,7 @@ func (r *TaskRouter) AppendRoutes(g fiber.Router) {
 	g.Get("/count", r.GetCount)
 	g.Get("/:id", r.Get)
 	g.Post("/:id/dismiss", r.Dismiss)
+	g.Post("/:id/cancel", r.Cancel)
 }
 
 func (r *TaskRouter) AppendNonJWTRoutes(g fiber.Router) {
@@ -168,6 +169,28 @@ func (r *TaskRouter) Dismiss(c *fiber.Ctx) error {
 	return c.SendStatus(http.StatusNoContent)
 }
 
+// Cancel godoc
+//
+//	@Summary		Cancel
+//	@Description	Cancel
+//	@Tags			Tasks
+//	@Id				tasks_cancel
+//	@Accept			json
+//	@Produce		json
+//	@Param			id	path	string	true	"ID"
+//	@Success		204
+//	@Failure		400	{object}	errorpkg.ErrorResponse
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/tasks/{id}/cancel [post]
+func (r *TaskRouter) Cancel(c *fiber.Ctx) error {
+	userID := GetUserID(c)
+	if err := r.taskSvc.Cancel(c.Params("id"), userID); err != nil {
+		return err
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
+
 // Create godoc
 //
 //	@Summary		Create
@@ -0,0 +1,136 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package router
+
+import (
+	"net/http"
+	"voltaserve/errorpkg"
+	"voltaserve/service"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+type TrashRouter struct {
+	trashSvc *service.TrashService
+}
+
+func NewTrashRouter() *TrashRouter {
+	return &TrashRouter{
+		trashSvc: service.NewTrashService(),
+	}
+}
+
+func (r *TrashRouter) AppendRoutes(g fiber.Router) {
+	g.Get("/", r.List)
+	g.Post("/restore", r.Restore)
+	g.Delete("/", r.Empty)
+	g.Delete("/:id", r.Purge)
+}
+
+// List godoc
+//
+//	@Summary		List
+//	@Description	List the trashed items of a workspace, most recently trashed first
+//	@Tags			Trash
+//	@Id				trash_list
+//	@Produce		json
+//	@Param			workspace_id	query		string	true	"Workspace ID"
+//	@Success		200				{array}		service.File
+//	@Failure		400				{object}	errorpkg.ErrorResponse
+//	@Failure		404				{object}	errorpkg.ErrorResponse
+//	@Failure		500				{object}	errorpkg.ErrorResponse
+//	@Router			/trash [get]
+func (r *TrashRouter) List(c *fiber.Ctx) error {
+	workspaceID := c.Query("workspace_id")
+	if workspaceID == "" {
+		return errorpkg.NewMissingQueryParamError("workspace_id")
+	}
+	res, err := r.trashSvc.List(workspaceID, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// Restore godoc
+//
+//	@Summary		Restore
+//	@Description	Restore items to their original location, or to the target if given
+//	@Tags			Trash
+//	@Id				trash_restore
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		service.TrashRestoreOptions	true	"Body"
+//	@Success		200		{array}		service.File
+//	@Failure		400		{object}	errorpkg.ErrorResponse
+//	@Failure		403		{object}	errorpkg.ErrorResponse
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		409		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/trash/restore [post]
+func (r *TrashRouter) Restore(c *fiber.Ctx) error {
+	opts := new(service.TrashRestoreOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	res, err := r.trashSvc.Restore(*opts, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// Empty godoc
+//
+//	@Summary		Empty
+//	@Description	Purge the items of the workspace's trash the user owns
+//	@Tags			Trash
+//	@Id				trash_empty
+//	@Param			workspace_id	query	string	true	"Workspace ID"
+//	@Success		204
+//	@Failure		400	{object}	errorpkg.ErrorResponse
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/trash [delete]
+func (r *TrashRouter) Empty(c *fiber.Ctx) error {
+	workspaceID := c.Query("workspace_id")
+	if workspaceID == "" {
+		return errorpkg.NewMissingQueryParamError("workspace_id")
+	}
+	if err := r.trashSvc.Empty(workspaceID, GetUserID(c)); err != nil {
+		return err
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
+
+// Purge godoc
+//
+//	@Summary		Purge
+//	@Description	Purge an item from the trash, it can't be restored afterwards
+//	@Tags			Trash
+//	@Id				trash_purge
+//	@Param			id	path	string	true	"ID"
+//	@Success		204
+//	@Failure		400	{object}	errorpkg.ErrorResponse
+//	@Failure		403	{object}	errorpkg.ErrorResponse
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/trash/{id} [delete]
+func (r *TrashRouter) Purge(c *fiber.Ctx) error {
+	if err := r.trashSvc.Purge(c.Params("id"), GetUserID(c)); err != nil {
+		return err
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
@@ -0,0 +1,270 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package router
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"voltaserve/errorpkg"
+	"voltaserve/helper"
+	"voltaserve/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+/*
+Resumable uploads following a subset of the tus 1.0.0 protocol, with the
+creation, checksum, termination and expiration extensions. Unlike tus, the
+file is only created when the upload is finalized.
+*/
+type UploadRouter struct {
+	uploadSvc *service.UploadService
+}
+
+const (
+	TusVersion            = "1.0.0"
+	TusExtensions         = "creation,checksum,termination,expiration"
+	TusChecksumAlgorithms = "sha1,sha256,md5"
+	TusContentType        = "application/offset+octet-stream"
+)
+
+func NewUploadRouter() *UploadRouter {
+	return &UploadRouter{
+		uploadSvc: service.NewUploadService(),
+	}
+}
+
+func (r *UploadRouter) AppendRoutes(g fiber.Router) {
+	g.Options("/", r.Options)
+	g.Post("/", r.Create)
+	g.Get("/:id", r.Get)
+	g.Head("/:id", r.Head)
+	g.Patch("/:id", r.Append)
+	g.Delete("/:id", r.Delete)
+	g.Post("/:id/finalize", r.Finalize)
+}
+
+// Options godoc
+//
+//	@Summary		Options
+//	@Description	Advertises the supported tus version and extensions
+//	@Tags			Uploads
+//	@Id				uploads_options
+//	@Success		204
+//	@Router			/uploads [options]
+func (r *UploadRouter) Options(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", TusVersion)
+	c.Set("Tus-Version", TusVersion)
+	c.Set("Tus-Extension", TusExtensions)
+	c.Set("Tus-Checksum-Algorithm", TusChecksumAlgorithms)
+	return c.SendStatus(http.StatusNoContent)
+}
+
+// Create godoc
+//
+//	@Summary		Create
+//	@Description	Starts an upload, the metadata must contain 'filename' and either 'file_id' or 'workspace_id'
+//	@Tags			Uploads
+//	@Id				uploads_create
+//	@Param			Upload-Length	header	int		true	"Upload Length"
+//	@Param			Upload-Metadata	header	string	true	"Upload Metadata"
+//	@Success		201
+//	@Failure		400	{object}	errorpkg.ErrorResponse
+//	@Failure		403	{object}	errorpkg.ErrorResponse
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/uploads [post]
+func (r *UploadRouter) Create(c *fiber.Ctx) error {
+	userID := GetUserID(c)
+	size, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || size <= 0 {
+		return errorpkg.NewInvalidHeaderError("Upload-Length")
+	}
+	metadata, err := parseUploadMetadata(c.Get("Upload-Metadata"))
+	if err != nil {
+		return errorpkg.NewInvalidHeaderError("Upload-Metadata")
+	}
+	opts := service.UploadCreateOptions{
+		Name:        metadata["filename"],
+		Size:        size,
+		WorkspaceID: metadata["workspace_id"],
+	}
+	if opts.Name == "" {
+		return errorpkg.NewMissingHeaderError("Upload-Metadata")
+	}
+	if v, ok := metadata["parent_id"]; ok && v != "" {
+		opts.ParentID = helper.ToPtr(v)
+	}
+	if v, ok := metadata["file_id"]; ok && v != "" {
+		opts.FileID = helper.ToPtr(v)
+	}
+	res, err := r.uploadSvc.Create(opts, userID)
+	if err != nil {
+		return err
+	}
+	c.Set("Tus-Resumable", TusVersion)
+	c.Set("Location", c.BaseURL()+strings.TrimSuffix(c.OriginalURL(), "/")+"/"+res.ID)
+	r.setExpires(c, res)
+	return c.SendStatus(http.StatusCreated)
+}
+
+// Get godoc
+//
+//	@Summary		Get
+//	@Description	Get
+//	@Tags			Uploads
+//	@Id				uploads_get
+//	@Produce		json
+//	@Param			id	path		string	true	"ID"
+//	@Success		200	{object}	service.Upload
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/uploads/{id} [get]
+func (r *UploadRouter) Get(c *fiber.Ctx) error {
+	res, err := r.uploadSvc.Find(c.Params("id"), GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// Head godoc
+//
+//	@Summary		Head
+//	@Description	Returns the offset to resume the upload from
+//	@Tags			Uploads
+//	@Id				uploads_head
+//	@Param			id	path	string	true	"ID"
+//	@Success		200
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/uploads/{id} [head]
+func (r *UploadRouter) Head(c *fiber.Ctx) error {
+	res, err := r.uploadSvc.Find(c.Params("id"), GetUserID(c))
+	if err != nil {
+		return err
+	}
+	c.Set("Tus-Resumable", TusVersion)
+	c.Set("Cache-Control", "no-store")
+	c.Set("Upload-Offset", strconv.FormatInt(res.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(res.Size, 10))
+	r.setExpires(c, res)
+	return c.SendStatus(http.StatusOK)
+}
+
+// Append godoc
+//
+//	@Summary		Append
+//	@Description	Writes a chunk, chunks other than the last one must be at least 5 MiB
+//	@Tags			Uploads
+//	@Id				uploads_append
+//	@Accept			application/offset+octet-stream
+//	@Param			id				path	string	true	"ID"
+//	@Param			Upload-Offset	header	int		true	"Upload Offset"
+//	@Param			Upload-Checksum	header	string	false	"Upload Checksum"
+//	@Success		204
+//	@Failure		400	{object}	errorpkg.ErrorResponse
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		409	{object}	errorpkg.ErrorResponse
+//	@Failure		423	{object}	errorpkg.ErrorResponse
+//	@Failure		460	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/uploads/{id} [patch]
+func (r *UploadRouter) Append(c *fiber.Ctx) error {
+	if !strings.HasPrefix(c.Get("Content-Type"), TusContentType) {
+		return c.SendStatus(http.StatusUnsupportedMediaType)
+	}
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return errorpkg.NewInvalidHeaderError("Upload-Offset")
+	}
+	res, err := r.uploadSvc.Append(c.Params("id"), service.UploadAppendOptions{
+		Offset:   offset,
+		Data:     c.Body(),
+		Checksum: c.Get("Upload-Checksum"),
+	}, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	c.Set("Tus-Resumable", TusVersion)
+	c.Set("Upload-Offset", strconv.FormatInt(res.Offset, 10))
+	r.setExpires(c, res)
+	return c.SendStatus(http.StatusNoContent)
+}
+
+// Finalize godoc
+//
+//	@Summary		Finalize
+//	@Description	Creates the file, or a new version of it, from a complete upload
+//	@Tags			Uploads
+//	@Id				uploads_finalize
+//	@Produce		json
+//	@Param			id	path		string	true	"ID"
+//	@Success		200	{object}	service.File
+//	@Failure		400	{object}	errorpkg.ErrorResponse
+//	@Failure		403	{object}	errorpkg.ErrorResponse
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/uploads/{id}/finalize [post]
+func (r *UploadRouter) Finalize(c *fiber.Ctx) error {
+	res, err := r.uploadSvc.Finalize(c.Params("id"), GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// Delete godoc
+//
+//	@Summary		Delete
+//	@Description	Aborts the upload
+//	@Tags			Uploads
+//	@Id				uploads_delete
+//	@Param			id	path	string	true	"ID"
+//	@Success		204
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/uploads/{id} [delete]
+func (r *UploadRouter) Delete(c *fiber.Ctx) error {
+	if err := r.uploadSvc.Delete(c.Params("id"), GetUserID(c)); err != nil {
+		return err
+	}
+	c.Set("Tus-Resumable", TusVersion)
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func (r *UploadRouter) setExpires(c *fiber.Ctx, upload *service.Upload) {
+	expireTime, err := time.Parse(time.RFC3339, upload.ExpireTime)
+	if err == nil {
+		c.Set("Upload-Expires", expireTime.Format(http.TimeFormat))
+	}
+}
+
+/* Parses 'key base64value,key base64value', values are optional */
+func parseUploadMetadata(value string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		res[key] = string(decoded)
+	}
+	return res, nil
+}
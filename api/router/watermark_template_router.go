@@ -0,0 +1,164 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package router
+
+import (
+	"net/http"
+	"voltaserve/errorpkg"
+	"voltaserve/service"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+type WatermarkTemplateRouter struct {
+	watermarkTemplateSvc *service.WatermarkTemplateService
+}
+
+func NewWatermarkTemplateRouter() *WatermarkTemplateRouter {
+	return &WatermarkTemplateRouter{
+		watermarkTemplateSvc: service.NewWatermarkTemplateService(),
+	}
+}
+
+func (r *WatermarkTemplateRouter) AppendRoutes(g fiber.Router) {
+	g.Post("/", r.Create)
+	g.Get("/", r.List)
+	g.Get("/:id", r.Get)
+	g.Patch("/:id", r.Patch)
+	g.Delete("/:id", r.Delete)
+}
+
+// Create godoc
+//
+//	@Summary		Create
+//	@Description	Create a watermark template, the text accepts placeholders like {user.email}, {date} or {file.name}
+//	@Tags			WatermarkTemplates
+//	@Id				watermark_templates_create
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		service.WatermarkTemplateCreateOptions	true	"Body"
+//	@Success		201		{object}	service.WatermarkTemplate
+//	@Failure		400		{object}	errorpkg.ErrorResponse
+//	@Failure		403		{object}	errorpkg.ErrorResponse
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/watermark_templates [post]
+func (r *WatermarkTemplateRouter) Create(c *fiber.Ctx) error {
+	opts := new(service.WatermarkTemplateCreateOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	res, err := r.watermarkTemplateSvc.Create(*opts, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.Status(http.StatusCreated).JSON(res)
+}
+
+// List godoc
+//
+//	@Summary		List
+//	@Description	List the watermark templates of a workspace
+//	@Tags			WatermarkTemplates
+//	@Id				watermark_templates_list
+//	@Produce		json
+//	@Param			workspace_id	query		string	true	"Workspace ID"
+//	@Success		200				{array}		service.WatermarkTemplate
+//	@Failure		403				{object}	errorpkg.ErrorResponse
+//	@Failure		404				{object}	errorpkg.ErrorResponse
+//	@Failure		500				{object}	errorpkg.ErrorResponse
+//	@Router			/watermark_templates [get]
+func (r *WatermarkTemplateRouter) List(c *fiber.Ctx) error {
+	workspaceID := c.Query("workspace_id")
+	if workspaceID == "" {
+		return errorpkg.NewMissingQueryParamError("workspace_id")
+	}
+	res, err := r.watermarkTemplateSvc.List(workspaceID, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// Get godoc
+//
+//	@Summary		Get
+//	@Description	Get
+//	@Tags			WatermarkTemplates
+//	@Id				watermark_templates_get
+//	@Produce		json
+//	@Param			id	path		string	true	"ID"
+//	@Success		200	{object}	service.WatermarkTemplate
+//	@Failure		403	{object}	errorpkg.ErrorResponse
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/watermark_templates/{id} [get]
+func (r *WatermarkTemplateRouter) Get(c *fiber.Ctx) error {
+	res, err := r.watermarkTemplateSvc.Find(c.Params("id"), GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// Patch godoc
+//
+//	@Summary		Patch
+//	@Description	Patch
+//	@Tags			WatermarkTemplates
+//	@Id				watermark_templates_patch
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string									true	"ID"
+//	@Param			body	body		service.WatermarkTemplatePatchOptions	true	"Body"
+//	@Success		200		{object}	service.WatermarkTemplate
+//	@Failure		400		{object}	errorpkg.ErrorResponse
+//	@Failure		403		{object}	errorpkg.ErrorResponse
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/watermark_templates/{id} [patch]
+func (r *WatermarkTemplateRouter) Patch(c *fiber.Ctx) error {
+	opts := new(service.WatermarkTemplatePatchOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	res, err := r.watermarkTemplateSvc.Patch(c.Params("id"), *opts, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// Delete godoc
+//
+//	@Summary		Delete
+//	@Description	Delete, workspaces using the template fall back to the default watermark
+//	@Tags			WatermarkTemplates
+//	@Id				watermark_templates_delete
+//	@Param			id	path	string	true	"ID"
+//	@Success		204
+//	@Failure		403	{object}	errorpkg.ErrorResponse
+//	@Failure		404	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/watermark_templates/{id} [delete]
+func (r *WatermarkTemplateRouter) Delete(c *fiber.Ctx) error {
+	if err := r.watermarkTemplateSvc.Delete(c.Params("id"), GetUserID(c)); err != nil {
+		return err
+	}
+	return c.SendStatus(http.StatusNoContent)
+}
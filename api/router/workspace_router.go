@@ -15,6 +15,7 @@ import (
 	"net/url"
 	"strconv"
 	"voltaserve/errorpkg"
+	"voltaserve/model"
 	"voltaserve/service"
 
 	"github.com/go-playground/validator/v10"
@@ -38,6 +39,8 @@ func (r *WorkspaceRouter) AppendRoutes(g fiber.Router) {
 	g.Delete("/:id", r.Delete)
 	g.Patch("/:id/name", r.PatchName)
 	g.Patch("/:id/storage_capacity", r.PatchStorageCapacity)
+	g.Patch("/:id/retention_policy", r.PatchRetentionPolicy)
+	g.Patch("/:id/watermark_settings", r.PatchWatermarkSettings)
 }
 
 // Create godoc
@@ -210,6 +213,84 @@ func (r *WorkspaceRouter) PatchStorageCapacity(c *fiber.Ctx) error {
 	return c.JSON(res)
 }
 
+type WorkspacePatchRetentionPolicyOptions struct {
+	KeepLast   *int `json:"keepLast" validate:"omitempty,min=1"`
+	KeepDays   *int `json:"keepDays" validate:"omitempty,min=1"`
+	KeepDaily  *int `json:"keepDaily" validate:"omitempty,min=1"`
+	KeepWeekly *int `json:"keepWeekly" validate:"omitempty,min=1"`
+}
+
+// PatchRetentionPolicy godoc
+//
+//	@Summary		Patch Retention Policy
+//	@Description	Set which versions of the files are kept, leaving every rule out keeps all versions
+//	@Tags			Workspaces
+//	@Id				workspaces_patch_retention_policy
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string									true	"ID"
+//	@Param			body	body		WorkspacePatchRetentionPolicyOptions	true	"Body"
+//	@Success		200		{object}	service.Workspace
+//	@Failure		400		{object}	errorpkg.ErrorResponse
+//	@Failure		403		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/workspaces/{id}/retention_policy [patch]
+func (r *WorkspaceRouter) PatchRetentionPolicy(c *fiber.Ctx) error {
+	opts := new(WorkspacePatchRetentionPolicyOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	res, err := r.workspaceSvc.PatchRetentionPolicy(c.Params("id"), &model.RetentionPolicy{
+		KeepLast:   opts.KeepLast,
+		KeepDays:   opts.KeepDays,
+		KeepDaily:  opts.KeepDaily,
+		KeepWeekly: opts.KeepWeekly,
+	}, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+type WorkspacePatchWatermarkSettingsOptions struct {
+	TemplateID *string `json:"templateId" validate:"omitempty,min=1"`
+	Enforced   bool    `json:"enforced"`
+}
+
+// PatchWatermarkSettings godoc
+//
+//	@Summary		Patch Watermark Settings
+//	@Description	Choose the watermark template of the workspace, and whether viewers can only download watermarked files
+//	@Tags			Workspaces
+//	@Id				workspaces_patch_watermark_settings
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		string									true	"ID"
+//	@Param			body	body		WorkspacePatchWatermarkSettingsOptions	true	"Body"
+//	@Success		200		{object}	service.Workspace
+//	@Failure		400		{object}	errorpkg.ErrorResponse
+//	@Failure		403		{object}	errorpkg.ErrorResponse
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/workspaces/{id}/watermark_settings [patch]
+func (r *WorkspaceRouter) PatchWatermarkSettings(c *fiber.Ctx) error {
+	opts := new(WorkspacePatchWatermarkSettingsOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	res, err := r.workspaceSvc.PatchWatermarkSettings(c.Params("id"), opts.TemplateID, opts.Enforced, GetUserID(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
 // Delete godoc
 //
 //	@Summary		Delete
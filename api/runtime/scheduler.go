@@ -0,0 +1,113 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package runtime
+
+import (
+	"time"
+	"voltaserve/infra"
+	"voltaserve/log"
+	"voltaserve/service"
+)
+
+/* A job the API runs periodically in the background */
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func() error
+}
+
+/*
+Scheduler runs background jobs. When several API instances are running,
+a Redis lock held for the job's interval makes sure only one of them runs
+a given job at a time.
+*/
+type Scheduler struct {
+	jobs  []Job
+	redis *infra.RedisManager
+}
+
+func NewScheduler() *Scheduler {
+	uploadSvc := service.NewUploadService()
+	trashSvc := service.NewTrashService()
+	outboxSvc := service.NewOutboxService()
+	retentionSvc := service.NewRetentionService()
+	taskSvc := service.NewTaskService()
+	storageSvc := service.NewStorageService()
+	return &Scheduler{
+		jobs: []Job{
+			{
+				Name:     "purge_expired_uploads",
+				Interval: time.Hour,
+				Run:      uploadSvc.PurgeExpired,
+			},
+			{
+				Name:     "purge_trash",
+				Interval: time.Hour,
+				Run:      trashSvc.PurgeExpired,
+			},
+			{
+				Name:     "enforce_retention",
+				Interval: time.Hour,
+				Run:      retentionSvc.Enforce,
+			},
+			{
+				Name:     "reap_orphaned_tasks",
+				Interval: time.Minute,
+				Run:      taskSvc.ReapOrphaned,
+			},
+			{
+				/* The sizes and counts of the folders catch up with the changes below them */
+				Name:     "fold_aggregates",
+				Interval: 10 * time.Second,
+				Run:      storageSvc.FoldAggregates,
+			},
+			{
+				/* Replays the events that were not processed right after their commit */
+				Name:     "process_outbox",
+				Interval: time.Minute,
+				Run:      outboxSvc.Process,
+			},
+		},
+		redis: infra.NewRedisManager(),
+	}
+}
+
+func (s *Scheduler) Start() {
+	for _, job := range s.jobs {
+		go s.loop(job)
+	}
+}
+
+func (s *Scheduler) loop(job Job) {
+	log.GetLogger().Infow("🚀  launching", "job", job.Name, "interval", job.Interval)
+	for {
+		s.run(job)
+		time.Sleep(job.Interval)
+	}
+}
+
+func (s *Scheduler) run(job Job) {
+	ok, err := s.redis.SetNX("scheduler:"+job.Name, time.Now().UTC().Format(time.RFC3339), job.Interval)
+	if err != nil {
+		log.GetLogger().Errorw(err.Error(), "job", job.Name)
+		return
+	}
+	if !ok {
+		/* Another instance ran it during this interval */
+		return
+	}
+	start := time.Now()
+	if err := job.Run(); err != nil {
+		log.GetLogger().Errorw(err.Error(), "job", job.Name)
+		return
+	}
+	log.GetLogger().Infow("🎉  succeeded", "job", job.Name, "elapsed", time.Since(start))
+}
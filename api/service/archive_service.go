@@ -0,0 +1,310 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"voltaserve/cache"
+	"voltaserve/errorpkg"
+	"voltaserve/guard"
+	"voltaserve/infra"
+	"voltaserve/log"
+	"voltaserve/model"
+	"voltaserve/repo"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	ArchiveVariantOriginal = "original"
+	ArchiveVariantPreview  = "preview"
+)
+
+/*
+ArchiveService streams ZIP archives of files and folders, straight from S3
+to the client without storing the archive anywhere.
+*/
+type ArchiveService struct {
+	fileRepo            repo.FileRepo
+	fileCache           *cache.FileCache
+	fileGuard           *guard.FileGuard
+	snapshotCache       *cache.SnapshotCache
+	dynamicWatermarkSvc *DynamicWatermarkService
+	s3                  *infra.S3Manager
+}
+
+func NewArchiveService() *ArchiveService {
+	return &ArchiveService{
+		fileRepo:            repo.NewFileRepo(),
+		fileCache:           cache.NewFileCache(),
+		fileGuard:           guard.NewFileGuard(),
+		snapshotCache:       cache.NewSnapshotCache(),
+		dynamicWatermarkSvc: NewDynamicWatermarkService(),
+		s3:                  infra.NewS3Manager(),
+	}
+}
+
+type ArchiveOptions struct {
+	/* Either ArchiveVariantOriginal or ArchiveVariantPreview, files without a preview fall back to their original */
+	Variant string
+	/* Stamped on the files the user can only download watermarked */
+	IP string
+}
+
+type Archive struct {
+	Name    string
+	Entries []ArchiveEntry
+}
+
+type ArchiveEntry struct {
+	/* Slash separated, folders end with a slash and have no object */
+	Path       string
+	Object     *model.S3Object
+	ModifyTime time.Time
+}
+
+/*
+Lists what goes in the archive, so that anything wrong is reported before
+the response starts. Entries the user can't view are left out, with their
+descendants, the files given must all be viewable though.
+*/
+func (svc *ArchiveService) Prepare(ids []string, opts ArchiveOptions, userID string) (*Archive, error) {
+	if opts.Variant == "" {
+		opts.Variant = ArchiveVariantOriginal
+	}
+	if opts.Variant != ArchiveVariantOriginal && opts.Variant != ArchiveVariantPreview {
+		return nil, errorpkg.NewInvalidQueryParamError("variant")
+	}
+	var files []model.File
+	for _, id := range ids {
+		file, err := svc.fileCache.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if err = svc.fileGuard.Authorize(userID, file, model.CapabilityDownload); err != nil {
+			return nil, err
+		}
+		if file.IsTrashed() {
+			return nil, errorpkg.NewFileNotFoundError(nil)
+		}
+		files = append(files, file)
+	}
+	res := &Archive{Entries: make([]ArchiveEntry, 0)}
+	if len(files) == 1 {
+		res.Name = strings.TrimSuffix(files[0].GetName(), filepath.Ext(files[0].GetName())) + ".zip"
+		if files[0].GetType() == model.FileTypeFolder {
+			res.Name = files[0].GetName() + ".zip"
+		}
+	} else {
+		res.Name = "archive.zip"
+	}
+	names := newArchiveNames()
+	for _, file := range files {
+		if file.GetType() == model.FileTypeFile {
+			entry, err := svc.newFileEntry(file, "", names, opts, userID)
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil {
+				res.Entries = append(res.Entries, *entry)
+			}
+			continue
+		}
+		entries, err := svc.listTree(file, names, opts, userID)
+		if err != nil {
+			return nil, err
+		}
+		res.Entries = append(res.Entries, entries...)
+	}
+	return res, nil
+}
+
+func (svc *ArchiveService) listTree(root model.File, names *archiveNames, opts ArchiveOptions, userID string) ([]ArchiveEntry, error) {
+	tree, err := svc.fileRepo.FindTree(root.GetID())
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[string][]model.File)
+	for _, f := range tree {
+		if f.GetParentID() != nil && f.GetID() != root.GetID() {
+			children[*f.GetParentID()] = append(children[*f.GetParentID()], f)
+		}
+	}
+	var res []ArchiveEntry
+	var walk func(folder model.File, dir string) error
+	walk = func(folder model.File, dir string) error {
+		res = append(res, ArchiveEntry{
+			Path:       dir,
+			ModifyTime: svc.modifyTime(folder),
+		})
+		for _, f := range children[folder.GetID()] {
+			if f.IsTrashed() || !svc.fileGuard.IsAuthorized(userID, f, model.CapabilityDownload) {
+				continue
+			}
+			if f.GetType() == model.FileTypeFolder {
+				if err := walk(f, names.add(dir, f.GetName())+"/"); err != nil {
+					return err
+				}
+				continue
+			}
+			entry, err := svc.newFileEntry(f, dir, names, opts, userID)
+			if err != nil {
+				return err
+			}
+			if entry != nil {
+				res = append(res, *entry)
+			}
+		}
+		return nil
+	}
+	if err := walk(root, names.add("", root.GetName())+"/"); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+/*
+Returns nil for files that have nothing to download yet. Users who can't
+upload versions get the files that have a watermark, or whose workspace
+enforces it, stamped for them like a single download. The ones that can't be
+stamped are left out.
+*/
+func (svc *ArchiveService) newFileEntry(file model.File, dir string, names *archiveNames, opts ArchiveOptions, userID string) (*ArchiveEntry, error) {
+	if file.GetSnapshotID() == nil {
+		return nil, nil
+	}
+	snapshot, err := svc.snapshotCache.Get(*file.GetSnapshotID())
+	if err != nil {
+		return nil, err
+	}
+	object := snapshot.GetOriginal()
+	variant := ArchiveVariantOriginal
+	name := file.GetName()
+	if opts.Variant == ArchiveVariantPreview && snapshot.HasPreview() {
+		object = snapshot.GetPreview()
+		variant = ArchiveVariantPreview
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + filepath.Ext(object.Key)
+	}
+	if object == nil {
+		return nil, nil
+	}
+	required, err := svc.dynamicWatermarkSvc.IsRequired(userID, file, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if required {
+		if !svc.dynamicWatermarkSvc.IsSupported(object) {
+			return nil, nil
+		}
+		object, err = svc.dynamicWatermarkSvc.Stamp(DynamicWatermarkOptions{
+			File:     file,
+			Snapshot: snapshot,
+			Object:   object,
+			Variant:  variant,
+			UserID:   userID,
+			IP:       opts.IP,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &ArchiveEntry{
+		Path:       names.add(dir, name),
+		Object:     object,
+		ModifyTime: svc.modifyTime(file),
+	}, nil
+}
+
+func (svc *ArchiveService) modifyTime(file model.File) time.Time {
+	value := file.GetCreateTime()
+	if file.GetUpdateTime() != nil {
+		value = *file.GetUpdateTime()
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
+
+/*
+Writes the archive, objects are copied as they are read from S3. The entries
+are stored rather than deflated, most originals are compressed already. The
+writer switches to ZIP64 by itself when sizes or offsets exceed 4 GiB.
+*/
+func (svc *ArchiveService) Write(w io.Writer, archive *Archive) error {
+	zw := zip.NewWriter(w)
+	for _, e := range archive.Entries {
+		header := &zip.FileHeader{
+			Name:     e.Path,
+			Method:   zip.Store,
+			Modified: e.ModifyTime,
+		}
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if e.Object == nil {
+			continue
+		}
+		if err := svc.copyObject(fw, e.Object); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (svc *ArchiveService) copyObject(w io.Writer, object *model.S3Object) error {
+	reader, err := svc.s3.GetObjectReader(object.Key, object.Bucket, minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer func(reader io.ReadCloser) {
+		if err := reader.Close(); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}(reader)
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+/* Keeps the names within a folder unique, e.g. for files given from different folders */
+type archiveNames struct {
+	taken map[string]bool
+}
+
+func newArchiveNames() *archiveNames {
+	return &archiveNames{taken: make(map[string]bool)}
+}
+
+func (n *archiveNames) add(dir string, name string) string {
+	/* Slashes would be taken for folders, backslashes as well by some tools */
+	name = strings.ReplaceAll(name, "/", "_")
+	name = strings.ReplaceAll(name, "\\", "_")
+	/* Would escape the folder when extracted */
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	res := dir + name
+	for i := 2; n.taken[strings.ToLower(res)]; i++ {
+		res = fmt.Sprintf("%s%s (%d)%s", dir, base, i, ext)
+	}
+	n.taken[strings.ToLower(res)] = true
+	return res
+}
@@ -0,0 +1,295 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"voltaserve/config"
+	"voltaserve/helper"
+	"voltaserve/infra"
+	"voltaserve/log"
+	"voltaserve/model"
+	"voltaserve/repo"
+
+	"github.com/minio/minio-go/v7"
+)
+
+/*
+BlobService stores the originals by their content in a bucket shared by all
+workspaces, so the same content is stored once however many snapshots refer
+to it. A blob is removed with the last snapshot that refers to it.
+*/
+type BlobService struct {
+	blobRepo     repo.BlobRepo
+	snapshotRepo repo.SnapshotRepo
+	s3           *infra.S3Manager
+	config       *config.Config
+}
+
+func NewBlobService() *BlobService {
+	return &BlobService{
+		blobRepo:     repo.NewBlobRepo(),
+		snapshotRepo: repo.NewSnapshotRepo(),
+		s3:           infra.NewS3Manager(),
+		config:       config.GetConfig(),
+	}
+}
+
+/* Stores the file, unless a blob with the same content exists already */
+func (svc *BlobService) PutFile(filePath string, contentType string) (model.Blob, error) {
+	checksum, err := svc.checksumFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	extension := strings.ToLower(filepath.Ext(filePath))
+	blob, err := svc.acquire(checksum, extension)
+	if err != nil {
+		return nil, err
+	}
+	if blob != nil {
+		return blob, nil
+	}
+	id := helper.NewID()
+	bucket := svc.config.S3.BlobBucket
+	key := svc.key(checksum, id, extension)
+	if err := svc.s3.CreateBucket(bucket); err != nil {
+		return nil, err
+	}
+	if err := svc.s3.PutFile(key, filePath, contentType, bucket, minio.PutObjectOptions{}); err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return svc.insert(repo.BlobInsertOptions{
+		ID:        id,
+		Checksum:  checksum,
+		Extension: extension,
+		Bucket:    bucket,
+		Key:       key,
+		Size:      stat.Size(),
+	})
+}
+
+/*
+Copies an object that was uploaded elsewhere into the store, unless a blob
+with the same content exists already. The object itself is left in place, the
+caller removes it once the snapshot referring to the blob is committed.
+*/
+func (svc *BlobService) PutS3Object(object model.S3Object) (model.Blob, error) {
+	checksum, err := svc.checksumS3Object(object)
+	if err != nil {
+		return nil, err
+	}
+	extension := strings.ToLower(filepath.Ext(object.Key))
+	blob, err := svc.acquire(checksum, extension)
+	if err != nil {
+		return nil, err
+	}
+	if blob != nil {
+		return blob, nil
+	}
+	id := helper.NewID()
+	bucket := svc.config.S3.BlobBucket
+	key := svc.key(checksum, id, extension)
+	if err := svc.s3.CreateBucket(bucket); err != nil {
+		return nil, err
+	}
+	if err := svc.s3.CopyObject(object.Key, object.Bucket, key, bucket); err != nil {
+		return nil, err
+	}
+	return svc.insert(repo.BlobInsertOptions{
+		ID:        id,
+		Checksum:  checksum,
+		Extension: extension,
+		Bucket:    bucket,
+		Key:       key,
+		Size:      *object.Size,
+	})
+}
+
+/* Removes a reference to the blob, the blob itself goes with the last one */
+func (svc *BlobService) Release(id string) error {
+	count, err := svc.blobRepo.Release(id)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	blob, err := svc.blobRepo.Find(id)
+	if err != nil {
+		return err
+	}
+	ok, err := svc.blobRepo.DeleteUnreferenced(id)
+	if err != nil {
+		return err
+	}
+	/* Referenced again in the meantime */
+	if !ok {
+		return nil
+	}
+	svc.removeObject(blob.GetKey(), blob.GetBucket())
+	return nil
+}
+
+/*
+Gives the snapshot copies of the preview, text and thumbnail of a snapshot
+that was processed already with the same blob, returns false if there is no
+such snapshot, then the snapshot needs to be processed.
+*/
+func (svc *BlobService) reuseArtifacts(snapshot model.Snapshot) (bool, error) {
+	if snapshot.GetBlobID() == nil {
+		return false, nil
+	}
+	source, err := svc.snapshotRepo.FindProcessedForBlob(*snapshot.GetBlobID())
+	if err != nil {
+		return false, err
+	}
+	if source == nil || source.GetID() == snapshot.GetID() {
+		return false, nil
+	}
+	/* Image pipelines record the dimensions on the original */
+	if source.HasOriginal() && source.GetOriginal().Image != nil {
+		original := snapshot.GetOriginal()
+		original.Image = source.GetOriginal().Image
+		snapshot.SetOriginal(original)
+	}
+	preview, err := svc.copyArtifact(source.GetPreview(), source, snapshot)
+	if err != nil {
+		return svc.abandonReuse(snapshot, err)
+	}
+	text, err := svc.copyArtifact(source.GetText(), source, snapshot)
+	if err != nil {
+		return svc.abandonReuse(snapshot, err)
+	}
+	thumbnail, err := svc.copyArtifact(source.GetThumbnail(), source, snapshot)
+	if err != nil {
+		return svc.abandonReuse(snapshot, err)
+	}
+	snapshot.SetPreview(preview)
+	snapshot.SetText(text)
+	snapshot.SetThumbnail(thumbnail)
+	return true, nil
+}
+
+/* An artifact that can't be copied, e.g. it's gone from S3, leaves the snapshot to the pipeline */
+func (svc *BlobService) abandonReuse(snapshot model.Snapshot, err error) (bool, error) {
+	log.GetLogger().Error(err)
+	if err := svc.s3.RemoveObjectsWithPrefix(snapshot.GetID()+"/", snapshot.GetOriginal().Bucket); err != nil {
+		log.GetLogger().Error(err)
+	}
+	return false, nil
+}
+
+/* Artifacts are copied next to the original, where the pipeline would have put them */
+func (svc *BlobService) copyArtifact(object *model.S3Object, source model.Snapshot, target model.Snapshot) (*model.S3Object, error) {
+	if object == nil {
+		return nil, nil
+	}
+	res := *object
+	res.Bucket = target.GetOriginal().Bucket
+	/* The preview of a PDF is the original itself */
+	if source.HasOriginal() && object.Bucket == source.GetOriginal().Bucket && object.Key == source.GetOriginal().Key {
+		res.Key = target.GetOriginal().Key
+		return &res, nil
+	}
+	res.Key = target.GetID() + "/" + path.Base(object.Key)
+	if err := svc.s3.CopyObject(object.Key, object.Bucket, res.Key, res.Bucket); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+/* Returns nil if there is no blob with this content */
+func (svc *BlobService) acquire(checksum string, extension string) (model.Blob, error) {
+	blob, err := svc.blobRepo.FindByChecksum(checksum, extension)
+	if err != nil {
+		return nil, err
+	}
+	if blob == nil {
+		return nil, nil
+	}
+	ok, err := svc.blobRepo.Acquire(blob.GetID())
+	if err != nil {
+		return nil, err
+	}
+	/* Released in the meantime */
+	if !ok {
+		return nil, nil
+	}
+	return blob, nil
+}
+
+/* If another blob with the same content won the race, ours is dropped */
+func (svc *BlobService) insert(opts repo.BlobInsertOptions) (model.Blob, error) {
+	blob, err := svc.blobRepo.Insert(opts)
+	if err != nil {
+		svc.removeObject(opts.Key, opts.Bucket)
+		return nil, err
+	}
+	if blob.GetID() != opts.ID {
+		svc.removeObject(opts.Key, opts.Bucket)
+	}
+	return blob, nil
+}
+
+/* Keys are unique to each blob, so removing one never affects a blob stored again later */
+func (svc *BlobService) key(checksum string, id string, extension string) string {
+	return "sha256/" + checksum + "/" + id + extension
+}
+
+func (svc *BlobService) checksumFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer func(f *os.File) {
+		if err := f.Close(); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}(f)
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (svc *BlobService) checksumS3Object(object model.S3Object) (string, error) {
+	reader, err := svc.s3.GetObjectReader(object.Key, object.Bucket, minio.GetObjectOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer func(reader io.ReadCloser) {
+		if err := reader.Close(); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}(reader)
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (svc *BlobService) removeObject(key string, bucket string) {
+	if err := svc.s3.RemoveObject(key, bucket, minio.RemoveObjectOptions{}); err != nil {
+		log.GetLogger().Error(err)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+	"voltaserve/cache"
+	"voltaserve/client"
+	"voltaserve/guard"
+	"voltaserve/helper"
+	"voltaserve/infra"
+	"voltaserve/log"
+	"voltaserve/model"
+	"voltaserve/repo"
+
+	"github.com/minio/minio-go/v7"
+)
+
+/* How long a watermarked download is served again to the same user and IP before it's regenerated */
+const dynamicWatermarkTTL = 10 * time.Minute
+
+/*
+How long a watermarked download is kept once it's no longer served, for the
+downloads that are still streaming it.
+*/
+const dynamicWatermarkRetention = 24 * time.Hour
+
+/*
+DynamicWatermarkService stamps downloads for the user requesting them, so that
+a leaked copy can be traced back to its user, IP and time. The workspace's
+template, if any, adds its text and styling.
+*/
+type DynamicWatermarkService struct {
+	redis                 *infra.RedisManager
+	s3                    *infra.S3Manager
+	userRepo              repo.UserRepo
+	workspaceCache        *cache.WorkspaceCache
+	fileGuard             *guard.FileGuard
+	watermarkTemplateRepo repo.WatermarkTemplateRepo
+	watermarkClient       *client.WatermarkClient
+	fileIdent             *infra.FileIdentifier
+	keyPrefix             string
+}
+
+func NewDynamicWatermarkService() *DynamicWatermarkService {
+	return &DynamicWatermarkService{
+		redis:                 infra.NewRedisManager(),
+		s3:                    infra.NewS3Manager(),
+		userRepo:              repo.NewUserRepo(),
+		workspaceCache:        cache.NewWorkspaceCache(),
+		fileGuard:             guard.NewFileGuard(),
+		watermarkTemplateRepo: repo.NewWatermarkTemplateRepo(),
+		watermarkClient:       client.NewWatermarkClient(),
+		fileIdent:             infra.NewFileIdentifier(),
+		keyPrefix:             "dynamic_watermark:",
+	}
+}
+
+type DynamicWatermarkOptions struct {
+	File     model.File
+	Snapshot model.Snapshot
+	/* The original or the preview of the snapshot */
+	Object  *model.S3Object
+	Variant string
+	UserID  string
+	IP      string
+}
+
+func (svc *DynamicWatermarkService) IsRequired(userID string, file model.File, snapshot model.Snapshot) (bool, error) {
+	workspace, err := svc.workspaceCache.Get(file.GetWorkspaceID())
+	if err != nil {
+		return false, err
+	}
+	return isDynamicWatermarkRequired(snapshot, workspace, svc.fileGuard.GetCapabilities(userID, file)), nil
+}
+
+/* Visitors of share links have no capabilities that would spare them the watermark */
+func (svc *DynamicWatermarkService) IsRequiredForShareLink(file model.File, snapshot model.Snapshot) (bool, error) {
+	workspace, err := svc.workspaceCache.Get(file.GetWorkspaceID())
+	if err != nil {
+		return false, err
+	}
+	return isDynamicWatermarkRequired(snapshot, workspace, nil), nil
+}
+
+/*
+Users who can't upload versions of a file, unlike its editors and owners, only
+get stamped copies of the snapshots that have a watermark, or of all of them
+when the workspace enforces it.
+*/
+func isDynamicWatermarkRequired(snapshot model.Snapshot, workspace model.Workspace, capabilities []string) bool {
+	if !snapshot.HasWatermark() && !workspace.IsWatermarkEnforced() {
+		return false
+	}
+	return !slices.Contains(capabilities, model.CapabilityUpload)
+}
+
+/*
+For the content derived from a snapshot that can't be stamped, like mosaic
+tiles and diffs, which is then left to the users who can upload versions when
+a stamped copy is required.
+*/
+func (svc *DynamicWatermarkService) AuthorizeUnstamped(userID string, file model.File, snapshot model.Snapshot) error {
+	required, err := svc.IsRequired(userID, file, snapshot)
+	if err != nil {
+		return err
+	}
+	if required {
+		return svc.fileGuard.Authorize(userID, file, model.CapabilityUpload)
+	}
+	return nil
+}
+
+/* Only images and PDFs can be stamped */
+func (svc *DynamicWatermarkService) IsSupported(object *model.S3Object) bool {
+	return svc.fileIdent.IsImage(object.GetExtension()) || svc.fileIdent.IsPDF(object.GetExtension())
+}
+
+/*
+Downloads from the same user and IP within dynamicWatermarkTTL share the
+copy, which carries the time of the first of them. Every copy has its own
+object, so a new one never overwrites a copy that is being downloaded.
+*/
+func (svc *DynamicWatermarkService) Stamp(opts DynamicWatermarkOptions) (*model.S3Object, error) {
+	key := svc.keyPrefix + opts.Snapshot.GetID() + ":" + opts.UserID + ":" + opts.Variant + ":" + opts.IP
+	if value, err := svc.redis.Get(key); err == nil {
+		res := model.S3Object{}
+		if err := json.Unmarshal([]byte(value), &res); err == nil {
+			return &res, nil
+		}
+	}
+	res, err := svc.create(opts)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	if err := svc.redis.SetEx(key, string(b), dynamicWatermarkTTL); err != nil {
+		/* The next download regenerates it, that's all */
+		log.GetLogger().Error(err)
+	}
+	before := time.Now().Add(-(dynamicWatermarkTTL + dynamicWatermarkRetention))
+	if err := svc.s3.RemoveObjectsWithPrefixModifiedBefore(svc.userPrefix(opts.Snapshot, opts.UserID), res.Bucket, before); err != nil {
+		log.GetLogger().Error(err)
+	}
+	return res, nil
+}
+
+/* Removes the watermarked downloads of a snapshot */
+func (svc *DynamicWatermarkService) DeleteAll(snapshot model.Snapshot) error {
+	buckets := make(map[string]bool)
+	for _, o := range []*model.S3Object{snapshot.GetOriginal(), snapshot.GetPreview()} {
+		if o != nil {
+			buckets[o.Bucket] = true
+		}
+	}
+	for bucket := range buckets {
+		if err := svc.s3.RemoveObjectsWithPrefix(svc.prefix(snapshot), bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (svc *DynamicWatermarkService) create(opts DynamicWatermarkOptions) (*model.S3Object, error) {
+	user, err := svc.userRepo.Find(opts.UserID)
+	if err != nil {
+		return nil, err
+	}
+	workspace, err := svc.workspaceCache.Get(opts.File.GetWorkspaceID())
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	createOpts := client.WatermarkCreateOptions{
+		S3Key:    svc.userPrefix(opts.Snapshot, opts.UserID) + helper.NewID() + "/" + opts.Variant + filepath.Ext(opts.Object.Key),
+		S3Bucket: opts.Object.Bucket,
+		Category: "document",
+		DateTime: now.UTC().Format("2006-01-02 15:04:05 UTC"),
+		Values:   []string{user.GetEmail(), opts.IP},
+	}
+	if svc.fileIdent.IsImage(opts.Object.GetExtension()) {
+		createOpts.Category = "image"
+	}
+	if workspace.GetWatermarkTemplateID() != nil {
+		template, err := svc.watermarkTemplateRepo.Find(*workspace.GetWatermarkTemplateID())
+		if err != nil {
+			return nil, err
+		}
+		createOpts.Text = helper.ToPtr(renderWatermarkText(template, user, workspace, opts.File, now))
+		createOpts.Color = helper.ToPtr(template.GetColor())
+		createOpts.Opacity = helper.ToPtr(template.GetOpacity())
+		createOpts.Angle = helper.ToPtr(template.GetAngle())
+		createOpts.Position = helper.ToPtr(template.GetPosition())
+		createOpts.Tiled = helper.ToPtr(template.IsTiled())
+		createOpts.FontSize = template.GetFontSize()
+	}
+	createOpts.Path = filepath.Join(os.TempDir(), helper.NewID()+filepath.Ext(opts.Object.Key))
+	if err := svc.s3.GetFile(opts.Object.Key, createOpts.Path, opts.Object.Bucket, minio.GetObjectOptions{}); err != nil {
+		return nil, err
+	}
+	defer func(path string) {
+		if err := os.Remove(path); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}(createOpts.Path)
+	if err := svc.watermarkClient.Create(createOpts); err != nil {
+		return nil, err
+	}
+	stat, err := svc.s3.StatObject(createOpts.S3Key, createOpts.S3Bucket, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &model.S3Object{
+		Bucket:      createOpts.S3Bucket,
+		Key:         createOpts.S3Key,
+		Size:        helper.ToPtr(stat.Size),
+		ContentType: stat.ContentType,
+	}, nil
+}
+
+func (svc *DynamicWatermarkService) prefix(snapshot model.Snapshot) string {
+	return snapshot.GetID() + "/watermarks/"
+}
+
+func (svc *DynamicWatermarkService) userPrefix(snapshot model.Snapshot, userID string) string {
+	return svc.prefix(snapshot) + userID + "/"
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"testing"
+	"voltaserve/model"
+	"voltaserve/repo"
+)
+
+/* Only what isDynamicWatermarkRequired reads */
+type testWorkspace struct {
+	model.Workspace
+	watermarkEnforced bool
+}
+
+func (w testWorkspace) IsWatermarkEnforced() bool {
+	return w.watermarkEnforced
+}
+
+func TestIsDynamicWatermarkRequired(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		watermarked       bool
+		watermarkEnforced bool
+		capabilities      []string
+		expected          bool
+	}{
+		{name: "viewer of a plain snapshot", capabilities: model.GetBuiltinCapabilities(model.PermissionViewer)},
+		{name: "viewer of a watermarked snapshot", watermarked: true, capabilities: model.GetBuiltinCapabilities(model.PermissionViewer), expected: true},
+		{name: "viewer in a workspace that enforces it", watermarkEnforced: true, capabilities: model.GetBuiltinCapabilities(model.PermissionViewer), expected: true},
+		{name: "editor of a watermarked snapshot", watermarked: true, capabilities: model.GetBuiltinCapabilities(model.PermissionEditor)},
+		{name: "editor in a workspace that enforces it", watermarkEnforced: true, capabilities: model.GetBuiltinCapabilities(model.PermissionEditor)},
+		{name: "owner of a watermarked snapshot", watermarked: true, watermarkEnforced: true, capabilities: model.GetBuiltinCapabilities(model.PermissionOwner)},
+		{name: "custom role that can download", watermarked: true, capabilities: []string{model.CapabilityRead, model.CapabilityDownload}, expected: true},
+		{name: "custom role that can upload", watermarkEnforced: true, capabilities: []string{model.CapabilityRead, model.CapabilityUpload}},
+		{name: "share link visitor of a plain snapshot"},
+		{name: "share link visitor of a watermarked snapshot", watermarked: true, expected: true},
+		{name: "share link visitor in a workspace that enforces it", watermarkEnforced: true, expected: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			snapshot := repo.NewSnapshot()
+			if tc.watermarked {
+				snapshot.SetWatermark(&model.S3Object{Bucket: "bucket", Key: "watermark.pdf"})
+			}
+			workspace := testWorkspace{watermarkEnforced: tc.watermarkEnforced}
+			if actual := isDynamicWatermarkRequired(snapshot, workspace, tc.capabilities); actual != tc.expected {
+				t.Fatalf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,728 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"voltaserve/cache"
+	"voltaserve/config"
+	"voltaserve/errorpkg"
+	"voltaserve/guard"
+	"voltaserve/helper"
+	"voltaserve/infra"
+	"voltaserve/model"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	archiveFormatZIP   = "zip"
+	archiveFormatTar   = "tar"
+	archiveFormatTarGz = "tar.gz"
+	archiveFormat7z    = "7z"
+)
+
+/*
+Archives this small are extracted whatever their compression ratio, it's
+the ratio of large archives that gives zip bombs away.
+*/
+const extractMinBudgetMB = 10
+
+/*
+ExtractService unpacks archives into folder trees. Files and folders are
+created like uploads would, so permissions, quota and processing apply to
+each of them.
+*/
+type ExtractService struct {
+	fileCache           *cache.FileCache
+	fileGuard           *guard.FileGuard
+	fileSvc             *FileService
+	snapshotCache       *cache.SnapshotCache
+	workspaceSvc        *WorkspaceService
+	taskSvc             *TaskService
+	dynamicWatermarkSvc *DynamicWatermarkService
+	s3                  *infra.S3Manager
+	config              *config.Config
+}
+
+func NewExtractService() *ExtractService {
+	return &ExtractService{
+		fileCache:           cache.NewFileCache(),
+		fileGuard:           guard.NewFileGuard(),
+		fileSvc:             NewFileService(),
+		snapshotCache:       cache.NewSnapshotCache(),
+		workspaceSvc:        NewWorkspaceService(),
+		taskSvc:             NewTaskService(),
+		dynamicWatermarkSvc: NewDynamicWatermarkService(),
+		s3:                  infra.NewS3Manager(),
+		config:              config.GetConfig(),
+	}
+}
+
+type FileExtractOptions struct {
+	/* The folder to extract into, defaults to the folder of the archive */
+	TargetID *string `json:"targetId,omitempty"`
+}
+
+/*
+Extracts in the background into a new folder named after the archive. When
+the extraction fails or gets canceled, what was extracted so far is kept.
+*/
+func (svc *ExtractService) ExtractAsync(id string, opts FileExtractOptions, userID string) (*Task, error) {
+	file, err := svc.fileCache.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityDownload); err != nil {
+		return nil, err
+	}
+	if file.GetType() != model.FileTypeFile {
+		return nil, errorpkg.NewFileIsNotAFileError(file)
+	}
+	format := archiveFormatFromName(file.GetName())
+	if format == "" {
+		return nil, errorpkg.NewArchiveFormatNotSupportedError()
+	}
+	if file.GetSnapshotID() == nil {
+		return nil, errorpkg.NewSnapshotNotFoundError(nil)
+	}
+	snapshot, err := svc.snapshotCache.Get(*file.GetSnapshotID())
+	if err != nil {
+		return nil, err
+	}
+	if !snapshot.HasOriginal() {
+		return nil, errorpkg.NewSnapshotNotFoundError(nil)
+	}
+	/* The extracted files would be out of reach of the watermark, like copies */
+	if err := svc.dynamicWatermarkSvc.AuthorizeUnstamped(userID, file, snapshot); err != nil {
+		return nil, err
+	}
+	targetID := file.GetParentID()
+	if opts.TargetID != nil {
+		targetID = opts.TargetID
+	}
+	if targetID == nil {
+		return nil, errorpkg.NewFileIsNotAFolderError(file)
+	}
+	target, err := svc.fileCache.Get(*targetID)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.fileGuard.Authorize(userID, target, model.CapabilityUpload); err != nil {
+		return nil, err
+	}
+	if target.GetType() != model.FileTypeFolder {
+		return nil, errorpkg.NewFileIsNotAFolderError(target)
+	}
+	return svc.taskSvc.runOperation(
+		fmt.Sprintf("Extracting %s.", file.GetName()),
+		TaskOperationExtract,
+		userID,
+		map[string]string{"fileId": file.GetID(), "targetId": target.GetID()},
+		func(progress *taskProgress) error {
+			return svc.extract(file, *snapshot.GetOriginal(), format, target, userID, progress)
+		},
+	)
+}
+
+func (svc *ExtractService) extract(file model.File, original model.S3Object, format string, target model.File, userID string, progress *taskProgress) error {
+	tmpDir, err := os.MkdirTemp("", "voltaserve-extract-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	archivePath := filepath.Join(tmpDir, "archive")
+	if err := svc.s3.GetFile(original.Key, archivePath, original.Bucket, minio.GetObjectOptions{}); err != nil {
+		return err
+	}
+	stat, err := os.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+	budget := svc.budget(stat.Size())
+	archive := newArchiveReader(format, archivePath, archiveLimits{
+		outputDir:  filepath.Join(tmpDir, "contents"),
+		maxEntries: svc.config.Limits.ExtractMaxEntries,
+		maxSize:    budget,
+	})
+	x := &extraction{
+		svc:         svc,
+		workspaceID: target.GetWorkspaceID(),
+		userID:      userID,
+		tmpDir:      tmpDir,
+		budget:      budget,
+		folders:     make(map[string]string),
+		files:       make(map[string]bool),
+		progress:    progress,
+	}
+	/* Check the whole listing before creating anything */
+	headers, err := archive.list()
+	if err != nil {
+		return err
+	}
+	var count int
+	var declared int64
+	for _, h := range headers {
+		name, err := acceptArchiveEntry(h.name)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		count++
+		declared += h.size
+	}
+	if count > svc.config.Limits.ExtractMaxEntries {
+		return errorpkg.NewArchiveLimitExceededError(fmt.Sprintf("more than %d entries", svc.config.Limits.ExtractMaxEntries))
+	}
+	if declared > x.budget {
+		return errorpkg.NewArchiveLimitExceededError(fmt.Sprintf("more than %d bytes once extracted", x.budget))
+	}
+	progress.setTotal(count)
+	name, err := svc.findFolderName(target.GetID(), archiveBaseName(file.GetName(), format))
+	if err != nil {
+		return err
+	}
+	root, err := svc.fileSvc.Create(FileCreateOptions{
+		WorkspaceID: target.GetWorkspaceID(),
+		Name:        name,
+		Type:        model.FileTypeFolder,
+		ParentID:    helper.ToPtr(target.GetID()),
+	}, userID)
+	if err != nil {
+		return err
+	}
+	x.folders["."] = root.ID
+	return archive.walk(x.visit)
+}
+
+/* The most bytes an archive of the given size may extract to */
+func (svc *ExtractService) budget(archiveSize int64) int64 {
+	res := archiveSize * int64(svc.config.Limits.ExtractMaxRatio)
+	res = max(res, helper.MegabyteToByte(extractMinBudgetMB))
+	return min(res, helper.MegabyteToByte(svc.config.Limits.ExtractMaxSizeMB))
+}
+
+/* Appends " (n)" to the name until no child of the folder has it */
+func (svc *ExtractService) findFolderName(folderID string, name string) (string, error) {
+	res := name
+	for i := 2; ; i++ {
+		existing, err := svc.fileSvc.getChildWithName(folderID, res)
+		if err != nil {
+			return "", err
+		}
+		if existing == nil {
+			return res, nil
+		}
+		res = fmt.Sprintf("%s (%d)", name, i)
+	}
+}
+
+/* Tracks the state of one extraction, folders and files are keyed by their path in the archive */
+type extraction struct {
+	svc         *ExtractService
+	workspaceID string
+	userID      string
+	tmpDir      string
+	budget      int64
+	written     int64
+	folders     map[string]string
+	files       map[string]bool
+	progress    *taskProgress
+}
+
+/*
+Returns the cleaned path of the entry, or an empty string if the entry
+should be skipped. Paths escaping the archive are an error.
+*/
+func acceptArchiveEntry(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", errorpkg.NewArchiveEntryPathInvalidError(name)
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == ".." {
+			return "", errorpkg.NewArchiveEntryPathInvalidError(name)
+		}
+		/* Metadata added by macOS */
+		if component == "__MACOSX" || component == ".DS_Store" {
+			return "", nil
+		}
+	}
+	res := path.Clean(name)
+	if res == "." {
+		return "", nil
+	}
+	return res, nil
+}
+
+func (x *extraction) visit(name string, isDir bool, r io.Reader) error {
+	name, err := acceptArchiveEntry(name)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return nil
+	}
+	if isDir {
+		if !x.files[name] {
+			if _, err := x.folder(name); err != nil {
+				return err
+			}
+		}
+	} else if _, isFolder := x.folders[name]; !isFolder && !x.files[name] {
+		/* Duplicates keep the first entry, like a file and folder sharing a path */
+		if err := x.file(name, r); err != nil {
+			return err
+		}
+	}
+	return x.progress.advance(1)
+}
+
+/* Returns the ID of the folder, creating it and its parents as needed */
+func (x *extraction) folder(dir string) (string, error) {
+	if id, ok := x.folders[dir]; ok {
+		return id, nil
+	}
+	parentID, err := x.folder(path.Dir(dir))
+	if err != nil {
+		return "", err
+	}
+	res, err := x.svc.fileSvc.Create(FileCreateOptions{
+		WorkspaceID: x.workspaceID,
+		Name:        path.Base(dir),
+		Type:        model.FileTypeFolder,
+		ParentID:    &parentID,
+	}, x.userID)
+	if err != nil {
+		return "", err
+	}
+	x.folders[dir] = res.ID
+	return res.ID, nil
+}
+
+func (x *extraction) file(name string, r io.Reader) error {
+	parentID, err := x.folder(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(x.tmpDir, helper.NewID()+path.Ext(name))
+	defer func() {
+		_ = os.Remove(tmpPath)
+	}()
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	/* Count the bytes actually written, headers can lie about sizes */
+	n, err := io.Copy(f, io.LimitReader(r, x.budget-x.written+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	x.written += n
+	if x.written > x.budget {
+		return errorpkg.NewArchiveLimitExceededError(fmt.Sprintf("more than %d bytes once extracted", x.budget))
+	}
+	ok, err := x.svc.workspaceSvc.HasEnoughSpaceForByteSize(x.workspaceID, n)
+	if err != nil {
+		return err
+	}
+	if !*ok {
+		return errorpkg.NewStorageLimitExceededError()
+	}
+	file, err := x.svc.fileSvc.Create(FileCreateOptions{
+		WorkspaceID: x.workspaceID,
+		Name:        path.Base(name),
+		Type:        model.FileTypeFile,
+		ParentID:    &parentID,
+	}, x.userID)
+	if err != nil {
+		return err
+	}
+	x.files[name] = true
+	if _, err := x.svc.fileSvc.Store(file.ID, tmpPath, FileStoreOptions{}, x.userID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func archiveFormatFromName(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return archiveFormatTarGz
+	case strings.HasSuffix(name, ".tar"):
+		return archiveFormatTar
+	case strings.HasSuffix(name, ".zip"):
+		return archiveFormatZIP
+	case strings.HasSuffix(name, ".7z"):
+		return archiveFormat7z
+	}
+	return ""
+}
+
+/* Strips the archive extension, "photos.tar.gz" becomes "photos" */
+func archiveBaseName(name string, format string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip", ".7z"} {
+		if strings.HasSuffix(lower, ext) && len(name) > len(ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
+
+type archiveHeader struct {
+	name  string
+	isDir bool
+	size  int64
+}
+
+/* Calls fn for every regular file and folder, r is nil for folders and only valid during the call */
+type archiveVisitor func(name string, isDir bool, r io.Reader) error
+
+/* Symbolic links, devices and other special entries are never listed nor visited, or the archive is refused */
+type archiveReader interface {
+	list() ([]archiveHeader, error)
+	walk(fn archiveVisitor) error
+}
+
+/* Readers that can't stream the entries extract to outputDir, within the limits */
+type archiveLimits struct {
+	outputDir  string
+	maxEntries int
+	maxSize    int64
+}
+
+func newArchiveReader(format string, archivePath string, limits archiveLimits) archiveReader {
+	switch format {
+	case archiveFormatZIP:
+		return &zipArchiveReader{path: archivePath}
+	case archiveFormat7z:
+		return &sevenZipArchiveReader{path: archivePath, limits: limits}
+	default:
+		return &tarArchiveReader{path: archivePath, gzip: format == archiveFormatTarGz}
+	}
+}
+
+type zipArchiveReader struct {
+	path string
+}
+
+func (a *zipArchiveReader) list() ([]archiveHeader, error) {
+	var res []archiveHeader
+	err := a.iterate(func(f *zip.File) error {
+		res = append(res, archiveHeader{
+			name:  f.Name,
+			isDir: f.FileInfo().IsDir(),
+			size:  int64(f.UncompressedSize64),
+		})
+		return nil
+	})
+	return res, err
+}
+
+func (a *zipArchiveReader) walk(fn archiveVisitor) error {
+	return a.iterate(func(f *zip.File) error {
+		if f.FileInfo().IsDir() {
+			return fn(f.Name, true, nil)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = rc.Close()
+		}()
+		return fn(f.Name, false, rc)
+	})
+}
+
+func (a *zipArchiveReader) iterate(fn func(f *zip.File) error) error {
+	zr, err := zip.OpenReader(a.path)
+	if err != nil {
+		return errorpkg.NewArchiveFormatNotSupportedError()
+	}
+	defer func() {
+		_ = zr.Close()
+	}()
+	for _, f := range zr.File {
+		if !f.FileInfo().IsDir() && !f.Mode().IsRegular() {
+			continue
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type tarArchiveReader struct {
+	path string
+	gzip bool
+}
+
+func (a *tarArchiveReader) list() ([]archiveHeader, error) {
+	var res []archiveHeader
+	err := a.iterate(func(hdr *tar.Header, _ io.Reader) error {
+		res = append(res, archiveHeader{
+			name:  hdr.Name,
+			isDir: hdr.Typeflag == tar.TypeDir,
+			size:  hdr.Size,
+		})
+		return nil
+	})
+	return res, err
+}
+
+func (a *tarArchiveReader) walk(fn archiveVisitor) error {
+	return a.iterate(func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Typeflag == tar.TypeDir {
+			return fn(hdr.Name, true, nil)
+		}
+		return fn(hdr.Name, false, r)
+	})
+}
+
+func (a *tarArchiveReader) iterate(fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var r io.Reader = f
+	if a.gzip {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return errorpkg.NewArchiveFormatNotSupportedError()
+		}
+		defer func() {
+			_ = gz.Close()
+		}()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errorpkg.NewArchiveFormatNotSupportedError()
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeDir {
+			continue
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+There is no 7z reader in the standard library, so the 7z binary lists the
+archive, then extracts all of it to the output folder. Nothing is extracted
+before the listing passed the checks, and archives with links are refused
+altogether, as 7z would create them.
+*/
+type sevenZipArchiveReader struct {
+	path   string
+	limits archiveLimits
+}
+
+type sevenZipEntry struct {
+	archiveHeader
+	isLink    bool
+	hasSize   bool
+	attribute string
+}
+
+func (a *sevenZipArchiveReader) list() ([]archiveHeader, error) {
+	entries, err := a.listEntries()
+	if err != nil {
+		return nil, err
+	}
+	if err := a.validate(entries); err != nil {
+		return nil, err
+	}
+	var res []archiveHeader
+	for _, e := range entries {
+		res = append(res, e.archiveHeader)
+	}
+	return res, nil
+}
+
+func (a *sevenZipArchiveReader) listEntries() ([]sevenZipEntry, error) {
+	output, err := exec.Command("7z", "l", "-slt", "--", a.path).Output()
+	if err != nil {
+		return nil, errorpkg.NewArchiveFormatNotSupportedError()
+	}
+	var res []sevenZipEntry
+	/* Entries come after the dashes, as "Key = Value" blocks starting with the path */
+	var inEntries bool
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !inEntries {
+			inEntries = strings.HasPrefix(line, "----------")
+			continue
+		}
+		key, value, found := strings.Cut(line, " = ")
+		if !found {
+			/* Keys with no value end with " =" */
+			key, found = strings.CutSuffix(line, " =")
+			if !found {
+				continue
+			}
+		}
+		if key == "Path" {
+			res = append(res, sevenZipEntry{archiveHeader: archiveHeader{name: value}})
+			continue
+		}
+		if len(res) == 0 {
+			continue
+		}
+		current := &res[len(res)-1]
+		switch key {
+		case "Folder":
+			current.isDir = value == "+"
+		case "Size":
+			if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+				current.size = size
+				current.hasSize = true
+			}
+		case "Attributes":
+			current.attribute = value
+		case "Symbolic Link", "Hard Link":
+			if value != "" {
+				current.isLink = true
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i := range res {
+		if isSevenZipLinkAttribute(res[i].attribute) {
+			res[i].isLink = true
+		}
+	}
+	return res, nil
+}
+
+/* The Unix mode follows the Windows attributes, e.g. "A_ lrwxrwxrwx" */
+func isSevenZipLinkAttribute(attribute string) bool {
+	for _, field := range strings.Fields(attribute) {
+		if len(field) == 10 && field[0] == 'l' {
+			return true
+		}
+	}
+	return false
+}
+
+/* Checks the listing against what 7z is about to write to disk, walk checks it again right before extracting */
+func (a *sevenZipArchiveReader) validate(entries []sevenZipEntry) error {
+	var count int
+	var declared int64
+	for _, e := range entries {
+		if _, err := acceptArchiveEntry(e.name); err != nil {
+			return err
+		}
+		if e.isLink {
+			return errorpkg.NewArchiveEntryPathInvalidError(e.name)
+		}
+		if !e.isDir && !e.hasSize {
+			return errorpkg.NewArchiveFormatNotSupportedError()
+		}
+		count++
+		declared += e.size
+	}
+	if count > a.limits.maxEntries {
+		return errorpkg.NewArchiveLimitExceededError(fmt.Sprintf("more than %d entries", a.limits.maxEntries))
+	}
+	if declared > a.limits.maxSize {
+		return errorpkg.NewArchiveLimitExceededError(fmt.Sprintf("more than %d bytes once extracted", a.limits.maxSize))
+	}
+	return nil
+}
+
+func (a *sevenZipArchiveReader) walk(fn archiveVisitor) error {
+	entries, err := a.listEntries()
+	if err != nil {
+		return err
+	}
+	if err := a.validate(entries); err != nil {
+		return err
+	}
+	if err := exec.Command("7z", "x", "-y", "-bd", "-o"+a.limits.outputDir, "--", a.path).Run(); err != nil {
+		return errorpkg.NewArchiveFormatNotSupportedError()
+	}
+	for _, e := range entries {
+		if err := a.visit(e.archiveHeader, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Stats what 7z extracted rather than trusting the listing, entries that are
+links or that sit under a linked folder are skipped.
+*/
+func (a *sevenZipArchiveReader) visit(h archiveHeader, fn archiveVisitor) error {
+	outputDir, err := filepath.EvalSymlinks(a.limits.outputDir)
+	if err != nil {
+		return err
+	}
+	entryPath := filepath.Join(outputDir, filepath.FromSlash(strings.ReplaceAll(h.name, "\\", "/")))
+	resolved, err := filepath.EvalSymlinks(entryPath)
+	if err != nil || resolved != entryPath {
+		return nil
+	}
+	stat, err := os.Lstat(entryPath)
+	if err != nil {
+		return nil
+	}
+	if stat.IsDir() {
+		return fn(h.name, true, nil)
+	}
+	if !stat.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(entryPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return fn(h.name, false, f)
+}
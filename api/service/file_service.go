@@ -14,7 +14,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
-	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
 	"time"
@@ -25,6 +25,7 @@ import (
 	"voltaserve/guard"
 	"voltaserve/helper"
 	"voltaserve/infra"
+	"voltaserve/log"
 	"voltaserve/model"
 	"voltaserve/repo"
 	"voltaserve/search"
@@ -34,56 +35,66 @@ import (
 )
 
 type FileService struct {
-	fileRepo       repo.FileRepo
-	fileSearch     *search.FileSearch
-	fileGuard      *guard.FileGuard
-	fileMapper     *FileMapper
-	fileCache      *cache.FileCache
-	workspaceCache *cache.WorkspaceCache
-	workspaceRepo  repo.WorkspaceRepo
-	workspaceGuard *guard.WorkspaceGuard
-	workspaceSvc   *WorkspaceService
-	snapshotRepo   repo.SnapshotRepo
-	snapshotCache  *cache.SnapshotCache
-	snapshotSvc    *SnapshotService
-	userRepo       repo.UserRepo
-	userMapper     *userMapper
-	groupCache     *cache.GroupCache
-	groupGuard     *guard.GroupGuard
-	groupMapper    *groupMapper
-	permissionRepo repo.PermissionRepo
-	taskSvc        *TaskService
-	fileIdent      *infra.FileIdentifier
-	s3             *infra.S3Manager
-	pipelineClient *client.PipelineClient
-	config         *config.Config
+	fileRepo            repo.FileRepo
+	fileSearch          *search.FileSearch
+	fileGuard           *guard.FileGuard
+	fileMapper          *FileMapper
+	fileCache           *cache.FileCache
+	filePermissionCache *cache.FilePermissionCache
+	workspaceCache      *cache.WorkspaceCache
+	workspaceRepo       repo.WorkspaceRepo
+	workspaceGuard      *guard.WorkspaceGuard
+	workspaceSvc        *WorkspaceService
+	snapshotRepo        repo.SnapshotRepo
+	snapshotCache       *cache.SnapshotCache
+	snapshotSvc         *SnapshotService
+	blobSvc             *BlobService
+	dynamicWatermarkSvc *DynamicWatermarkService
+	userRepo            repo.UserRepo
+	userMapper          *userMapper
+	groupCache          *cache.GroupCache
+	roleCache           *cache.RoleCache
+	groupGuard          *guard.GroupGuard
+	groupMapper         *groupMapper
+	permissionRepo      repo.PermissionRepo
+	taskSvc             *TaskService
+	outboxSvc           *OutboxService
+	fileIdent           *infra.FileIdentifier
+	s3                  *infra.S3Manager
+	pipelineClient      *client.PipelineClient
+	config              *config.Config
 }
 
 func NewFileService() *FileService {
 	return &FileService{
-		fileRepo:       repo.NewFileRepo(),
-		fileCache:      cache.NewFileCache(),
-		fileSearch:     search.NewFileSearch(),
-		fileGuard:      guard.NewFileGuard(),
-		fileMapper:     NewFileMapper(),
-		workspaceGuard: guard.NewWorkspaceGuard(),
-		workspaceCache: cache.NewWorkspaceCache(),
-		workspaceRepo:  repo.NewWorkspaceRepo(),
-		workspaceSvc:   NewWorkspaceService(),
-		snapshotRepo:   repo.NewSnapshotRepo(),
-		snapshotCache:  cache.NewSnapshotCache(),
-		snapshotSvc:    NewSnapshotService(),
-		userRepo:       repo.NewUserRepo(),
-		userMapper:     newUserMapper(),
-		groupCache:     cache.NewGroupCache(),
-		groupGuard:     guard.NewGroupGuard(),
-		groupMapper:    newGroupMapper(),
-		permissionRepo: repo.NewPermissionRepo(),
-		taskSvc:        NewTaskService(),
-		fileIdent:      infra.NewFileIdentifier(),
-		s3:             infra.NewS3Manager(),
-		pipelineClient: client.NewPipelineClient(),
-		config:         config.GetConfig(),
+		fileRepo:            repo.NewFileRepo(),
+		fileCache:           cache.NewFileCache(),
+		filePermissionCache: cache.NewFilePermissionCache(),
+		fileSearch:          search.NewFileSearch(),
+		fileGuard:           guard.NewFileGuard(),
+		fileMapper:          NewFileMapper(),
+		workspaceGuard:      guard.NewWorkspaceGuard(),
+		workspaceCache:      cache.NewWorkspaceCache(),
+		workspaceRepo:       repo.NewWorkspaceRepo(),
+		workspaceSvc:        NewWorkspaceService(),
+		snapshotRepo:        repo.NewSnapshotRepo(),
+		snapshotCache:       cache.NewSnapshotCache(),
+		snapshotSvc:         NewSnapshotService(),
+		blobSvc:             NewBlobService(),
+		dynamicWatermarkSvc: NewDynamicWatermarkService(),
+		userRepo:            repo.NewUserRepo(),
+		userMapper:          newUserMapper(),
+		groupCache:          cache.NewGroupCache(),
+		roleCache:           cache.NewRoleCache(),
+		groupGuard:          guard.NewGroupGuard(),
+		groupMapper:         newGroupMapper(),
+		permissionRepo:      repo.NewPermissionRepo(),
+		taskSvc:             NewTaskService(),
+		outboxSvc:           NewOutboxService(),
+		fileIdent:           infra.NewFileIdentifier(),
+		s3:                  infra.NewS3Manager(),
+		pipelineClient:      client.NewPipelineClient(),
+		config:              config.GetConfig(),
 	}
 }
 
@@ -95,16 +106,24 @@ type FileCreateOptions struct {
 }
 
 type File struct {
-	ID          string    `json:"id"`
-	WorkspaceID string    `json:"workspaceId"`
-	Name        string    `json:"name"`
-	Type        string    `json:"type"`
-	ParentID    *string   `json:"parentId,omitempty"`
-	Permission  string    `json:"permission"`
-	IsShared    *bool     `json:"isShared,omitempty"`
-	Snapshot    *Snapshot `json:"snapshot,omitempty"`
-	CreateTime  string    `json:"createTime"`
-	UpdateTime  *string   `json:"updateTime,omitempty"`
+	ID          string  `json:"id"`
+	WorkspaceID string  `json:"workspaceId"`
+	Name        string  `json:"name"`
+	Type        string  `json:"type"`
+	ParentID    *string `json:"parentId,omitempty"`
+	/* The highest built-in role the capabilities amount to */
+	Permission   string    `json:"permission"`
+	Capabilities []string  `json:"capabilities"`
+	IsShared     *bool     `json:"isShared,omitempty"`
+	Snapshot     *Snapshot `json:"snapshot,omitempty"`
+	Size         int64     `json:"size"`
+	FileCount    *int64    `json:"fileCount,omitempty"`
+	FolderCount  *int64    `json:"folderCount,omitempty"`
+	TrashTime    *string   `json:"trashTime,omitempty"`
+	CreateTime   string    `json:"createTime"`
+	UpdateTime   *string   `json:"updateTime,omitempty"`
+	/* Whether the permissions of the parent apply, in addition to the ones granted on the file */
+	InheritsPermissions bool `json:"inheritsPermissions"`
 }
 
 func (svc *FileService) Create(opts FileCreateOptions, userID string) (*File, error) {
@@ -169,9 +188,11 @@ func (svc *FileService) create(opts FileCreateOptions, userID string) (*File, er
 	if err != nil {
 		return nil, err
 	}
-	if err := svc.fileRepo.GrantUserPermission(file.GetID(), userID, model.PermissionOwner); err != nil {
+	_, eventIDs, err := svc.fileRepo.GrantUserPermission(file.GetID(), userID, model.PermissionOwner)
+	if err != nil {
 		return nil, err
 	}
+	svc.outboxSvc.Dispatch(eventIDs...)
 	file, err = svc.fileCache.Refresh(file.GetID())
 	if err != nil {
 		return nil, err
@@ -191,7 +212,7 @@ func (svc *FileService) validateParent(id string, userID string) error {
 	if err != nil {
 		return err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionEditor); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityUpload); err != nil {
 		return err
 	}
 	if file.GetType() != model.FileTypeFolder {
@@ -200,48 +221,119 @@ func (svc *FileService) validateParent(id string, userID string) error {
 	return nil
 }
 
-func (svc *FileService) Store(id string, path string, userID string) (*File, error) {
+/* Describes the version being stored, both are optional */
+type FileStoreOptions struct {
+	Label   *string
+	Comment *string
+}
+
+func (svc *FileService) Store(id string, path string, opts FileStoreOptions, userID string) (*File, error) {
 	file, err := svc.fileRepo.Find(id)
 	if err != nil {
 		return nil, err
 	}
-	workspace, err := svc.workspaceCache.Get(file.GetWorkspaceID())
+	stat, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
-	latestVersion, err := svc.snapshotRepo.GetLatestVersionForFile(id)
+	fileType, err := svc.fileIdent.DetectFromFile(path)
 	if err != nil {
 		return nil, err
 	}
-	snapshotID := helper.NewID()
-	snapshot := repo.NewSnapshot()
-	snapshot.SetID(snapshotID)
-	snapshot.SetVersion(latestVersion + 1)
-	if err = svc.snapshotRepo.Insert(snapshot); err != nil {
+	blob, err := svc.blobSvc.PutFile(path, fileType.MIME)
+	if err != nil {
 		return nil, err
 	}
-	snapshot, err = svc.snapshotCache.Get(snapshotID)
+	original := model.S3Object{
+		Bucket:      blob.GetBucket(),
+		Key:         blob.GetKey(),
+		Size:        helper.ToPtr(stat.Size()),
+		ContentType: fileType.MIME,
+		Extension:   helper.ToPtr(fileType.Extension),
+	}
+	exceedsProcessingLimit := stat.Size() > helper.MegabyteToByte(svc.fileIdent.GetProcessingLimitMB(path, fileType))
+	return svc.storeSnapshot(file, helper.NewID(), original, blob, opts, exceedsProcessingLimit, userID)
+}
+
+/*
+Creates a snapshot for an original that was uploaded to S3 in parts, the
+object is moved to the blob store. The uploaded object is only removed once
+the snapshot is committed, so a failed attempt can be retried.
+*/
+func (svc *FileService) StoreS3Object(id string, snapshotID string, original model.S3Object, opts FileStoreOptions, userID string) (*File, error) {
+	file, err := svc.fileRepo.Find(id)
 	if err != nil {
 		return nil, err
 	}
-	if err = svc.snapshotRepo.MapWithFile(snapshotID, id); err != nil {
+	getOpts := minio.GetObjectOptions{}
+	if err := getOpts.SetRange(0, infra.DetectionHeaderSize-1); err != nil {
 		return nil, err
 	}
-	stat, err := os.Stat(path)
+	header, _, err := svc.s3.GetObject(original.Key, original.Bucket, getOpts)
 	if err != nil {
 		return nil, err
 	}
-	exceedsProcessingLimit := stat.Size() > helper.MegabyteToByte(svc.fileIdent.GetProcessingLimitMB(path))
-	original := model.S3Object{
-		Bucket: workspace.GetBucket(),
-		Key:    snapshotID + "/original" + strings.ToLower(filepath.Ext(path)),
-		Size:   helper.ToPtr(stat.Size()),
+	fileType := svc.fileIdent.Detect(header.Bytes(), original.Key)
+	exceedsProcessingLimit := *original.Size > helper.MegabyteToByte(svc.fileIdent.GetProcessingLimitMB(original.Key, fileType))
+	blob, err := svc.blobSvc.PutS3Object(original)
+	if err != nil {
+		return nil, err
+	}
+	source := original
+	original.Bucket = blob.GetBucket()
+	original.Key = blob.GetKey()
+	original.ContentType = fileType.MIME
+	original.Extension = helper.ToPtr(fileType.Extension)
+	res, err := svc.storeSnapshot(file, snapshotID, original, blob, opts, exceedsProcessingLimit, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := svc.s3.RemoveObject(source.Key, source.Bucket, minio.RemoveObjectOptions{}); err != nil {
+		log.GetLogger().Error(err)
+	}
+	return res, nil
+}
+
+/*
+The snapshot takes the reference to the blob acquired by the caller. If a
+snapshot with the same blob was processed already, its artifacts are reused
+and the snapshot skips the pipeline.
+*/
+func (svc *FileService) storeSnapshot(file model.File, snapshotID string, original model.S3Object, blob model.Blob, opts FileStoreOptions, exceedsProcessingLimit bool, userID string) (*File, error) {
+	latestVersion, err := svc.snapshotRepo.GetLatestVersionForFile(file.GetID())
+	if err != nil {
+		svc.releaseBlob(blob)
+		return nil, err
 	}
-	if err = svc.s3.PutFile(original.Key, path, infra.DetectMimeFromPath(path), workspace.GetBucket(), minio.PutObjectOptions{}); err != nil {
+	snapshot := repo.NewSnapshot()
+	snapshot.SetID(snapshotID)
+	snapshot.SetVersion(latestVersion + 1)
+	snapshot.SetBlobID(helper.ToPtr(blob.GetID()))
+	snapshot.SetUserID(&userID)
+	/* Mapping the snapshot adds the size of its original to the file */
+	snapshot.SetOriginal(&original)
+	if err = svc.snapshotRepo.Insert(snapshot); err != nil {
+		svc.releaseBlob(blob)
+		return nil, err
+	}
+	snapshot, err = svc.snapshotCache.Get(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.snapshotRepo.MapWithFile(snapshotID, file.GetID(), repo.SnapshotMapOptions{
+		Label:   normalizeSnapshotLabel(opts.Label),
+		Comment: normalizeSnapshotComment(opts.Comment),
+	}); err != nil {
 		return nil, err
 	}
 	snapshot.SetOriginal(&original)
-	if exceedsProcessingLimit {
+	var isReused bool
+	if !exceedsProcessingLimit {
+		if isReused, err = svc.blobSvc.reuseArtifacts(snapshot); err != nil {
+			return nil, err
+		}
+	}
+	if exceedsProcessingLimit || isReused {
 		snapshot.SetStatus(model.SnapshotStatusReady)
 	} else {
 		snapshot.SetStatus(model.SnapshotStatusWaiting)
@@ -257,7 +349,7 @@ func (svc *FileService) Store(id string, path string, userID string) (*File, err
 	if err != nil {
 		return nil, err
 	}
-	if !exceedsProcessingLimit {
+	if !exceedsProcessingLimit && !isReused {
 		task, err := svc.taskSvc.insertAndSync(repo.TaskInsertOptions{
 			ID:              helper.NewID(),
 			Name:            "Waiting.",
@@ -274,10 +366,15 @@ func (svc *FileService) Store(id string, path string, userID string) (*File, err
 			return nil, err
 		}
 		if err := svc.pipelineClient.Run(&client.PipelineRunOptions{
-			TaskID:     task.GetID(),
-			SnapshotID: snapshot.GetID(),
-			Bucket:     original.Bucket,
-			Key:        original.Key,
+			TaskID:      task.GetID(),
+			SnapshotID:  snapshot.GetID(),
+			Bucket:      original.Bucket,
+			Key:         original.Key,
+			ContentType: original.ContentType,
+			Extension:   original.GetExtension(),
+			Priority:    client.PipelinePriorityBulk,
+			UserID:      userID,
+			WorkspaceID: file.GetWorkspaceID(),
 		}); err != nil {
 			return nil, err
 		}
@@ -289,95 +386,94 @@ func (svc *FileService) Store(id string, path string, userID string) (*File, err
 	return res, nil
 }
 
-func (svc *FileService) DownloadOriginalBuffer(id string, rangeHeader string, buf *bytes.Buffer, userID string) (*DownloadResult, error) {
-	file, err := svc.fileCache.Get(id)
+/* Only until the snapshot is inserted, from then on the snapshot holds the reference */
+func (svc *FileService) releaseBlob(blob model.Blob) {
+	if err := svc.blobSvc.Release(blob.GetID()); err != nil {
+		log.GetLogger().Error(err)
+	}
+}
+
+/*
+Authorizes the download, the object itself is streamed by the caller. Users
+who can't upload versions get a copy watermarked for them when the file has
+a watermark or the workspace enforces it.
+*/
+func (svc *FileService) DownloadOriginal(id string, userID string, ip string) (*DownloadResult, error) {
+	file, snapshot, err := svc.authorizeDownload(id, userID)
 	if err != nil {
 		return nil, err
 	}
-	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
-		return nil, errorpkg.NewFileIsNotAFileError(file)
+	if !snapshot.HasOriginal() {
+		return nil, errorpkg.NewS3ObjectNotFoundError(nil)
 	}
-	snapshot, err := svc.snapshotCache.Get(*file.GetSnapshotID())
+	object, err := svc.downloadObject(file, snapshot, snapshot.GetOriginal(), "original", userID, ip)
 	if err != nil {
 		return nil, err
 	}
-	if snapshot.HasWatermark() {
-		if err = svc.fileGuard.Authorize(userID, file, model.PermissionEditor); err != nil {
-			return nil, err
-		}
-	} else {
-		if err = svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
-			return nil, err
-		}
+	return &DownloadResult{
+		File:     file,
+		Snapshot: snapshot,
+		Object:   object,
+	}, nil
+}
+
+func (svc *FileService) DownloadPreview(id string, userID string, ip string) (*DownloadResult, error) {
+	file, snapshot, err := svc.authorizeDownload(id, userID)
+	if err != nil {
+		return nil, err
 	}
-	if snapshot.HasOriginal() {
-		objectInfo, err := svc.s3.StatObject(snapshot.GetOriginal().Key, snapshot.GetOriginal().Bucket, minio.StatObjectOptions{})
-		if err != nil {
-			return nil, err
-		}
-		opts := minio.GetObjectOptions{}
-		var ri *infra.RangeInterval
-		if rangeHeader != "" {
-			ri = infra.NewRangeInterval(rangeHeader, objectInfo.Size)
-			ri.ApplyToMinIOGetObjectOptions(&opts)
-		}
-		if _, err := svc.s3.GetObjectWithBuffer(snapshot.GetOriginal().Key, snapshot.GetOriginal().Bucket, buf, opts); err != nil {
-			return nil, err
-		}
-		return &DownloadResult{
-			Buffer:   buf,
-			File:     file,
-			Snapshot: snapshot,
-		}, nil
-	} else {
+	if !snapshot.HasPreview() {
 		return nil, errorpkg.NewS3ObjectNotFoundError(nil)
 	}
+	object, err := svc.downloadObject(file, snapshot, snapshot.GetPreview(), "preview", userID, ip)
+	if err != nil {
+		return nil, err
+	}
+	return &DownloadResult{
+		File:     file,
+		Snapshot: snapshot,
+		Object:   object,
+	}, nil
 }
 
-func (svc *FileService) DownloadPreviewBuffer(id string, rangeHeader string, buf *bytes.Buffer, userID string) (*DownloadResult, error) {
+func (svc *FileService) authorizeDownload(id string, userID string) (model.File, model.Snapshot, error) {
 	file, err := svc.fileCache.Get(id)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
-		return nil, errorpkg.NewFileIsNotAFileError(file)
+		return nil, nil, errorpkg.NewFileIsNotAFileError(file)
 	}
 	snapshot, err := svc.snapshotCache.Get(*file.GetSnapshotID())
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityDownload); err != nil {
+		return nil, nil, err
+	}
+	return file, snapshot, nil
+}
+
+/* Files that can't be watermarked are left to the users who can upload versions */
+func (svc *FileService) downloadObject(file model.File, snapshot model.Snapshot, object *model.S3Object, variant string, userID string, ip string) (*model.S3Object, error) {
+	required, err := svc.dynamicWatermarkSvc.IsRequired(userID, file, snapshot)
 	if err != nil {
 		return nil, err
 	}
-	if snapshot.HasWatermark() {
-		if err = svc.fileGuard.Authorize(userID, file, model.PermissionEditor); err != nil {
-			return nil, err
-		}
-	} else {
-		if err = svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
-			return nil, err
-		}
+	if !required {
+		return object, nil
 	}
-	if snapshot.HasPreview() {
-		objectInfo, err := svc.s3.StatObject(snapshot.GetOriginal().Key, snapshot.GetOriginal().Bucket, minio.StatObjectOptions{})
-		if err != nil {
-			return nil, err
-		}
-		opts := minio.GetObjectOptions{}
-		var ri *infra.RangeInterval
-		if rangeHeader != "" {
-			ri = infra.NewRangeInterval(rangeHeader, objectInfo.Size)
-			ri.ApplyToMinIOGetObjectOptions(&opts)
-		}
-		if _, err := svc.s3.GetObjectWithBuffer(snapshot.GetPreview().Key, snapshot.GetPreview().Bucket, buf, opts); err != nil {
-			return nil, err
-		}
-		return &DownloadResult{
-			RangeInterval: ri,
-			Buffer:        buf,
-			File:          file,
-			Snapshot:      snapshot,
-		}, nil
-	} else {
-		return nil, errorpkg.NewS3ObjectNotFoundError(nil)
+	if !svc.dynamicWatermarkSvc.IsSupported(object) {
+		return nil, svc.fileGuard.Authorize(userID, file, model.CapabilityUpload)
 	}
+	return svc.dynamicWatermarkSvc.Stamp(DynamicWatermarkOptions{
+		File:     file,
+		Snapshot: snapshot,
+		Object:   object,
+		Variant:  variant,
+		UserID:   userID,
+		IP:       ip,
+	})
 }
 
 func (svc *FileService) DownloadThumbnailBuffer(id string, userID string) (*bytes.Buffer, model.File, model.Snapshot, error) {
@@ -410,7 +506,7 @@ func (svc *FileService) Find(ids []string, userID string) ([]*File, error) {
 		if err != nil {
 			continue
 		}
-		if err = svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
+		if err = svc.fileGuard.Authorize(userID, file, model.CapabilityRead); err != nil {
 			return nil, err
 		}
 		f, err := svc.fileMapper.mapOne(file, userID)
@@ -621,7 +717,7 @@ func (svc *FileService) List(id string, opts FileListOptions, userID string) (*F
 	if err != nil {
 		return nil, err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityRead); err != nil {
 		return nil, err
 	}
 	if opts.Page < 1 {
@@ -730,7 +826,7 @@ func (svc *FileService) GetPath(id string, userID string) ([]*File, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityRead); err != nil {
 		return nil, err
 	}
 	path, err := svc.fileRepo.FindPath(id)
@@ -748,50 +844,84 @@ func (svc *FileService) GetPath(id string, userID string) ([]*File, error) {
 	return res, nil
 }
 
-func (svc *FileService) Copy(targetID string, sourceIDs []string, userID string) (copiedFiles []*File, err error) {
-	target, err := svc.fileCache.Get(targetID)
+func (svc *FileService) Copy(targetID string, sourceIDs []string, userID string) ([]*File, error) {
+	if err := svc.checkCopy(targetID, sourceIDs, userID); err != nil {
+		return nil, err
+	}
+	clones, err := svc.copy(targetID, sourceIDs, userID, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := svc.fileMapper.mapMany(clones, userID)
 	if err != nil {
 		return nil, err
 	}
+	return res, nil
+}
 
-	/* Do checks */
+/* Copies in the background, a cancellation rolls back the whole copy */
+func (svc *FileService) CopyAsync(targetID string, sourceIDs []string, userID string) (*Task, error) {
+	if err := svc.checkCopy(targetID, sourceIDs, userID); err != nil {
+		return nil, err
+	}
+	return svc.taskSvc.runOperation(
+		fmt.Sprintf("Copying %s.", svc.describeCount(len(sourceIDs))),
+		TaskOperationCopy,
+		userID,
+		map[string]string{"targetId": targetID},
+		func(progress *taskProgress) error {
+			_, err := svc.copy(targetID, sourceIDs, userID, progress)
+			return err
+		},
+	)
+}
+
+func (svc *FileService) checkCopy(targetID string, sourceIDs []string, userID string) error {
+	target, err := svc.fileCache.Get(targetID)
+	if err != nil {
+		return err
+	}
 	for _, sourceID := range sourceIDs {
 		var source model.File
 		if source, err = svc.fileCache.Get(sourceID); err != nil {
-			return nil, err
+			return err
 		}
-		if err = svc.fileGuard.Authorize(userID, target, model.PermissionEditor); err != nil {
-			return nil, err
+		if err = svc.fileGuard.Authorize(userID, target, model.CapabilityUpload); err != nil {
+			return err
 		}
-		if err = svc.fileGuard.Authorize(userID, source, model.PermissionEditor); err != nil {
-			return nil, err
+		/* The copy would be out of reach of the watermark, so only the users who get the files as is can copy them */
+		if err = svc.fileGuard.Authorize(userID, source, model.CapabilityUpload); err != nil {
+			return err
 		}
 		if source.GetID() == target.GetID() {
-			return nil, errorpkg.NewFileCannotBeCopiedIntoIselfError(source)
+			return errorpkg.NewFileCannotBeCopiedIntoIselfError(source)
 		}
 		if target.GetType() != model.FileTypeFolder {
-			return nil, errorpkg.NewFileIsNotAFolderError(target)
+			return errorpkg.NewFileIsNotAFolderError(target)
 		}
 		if yes, _ := svc.fileRepo.IsGrandChildOf(target.GetID(), source.GetID()); yes {
-			return nil, errorpkg.NewFileCannotBeCopiedIntoOwnSubtreeError(source)
+			return errorpkg.NewFileCannotBeCopiedIntoOwnSubtreeError(source)
 		}
 	}
+	return nil
+}
 
+func (svc *FileService) copy(targetID string, sourceIDs []string, userID string, progress *taskProgress) ([]model.File, error) {
 	/* Do copying */
 	allClones := []model.File{}
+	originalIDs := make(map[string]string)
+	var allPermissions []model.UserPermission
 	for _, sourceID := range sourceIDs {
 		/* Get original tree */
-		var sourceTree []model.File
-		if sourceTree, err = svc.fileRepo.FindTree(sourceID); err != nil {
+		sourceTree, err := svc.fileRepo.FindTree(sourceID)
+		if err != nil {
 			return nil, err
 		}
 
 		/* Clone source tree */
 		var rootCloneIndex int
 		var cloneIDs = make(map[string]string)
-		var originalIDs = make(map[string]string)
 		var clones []model.File
-		var permissions []model.UserPermission
 		for i, o := range sourceTree {
 			c := repo.NewFile()
 			c.SetID(helper.NewID())
@@ -807,14 +937,6 @@ func (svc *FileService) Copy(targetID string, sourceIDs []string, userID string)
 			cloneIDs[o.GetID()] = c.GetID()
 			originalIDs[c.GetID()] = o.GetID()
 			clones = append(clones, c)
-
-			p := repo.NewUserPermission()
-			p.SetID(helper.NewID())
-			p.SetUserID(userID)
-			p.SetResourceID(c.GetID())
-			p.SetPermission(model.PermissionOwner)
-			p.SetCreateTime(time.Now().UTC().Format(time.RFC3339))
-			permissions = append(permissions, p)
 		}
 
 		/* Set parent IDs of clones */
@@ -825,6 +947,15 @@ func (svc *FileService) Copy(targetID string, sourceIDs []string, userID string)
 
 		rootClone := clones[rootCloneIndex]
 
+		/* The rest of the clones inherit it */
+		p := repo.NewUserPermission()
+		p.SetID(helper.NewID())
+		p.SetUserID(userID)
+		p.SetResourceID(rootClone.GetID())
+		p.SetPermission(model.PermissionOwner)
+		p.SetCreateTime(time.Now().UTC().Format(time.RFC3339))
+		allPermissions = append(allPermissions, p)
+
 		/* Parent ID of root clone is target ID */
 		if clones != nil {
 			rootClone.SetParentID(&targetID)
@@ -839,143 +970,115 @@ func (svc *FileService) Copy(targetID string, sourceIDs []string, userID string)
 			rootClone.SetName(fmt.Sprintf("Copy of %s", rootClone.GetName()))
 		}
 
-		/* Persist clones */
-		if err = svc.fileRepo.BulkInsert(clones, 100); err != nil {
-			return nil, err
-		}
-
-		/* Persist permissions */
-		if err = svc.fileRepo.BulkInsertPermissions(permissions, 100); err != nil {
-			return nil, err
-		}
-
-		/* Attach latest snapshot to clones */
-		for _, c := range clones {
-			if err := svc.snapshotRepo.Attach(originalIDs[c.GetID()], c.GetID()); err != nil {
-				return nil, err
-			}
-		}
-
-		/* Index clones for search */
-		if err := svc.fileSearch.Index(clones); err != nil {
-			return nil, err
-		}
-
-		/* Create cache for clones */
-		for _, c := range clones {
-			if _, err := svc.fileCache.Refresh(c.GetID()); err != nil {
-				return nil, err
-			}
-		}
-
 		allClones = append(allClones, clones...)
 	}
 
-	/* Refresh updateTime on target */
-	timeNow := time.Now().UTC().Format(time.RFC3339)
-	target.SetUpdateTime(&timeNow)
-	if err := svc.fileRepo.Save(target); err != nil {
+	/* Persist clones, their permissions and snapshots, and refresh updateTime on target */
+	progress.setTotal(len(allClones))
+	eventIDs, err := svc.fileRepo.Copy(repo.FileCopyOptions{
+		TargetID:    targetID,
+		Clones:      allClones,
+		Permissions: allPermissions,
+		OriginalIDs: originalIDs,
+		OnProgress:  progress.advance,
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	copiedFiles, err = svc.fileMapper.mapMany(allClones, userID)
-	if err != nil {
-		return nil, err
+	/* Index and cache the clones */
+	svc.outboxSvc.Dispatch(eventIDs...)
+
+	return allClones, nil
+}
+
+func (svc *FileService) Move(targetID string, sourceIDs []string, userID string) ([]string, error) {
+	if err := svc.checkMove(targetID, sourceIDs, userID); err != nil {
+		return []string{}, err
 	}
+	return svc.move(targetID, sourceIDs, nil)
+}
 
-	return copiedFiles, nil
+/* Moves in the background, a cancellation rolls back the whole move */
+func (svc *FileService) MoveAsync(targetID string, sourceIDs []string, userID string) (*Task, error) {
+	if err := svc.checkMove(targetID, sourceIDs, userID); err != nil {
+		return nil, err
+	}
+	return svc.taskSvc.runOperation(
+		fmt.Sprintf("Moving %s.", svc.describeCount(len(sourceIDs))),
+		TaskOperationMove,
+		userID,
+		map[string]string{"targetId": targetID},
+		func(progress *taskProgress) error {
+			_, err := svc.move(targetID, sourceIDs, progress)
+			return err
+		},
+	)
 }
 
-func (svc *FileService) Move(targetID string, sourceIDs []string, userID string) (parentIDs []string, err error) {
-	parentIDs = []string{}
+func (svc *FileService) checkMove(targetID string, sourceIDs []string, userID string) error {
 	target, err := svc.fileCache.Get(targetID)
 	if err != nil {
-		return []string{}, err
+		return err
 	}
-
-	/* Do checks */
 	for _, id := range sourceIDs {
 		source, err := svc.fileCache.Get(id)
 		if err != nil {
-			return []string{}, err
+			return err
 		}
 		if source.GetParentID() != nil {
 			existing, err := svc.getChildWithName(targetID, source.GetName())
 			if err != nil {
-				return nil, err
+				return err
 			}
 			if existing != nil {
-				return nil, errorpkg.NewFileWithSimilarNameExistsError()
+				return errorpkg.NewFileWithSimilarNameExistsError()
 			}
 		}
-		if err := svc.fileGuard.Authorize(userID, target, model.PermissionEditor); err != nil {
-			return []string{}, err
+		if err := svc.fileGuard.Authorize(userID, target, model.CapabilityUpload); err != nil {
+			return err
 		}
-		if err := svc.fileGuard.Authorize(userID, source, model.PermissionEditor); err != nil {
-			return []string{}, err
+		if err := svc.fileGuard.Authorize(userID, source, model.CapabilityMove); err != nil {
+			return err
 		}
 		if source.GetParentID() != nil && *source.GetParentID() == target.GetID() {
-			return []string{}, errorpkg.NewFileAlreadyChildOfDestinationError(source, target)
+			return errorpkg.NewFileAlreadyChildOfDestinationError(source, target)
 		}
 		if target.GetID() == source.GetID() {
-			return []string{}, errorpkg.NewFileCannotBeMovedIntoItselfError(source)
+			return errorpkg.NewFileCannotBeMovedIntoItselfError(source)
 		}
 		if target.GetType() != model.FileTypeFolder {
-			return []string{}, errorpkg.NewFileIsNotAFolderError(target)
+			return errorpkg.NewFileIsNotAFolderError(target)
 		}
 		targetIsGrandChildOfSource, _ := svc.fileRepo.IsGrandChildOf(target.GetID(), source.GetID())
 		if targetIsGrandChildOfSource {
-			return []string{}, errorpkg.NewTargetIsGrandChildOfSourceError(source)
+			return errorpkg.NewTargetIsGrandChildOfSourceError(source)
 		}
 	}
+	return nil
+}
 
+func (svc *FileService) move(targetID string, sourceIDs []string, progress *taskProgress) ([]string, error) {
+	parentIDs := []string{}
 	/* Do moving */
 	for _, id := range sourceIDs {
-		source, _ := svc.fileCache.Get(id)
-
-		/* Add old parent */
-		parentIDs = append(parentIDs, *source.GetParentID())
-
-		/* Move source into target */
-		if err := svc.fileRepo.MoveSourceIntoTarget(target.GetID(), source.GetID()); err != nil {
-			return []string{}, err
-		}
-
-		/* Get updated source */
-		source, err = svc.fileRepo.Find(source.GetID())
+		source, err := svc.fileCache.Get(id)
 		if err != nil {
 			return []string{}, err
 		}
 
-		// Add new parent
-		parentIDs = append(parentIDs, *source.GetParentID())
-
-		/* Refresh updateTime on source and target */
-		timeNow := time.Now().UTC().Format(time.RFC3339)
-		source.SetUpdateTime(&timeNow)
-		if err := svc.fileRepo.Save(source); err != nil {
-			return []string{}, err
-		}
-		if err := svc.sync(source); err != nil {
-			return []string{}, err
-		}
-		target.SetUpdateTime(&timeNow)
-		if err := svc.fileRepo.Save(target); err != nil {
-			return []string{}, err
-		}
-		if err := svc.sync(target); err != nil {
-			return []string{}, err
-		}
-		sourceTree, err := svc.fileRepo.FindTree(source.GetID())
-		if err != nil {
-			return []string{}, err
-		}
-		for _, f := range sourceTree {
-			if err := svc.sync(f); err != nil {
-				return []string{}, err
-			}
-		}
+		/* Add old and new parent */
+		parentIDs = append(parentIDs, *source.GetParentID(), targetID)
 	}
+	progress.setTotal(len(sourceIDs))
+	eventIDs, err := svc.fileRepo.Move(targetID, sourceIDs, progress.advance)
+	if err != nil {
+		return []string{}, err
+	}
+
+	/* Sync the moved trees and the target */
+	svc.outboxSvc.Dispatch(eventIDs...)
+
 	return parentIDs, nil
 }
 
@@ -993,7 +1096,7 @@ func (svc *FileService) PatchName(id string, name string, userID string) (*File,
 			return nil, errorpkg.NewFileWithSimilarNameExistsError()
 		}
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionEditor); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityRename); err != nil {
 		return nil, err
 	}
 	file.SetName(name)
@@ -1010,97 +1113,90 @@ func (svc *FileService) PatchName(id string, name string, userID string) (*File,
 	return res, nil
 }
 
+/* Moves the files to the trash, they are purged later by TrashService */
 func (svc *FileService) Delete(ids []string, userID string) ([]string, error) {
-	var res []string
+	if err := svc.checkDelete(ids, userID); err != nil {
+		return nil, err
+	}
+	return svc.delete(ids, nil)
+}
+
+/* Deletes in the background, a cancellation leaves the files already trashed in the trash */
+func (svc *FileService) DeleteAsync(ids []string, userID string) (*Task, error) {
+	if err := svc.checkDelete(ids, userID); err != nil {
+		return nil, err
+	}
+	return svc.taskSvc.runOperation(
+		fmt.Sprintf("Deleting %s.", svc.describeCount(len(ids))),
+		TaskOperationDelete,
+		userID,
+		nil,
+		func(progress *taskProgress) error {
+			_, err := svc.delete(ids, progress)
+			return err
+		},
+	)
+}
+
+func (svc *FileService) checkDelete(ids []string, userID string) error {
 	for _, id := range ids {
 		file, err := svc.fileCache.Get(id)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if file.GetParentID() == nil {
 			workspace, err := svc.workspaceCache.Get(file.GetWorkspaceID())
 			if err != nil {
-				return []string{}, err
+				return err
 			}
-			return nil, errorpkg.NewCannotDeleteWorkspaceRootError(file, workspace)
+			return errorpkg.NewCannotDeleteWorkspaceRootError(file, workspace)
+		}
+		if err = svc.fileGuard.Authorize(userID, file, model.CapabilityDelete); err != nil {
+			return err
 		}
-		if err = svc.fileGuard.Authorize(userID, file, model.PermissionOwner); err != nil {
+	}
+	return nil
+}
+
+func (svc *FileService) delete(ids []string, progress *taskProgress) ([]string, error) {
+	var res []string
+	progress.setTotal(len(ids))
+	for _, id := range ids {
+		file, err := svc.fileCache.Get(id)
+		if err != nil {
 			return nil, err
 		}
 
 		// Add parent
 		res = append(res, *file.GetParentID())
 
-		var tree []model.File
-		tree, err = svc.fileRepo.FindTree(file.GetID())
-		if err != nil {
-			return nil, err
-		}
-		var treeIDs []string
-		for _, f := range tree {
-			treeIDs = append(treeIDs, f.GetID())
-		}
-		/* Delete from search */
-		if err := svc.fileSearch.Delete(treeIDs); err != nil {
-			/* Here we intentionally don't return an error or panic, we just print the error,
-			that's because we still want to delete the file in the repo afterwards even
-			if we fail to delete it from the search. */
-			fmt.Println(err)
-		}
-		/* Delete from cache */
-		for _, f := range tree {
-			if err = svc.fileCache.Delete(f.GetID()); err != nil {
-				// Same thing as above for the search
-				fmt.Println(err)
-			}
-		}
-		/* Delete from repo */
-		for _, f := range tree {
-			if err = svc.fileRepo.Delete(f.GetID()); err != nil {
-				return nil, err
-			}
-			if err = svc.snapshotRepo.DeleteMappingsForFile(f.GetID()); err != nil {
-				return nil, err
-			}
-		}
-		var danglingSnapshots []model.Snapshot
-		danglingSnapshots, err = svc.snapshotRepo.FindAllDangling()
+		eventIDs, err := svc.fileRepo.Trash(file.GetID())
 		if err != nil {
 			return nil, err
 		}
-		for _, s := range danglingSnapshots {
-			if s.HasOriginal() {
-				if err = svc.s3.RemoveObject(s.GetOriginal().Key, s.GetOriginal().Bucket, minio.RemoveObjectOptions{}); err != nil {
-					return nil, err
-				}
-			}
-			if s.HasPreview() {
-				if err = svc.s3.RemoveObject(s.GetPreview().Key, s.GetPreview().Bucket, minio.RemoveObjectOptions{}); err != nil {
-					return nil, err
-				}
-			}
-			if s.HasText() {
-				if err = svc.s3.RemoveObject(s.GetText().Key, s.GetText().Bucket, minio.RemoveObjectOptions{}); err != nil {
-					return nil, err
-				}
-			}
-			if err := svc.snapshotCache.Delete(s.GetID()); err != nil {
-				return nil, err
-			}
-		}
-		if err = svc.snapshotRepo.DeleteAllDangling(); err != nil {
+		/* Remove the trashed tree from search and cache, even if a later one fails */
+		svc.outboxSvc.Dispatch(eventIDs...)
+		if err = progress.advance(1); err != nil {
 			return nil, err
 		}
 	}
 	return res, nil
 }
 
+/* E.g. '1 item' or '3 items' */
+func (svc *FileService) describeCount(count int) string {
+	if count == 1 {
+		return "1 item"
+	}
+	return fmt.Sprintf("%d items", count)
+}
+
 func (svc *FileService) GetSize(id string, userID string) (*int64, error) {
 	file, err := svc.fileCache.Get(id)
 	if err != nil {
 		return nil, err
 	}
-	if err := svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
+	if err := svc.fileGuard.Authorize(userID, file, model.CapabilityRead); err != nil {
 		return nil, err
 	}
 	res, err := svc.fileRepo.GetSize(id)
@@ -1115,7 +1211,7 @@ func (svc *FileService) GetCount(id string, userID string) (*int64, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
+	if err := svc.fileGuard.Authorize(userID, file, model.CapabilityRead); err != nil {
 		return nil, err
 	}
 	res, err := svc.fileRepo.GetItemCount(id)
@@ -1131,13 +1227,17 @@ func (svc *FileService) GrantUserPermission(ids []string, assigneeID string, per
 		if err != nil {
 			return err
 		}
-		if err = svc.fileGuard.Authorize(userID, file, model.PermissionOwner); err != nil {
+		if err = svc.fileGuard.Authorize(userID, file, model.CapabilityShare); err != nil {
 			return err
 		}
 		if _, err := svc.userRepo.Find(assigneeID); err != nil {
 			return err
 		}
-		if err = svc.fileRepo.GrantUserPermission(id, assigneeID, permission); err != nil {
+		if err = svc.validatePermission(file, model.FilePermission{UserID: &assigneeID, Value: permission}, userID); err != nil {
+			return err
+		}
+		changedIDs, eventIDs, err := svc.fileRepo.GrantUserPermission(id, assigneeID, permission)
+		if err != nil {
 			return err
 		}
 		if _, err := svc.fileCache.Refresh(file.GetID()); err != nil {
@@ -1159,15 +1259,162 @@ func (svc *FileService) GrantUserPermission(ids []string, assigneeID string, per
 				return err
 			}
 		}
-		tree, err := svc.fileRepo.FindTree(id)
+		if err := svc.afterPermissionChange(file, changedIDs, eventIDs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Loads what validatePermissionChange needs. The change is a grant of the value
+of the permission to its user or group, or a revocation when it has no value.
+*/
+func (svc *FileService) validatePermission(file model.File, change model.FilePermission, userID string) error {
+	var granted []string
+	if change.Value != "" {
+		var err error
+		if granted, err = svc.getRoleCapabilities(change.Value, file); err != nil {
+			return err
+		}
+	}
+	var held []string
+	if change.UserID != nil {
+		held = svc.fileGuard.GetCapabilities(*change.UserID, file)
+	} else {
+		held = svc.fileGuard.GetGroupCapabilities(*change.GroupID, file)
+	}
+	return validatePermissionChange(permissionChange{
+		File:        file,
+		UserID:      userID,
+		Change:      change,
+		Granted:     granted,
+		Held:        held,
+		Own:         svc.fileGuard.GetCapabilities(userID, file),
+		Permissions: svc.fileGuard.GetPermissions(file),
+	})
+}
+
+/* The permission is either a built-in role or a custom role of the workspace's organization */
+func (svc *FileService) getRoleCapabilities(permission string, file model.File) ([]string, error) {
+	if model.IsBuiltinRole(permission) {
+		return model.GetBuiltinCapabilities(permission), nil
+	}
+	role, err := svc.roleCache.Get(permission)
+	if err != nil {
+		return nil, err
+	}
+	workspace, err := svc.workspaceCache.Get(file.GetWorkspaceID())
+	if err != nil {
+		return nil, err
+	}
+	if role.GetOrganizationID() != workspace.GetOrganizationID() {
+		return nil, errorpkg.NewInvalidPermissionError(permission)
+	}
+	return role.GetCapabilities(), nil
+}
+
+type permissionChange struct {
+	File   model.File
+	UserID string
+	Change model.FilePermission
+	/* The capabilities of the role granted, none when revoking */
+	Granted []string
+	/* The capabilities the user or group of the change holds on the file */
+	Held []string
+	/* The capabilities of the user making the change */
+	Own []string
+	/* The permissions that apply to the file */
+	Permissions []*model.FilePermission
+}
+
+/*
+Users can't grant permissions to themselves, nor grant more than they can do on
+the file, nor change the permissions of users or groups that can do more than
+them. The last owner of the file can't be revoked nor demoted.
+*/
+func validatePermissionChange(c permissionChange) error {
+	if c.Change.Value != "" && c.Change.UserID != nil && *c.Change.UserID == c.UserID {
+		return errorpkg.NewCannotGrantPermissionToSelfError()
+	}
+	for _, capability := range c.Granted {
+		if !slices.Contains(c.Own, capability) {
+			return errorpkg.NewPermissionExceedsOwnError(c.UserID, c.File, c.Change.Value)
+		}
+	}
+	for _, capability := range c.Held {
+		if !slices.Contains(c.Own, capability) {
+			return errorpkg.NewAssigneeExceedsOwnPermissionError(c.UserID, c.File)
+		}
+	}
+	if c.Change.Value == model.PermissionOwner {
+		return nil
+	}
+	isOwner, hasOtherOwner := false, false
+	for _, p := range c.Permissions {
+		if p.Value != model.PermissionOwner {
+			continue
+		}
+		if isSamePrincipal(p, &c.Change) {
+			isOwner = true
+		} else {
+			hasOtherOwner = true
+		}
+	}
+	if isOwner && !hasOtherOwner {
+		return errorpkg.NewCannotRemoveLastRemainingOwnerOfFileError(c.File)
+	}
+	return nil
+}
+
+func isSamePrincipal(a *model.FilePermission, b *model.FilePermission) bool {
+	if a.UserID != nil && b.UserID != nil {
+		return *a.UserID == *b.UserID
+	}
+	if a.GroupID != nil && b.GroupID != nil {
+		return *a.GroupID == *b.GroupID
+	}
+	return false
+}
+
+/*
+The descendants inherit the change, the cache of their resolved permissions has
+to go. It's resolved again from the cached files, so the files below that lost
+their own grant are cached again first, instead of waiting for their events.
+*/
+func (svc *FileService) afterPermissionChange(file model.File, changedIDs []string, eventIDs []string) error {
+	if err := svc.outboxSvc.SyncCache(changedIDs); err != nil {
+		return err
+	}
+	/* Done with the events as well, rather than leaving them to the job */
+	svc.outboxSvc.Dispatch(eventIDs...)
+	if _, err := svc.fileCache.Refresh(file.GetID()); err != nil {
+		return err
+	}
+	if err := svc.filePermissionCache.Invalidate(file.GetWorkspaceID()); err != nil {
+		return err
+	}
+	return nil
+}
+
+/* Caches every file again along with its grants, after they were changed in the database */
+func (svc *FileService) SyncCache() error {
+	workspaceIDs, err := svc.workspaceRepo.GetIDs()
+	if err != nil {
+		return err
+	}
+	for _, workspaceID := range workspaceIDs {
+		ids, err := svc.fileRepo.GetIDsByWorkspace(workspaceID)
 		if err != nil {
 			return err
 		}
-		for _, f := range tree {
-			if err := svc.sync(f); err != nil {
-				return err
-			}
+		if err := svc.outboxSvc.SyncCache(ids); err != nil {
+			return err
 		}
+		if err := svc.filePermissionCache.Invalidate(workspaceID); err != nil {
+			return err
+		}
+		log.GetLogger().Infow("synced file cache", "workspace", workspaceID, "count", len(ids))
 	}
 	return nil
 }
@@ -1178,27 +1425,22 @@ func (svc *FileService) RevokeUserPermission(ids []string, assigneeID string, us
 		if err != nil {
 			return err
 		}
-		if err := svc.fileGuard.Authorize(userID, file, model.PermissionOwner); err != nil {
+		if err := svc.fileGuard.Authorize(userID, file, model.CapabilityShare); err != nil {
 			return err
 		}
 		if _, err := svc.userRepo.Find(assigneeID); err != nil {
 			return err
 		}
-		tree, err := svc.fileRepo.FindTree(id)
-		if err != nil {
+		if err := svc.validatePermission(file, model.FilePermission{UserID: &assigneeID}, userID); err != nil {
 			return err
 		}
-		if err := svc.fileRepo.RevokeUserPermission(tree, assigneeID); err != nil {
+		changedIDs, eventIDs, err := svc.fileRepo.RevokeUserPermission(id, assigneeID)
+		if err != nil {
 			return err
 		}
-		if _, err := svc.fileCache.Refresh(file.GetID()); err != nil {
+		if err := svc.afterPermissionChange(file, changedIDs, eventIDs); err != nil {
 			return err
 		}
-		for _, f := range tree {
-			if _, err := svc.fileCache.Refresh(f.GetID()); err != nil {
-				return err
-			}
-		}
 	}
 	return nil
 }
@@ -1209,7 +1451,7 @@ func (svc *FileService) GrantGroupPermission(ids []string, groupID string, permi
 		if err != nil {
 			return err
 		}
-		if err = svc.fileGuard.Authorize(userID, file, model.PermissionOwner); err != nil {
+		if err = svc.fileGuard.Authorize(userID, file, model.CapabilityShare); err != nil {
 			return err
 		}
 		group, err := svc.groupCache.Get(groupID)
@@ -1219,7 +1461,11 @@ func (svc *FileService) GrantGroupPermission(ids []string, groupID string, permi
 		if err := svc.groupGuard.Authorize(userID, group, model.PermissionViewer); err != nil {
 			return err
 		}
-		if err = svc.fileRepo.GrantGroupPermission(id, groupID, permission); err != nil {
+		if err = svc.validatePermission(file, model.FilePermission{GroupID: &groupID, Value: permission}, userID); err != nil {
+			return err
+		}
+		changedIDs, eventIDs, err := svc.fileRepo.GrantGroupPermission(id, groupID, permission)
+		if err != nil {
 			return err
 		}
 		if _, err := svc.fileCache.Refresh(file.GetID()); err != nil {
@@ -1241,15 +1487,9 @@ func (svc *FileService) GrantGroupPermission(ids []string, groupID string, permi
 				return err
 			}
 		}
-		tree, err := svc.fileRepo.FindTree(id)
-		if err != nil {
+		if err := svc.afterPermissionChange(file, changedIDs, eventIDs); err != nil {
 			return err
 		}
-		for _, f := range tree {
-			if err := svc.sync(f); err != nil {
-				return err
-			}
-		}
 	}
 	return nil
 }
@@ -1260,7 +1500,7 @@ func (svc *FileService) RevokeGroupPermission(ids []string, groupID string, user
 		if err != nil {
 			return err
 		}
-		if err := svc.fileGuard.Authorize(userID, file, model.PermissionOwner); err != nil {
+		if err := svc.fileGuard.Authorize(userID, file, model.CapabilityShare); err != nil {
 			return err
 		}
 		group, err := svc.groupCache.Get(groupID)
@@ -1270,21 +1510,16 @@ func (svc *FileService) RevokeGroupPermission(ids []string, groupID string, user
 		if err := svc.groupGuard.Authorize(userID, group, model.PermissionViewer); err != nil {
 			return err
 		}
-		tree, err := svc.fileRepo.FindTree(id)
-		if err != nil {
+		if err := svc.validatePermission(file, model.FilePermission{GroupID: &groupID}, userID); err != nil {
 			return err
 		}
-		if err := svc.fileRepo.RevokeGroupPermission(tree, groupID); err != nil {
+		changedIDs, eventIDs, err := svc.fileRepo.RevokeGroupPermission(id, groupID)
+		if err != nil {
 			return err
 		}
-		if _, err := svc.fileCache.Refresh(file.GetID()); err != nil {
+		if err := svc.afterPermissionChange(file, changedIDs, eventIDs); err != nil {
 			return err
 		}
-		for _, f := range tree {
-			if _, err := svc.fileCache.Refresh(f.GetID()); err != nil {
-				return err
-			}
-		}
 	}
 	return nil
 }
@@ -1293,6 +1528,9 @@ type UserPermission struct {
 	ID         string `json:"id"`
 	User       *User  `json:"user"`
 	Permission string `json:"permission"`
+	/* Inherited permissions are granted on SourceID, one of the ancestors */
+	IsInherited bool   `json:"isInherited"`
+	SourceID    string `json:"sourceId"`
 }
 
 func (svc *FileService) GetUserPermissions(id string, userID string) ([]*UserPermission, error) {
@@ -1300,35 +1538,47 @@ func (svc *FileService) GetUserPermissions(id string, userID string) ([]*UserPer
 	if err != nil {
 		return nil, err
 	}
-	if err := svc.fileGuard.Authorize(userID, file, model.PermissionOwner); err != nil {
-		return nil, err
-	}
-	permissions, err := svc.permissionRepo.GetUserPermissions(id)
-	if err != nil {
+	if err := svc.fileGuard.Authorize(userID, file, model.CapabilityShare); err != nil {
 		return nil, err
 	}
+	grants := make(map[string][]model.UserPermission)
 	res := make([]*UserPermission, 0)
-	for _, p := range permissions {
-		if p.GetUserID() == userID {
+	for _, p := range svc.fileGuard.GetPermissions(file) {
+		if p.UserID == nil || *p.UserID == userID {
 			continue
 		}
-		u, err := svc.userRepo.Find(p.GetUserID())
+		if _, ok := grants[p.SourceID]; !ok {
+			if grants[p.SourceID], err = svc.permissionRepo.GetUserPermissions(p.SourceID); err != nil {
+				return nil, err
+			}
+		}
+		var grantID string
+		for _, g := range grants[p.SourceID] {
+			if g.GetUserID() == *p.UserID {
+				grantID = g.GetID()
+			}
+		}
+		u, err := svc.userRepo.Find(*p.UserID)
 		if err != nil {
 			return nil, err
 		}
 		res = append(res, &UserPermission{
-			ID:         p.GetID(),
-			User:       svc.userMapper.mapOne(u),
-			Permission: p.GetPermission(),
+			ID:          grantID,
+			User:        svc.userMapper.mapOne(u),
+			Permission:  p.Value,
+			IsInherited: p.IsInherited,
+			SourceID:    p.SourceID,
 		})
 	}
 	return res, nil
 }
 
 type GroupPermission struct {
-	ID         string `json:"id"`
-	Group      *Group `json:"group"`
-	Permission string `json:"permission"`
+	ID          string `json:"id"`
+	Group       *Group `json:"group"`
+	Permission  string `json:"permission"`
+	IsInherited bool   `json:"isInherited"`
+	SourceID    string `json:"sourceId"`
 }
 
 func (svc *FileService) GetGroupPermissions(id string, userID string) ([]*GroupPermission, error) {
@@ -1336,16 +1586,27 @@ func (svc *FileService) GetGroupPermissions(id string, userID string) ([]*GroupP
 	if err != nil {
 		return nil, err
 	}
-	if err := svc.fileGuard.Authorize(userID, file, model.PermissionOwner); err != nil {
-		return nil, err
-	}
-	permissions, err := svc.permissionRepo.GetGroupPermissions(id)
-	if err != nil {
+	if err := svc.fileGuard.Authorize(userID, file, model.CapabilityShare); err != nil {
 		return nil, err
 	}
+	grants := make(map[string][]model.GroupPermission)
 	res := make([]*GroupPermission, 0)
-	for _, p := range permissions {
-		m, err := svc.groupCache.Get(p.GetGroupID())
+	for _, p := range svc.fileGuard.GetPermissions(file) {
+		if p.GroupID == nil {
+			continue
+		}
+		if _, ok := grants[p.SourceID]; !ok {
+			if grants[p.SourceID], err = svc.permissionRepo.GetGroupPermissions(p.SourceID); err != nil {
+				return nil, err
+			}
+		}
+		var grantID string
+		for _, g := range grants[p.SourceID] {
+			if g.GetGroupID() == *p.GroupID {
+				grantID = g.GetID()
+			}
+		}
+		m, err := svc.groupCache.Get(*p.GroupID)
 		if err != nil {
 			return nil, err
 		}
@@ -1354,18 +1615,61 @@ func (svc *FileService) GetGroupPermissions(id string, userID string) ([]*GroupP
 			return nil, err
 		}
 		res = append(res, &GroupPermission{
-			ID:         p.GetID(),
-			Group:      g,
-			Permission: p.GetPermission(),
+			ID:          grantID,
+			Group:       g,
+			Permission:  p.Value,
+			IsInherited: p.IsInherited,
+			SourceID:    p.SourceID,
 		})
 	}
 	return res, nil
 }
 
+/*
+Breaking the inheritance grants the inherited permissions on the file, so they
+can be revoked one by one. Restoring it keeps the ones granted on the file.
+*/
+func (svc *FileService) PatchPermissionInheritance(id string, inherit bool, userID string) (*File, error) {
+	file, err := svc.fileCache.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityShare); err != nil {
+		return nil, err
+	}
+	if file.InheritsPermissions() != inherit {
+		if inherit {
+			err = svc.fileRepo.RestorePermissionInheritance(id)
+		} else {
+			var inherited []*model.FilePermission
+			for _, p := range svc.fileGuard.GetPermissions(file) {
+				if p.IsInherited {
+					inherited = append(inherited, p)
+				}
+			}
+			err = svc.fileRepo.BreakPermissionInheritance(id, inherited)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = svc.afterPermissionChange(file, nil, nil); err != nil {
+			return nil, err
+		}
+	}
+	if file, err = svc.fileCache.Get(id); err != nil {
+		return nil, err
+	}
+	res, err := svc.fileMapper.mapOne(file, userID)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 func (svc *FileService) doAuthorization(data []model.File, userID string) ([]model.File, error) {
 	var res []model.File
 	for _, f := range data {
-		if svc.fileGuard.IsAuthorized(userID, f, model.PermissionViewer) {
+		if svc.fileGuard.IsAuthorized(userID, f, model.CapabilityRead) {
 			res = append(res, f)
 		}
 	}
@@ -1380,7 +1684,7 @@ func (svc *FileService) doAuthorizationByIDs(ids []string, userID string) ([]mod
 		if err != nil {
 			return nil, err
 		}
-		if svc.fileGuard.IsAuthorized(userID, f, model.PermissionViewer) {
+		if svc.fileGuard.IsAuthorized(userID, f, model.CapabilityRead) {
 			res = append(res, f)
 		}
 	}
@@ -1721,7 +2025,7 @@ func (svc *FileService) sync(file model.File) error {
 }
 
 type FileMapper struct {
-	groupCache     *cache.GroupCache
+	fileGuard      *guard.FileGuard
 	snapshotMapper *SnapshotMapper
 	snapshotCache  *cache.SnapshotCache
 	snapshotRepo   repo.SnapshotRepo
@@ -1730,7 +2034,7 @@ type FileMapper struct {
 
 func NewFileMapper() *FileMapper {
 	return &FileMapper{
-		groupCache:     cache.NewGroupCache(),
+		fileGuard:      guard.NewFileGuard(),
 		snapshotMapper: NewSnapshotMapper(),
 		snapshotCache:  cache.NewSnapshotCache(),
 		snapshotRepo:   repo.NewSnapshotRepo(),
@@ -1745,9 +2049,15 @@ func (mp *FileMapper) mapOne(m model.File, userID string) (*File, error) {
 		Name:        m.GetName(),
 		Type:        m.GetType(),
 		ParentID:    m.GetParentID(),
+		Size:        m.GetSize(),
+		TrashTime:   m.GetTrashTime(),
 		CreateTime:  m.GetCreateTime(),
 		UpdateTime:  m.GetUpdateTime(),
 	}
+	if m.GetType() == model.FileTypeFolder {
+		res.FileCount = helper.ToPtr(m.GetFileCount())
+		res.FolderCount = helper.ToPtr(m.GetFolderCount())
+	}
 	if m.GetSnapshotID() != nil {
 		snapshot, err := mp.snapshotCache.Get(*m.GetSnapshotID())
 		if err != nil {
@@ -1756,31 +2066,16 @@ func (mp *FileMapper) mapOne(m model.File, userID string) (*File, error) {
 		res.Snapshot = mp.snapshotMapper.mapOne(snapshot)
 		res.Snapshot.IsActive = true
 	}
-	res.Permission = ""
-	for _, p := range m.GetUserPermissions() {
-		if p.GetUserID() == userID && model.GetPermissionWeight(p.GetValue()) > model.GetPermissionWeight(res.Permission) {
-			res.Permission = p.GetValue()
-		}
-	}
-	for _, p := range m.GetGroupPermissions() {
-		g, err := mp.groupCache.Get(p.GetGroupID())
-		if err != nil {
-			return nil, err
-		}
-		for _, u := range g.GetUsers() {
-			if u == userID && model.GetPermissionWeight(p.GetValue()) > model.GetPermissionWeight(res.Permission) {
-				res.Permission = p.GetValue()
+	res.InheritsPermissions = m.InheritsPermissions()
+	res.Capabilities = mp.fileGuard.GetCapabilities(userID, m)
+	res.Permission = model.GetPermissionForCapabilities(res.Capabilities)
+	if slices.Contains(res.Capabilities, model.CapabilityShare) {
+		shareCount := 0
+		for _, p := range mp.fileGuard.GetPermissions(m) {
+			if p.UserID == nil || *p.UserID != userID {
+				shareCount++
 			}
 		}
-	}
-	shareCount := 0
-	for _, p := range m.GetUserPermissions() {
-		if p.GetUserID() != userID {
-			shareCount++
-		}
-	}
-	if res.Permission == model.PermissionOwner {
-		shareCount += len(m.GetGroupPermissions())
 		res.IsShared = new(bool)
 		if shareCount > 0 {
 			*res.IsShared = true
@@ -0,0 +1,152 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"errors"
+	"testing"
+	"voltaserve/errorpkg"
+	"voltaserve/helper"
+	"voltaserve/model"
+	"voltaserve/repo"
+)
+
+func TestValidatePermissionChange(t *testing.T) {
+	file := repo.NewFile()
+	file.SetID("file")
+	file.SetName("file")
+	viewer := model.GetBuiltinCapabilities(model.PermissionViewer)
+	editor := model.GetBuiltinCapabilities(model.PermissionEditor)
+	owner := model.GetBuiltinCapabilities(model.PermissionOwner)
+	userPermission := func(userID string, value string) *model.FilePermission {
+		return &model.FilePermission{UserID: helper.ToPtr(userID), Value: value}
+	}
+	groupPermission := func(groupID string, value string) *model.FilePermission {
+		return &model.FilePermission{GroupID: helper.ToPtr(groupID), Value: value}
+	}
+	for _, tc := range []struct {
+		name     string
+		change   model.FilePermission
+		granted  []string
+		held     []string
+		own      []string
+		existing []*model.FilePermission
+		code     string
+	}{
+		{
+			name:     "owner grants editor",
+			change:   *userPermission("bob", model.PermissionEditor),
+			granted:  editor,
+			own:      owner,
+			existing: []*model.FilePermission{userPermission("alice", model.PermissionOwner)},
+		},
+		{
+			name:     "editor grants viewer",
+			change:   *userPermission("bob", model.PermissionViewer),
+			granted:  viewer,
+			own:      editor,
+			existing: []*model.FilePermission{userPermission("carol", model.PermissionOwner)},
+		},
+		{
+			name:     "editor grants owner",
+			change:   *userPermission("bob", model.PermissionOwner),
+			granted:  owner,
+			own:      editor,
+			existing: []*model.FilePermission{userPermission("carol", model.PermissionOwner)},
+			code:     "permission_exceeds_own",
+		},
+		{
+			name:     "editor demotes an owner",
+			change:   *userPermission("bob", model.PermissionViewer),
+			granted:  viewer,
+			held:     owner,
+			own:      editor,
+			existing: []*model.FilePermission{userPermission("bob", model.PermissionOwner)},
+			code:     "assignee_exceeds_own_permission",
+		},
+		{
+			name:     "editor revokes an owner group",
+			change:   *groupPermission("team", ""),
+			held:     owner,
+			own:      editor,
+			existing: []*model.FilePermission{groupPermission("team", model.PermissionOwner)},
+			code:     "assignee_exceeds_own_permission",
+		},
+		{
+			name:     "editor revokes a viewer",
+			change:   *userPermission("bob", ""),
+			held:     viewer,
+			own:      editor,
+			existing: []*model.FilePermission{userPermission("carol", model.PermissionOwner)},
+		},
+		{
+			name:    "owner grants to self",
+			change:  *userPermission("alice", model.PermissionViewer),
+			granted: viewer,
+			own:     owner,
+			code:    "cannot_grant_permission_to_self",
+		},
+		{
+			name:     "owner revokes self with another owner",
+			change:   *userPermission("alice", ""),
+			held:     owner,
+			own:      owner,
+			existing: []*model.FilePermission{userPermission("alice", model.PermissionOwner), groupPermission("team", model.PermissionOwner)},
+		},
+		{
+			name:     "owner revokes the last owner",
+			change:   *userPermission("bob", ""),
+			held:     owner,
+			own:      owner,
+			existing: []*model.FilePermission{userPermission("bob", model.PermissionOwner)},
+			code:     "cannot_remove_last_owner_of_file",
+		},
+		{
+			name:     "owner demotes the last owner",
+			change:   *groupPermission("team", model.PermissionEditor),
+			granted:  editor,
+			held:     owner,
+			own:      owner,
+			existing: []*model.FilePermission{groupPermission("team", model.PermissionOwner), userPermission("bob", model.PermissionEditor)},
+			code:     "cannot_remove_last_owner_of_file",
+		},
+		{
+			name:     "owner grants owner to the last owner",
+			change:   *userPermission("bob", model.PermissionOwner),
+			granted:  owner,
+			held:     owner,
+			own:      owner,
+			existing: []*model.FilePermission{userPermission("bob", model.PermissionOwner)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validatePermissionChange(permissionChange{
+				File:        file,
+				UserID:      "alice",
+				Change:      tc.change,
+				Granted:     tc.granted,
+				Held:        tc.held,
+				Own:         tc.own,
+				Permissions: tc.existing,
+			})
+			if tc.code == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			var errorResponse *errorpkg.ErrorResponse
+			if !errors.As(err, &errorResponse) || errorResponse.Code != tc.code {
+				t.Fatalf("expected %s, got %v", tc.code, err)
+			}
+		})
+	}
+}
@@ -30,17 +30,18 @@ import (
 )
 
 type InsightsService struct {
-	languages      []*InsightsLanguage
-	snapshotCache  *cache.SnapshotCache
-	snapshotRepo   repo.SnapshotRepo
-	snapshotSvc    *SnapshotService
-	fileCache      *cache.FileCache
-	fileGuard      *guard.FileGuard
-	taskSvc        *TaskService
-	s3             *infra.S3Manager
-	languageClient *client.LanguageClient
-	pipelineClient *client.PipelineClient
-	fileIdent      *infra.FileIdentifier
+	languages           []*InsightsLanguage
+	snapshotCache       *cache.SnapshotCache
+	snapshotRepo        repo.SnapshotRepo
+	snapshotSvc         *SnapshotService
+	fileCache           *cache.FileCache
+	fileGuard           *guard.FileGuard
+	taskSvc             *TaskService
+	dynamicWatermarkSvc *DynamicWatermarkService
+	s3                  *infra.S3Manager
+	languageClient      *client.LanguageClient
+	pipelineClient      *client.PipelineClient
+	fileIdent           *infra.FileIdentifier
 }
 
 func NewInsightsService() *InsightsService {
@@ -61,16 +62,17 @@ func NewInsightsService() *InsightsService {
 			{ID: "spa", ISO6393: "spa", Name: "Spanish"},
 			{ID: "swe", ISO6393: "swe", Name: "Swedish"},
 		},
-		snapshotCache:  cache.NewSnapshotCache(),
-		snapshotRepo:   repo.NewSnapshotRepo(),
-		snapshotSvc:    NewSnapshotService(),
-		fileCache:      cache.NewFileCache(),
-		fileGuard:      guard.NewFileGuard(),
-		taskSvc:        NewTaskService(),
-		s3:             infra.NewS3Manager(),
-		languageClient: client.NewLanguageClient(),
-		pipelineClient: client.NewPipelineClient(),
-		fileIdent:      infra.NewFileIdentifier(),
+		snapshotCache:       cache.NewSnapshotCache(),
+		snapshotRepo:        repo.NewSnapshotRepo(),
+		snapshotSvc:         NewSnapshotService(),
+		fileCache:           cache.NewFileCache(),
+		fileGuard:           guard.NewFileGuard(),
+		taskSvc:             NewTaskService(),
+		dynamicWatermarkSvc: NewDynamicWatermarkService(),
+		s3:                  infra.NewS3Manager(),
+		languageClient:      client.NewLanguageClient(),
+		pipelineClient:      client.NewPipelineClient(),
+		fileIdent:           infra.NewFileIdentifier(),
 	}
 }
 
@@ -93,7 +95,7 @@ func (svc *InsightsService) Create(id string, opts InsightsCreateOptions, userID
 	if err != nil {
 		return err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionEditor); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityRunInsights); err != nil {
 		return err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -127,19 +129,24 @@ func (svc *InsightsService) Create(id string, opts InsightsCreateOptions, userID
 	if err := svc.snapshotSvc.SaveAndSync(snapshot); err != nil {
 		return err
 	}
-	key := snapshot.GetOriginal().Key
-	if svc.fileIdent.IsOffice(key) || svc.fileIdent.IsPlainText(key) {
-		key = snapshot.GetPreview().Key
+	object := snapshot.GetOriginal()
+	if svc.fileIdent.IsOffice(object.GetExtension()) || svc.fileIdent.IsPlainText(object.GetExtension()) {
+		object = snapshot.GetPreview()
 	}
 	if err := svc.pipelineClient.Run(&client.PipelineRunOptions{
-		PipelineID: helper.ToPtr(client.PipelineInsights),
-		TaskID:     task.GetID(),
-		SnapshotID: snapshot.GetID(),
-		Bucket:     snapshot.GetOriginal().Bucket,
-		Key:        key,
+		PipelineID:  helper.ToPtr(client.PipelineInsights),
+		TaskID:      task.GetID(),
+		SnapshotID:  snapshot.GetID(),
+		Bucket:      object.Bucket,
+		Key:         object.Key,
+		ContentType: object.ContentType,
+		Extension:   object.GetExtension(),
 		Payload: map[string]string{
 			"language": opts.LanguageID,
 		},
+		Priority:    client.PipelinePriorityInteractive,
+		UserID:      userID,
+		WorkspaceID: file.GetWorkspaceID(),
 	}); err != nil {
 		return err
 	}
@@ -151,7 +158,7 @@ func (svc *InsightsService) Patch(id string, userID string) error {
 	if err != nil {
 		return err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionEditor); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityRunInsights); err != nil {
 		return err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -193,12 +200,17 @@ func (svc *InsightsService) Patch(id string, userID string) error {
 		return err
 	}
 	if err := svc.pipelineClient.Run(&client.PipelineRunOptions{
-		PipelineID: helper.ToPtr(client.PipelineInsights),
-		TaskID:     task.GetID(),
-		SnapshotID: snapshot.GetID(),
-		Bucket:     snapshot.GetOriginal().Bucket,
-		Key:        snapshot.GetOriginal().Key,
-		Payload:    map[string]string{"language": *snapshot.GetLanguage()},
+		PipelineID:  helper.ToPtr(client.PipelineInsights),
+		TaskID:      task.GetID(),
+		SnapshotID:  snapshot.GetID(),
+		Bucket:      snapshot.GetOriginal().Bucket,
+		Key:         snapshot.GetOriginal().Key,
+		ContentType: snapshot.GetOriginal().ContentType,
+		Extension:   snapshot.GetOriginal().GetExtension(),
+		Payload:     map[string]string{"language": *snapshot.GetLanguage()},
+		Priority:    client.PipelinePriorityInteractive,
+		UserID:      userID,
+		WorkspaceID: file.GetWorkspaceID(),
 	}); err != nil {
 		return err
 	}
@@ -210,7 +222,7 @@ func (svc *InsightsService) Delete(id string, userID string) error {
 	if err != nil {
 		return err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionOwner); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityRunInsights); err != nil {
 		return err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -252,7 +264,7 @@ func (svc *InsightsService) Delete(id string, userID string) error {
 	go func(task model.Task, snapshot model.Snapshot) {
 		failed := false
 		combinedErrMsg := ""
-		if svc.fileIdent.IsImage(snapshot.GetOriginal().Key) {
+		if svc.fileIdent.IsImage(snapshot.GetOriginal().GetExtension()) {
 			if err := svc.deleteText(snapshot); err != nil {
 				combinedErrMsg = err.Error()
 				failed = true
@@ -336,7 +348,7 @@ func (svc *InsightsService) ListEntities(id string, opts InsightsListEntitiesOpt
 	if err != nil {
 		return nil, err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityRead); err != nil {
 		return nil, err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -436,7 +448,7 @@ func (svc *InsightsService) GetInfo(id string, userID string) (*InsightsInfo, er
 	if err != nil {
 		return nil, err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityRead); err != nil {
 		return nil, err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -466,12 +478,13 @@ func (svc *InsightsService) GetInfo(id string, userID string) (*InsightsInfo, er
 	}, nil
 }
 
+/* The text and the OCR are the content of the file, they are downloads that can't be stamped */
 func (svc *InsightsService) DownloadTextBuffer(id string, userID string) (*bytes.Buffer, model.File, model.Snapshot, error) {
 	file, err := svc.fileCache.Get(id)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityDownload); err != nil {
 		return nil, nil, nil, err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -492,6 +505,9 @@ func (svc *InsightsService) DownloadTextBuffer(id string, userID string) (*bytes
 			snapshot = previous
 		}
 	}
+	if err := svc.dynamicWatermarkSvc.AuthorizeUnstamped(userID, file, snapshot); err != nil {
+		return nil, nil, nil, err
+	}
 	if snapshot.HasText() {
 		buf, _, err := svc.s3.GetObject(snapshot.GetText().Key, snapshot.GetText().Bucket, minio.GetObjectOptions{})
 		if err != nil {
@@ -508,7 +524,7 @@ func (svc *InsightsService) DownloadOCRBuffer(id string, userID string) (*bytes.
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityDownload); err != nil {
 		return nil, nil, nil, err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -529,6 +545,9 @@ func (svc *InsightsService) DownloadOCRBuffer(id string, userID string) (*bytes.
 			snapshot = previous
 		}
 	}
+	if err := svc.dynamicWatermarkSvc.AuthorizeUnstamped(userID, file, snapshot); err != nil {
+		return nil, nil, nil, err
+	}
 	if snapshot.HasOCR() {
 		buf, _, err := svc.s3.GetObject(snapshot.GetOCR().Key, snapshot.GetOCR().Bucket, minio.GetObjectOptions{})
 		if err != nil {
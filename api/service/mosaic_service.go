@@ -25,30 +25,32 @@ import (
 )
 
 type MosaicService struct {
-	snapshotCache  *cache.SnapshotCache
-	snapshotRepo   repo.SnapshotRepo
-	snapshotSvc    *SnapshotService
-	fileCache      *cache.FileCache
-	fileGuard      *guard.FileGuard
-	taskSvc        *TaskService
-	s3             *infra.S3Manager
-	mosaicClient   *client.MosaicClient
-	pipelineClient *client.PipelineClient
-	fileIdent      *infra.FileIdentifier
+	snapshotCache       *cache.SnapshotCache
+	snapshotRepo        repo.SnapshotRepo
+	snapshotSvc         *SnapshotService
+	fileCache           *cache.FileCache
+	fileGuard           *guard.FileGuard
+	taskSvc             *TaskService
+	dynamicWatermarkSvc *DynamicWatermarkService
+	s3                  *infra.S3Manager
+	mosaicClient        *client.MosaicClient
+	pipelineClient      *client.PipelineClient
+	fileIdent           *infra.FileIdentifier
 }
 
 func NewMosaicService() *MosaicService {
 	return &MosaicService{
-		snapshotCache:  cache.NewSnapshotCache(),
-		snapshotRepo:   repo.NewSnapshotRepo(),
-		snapshotSvc:    NewSnapshotService(),
-		fileCache:      cache.NewFileCache(),
-		fileGuard:      guard.NewFileGuard(),
-		taskSvc:        NewTaskService(),
-		s3:             infra.NewS3Manager(),
-		mosaicClient:   client.NewMosaicClient(),
-		pipelineClient: client.NewPipelineClient(),
-		fileIdent:      infra.NewFileIdentifier(),
+		snapshotCache:       cache.NewSnapshotCache(),
+		snapshotRepo:        repo.NewSnapshotRepo(),
+		snapshotSvc:         NewSnapshotService(),
+		fileCache:           cache.NewFileCache(),
+		fileGuard:           guard.NewFileGuard(),
+		taskSvc:             NewTaskService(),
+		dynamicWatermarkSvc: NewDynamicWatermarkService(),
+		s3:                  infra.NewS3Manager(),
+		mosaicClient:        client.NewMosaicClient(),
+		pipelineClient:      client.NewPipelineClient(),
+		fileIdent:           infra.NewFileIdentifier(),
 	}
 }
 
@@ -57,7 +59,7 @@ func (svc *MosaicService) Create(id string, userID string) error {
 	if err != nil {
 		return err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionEditor); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityUpload); err != nil {
 		return err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -91,11 +93,16 @@ func (svc *MosaicService) Create(id string, userID string) error {
 		return err
 	}
 	if err := svc.pipelineClient.Run(&client.PipelineRunOptions{
-		PipelineID: helper.ToPtr(client.PipelineMosaic),
-		TaskID:     task.GetID(),
-		SnapshotID: snapshot.GetID(),
-		Bucket:     snapshot.GetOriginal().Bucket,
-		Key:        snapshot.GetOriginal().Key,
+		PipelineID:  helper.ToPtr(client.PipelineMosaic),
+		TaskID:      task.GetID(),
+		SnapshotID:  snapshot.GetID(),
+		Bucket:      snapshot.GetOriginal().Bucket,
+		Key:         snapshot.GetOriginal().Key,
+		ContentType: snapshot.GetOriginal().ContentType,
+		Extension:   snapshot.GetOriginal().GetExtension(),
+		Priority:    client.PipelinePriorityInteractive,
+		UserID:      userID,
+		WorkspaceID: file.GetWorkspaceID(),
 	}); err != nil {
 		return err
 	}
@@ -107,7 +114,7 @@ func (svc *MosaicService) Delete(id string, userID string) error {
 	if err != nil {
 		return err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionOwner); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityManageVersions); err != nil {
 		return err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -127,7 +134,7 @@ func (svc *MosaicService) Delete(id string, userID string) error {
 	if !snapshot.HasMosaic() {
 		return errorpkg.NewMosaicNotFoundError(nil)
 	}
-	if svc.fileIdent.IsImage(snapshot.GetOriginal().Key) {
+	if svc.fileIdent.IsImage(snapshot.GetOriginal().GetExtension()) {
 		task, err := svc.taskSvc.insertAndSync(repo.TaskInsertOptions{
 			ID:              helper.NewID(),
 			Name:            "Deleting mosaic.",
@@ -186,7 +193,7 @@ func (svc *MosaicService) GetInfo(id string, userID string) (*MosaicInfo, error)
 	if err != nil {
 		return nil, err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityRead); err != nil {
 		return nil, err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -209,6 +216,14 @@ func (svc *MosaicService) GetInfo(id string, userID string) (*MosaicInfo, error)
 			isOutdated = true
 		}
 	}
+	/* The tiles can't be stamped, the viewer falls back to the watermarked preview */
+	required, err := svc.dynamicWatermarkSvc.IsRequired(userID, file, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if required {
+		return &MosaicInfo{IsAvailable: false}, nil
+	}
 	res, err := svc.mosaicClient.GetMetadata(client.MosaicGetMetadataOptions{
 		S3Key:    filepath.FromSlash(snapshot.GetID()),
 		S3Bucket: snapshot.GetOriginal().Bucket,
@@ -236,7 +251,7 @@ func (svc *MosaicService) DownloadTileBuffer(id string, opts MosaicDownloadTileO
 	if err != nil {
 		return nil, err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityRead); err != nil {
 		return nil, err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -257,6 +272,9 @@ func (svc *MosaicService) DownloadTileBuffer(id string, opts MosaicDownloadTileO
 			snapshot = previous
 		}
 	}
+	if err := svc.dynamicWatermarkSvc.AuthorizeUnstamped(userID, file, snapshot); err != nil {
+		return nil, err
+	}
 	res, err := svc.mosaicClient.DownloadTileBuffer(client.MosaicDownloadTileOptions{
 		S3Key:     filepath.FromSlash(snapshot.GetID()),
 		S3Bucket:  snapshot.GetOriginal().Bucket,
@@ -0,0 +1,262 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+	"voltaserve/cache"
+	"voltaserve/helper"
+	"voltaserve/log"
+	"voltaserve/model"
+	"voltaserve/repo"
+	"voltaserve/search"
+)
+
+/* Events claimed longer ago than this are considered abandoned, e.g. by a crashed instance */
+const outboxClaimTimeout = 5 * time.Minute
+
+/* Processed events are kept this long for troubleshooting */
+const outboxRetention = 7 * 24 * time.Hour
+
+const outboxBatchSize = 100
+
+/* Events about large trees are synced this many files at a time, to keep the queries small */
+const outboxSyncChunkSize = 1000
+
+/* A failing event is retried after outboxRetryDelay, doubling each time up to outboxMaxRetryDelay */
+const (
+	outboxRetryDelay    = 10 * time.Second
+	outboxMaxRetryDelay = time.Hour
+	outboxMaxAttempts   = 10
+)
+
+/*
+OutboxService applies the side effects of the changes committed with an
+outbox event, i.e. updating the search index and the cache. Events are
+processed right after the change is committed, and by a background job that
+picks up whatever was left behind, e.g. after a crash.
+*/
+type OutboxService struct {
+	outboxRepo          repo.OutboxRepo
+	fileRepo            repo.FileRepo
+	fileSearch          *search.FileSearch
+	fileCache           *cache.FileCache
+	filePermissionCache *cache.FilePermissionCache
+}
+
+func NewOutboxService() *OutboxService {
+	return &OutboxService{
+		outboxRepo:          repo.NewOutboxRepo(),
+		fileRepo:            repo.NewFileRepo(),
+		fileSearch:          search.NewFileSearch(),
+		fileCache:           cache.NewFileCache(),
+		filePermissionCache: cache.NewFilePermissionCache(),
+	}
+}
+
+/* Processes the pending events of every change, failed events are left for a later run */
+func (svc *OutboxService) Process() error {
+	staleClaimTime := svc.staleClaimTime()
+	for {
+		events, err := svc.outboxRepo.FindPending(staleClaimTime, outboxBatchSize)
+		if err != nil {
+			return err
+		}
+		processed := 0
+		for _, e := range events {
+			ok, err := svc.process(e.GetID(), staleClaimTime)
+			if err != nil {
+				return err
+			}
+			if ok {
+				processed++
+			}
+		}
+		/* Stop when nothing could be processed, otherwise failing events would be retried in a loop */
+		if len(events) < outboxBatchSize || processed == 0 {
+			break
+		}
+	}
+	return svc.outboxRepo.DeleteProcessedBefore(time.Now().Add(-outboxRetention).UTC().Format(time.RFC3339))
+}
+
+/*
+Processes the events a change just committed, without failing the caller
+whose change is already committed. Whatever fails is left to Process.
+*/
+func (svc *OutboxService) Dispatch(eventIDs ...string) {
+	staleClaimTime := svc.staleClaimTime()
+	for _, id := range eventIDs {
+		if _, err := svc.process(id, staleClaimTime); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}
+}
+
+/* Returns whether the event was claimed and processed successfully */
+func (svc *OutboxService) process(id string, staleClaimTime string) (bool, error) {
+	event, err := svc.outboxRepo.Claim(id, staleClaimTime)
+	if err != nil {
+		return false, err
+	}
+	if event == nil {
+		return false, nil
+	}
+	if err := svc.handle(event); err != nil {
+		log.GetLogger().Errorw(err.Error(), "event", event.GetID(), "type", event.GetType(), "attempts", event.GetAttempts()+1)
+		if event.GetAttempts()+1 >= outboxMaxAttempts {
+			log.GetLogger().Errorw("giving up on outbox event", "event", event.GetID(), "type", event.GetType())
+		}
+		if err := svc.outboxRepo.MarkFailed(repo.OutboxMarkFailedOptions{
+			ID:          event.GetID(),
+			Message:     err.Error(),
+			RetryTime:   time.Now().Add(svc.retryDelay(event.GetAttempts())).UTC().Format(time.RFC3339),
+			MaxAttempts: outboxMaxAttempts,
+		}); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	if err := svc.outboxRepo.MarkProcessed(event.GetID()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (svc *OutboxService) retryDelay(attempts int) time.Duration {
+	res := outboxRetryDelay
+	for i := 0; i < attempts && res < outboxMaxRetryDelay; i++ {
+		res *= 2
+	}
+	return min(res, outboxMaxRetryDelay)
+}
+
+/* Events claimed before this are considered abandoned */
+func (svc *OutboxService) staleClaimTime() string {
+	return time.Now().Add(-outboxClaimTimeout).UTC().Format(time.RFC3339)
+}
+
+func (svc *OutboxService) handle(event model.OutboxEvent) error {
+	switch event.GetType() {
+	case model.OutboxEventFileSync:
+		var payload model.OutboxFileSyncPayload
+		if err := json.Unmarshal(event.GetPayload(), &payload); err != nil {
+			return err
+		}
+		for _, ids := range helper.Chunk(payload.FileIDs, outboxSyncChunkSize) {
+			if err := svc.syncFiles(ids); err != nil {
+				return err
+			}
+		}
+		return nil
+	case model.OutboxEventFileCacheSync:
+		var payload model.OutboxFileSyncPayload
+		if err := json.Unmarshal(event.GetPayload(), &payload); err != nil {
+			return err
+		}
+		return svc.SyncCache(payload.FileIDs)
+	default:
+		return errors.New("unknown outbox event type: " + event.GetType())
+	}
+}
+
+/* Does what the cache sync events do, for the callers that can't wait for them */
+func (svc *OutboxService) SyncCache(ids []string) error {
+	for _, chunk := range helper.Chunk(ids, outboxSyncChunkSize) {
+		if err := svc.syncCache(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Deleted files are removed from the cache, the others are updated */
+func (svc *OutboxService) syncCache(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	files, err := svc.fileRepo.FindByIDs(ids)
+	if err != nil {
+		return err
+	}
+	found := make(map[string]bool)
+	for _, f := range files {
+		found[f.GetID()] = true
+		if f.IsTrashed() {
+			continue
+		}
+		if err := svc.fileCache.Set(f); err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		if !found[id] {
+			if err := svc.fileCache.Delete(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Trashed and deleted files are removed from the search index and the cache, the
+others are updated. The tree changed, so do the permissions inherited in it.
+*/
+func (svc *OutboxService) syncFiles(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	files, err := svc.fileRepo.FindByIDs(ids)
+	if err != nil {
+		return err
+	}
+	workspaceIDs := make(map[string]bool)
+	active := make(map[string]bool)
+	var index []model.File
+	for _, f := range files {
+		workspaceIDs[f.GetWorkspaceID()] = true
+		if !f.IsTrashed() {
+			active[f.GetID()] = true
+			index = append(index, f)
+		}
+	}
+	var removed []string
+	for _, id := range ids {
+		if !active[id] {
+			removed = append(removed, id)
+		}
+	}
+	if err := svc.fileSearch.Index(index); err != nil {
+		return err
+	}
+	if err := svc.fileSearch.Delete(removed); err != nil {
+		return err
+	}
+	for _, f := range index {
+		if err := svc.fileCache.Set(f); err != nil {
+			return err
+		}
+	}
+	for _, id := range removed {
+		if err := svc.fileCache.Delete(id); err != nil {
+			return err
+		}
+	}
+	for workspaceID := range workspaceIDs {
+		if err := svc.filePermissionCache.Invalidate(workspaceID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+	"voltaserve/cache"
+	"voltaserve/helper"
+	"voltaserve/log"
+	"voltaserve/model"
+	"voltaserve/repo"
+)
+
+/*
+RetentionService prunes the versions of files according to the retention
+policy of their workspace, labelled versions are always kept. Storage usage
+is computed from the versions mapped to files, so it goes down as soon as a
+version is pruned.
+*/
+type RetentionService struct {
+	workspaceRepo  repo.WorkspaceRepo
+	workspaceCache *cache.WorkspaceCache
+	fileRepo       repo.FileRepo
+	snapshotRepo   repo.SnapshotRepo
+	snapshotCache  *cache.SnapshotCache
+	snapshotSvc    *SnapshotService
+	taskCache      *cache.TaskCache
+}
+
+func NewRetentionService() *RetentionService {
+	return &RetentionService{
+		workspaceRepo:  repo.NewWorkspaceRepo(),
+		workspaceCache: cache.NewWorkspaceCache(),
+		fileRepo:       repo.NewFileRepo(),
+		snapshotRepo:   repo.NewSnapshotRepo(),
+		snapshotCache:  cache.NewSnapshotCache(),
+		snapshotSvc:    NewSnapshotService(),
+		taskCache:      cache.NewTaskCache(),
+	}
+}
+
+/* The files whose versions are loaded and pruned at a time */
+const retentionPageSize = 500
+
+/* Applies the retention policy of every workspace that has one */
+func (svc *RetentionService) Enforce() error {
+	ids, err := svc.workspaceRepo.GetIDsWithRetentionPolicy()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		workspace, err := svc.workspaceCache.Get(id)
+		if err != nil {
+			log.GetLogger().Error(err)
+			continue
+		}
+		count, size, err := svc.enforce(workspace)
+		if err != nil {
+			log.GetLogger().Errorw(err.Error(), "workspace", workspace.GetID())
+		}
+		if count > 0 {
+			log.GetLogger().Infow("pruned versions", "workspace", workspace.GetID(), "count", count, "bytes", size)
+		}
+	}
+	return nil
+}
+
+/* Returns the number of versions pruned and the bytes they freed */
+func (svc *RetentionService) enforce(workspace model.Workspace) (int, int64, error) {
+	policy := workspace.GetRetentionPolicy()
+	if policy.IsEmpty() {
+		return 0, 0, nil
+	}
+	now := time.Now().UTC()
+	opts := repo.FilePrunableOptions{
+		WorkspaceID: workspace.GetID(),
+		/* The active version is always kept */
+		MinSnapshots: 2,
+		Limit:        retentionPageSize,
+	}
+	if policy.KeepLast != nil {
+		opts.MinSnapshots = max(opts.MinSnapshots, *policy.KeepLast+1)
+	}
+	if policy.KeepDays != nil {
+		opts.CreatedBefore = helper.ToPtr(now.AddDate(0, 0, -*policy.KeepDays).Format(time.RFC3339))
+	}
+	var count int
+	var size int64
+	for {
+		ids, err := svc.fileRepo.GetIDsWithPrunableSnapshots(opts)
+		if err != nil {
+			return count, size, err
+		}
+		files, err := svc.fileRepo.FindByIDs(ids)
+		if err != nil {
+			return count, size, err
+		}
+		for _, file := range files {
+			snapshots, err := svc.snapshotRepo.FindAllForFile(file.GetID())
+			if err != nil {
+				return count, size, err
+			}
+			for _, s := range svc.findPrunable(policy, file, snapshots, now) {
+				if err := svc.prune(file, s); err != nil {
+					return count, size, err
+				}
+				count++
+				size += originalSize(s)
+			}
+		}
+		if len(ids) < retentionPageSize {
+			return count, size, nil
+		}
+		opts.AfterID = ids[len(ids)-1]
+	}
+}
+
+/* Detaches the version from the file, and removes it if no other file refers to it */
+func (svc *RetentionService) prune(file model.File, snapshot model.Snapshot) error {
+	if err := svc.snapshotRepo.Detach(snapshot.GetID(), file.GetID()); err != nil {
+		return err
+	}
+	associationCount, err := svc.snapshotRepo.CountAssociations(snapshot.GetID())
+	if err != nil {
+		return err
+	}
+	if associationCount > 0 {
+		return nil
+	}
+	if err := svc.snapshotSvc.deleteObjects(snapshot); err != nil {
+		return err
+	}
+	if err := svc.snapshotRepo.Delete(snapshot.GetID()); err != nil {
+		return err
+	}
+	if err := svc.snapshotCache.Delete(snapshot.GetID()); err != nil {
+		return err
+	}
+	return nil
+}
+
+/* Returns the versions none of the policy's rules keep */
+func (svc *RetentionService) findPrunable(policy *model.RetentionPolicy, file model.File, snapshots []model.Snapshot, now time.Time) []model.Snapshot {
+	/* Most recent first */
+	sorted := append([]model.Snapshot{}, snapshots...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].GetVersion() > sorted[j].GetVersion()
+	})
+	keep := make(map[string]bool)
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	for i, s := range sorted {
+		createTime, err := time.Parse(time.RFC3339, s.GetCreateTime())
+		if err != nil {
+			/* Can't tell its age, better keep it */
+			keep[s.GetID()] = true
+			continue
+		}
+		createTime = createTime.UTC()
+		if policy.KeepLast != nil && i < *policy.KeepLast {
+			keep[s.GetID()] = true
+		}
+		if policy.KeepDays != nil && createTime.After(now.AddDate(0, 0, -*policy.KeepDays)) {
+			keep[s.GetID()] = true
+		}
+		day := createTime.Format(time.DateOnly)
+		if policy.KeepDaily != nil && !days[day] && len(days) < *policy.KeepDaily {
+			days[day] = true
+			keep[s.GetID()] = true
+		}
+		year, week := createTime.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%d", year, week)
+		if policy.KeepWeekly != nil && !weeks[weekKey] && len(weeks) < *policy.KeepWeekly {
+			weeks[weekKey] = true
+			keep[s.GetID()] = true
+		}
+	}
+	var res []model.Snapshot
+	for _, s := range sorted {
+		if keep[s.GetID()] || s.GetLabel() != nil {
+			continue
+		}
+		if file.GetSnapshotID() != nil && *file.GetSnapshotID() == s.GetID() {
+			continue
+		}
+		isPending, err := isTaskPending(s, svc.taskCache)
+		if err != nil {
+			log.GetLogger().Error(err)
+			continue
+		}
+		if *isPending {
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
@@ -0,0 +1,228 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"slices"
+	"voltaserve/cache"
+	"voltaserve/errorpkg"
+	"voltaserve/guard"
+	"voltaserve/helper"
+	"voltaserve/model"
+	"voltaserve/repo"
+)
+
+type RoleService struct {
+	roleRepo   repo.RoleRepo
+	roleCache  *cache.RoleCache
+	roleMapper *roleMapper
+	orgCache   *cache.OrganizationCache
+	orgGuard   *guard.OrganizationGuard
+}
+
+func NewRoleService() *RoleService {
+	return &RoleService{
+		roleRepo:   repo.NewRoleRepo(),
+		roleCache:  cache.NewRoleCache(),
+		roleMapper: newRoleMapper(),
+		orgCache:   cache.NewOrganizationCache(),
+		orgGuard:   guard.NewOrganizationGuard(),
+	}
+}
+
+/* Built-in roles have their name as ID and no organization */
+type Role struct {
+	ID             string   `json:"id"`
+	OrganizationID *string  `json:"organizationId,omitempty"`
+	Name           string   `json:"name"`
+	Capabilities   []string `json:"capabilities"`
+	IsBuiltin      bool     `json:"isBuiltin"`
+	CreateTime     *string  `json:"createTime,omitempty"`
+	UpdateTime     *string  `json:"updateTime,omitempty"`
+}
+
+type RoleCreateOptions struct {
+	OrganizationID string   `json:"organizationId" validate:"required"`
+	Name           string   `json:"name" validate:"required,max=255"`
+	Capabilities   []string `json:"capabilities" validate:"required,min=1"`
+}
+
+func (svc *RoleService) Create(opts RoleCreateOptions, userID string) (*Role, error) {
+	org, err := svc.orgCache.Get(opts.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.orgGuard.Authorize(userID, org, model.PermissionOwner); err != nil {
+		return nil, err
+	}
+	capabilities, err := svc.normalizeCapabilities(opts.Capabilities)
+	if err != nil {
+		return nil, err
+	}
+	role, err := svc.roleRepo.Insert(repo.RoleInsertOptions{
+		ID:             helper.NewID(),
+		OrganizationID: org.GetID(),
+		Name:           opts.Name,
+		Capabilities:   capabilities,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.roleCache.Set(role); err != nil {
+		return nil, err
+	}
+	return svc.roleMapper.mapOne(role), nil
+}
+
+func (svc *RoleService) Find(id string, userID string) (*Role, error) {
+	if model.IsBuiltinRole(id) {
+		return svc.roleMapper.mapBuiltin(id), nil
+	}
+	role, err := svc.findAuthorized(id, userID, model.PermissionViewer)
+	if err != nil {
+		return nil, err
+	}
+	return svc.roleMapper.mapOne(role), nil
+}
+
+/* The built-in roles come first, followed by the custom roles of the organization */
+func (svc *RoleService) List(orgID string, userID string) ([]*Role, error) {
+	org, err := svc.orgCache.Get(orgID)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.orgGuard.Authorize(userID, org, model.PermissionViewer); err != nil {
+		return nil, err
+	}
+	roles, err := svc.roleRepo.FindByOrganization(org.GetID())
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*Role, 0)
+	for _, permission := range []string{model.PermissionViewer, model.PermissionEditor, model.PermissionOwner} {
+		res = append(res, svc.roleMapper.mapBuiltin(permission))
+	}
+	for _, r := range roles {
+		res = append(res, svc.roleMapper.mapOne(r))
+	}
+	return res, nil
+}
+
+type RolePatchOptions struct {
+	Name         *string  `json:"name,omitempty" validate:"omitempty,min=1,max=255"`
+	Capabilities []string `json:"capabilities,omitempty" validate:"omitempty,min=1"`
+}
+
+/* Takes effect right away on every file the role is granted on */
+func (svc *RoleService) Patch(id string, opts RolePatchOptions, userID string) (*Role, error) {
+	role, err := svc.findAuthorized(id, userID, model.PermissionOwner)
+	if err != nil {
+		return nil, err
+	}
+	name := role.GetName()
+	if opts.Name != nil {
+		name = *opts.Name
+	}
+	capabilities := role.GetCapabilities()
+	if opts.Capabilities != nil {
+		if capabilities, err = svc.normalizeCapabilities(opts.Capabilities); err != nil {
+			return nil, err
+		}
+	}
+	if role, err = svc.roleRepo.Update(role.GetID(), name, capabilities); err != nil {
+		return nil, err
+	}
+	if err = svc.roleCache.Set(role); err != nil {
+		return nil, err
+	}
+	return svc.roleMapper.mapOne(role), nil
+}
+
+func (svc *RoleService) Delete(id string, userID string) error {
+	role, err := svc.findAuthorized(id, userID, model.PermissionOwner)
+	if err != nil {
+		return err
+	}
+	isGranted, err := svc.roleRepo.IsGranted(role.GetID())
+	if err != nil {
+		return err
+	}
+	if isGranted {
+		return errorpkg.NewRoleIsGrantedError()
+	}
+	if err = svc.roleRepo.Delete(role.GetID()); err != nil {
+		return err
+	}
+	if err = svc.roleCache.Delete(role.GetID()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (svc *RoleService) findAuthorized(id string, userID string, permission string) (model.Role, error) {
+	if model.IsBuiltinRole(id) {
+		return nil, errorpkg.NewRoleNotFoundError(nil)
+	}
+	role, err := svc.roleCache.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	org, err := svc.orgCache.Get(role.GetOrganizationID())
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.orgGuard.Authorize(userID, org, permission); err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+/* Every role can read, the capabilities are kept in a stable order */
+func (svc *RoleService) normalizeCapabilities(capabilities []string) ([]string, error) {
+	for _, c := range capabilities {
+		if !model.IsCapability(c) {
+			return nil, errorpkg.NewInvalidCapabilityError(c)
+		}
+	}
+	res := make([]string, 0)
+	for _, c := range model.Capabilities {
+		if c == model.CapabilityRead || slices.Contains(capabilities, c) {
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+type roleMapper struct{}
+
+func newRoleMapper() *roleMapper {
+	return &roleMapper{}
+}
+
+func (mp *roleMapper) mapOne(m model.Role) *Role {
+	return &Role{
+		ID:             m.GetID(),
+		OrganizationID: helper.ToPtr(m.GetOrganizationID()),
+		Name:           m.GetName(),
+		Capabilities:   m.GetCapabilities(),
+		CreateTime:     helper.ToPtr(m.GetCreateTime()),
+		UpdateTime:     m.GetUpdateTime(),
+	}
+}
+
+func (mp *roleMapper) mapBuiltin(permission string) *Role {
+	return &Role{
+		ID:           permission,
+		Name:         permission,
+		Capabilities: model.GetBuiltinCapabilities(permission),
+		IsBuiltin:    true,
+	}
+}
@@ -0,0 +1,637 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+	"voltaserve/cache"
+	"voltaserve/config"
+	"voltaserve/errorpkg"
+	"voltaserve/guard"
+	"voltaserve/helper"
+	"voltaserve/infra"
+	"voltaserve/log"
+	"voltaserve/model"
+	"voltaserve/repo"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+/* How long a password protected link stays unlocked */
+const shareLinkUnlockTTL = time.Hour
+
+/* Unlock attempts allowed per window, from one address and from everywhere, to slow down guessing */
+const (
+	shareLinkUnlockWindow          = 15 * time.Minute
+	shareLinkUnlockAttemptsPerIP   = 10
+	shareLinkUnlockAttemptsPerLink = 100
+)
+
+/* Requests from the same visitor within this window belong to the same download, unless they start over */
+const shareLinkDownloadSessionTTL = time.Hour
+
+type ShareLinkService struct {
+	shareLinkRepo       repo.ShareLinkRepo
+	shareLinkMapper     *shareLinkMapper
+	fileRepo            repo.FileRepo
+	fileCache           *cache.FileCache
+	fileGuard           *guard.FileGuard
+	snapshotCache       *cache.SnapshotCache
+	dynamicWatermarkSvc *DynamicWatermarkService
+	redis               *infra.RedisManager
+	config              *config.Config
+}
+
+func NewShareLinkService() *ShareLinkService {
+	return &ShareLinkService{
+		shareLinkRepo:       repo.NewShareLinkRepo(),
+		shareLinkMapper:     newShareLinkMapper(),
+		fileRepo:            repo.NewFileRepo(),
+		fileCache:           cache.NewFileCache(),
+		fileGuard:           guard.NewFileGuard(),
+		snapshotCache:       cache.NewSnapshotCache(),
+		dynamicWatermarkSvc: NewDynamicWatermarkService(),
+		redis:               infra.NewRedisManager(),
+		config:              config.GetConfig(),
+	}
+}
+
+type ShareLink struct {
+	ID            string  `json:"id"`
+	FileID        string  `json:"fileId"`
+	Mode          string  `json:"mode"`
+	HasPassword   bool    `json:"hasPassword"`
+	MaxDownloads  *int64  `json:"maxDownloads,omitempty"`
+	DownloadCount int64   `json:"downloadCount"`
+	ExpireTime    string  `json:"expireTime"`
+	RevokeTime    *string `json:"revokeTime,omitempty"`
+	/* Only returned when the link is created, it's stored hashed */
+	Token      *string `json:"token,omitempty"`
+	CreateTime string  `json:"createTime"`
+	UpdateTime *string `json:"updateTime,omitempty"`
+}
+
+type ShareLinkAccess struct {
+	ID         string  `json:"id"`
+	FileID     *string `json:"fileId,omitempty"`
+	Action     string  `json:"action"`
+	IP         string  `json:"ip"`
+	UserAgent  string  `json:"userAgent"`
+	CreateTime string  `json:"createTime"`
+}
+
+/* What an anonymous visitor sees of a share link */
+type Share struct {
+	Mode               string      `json:"mode"`
+	ExpireTime         string      `json:"expireTime"`
+	RemainingDownloads *int64      `json:"remainingDownloads,omitempty"`
+	File               *SharedFile `json:"file"`
+}
+
+type SharedFile struct {
+	ID         string        `json:"id"`
+	Name       string        `json:"name"`
+	Type       string        `json:"type"`
+	ParentID   *string       `json:"parentId,omitempty"`
+	Original   *SharedObject `json:"original,omitempty"`
+	Preview    *SharedObject `json:"preview,omitempty"`
+	CreateTime string        `json:"createTime"`
+	UpdateTime *string       `json:"updateTime,omitempty"`
+}
+
+type SharedObject struct {
+	Extension   string            `json:"extension"`
+	Size        *int64            `json:"size,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Image       *model.ImageProps `json:"image,omitempty"`
+}
+
+type ShareLinkUnlock struct {
+	AccessToken string `json:"accessToken"`
+	ExpireTime  string `json:"expireTime"`
+}
+
+/* Who accessed a share link, for the access log */
+type ShareLinkAccessContext struct {
+	IP        string
+	UserAgent string
+}
+
+type ShareLinkCreateOptions struct {
+	FileID       string  `json:"fileId" validate:"required"`
+	Mode         string  `json:"mode" validate:"required,oneof=download preview"`
+	ExpireTime   string  `json:"expireTime" validate:"required"`
+	Password     *string `json:"password,omitempty" validate:"omitempty,min=1,max=255"`
+	MaxDownloads *int64  `json:"maxDownloads,omitempty" validate:"omitempty,min=1"`
+}
+
+func (svc *ShareLinkService) Create(opts ShareLinkCreateOptions, userID string) (*ShareLink, error) {
+	file, err := svc.fileCache.Get(opts.FileID)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityShare); err != nil {
+		return nil, err
+	}
+	expireTime, err := time.Parse(time.RFC3339, opts.ExpireTime)
+	if err != nil || !expireTime.After(time.Now()) {
+		return nil, errorpkg.NewInvalidExpireTimeError()
+	}
+	token, err := helper.NewSecret()
+	if err != nil {
+		return nil, err
+	}
+	var passwordHash *string
+	if opts.Password != nil {
+		hash, err := helper.HashPassword(*opts.Password)
+		if err != nil {
+			return nil, err
+		}
+		passwordHash = &hash
+	}
+	shareLink, err := svc.shareLinkRepo.Insert(repo.ShareLinkInsertOptions{
+		ID:           helper.NewID(),
+		FileID:       file.GetID(),
+		UserID:       userID,
+		TokenHash:    helper.HashSecret(token),
+		PasswordHash: passwordHash,
+		Mode:         opts.Mode,
+		MaxDownloads: opts.MaxDownloads,
+		ExpireTime:   expireTime.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := svc.shareLinkMapper.mapOne(shareLink)
+	res.Token = &token
+	return res, nil
+}
+
+func (svc *ShareLinkService) List(fileID string, userID string) ([]*ShareLink, error) {
+	file, err := svc.fileCache.Get(fileID)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityShare); err != nil {
+		return nil, err
+	}
+	shareLinks, err := svc.shareLinkRepo.FindByFile(file.GetID())
+	if err != nil {
+		return nil, err
+	}
+	return svc.shareLinkMapper.mapMany(shareLinks), nil
+}
+
+func (svc *ShareLinkService) Revoke(id string, userID string) error {
+	shareLink, err := svc.findAuthorized(id, userID)
+	if err != nil {
+		return err
+	}
+	return svc.shareLinkRepo.Revoke(shareLink.GetID())
+}
+
+func (svc *ShareLinkService) ListAccesses(id string, userID string) ([]*ShareLinkAccess, error) {
+	shareLink, err := svc.findAuthorized(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	accesses, err := svc.shareLinkRepo.FindAccesses(shareLink.GetID())
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*ShareLinkAccess, 0)
+	for _, a := range accesses {
+		res = append(res, &ShareLinkAccess{
+			ID:         a.GetID(),
+			FileID:     a.GetFileID(),
+			Action:     a.GetAction(),
+			IP:         a.GetIP(),
+			UserAgent:  a.GetUserAgent(),
+			CreateTime: a.GetCreateTime(),
+		})
+	}
+	return res, nil
+}
+
+/* Exchanges the password of a link for an access token, to pass along with later requests */
+func (svc *ShareLinkService) Unlock(token string, password string, access ShareLinkAccessContext) (*ShareLinkUnlock, error) {
+	shareLink, err := svc.findActive(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := svc.limitUnlock(shareLink, access); err != nil {
+		return nil, err
+	}
+	if !shareLink.HasPassword() || !helper.VerifyPassword(password, *shareLink.GetPasswordHash()) {
+		svc.logAccess(shareLink, nil, model.ShareLinkActionDenied, access)
+		return nil, errorpkg.NewShareLinkPasswordInvalidError()
+	}
+	expireTime := time.Now().Add(shareLinkUnlockTTL)
+	accessToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   shareLink.GetID(),
+		ExpiresAt: jwt.NewNumericDate(expireTime),
+	}).SignedString(svc.unlockKey())
+	if err != nil {
+		return nil, err
+	}
+	svc.logAccess(shareLink, nil, model.ShareLinkActionUnlock, access)
+	return &ShareLinkUnlock{
+		AccessToken: accessToken,
+		ExpireTime:  expireTime.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+func (svc *ShareLinkService) Get(token string, accessToken string, access ShareLinkAccessContext) (*Share, error) {
+	shareLink, file, err := svc.open(token, accessToken, access)
+	if err != nil {
+		return nil, err
+	}
+	sharedFile, err := svc.mapSharedFile(shareLink, file)
+	if err != nil {
+		return nil, err
+	}
+	svc.logAccess(shareLink, helper.ToPtr(file.GetID()), model.ShareLinkActionView, access)
+	res := &Share{
+		Mode:       shareLink.GetMode(),
+		ExpireTime: shareLink.GetExpireTime(),
+		File:       sharedFile,
+	}
+	if shareLink.GetMaxDownloads() != nil {
+		res.RemainingDownloads = helper.ToPtr(max(*shareLink.GetMaxDownloads()-shareLink.GetDownloadCount(), 0))
+	}
+	return res, nil
+}
+
+/* Lists a folder of the share, which is either the shared folder or one of its descendants */
+func (svc *ShareLinkService) ListFolder(token string, accessToken string, id string, access ShareLinkAccessContext) ([]*SharedFile, error) {
+	shareLink, folder, err := svc.openFile(token, accessToken, id, access)
+	if err != nil {
+		return nil, err
+	}
+	if folder.GetType() != model.FileTypeFolder {
+		return nil, errorpkg.NewFileIsNotAFolderError(folder)
+	}
+	children, err := svc.fileRepo.FindChildren(folder.GetID())
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*SharedFile, 0)
+	for _, child := range children {
+		f, err := svc.mapSharedFile(shareLink, child)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, f)
+	}
+	svc.logAccess(shareLink, helper.ToPtr(folder.GetID()), model.ShareLinkActionList, access)
+	return res, nil
+}
+
+type ShareLinkDownloadOptions struct {
+	/* Set for HEAD requests, which never count towards the download limit */
+	Probe bool
+	/* Set when the requested ranges include the start or the end of the file */
+	Restart bool
+}
+
+/*
+Authorizes downloading the original of a shared file. The requests a player
+makes while seeking through a video count as one download, see countDownload.
+*/
+func (svc *ShareLinkService) DownloadOriginal(token string, accessToken string, id string, opts ShareLinkDownloadOptions, access ShareLinkAccessContext) (*DownloadResult, error) {
+	shareLink, file, err := svc.openFile(token, accessToken, id, access)
+	if err != nil {
+		return nil, err
+	}
+	if shareLink.GetMode() != model.ShareLinkModeDownload {
+		svc.logAccess(shareLink, helper.ToPtr(file.GetID()), model.ShareLinkActionDenied, access)
+		return nil, errorpkg.NewShareLinkPreviewOnlyError()
+	}
+	snapshot, err := svc.findSnapshot(file)
+	if err != nil {
+		return nil, err
+	}
+	if !snapshot.HasOriginal() {
+		return nil, errorpkg.NewS3ObjectNotFoundError(nil)
+	}
+	object, err := svc.downloadObject(shareLink, file, snapshot, snapshot.GetOriginal(), "original", access)
+	if err != nil {
+		return nil, err
+	}
+	if err := svc.countDownload(shareLink, file, model.ShareLinkActionDownloadOriginal, opts, access); err != nil {
+		return nil, err
+	}
+	svc.logAccess(shareLink, helper.ToPtr(file.GetID()), model.ShareLinkActionDownloadOriginal, access)
+	return &DownloadResult{
+		File:     file,
+		Snapshot: snapshot,
+		Object:   object,
+	}, nil
+}
+
+func (svc *ShareLinkService) DownloadPreview(token string, accessToken string, id string, opts ShareLinkDownloadOptions, access ShareLinkAccessContext) (*DownloadResult, error) {
+	shareLink, file, err := svc.openFile(token, accessToken, id, access)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := svc.findSnapshot(file)
+	if err != nil {
+		return nil, err
+	}
+	if !snapshot.HasPreview() {
+		return nil, errorpkg.NewS3ObjectNotFoundError(nil)
+	}
+	object, err := svc.downloadObject(shareLink, file, snapshot, snapshot.GetPreview(), "preview", access)
+	if err != nil {
+		return nil, err
+	}
+	if err := svc.countDownload(shareLink, file, model.ShareLinkActionDownloadPreview, opts, access); err != nil {
+		return nil, err
+	}
+	svc.logAccess(shareLink, helper.ToPtr(file.GetID()), model.ShareLinkActionDownloadPreview, access)
+	return &DownloadResult{
+		File:     file,
+		Snapshot: snapshot,
+		Object:   object,
+	}, nil
+}
+
+/*
+Visitors get the copies of watermarked files stamped like the users who can't
+upload versions, made out to the user who created the link and to the visitor's
+IP. The files that can't be stamped aren't served.
+*/
+func (svc *ShareLinkService) downloadObject(shareLink model.ShareLink, file model.File, snapshot model.Snapshot, object *model.S3Object, variant string, access ShareLinkAccessContext) (*model.S3Object, error) {
+	required, err := svc.dynamicWatermarkSvc.IsRequiredForShareLink(file, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if !required {
+		return object, nil
+	}
+	if !svc.dynamicWatermarkSvc.IsSupported(object) {
+		svc.logAccess(shareLink, helper.ToPtr(file.GetID()), model.ShareLinkActionDenied, access)
+		return nil, errorpkg.NewWatermarkRequiredError(file)
+	}
+	return svc.dynamicWatermarkSvc.Stamp(DynamicWatermarkOptions{
+		File:     file,
+		Snapshot: snapshot,
+		Object:   object,
+		Variant:  variant,
+		UserID:   shareLink.GetUserID(),
+		IP:       access.IP,
+	})
+}
+
+/*
+Counts attempts in fixed windows. Successful attempts count too, otherwise a
+correct guess would be the only thing telling a visitor to stop.
+*/
+func (svc *ShareLinkService) limitUnlock(shareLink model.ShareLink, access ShareLinkAccessContext) error {
+	prefix := "share_link:" + shareLink.GetID() + ":unlock"
+	for key, limit := range map[string]int64{
+		prefix:                   shareLinkUnlockAttemptsPerLink,
+		prefix + ":" + access.IP: shareLinkUnlockAttemptsPerIP,
+	} {
+		count, err := svc.redis.Incr(key)
+		if err != nil {
+			return err
+		}
+		if count == 1 {
+			if err := svc.redis.Expire(key, shareLinkUnlockWindow); err != nil {
+				return err
+			}
+		}
+		if count > limit {
+			svc.logAccess(shareLink, nil, model.ShareLinkActionDenied, access)
+			return errorpkg.NewShareLinkUnlockRateLimitedError()
+		}
+	}
+	return nil
+}
+
+/*
+Counts a download when the request starts the file over, or when it is the
+first request of this visitor for this file, whatever range it asks for.
+*/
+func (svc *ShareLinkService) countDownload(shareLink model.ShareLink, file model.File, action string, opts ShareLinkDownloadOptions, access ShareLinkAccessContext) error {
+	if opts.Probe || shareLink.GetMaxDownloads() == nil {
+		return nil
+	}
+	visitor := sha256.Sum256([]byte(access.IP + "\n" + access.UserAgent))
+	key := "share_link:" + shareLink.GetID() + ":" + action + ":" + file.GetID() + ":" + hex.EncodeToString(visitor[:])
+	first, err := svc.redis.SetNX(key, "1", shareLinkDownloadSessionTTL)
+	if err != nil {
+		return err
+	}
+	if !first && !opts.Restart {
+		return nil
+	}
+	ok, err := svc.shareLinkRepo.IncrementDownloadCount(shareLink.GetID())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		svc.logAccess(shareLink, helper.ToPtr(file.GetID()), model.ShareLinkActionDenied, access)
+		return errorpkg.NewShareLinkDownloadLimitReachedError()
+	}
+	return nil
+}
+
+/* Resolves the link and checks the password, if the link has one */
+func (svc *ShareLinkService) open(token string, accessToken string, access ShareLinkAccessContext) (model.ShareLink, model.File, error) {
+	shareLink, err := svc.findActive(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if shareLink.HasPassword() && !svc.isUnlocked(shareLink, accessToken) {
+		svc.logAccess(shareLink, nil, model.ShareLinkActionDenied, access)
+		return nil, nil, errorpkg.NewShareLinkPasswordRequiredError()
+	}
+	file, err := svc.fileCache.Get(shareLink.GetFileID())
+	if err != nil {
+		return nil, nil, err
+	}
+	if file.IsTrashed() {
+		return nil, nil, errorpkg.NewShareLinkNotFoundError(nil)
+	}
+	return shareLink, file, nil
+}
+
+func (svc *ShareLinkService) openFile(token string, accessToken string, id string, access ShareLinkAccessContext) (model.ShareLink, model.File, error) {
+	shareLink, root, err := svc.open(token, accessToken, access)
+	if err != nil {
+		return nil, nil, err
+	}
+	if id == root.GetID() {
+		return shareLink, root, nil
+	}
+	ok, err := svc.fileRepo.IsGrandChildOf(id, root.GetID())
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		svc.logAccess(shareLink, &id, model.ShareLinkActionDenied, access)
+		return nil, nil, errorpkg.NewFileNotInShareLinkError()
+	}
+	file, err := svc.fileCache.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return shareLink, file, nil
+}
+
+func (svc *ShareLinkService) findActive(token string) (model.ShareLink, error) {
+	shareLink, err := svc.shareLinkRepo.FindByTokenHash(helper.HashSecret(token))
+	if err != nil {
+		return nil, err
+	}
+	if shareLink.IsRevoked() {
+		return nil, errorpkg.NewShareLinkNotFoundError(nil)
+	}
+	if shareLink.IsExpired() {
+		return nil, errorpkg.NewShareLinkExpiredError()
+	}
+	return shareLink, nil
+}
+
+func (svc *ShareLinkService) findAuthorized(id string, userID string) (model.ShareLink, error) {
+	shareLink, err := svc.shareLinkRepo.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	file, err := svc.fileCache.Get(shareLink.GetFileID())
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityShare); err != nil {
+		return nil, err
+	}
+	return shareLink, nil
+}
+
+func (svc *ShareLinkService) findSnapshot(file model.File) (model.Snapshot, error) {
+	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
+		return nil, errorpkg.NewFileIsNotAFileError(file)
+	}
+	return svc.snapshotCache.Get(*file.GetSnapshotID())
+}
+
+func (svc *ShareLinkService) isUnlocked(shareLink model.ShareLink, accessToken string) bool {
+	if accessToken == "" {
+		return false
+	}
+	token, err := jwt.ParseWithClaims(accessToken, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return svc.unlockKey(), nil
+	})
+	if err != nil || !token.Valid {
+		return false
+	}
+	subject, err := token.Claims.GetSubject()
+	if err != nil {
+		return false
+	}
+	return subject == shareLink.GetID()
+}
+
+/* Derived from the JWT signing key, so that an unlock token can never pass as a user's access token */
+func (svc *ShareLinkService) unlockKey() []byte {
+	mac := hmac.New(sha256.New, []byte(svc.config.Security.JWTSigningKey))
+	mac.Write([]byte("share_link_unlock"))
+	return mac.Sum(nil)
+}
+
+func (svc *ShareLinkService) logAccess(shareLink model.ShareLink, fileID *string, action string, access ShareLinkAccessContext) {
+	if err := svc.shareLinkRepo.InsertAccess(repo.ShareLinkAccessInsertOptions{
+		ID:          helper.NewID(),
+		ShareLinkID: shareLink.GetID(),
+		FileID:      fileID,
+		Action:      action,
+		IP:          access.IP,
+		UserAgent:   access.UserAgent,
+	}); err != nil {
+		/* Failing to log shouldn't prevent the access */
+		log.GetLogger().Error(err)
+	}
+}
+
+func (svc *ShareLinkService) mapSharedFile(shareLink model.ShareLink, file model.File) (*SharedFile, error) {
+	res := &SharedFile{
+		ID:         file.GetID(),
+		Name:       file.GetName(),
+		Type:       file.GetType(),
+		CreateTime: file.GetCreateTime(),
+		UpdateTime: file.GetUpdateTime(),
+	}
+	/* The shared file has no parent as far as the visitor is concerned */
+	if file.GetID() != shareLink.GetFileID() {
+		res.ParentID = file.GetParentID()
+	}
+	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
+		return res, nil
+	}
+	snapshot, err := svc.snapshotCache.Get(*file.GetSnapshotID())
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.HasOriginal() && shareLink.GetMode() == model.ShareLinkModeDownload {
+		res.Original = svc.mapSharedObject(snapshot.GetOriginal())
+	}
+	if snapshot.HasPreview() {
+		res.Preview = svc.mapSharedObject(snapshot.GetPreview())
+	}
+	return res, nil
+}
+
+func (svc *ShareLinkService) mapSharedObject(m *model.S3Object) *SharedObject {
+	return &SharedObject{
+		Extension:   m.GetExtension(),
+		Size:        m.Size,
+		ContentType: m.ContentType,
+		Image:       m.Image,
+	}
+}
+
+type shareLinkMapper struct{}
+
+func newShareLinkMapper() *shareLinkMapper {
+	return &shareLinkMapper{}
+}
+
+func (mp *shareLinkMapper) mapOne(m model.ShareLink) *ShareLink {
+	return &ShareLink{
+		ID:            m.GetID(),
+		FileID:        m.GetFileID(),
+		Mode:          m.GetMode(),
+		HasPassword:   m.HasPassword(),
+		MaxDownloads:  m.GetMaxDownloads(),
+		DownloadCount: m.GetDownloadCount(),
+		ExpireTime:    m.GetExpireTime(),
+		RevokeTime:    m.GetRevokeTime(),
+		CreateTime:    m.GetCreateTime(),
+		UpdateTime:    m.GetUpdateTime(),
+	}
+}
+
+func (mp *shareLinkMapper) mapMany(shareLinks []model.ShareLink) []*ShareLink {
+	res := make([]*ShareLink, 0)
+	for _, s := range shareLinks {
+		res = append(res, mp.mapOne(s))
+	}
+	return res
+}
@@ -0,0 +1,513 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"time"
+	"voltaserve/cache"
+	"voltaserve/client"
+	"voltaserve/errorpkg"
+	"voltaserve/guard"
+	"voltaserve/helper"
+	"voltaserve/infra"
+	"voltaserve/log"
+	"voltaserve/model"
+	"voltaserve/repo"
+
+	"github.com/minio/minio-go/v7"
+)
+
+type SnapshotDiffService struct {
+	snapshotDiffRepo    repo.SnapshotDiffRepo
+	snapshotDiffMapper  *SnapshotDiffMapper
+	snapshotCache       *cache.SnapshotCache
+	fileRepo            repo.FileRepo
+	fileCache           *cache.FileCache
+	fileGuard           *guard.FileGuard
+	taskSvc             *TaskService
+	dynamicWatermarkSvc *DynamicWatermarkService
+	pipelineClient      *client.PipelineClient
+	fileIdent           *infra.FileIdentifier
+	s3                  *infra.S3Manager
+}
+
+func NewSnapshotDiffService() *SnapshotDiffService {
+	return &SnapshotDiffService{
+		snapshotDiffRepo:    repo.NewSnapshotDiffRepo(),
+		snapshotDiffMapper:  NewSnapshotDiffMapper(),
+		snapshotCache:       cache.NewSnapshotCache(),
+		fileRepo:            repo.NewFileRepo(),
+		fileCache:           cache.NewFileCache(),
+		fileGuard:           guard.NewFileGuard(),
+		taskSvc:             NewTaskService(),
+		dynamicWatermarkSvc: NewDynamicWatermarkService(),
+		pipelineClient:      client.NewPipelineClient(),
+		fileIdent:           infra.NewFileIdentifier(),
+		s3:                  infra.NewS3Manager(),
+	}
+}
+
+type SnapshotDiff struct {
+	ID             string                       `json:"id"`
+	SnapshotID     string                       `json:"snapshotId"`
+	BaseSnapshotID string                       `json:"baseSnapshotId"`
+	Status         string                       `json:"status"`
+	Task           *TaskInfo                    `json:"task,omitempty"`
+	Text           *Download                    `json:"text,omitempty"`
+	Summary        *model.SnapshotDiffSummary   `json:"summary,omitempty"`
+	Pages          []*SnapshotDiffPage          `json:"pages,omitempty"`
+	Metadata       []model.SnapshotDiffMetadata `json:"metadata"`
+	CreateTime     string                       `json:"createTime"`
+	UpdateTime     *string                      `json:"updateTime,omitempty"`
+}
+
+type SnapshotDiffPage struct {
+	Number  int       `json:"number"`
+	Changed float64   `json:"changed"`
+	Image   *Download `json:"image,omitempty"`
+}
+
+type SnapshotDiffCreateOptions struct {
+	SnapshotID     string `json:"snapshotId" validate:"required"`
+	BaseSnapshotID string `json:"baseSnapshotId" validate:"required,nefield=SnapshotID"`
+}
+
+/* A diff pending for longer than this is considered abandoned and is computed again */
+const snapshotDiffStaleAfter = time.Hour
+
+/*
+Returns the diff between the two snapshots, computing it if it hasn't been
+already. A diff that failed, or that has been pending for too long, is
+computed again. Concurrent requests for the same pair share one diff.
+*/
+func (svc *SnapshotDiffService) Create(opts SnapshotDiffCreateOptions, userID string) (*SnapshotDiff, error) {
+	file, err := svc.findCommonFile(opts.SnapshotID, opts.BaseSnapshotID, userID)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := svc.snapshotDiffRepo.FindBySnapshots(opts.SnapshotID, opts.BaseSnapshotID)
+	if err != nil && !errorpkg.IsNotFound(err) {
+		return nil, err
+	}
+	if existing != nil && !svc.needsRecompute(existing) {
+		return svc.snapshotDiffMapper.mapOne(existing), nil
+	}
+	snapshot, err := svc.snapshotCache.Get(opts.SnapshotID)
+	if err != nil {
+		return nil, err
+	}
+	base, err := svc.snapshotCache.Get(opts.BaseSnapshotID)
+	if err != nil {
+		return nil, err
+	}
+	payload := svc.pipelinePayload(snapshot, base)
+	/* Nothing for the pipeline to compare, the metadata is all there is */
+	status := model.SnapshotStatusReady
+	if len(payload) > 0 {
+		status = model.SnapshotStatusWaiting
+	}
+	var diff model.SnapshotDiff
+	if existing == nil {
+		var inserted bool
+		diff, inserted, err = svc.snapshotDiffRepo.Insert(repo.SnapshotDiffInsertOptions{
+			ID:             helper.NewID(),
+			SnapshotID:     snapshot.GetID(),
+			BaseSnapshotID: base.GetID(),
+			Status:         status,
+			Metadata:       svc.compareMetadata(snapshot, base),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !inserted {
+			return svc.snapshotDiffMapper.mapOne(diff), nil
+		}
+	} else {
+		restarted, err := svc.snapshotDiffRepo.Restart(existing.GetID(), repo.SnapshotDiffRestartOptions{
+			Status:      status,
+			Metadata:    svc.compareMetadata(snapshot, base),
+			StaleBefore: time.Now().UTC().Add(-snapshotDiffStaleAfter).Format(time.RFC3339),
+		})
+		if err != nil {
+			return nil, err
+		}
+		diff, err = svc.snapshotDiffRepo.Find(existing.GetID())
+		if err != nil {
+			return nil, err
+		}
+		if !restarted {
+			return svc.snapshotDiffMapper.mapOne(diff), nil
+		}
+		svc.deleteObjects(existing)
+	}
+	if len(payload) == 0 {
+		return svc.snapshotDiffMapper.mapOne(diff), nil
+	}
+	if err := svc.run(diff, snapshot, base, file, payload, userID); err != nil {
+		if err := svc.snapshotDiffRepo.Update(diff.GetID(), repo.SnapshotDiffUpdateOptions{
+			Fields: []string{repo.SnapshotDiffFieldStatus},
+			Status: helper.ToPtr(model.SnapshotStatusError),
+		}); err != nil {
+			log.GetLogger().Error(err)
+		}
+		return nil, err
+	}
+	diff, err = svc.snapshotDiffRepo.Find(diff.GetID())
+	if err != nil {
+		return nil, err
+	}
+	return svc.snapshotDiffMapper.mapOne(diff), nil
+}
+
+func (svc *SnapshotDiffService) needsRecompute(diff model.SnapshotDiff) bool {
+	switch diff.GetStatus() {
+	case model.SnapshotStatusError:
+		return true
+	case model.SnapshotStatusWaiting, model.SnapshotStatusProcessing:
+		lastTime := diff.GetCreateTime()
+		if diff.GetUpdateTime() != nil {
+			lastTime = *diff.GetUpdateTime()
+		}
+		t, err := time.Parse(time.RFC3339, lastTime)
+		if err != nil {
+			return false
+		}
+		return time.Since(t) > snapshotDiffStaleAfter
+	default:
+		return false
+	}
+}
+
+func (svc *SnapshotDiffService) run(diff model.SnapshotDiff, snapshot model.Snapshot, base model.Snapshot, file model.File, payload map[string]string, userID string) error {
+	task, err := svc.taskSvc.insertAndSync(repo.TaskInsertOptions{
+		ID:              helper.NewID(),
+		Name:            "Waiting.",
+		UserID:          userID,
+		IsIndeterminate: true,
+		Status:          model.TaskStatusWaiting,
+		Payload:         map[string]string{"fileId": file.GetID()},
+	})
+	if err != nil {
+		return err
+	}
+	if err := svc.snapshotDiffRepo.Update(diff.GetID(), repo.SnapshotDiffUpdateOptions{
+		Fields: []string{repo.SnapshotDiffFieldTaskID},
+		TaskID: helper.ToPtr(task.GetID()),
+	}); err != nil {
+		return err
+	}
+	payload[client.DiffPayloadID] = diff.GetID()
+	payload[client.DiffPayloadBaseSnapshotID] = base.GetID()
+	payload[client.DiffPayloadBaseBucket] = base.GetOriginal().Bucket
+	return svc.pipelineClient.Run(&client.PipelineRunOptions{
+		PipelineID:  helper.ToPtr(client.PipelineDiff),
+		TaskID:      task.GetID(),
+		SnapshotID:  snapshot.GetID(),
+		Bucket:      snapshot.GetOriginal().Bucket,
+		Key:         snapshot.GetOriginal().Key,
+		Payload:     payload,
+		Priority:    client.PipelinePriorityInteractive,
+		UserID:      userID,
+		WorkspaceID: file.GetWorkspaceID(),
+	})
+}
+
+func (svc *SnapshotDiffService) Find(id string, userID string) (*SnapshotDiff, error) {
+	diff, err := svc.find(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	return svc.snapshotDiffMapper.mapOne(diff), nil
+}
+
+func (svc *SnapshotDiffService) DownloadText(id string, userID string) (*model.S3Object, error) {
+	diff, err := svc.find(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !diff.HasText() {
+		return nil, errorpkg.NewS3ObjectNotFoundError(nil)
+	}
+	return diff.GetText(), nil
+}
+
+func (svc *SnapshotDiffService) DownloadPage(id string, page int, userID string) (*model.S3Object, error) {
+	diff, err := svc.find(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range diff.GetPages() {
+		if p.Number == page && p.Image != nil {
+			return p.Image, nil
+		}
+	}
+	return nil, errorpkg.NewS3ObjectNotFoundError(nil)
+}
+
+type SnapshotDiffPatchOptions struct {
+	Fields  []string                   `json:"fields"`
+	Status  *string                    `json:"status"`
+	Text    *model.S3Object            `json:"text"`
+	Summary *model.SnapshotDiffSummary `json:"summary"`
+	Pages   []model.SnapshotDiffPage   `json:"pages"`
+}
+
+/* Called by the diff pipeline, a diff that is no longer pending lets go of its task */
+func (svc *SnapshotDiffService) Patch(id string, opts SnapshotDiffPatchOptions) (*SnapshotDiff, error) {
+	fields := opts.Fields
+	if opts.Status != nil && helper.Includes(fields, repo.SnapshotDiffFieldStatus) &&
+		(*opts.Status == model.SnapshotStatusReady || *opts.Status == model.SnapshotStatusError) {
+		fields = append(fields, repo.SnapshotDiffFieldTaskID)
+	}
+	if err := svc.snapshotDiffRepo.Update(id, repo.SnapshotDiffUpdateOptions{
+		Fields:  fields,
+		Status:  opts.Status,
+		Text:    opts.Text,
+		Summary: opts.Summary,
+		Pages:   opts.Pages,
+	}); err != nil {
+		return nil, err
+	}
+	diff, err := svc.snapshotDiffRepo.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	return svc.snapshotDiffMapper.mapOne(diff), nil
+}
+
+/* Removes the diffs involving the snapshot along with their S3 objects */
+func (svc *SnapshotDiffService) DeleteAllForSnapshot(snapshotID string) error {
+	diffs, err := svc.snapshotDiffRepo.FindAllForSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+	for _, d := range diffs {
+		if err := svc.delete(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (svc *SnapshotDiffService) delete(diff model.SnapshotDiff) error {
+	svc.deleteObjects(diff)
+	return svc.snapshotDiffRepo.Delete(diff.GetID())
+}
+
+func (svc *SnapshotDiffService) deleteObjects(diff model.SnapshotDiff) {
+	var objects []*model.S3Object
+	if diff.HasText() {
+		objects = append(objects, diff.GetText())
+	}
+	for _, p := range diff.GetPages() {
+		if p.Image != nil {
+			objects = append(objects, p.Image)
+		}
+	}
+	for _, o := range objects {
+		if err := svc.s3.RemoveObject(o.Key, o.Bucket, minio.RemoveObjectOptions{}); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}
+}
+
+func (svc *SnapshotDiffService) find(id string, userID string) (model.SnapshotDiff, error) {
+	diff, err := svc.snapshotDiffRepo.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := svc.findCommonFile(diff.GetSnapshotID(), diff.GetBaseSnapshotID(), userID); err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+/*
+Both snapshots must be versions of a file the user can view. The pages and text
+of a diff can't be stamped, so when either snapshot requires a watermark for the
+user, only the users who can upload versions see the diff.
+*/
+func (svc *SnapshotDiffService) findCommonFile(snapshotID string, baseSnapshotID string, userID string) (model.File, error) {
+	fileIDs, err := svc.fileRepo.GetIDsBySnapshot(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	baseFileIDs, err := svc.fileRepo.GetIDsBySnapshot(baseSnapshotID)
+	if err != nil {
+		return nil, err
+	}
+	if len(fileIDs) == 0 || len(baseFileIDs) == 0 {
+		return nil, errorpkg.NewSnapshotNotFoundError(nil)
+	}
+	var lastErr error = errorpkg.NewSnapshotsNotOfSameFileError()
+	for _, fileID := range fileIDs {
+		if !helper.Includes(baseFileIDs, fileID) {
+			continue
+		}
+		file, err := svc.fileCache.Get(fileID)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := svc.fileGuard.Authorize(userID, file, model.CapabilityRead); err != nil {
+			lastErr = err
+			continue
+		}
+		if err := svc.authorizeUnstamped(file, snapshotID, baseSnapshotID, userID); err != nil {
+			lastErr = err
+			continue
+		}
+		return file, nil
+	}
+	return nil, lastErr
+}
+
+func (svc *SnapshotDiffService) authorizeUnstamped(file model.File, snapshotID string, baseSnapshotID string, userID string) error {
+	for _, id := range []string{snapshotID, baseSnapshotID} {
+		snapshot, err := svc.snapshotCache.Get(id)
+		if err != nil {
+			return err
+		}
+		if err := svc.dynamicWatermarkSvc.AuthorizeUnstamped(userID, file, snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Tells the pipeline which objects to compare, empty when there is nothing to compare */
+func (svc *SnapshotDiffService) pipelinePayload(snapshot model.Snapshot, base model.Snapshot) map[string]string {
+	res := make(map[string]string)
+	if snapshot.HasText() {
+		res[client.DiffPayloadText] = snapshot.GetText().Key
+	}
+	if base.HasText() {
+		res[client.DiffPayloadBaseText] = base.GetText().Key
+	}
+	if svc.hasPDFPreview(snapshot) {
+		res[client.DiffPayloadPreview] = snapshot.GetPreview().Key
+	}
+	if svc.hasPDFPreview(base) {
+		res[client.DiffPayloadBasePreview] = base.GetPreview().Key
+	}
+	return res
+}
+
+func (svc *SnapshotDiffService) hasPDFPreview(snapshot model.Snapshot) bool {
+	return snapshot.HasPreview() && svc.fileIdent.IsPDF(snapshot.GetPreview().GetExtension())
+}
+
+/* Lists the properties that differ, those unknown on both sides are left out */
+func (svc *SnapshotDiffService) compareMetadata(snapshot model.Snapshot, base model.Snapshot) []model.SnapshotDiffMetadata {
+	res := make([]model.SnapshotDiffMetadata, 0)
+	add := func(field string, baseValue interface{}, value interface{}) {
+		if baseValue == nil && value == nil {
+			return
+		}
+		if baseValue != nil && value != nil && baseValue == value {
+			return
+		}
+		res = append(res, model.SnapshotDiffMetadata{Field: field, Base: baseValue, Current: value})
+	}
+	original, baseOriginal := snapshot.GetOriginal(), base.GetOriginal()
+	add(model.SnapshotDiffMetadataSize, objectSize(baseOriginal), objectSize(original))
+	add(model.SnapshotDiffMetadataContentType, objectContentType(baseOriginal), objectContentType(original))
+	add(model.SnapshotDiffMetadataWidth, imageWidth(baseOriginal), imageWidth(original))
+	add(model.SnapshotDiffMetadataHeight, imageHeight(baseOriginal), imageHeight(original))
+	add(model.SnapshotDiffMetadataLanguage, derefString(base.GetLanguage()), derefString(snapshot.GetLanguage()))
+	return res
+}
+
+func objectSize(o *model.S3Object) interface{} {
+	if o == nil || o.Size == nil {
+		return nil
+	}
+	return *o.Size
+}
+
+func objectContentType(o *model.S3Object) interface{} {
+	if o == nil || o.ContentType == "" {
+		return nil
+	}
+	return o.ContentType
+}
+
+func imageWidth(o *model.S3Object) interface{} {
+	if o == nil || o.Image == nil {
+		return nil
+	}
+	return o.Image.Width
+}
+
+func imageHeight(o *model.S3Object) interface{} {
+	if o == nil || o.Image == nil {
+		return nil
+	}
+	return o.Image.Height
+}
+
+func derefString(s *string) interface{} {
+	if s == nil {
+		return nil
+	}
+	return *s
+}
+
+type SnapshotDiffMapper struct {
+	taskCache      *cache.TaskCache
+	snapshotMapper *SnapshotMapper
+}
+
+func NewSnapshotDiffMapper() *SnapshotDiffMapper {
+	return &SnapshotDiffMapper{
+		taskCache:      cache.NewTaskCache(),
+		snapshotMapper: NewSnapshotMapper(),
+	}
+}
+
+func (mp *SnapshotDiffMapper) mapOne(m model.SnapshotDiff) *SnapshotDiff {
+	res := &SnapshotDiff{
+		ID:             m.GetID(),
+		SnapshotID:     m.GetSnapshotID(),
+		BaseSnapshotID: m.GetBaseSnapshotID(),
+		Status:         m.GetStatus(),
+		Summary:        m.GetSummary(),
+		Metadata:       m.GetMetadata(),
+		CreateTime:     m.GetCreateTime(),
+		UpdateTime:     m.GetUpdateTime(),
+	}
+	if res.Metadata == nil {
+		res.Metadata = make([]model.SnapshotDiffMetadata, 0)
+	}
+	if m.HasText() {
+		res.Text = mp.snapshotMapper.mapS3Object(m.GetText())
+	}
+	for _, p := range m.GetPages() {
+		page := &SnapshotDiffPage{
+			Number:  p.Number,
+			Changed: p.Changed,
+		}
+		if p.Image != nil {
+			page.Image = mp.snapshotMapper.mapS3Object(p.Image)
+		}
+		res.Pages = append(res.Pages, page)
+	}
+	if m.GetTaskID() != nil {
+		res.Task = &TaskInfo{ID: *m.GetTaskID()}
+		task, err := mp.taskCache.Get(*m.GetTaskID())
+		if err != nil {
+			log.GetLogger().Error(err)
+		} else {
+			res.Task.IsPending = task.GetStatus() == model.TaskStatusWaiting || task.GetStatus() == model.TaskStatusRunning
+		}
+	}
+	return res
+}
@@ -13,6 +13,7 @@ package service
 import (
 	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 	"voltaserve/cache"
 	"voltaserve/client"
@@ -20,37 +21,50 @@ import (
 	"voltaserve/errorpkg"
 	"voltaserve/guard"
 	"voltaserve/helper"
+	"voltaserve/infra"
 	"voltaserve/log"
 	"voltaserve/model"
 	"voltaserve/repo"
 	"voltaserve/search"
+
+	"github.com/minio/minio-go/v7"
 )
 
 type SnapshotService struct {
-	snapshotRepo   repo.SnapshotRepo
-	snapshotCache  *cache.SnapshotCache
-	snapshotMapper *SnapshotMapper
-	fileCache      *cache.FileCache
-	fileGuard      *guard.FileGuard
-	fileRepo       repo.FileRepo
-	fileSearch     *search.FileSearch
-	fileMapper     *FileMapper
-	taskCache      *cache.TaskCache
-	config         *config.Config
+	snapshotRepo        repo.SnapshotRepo
+	snapshotCache       *cache.SnapshotCache
+	snapshotMapper      *SnapshotMapper
+	fileCache           *cache.FileCache
+	fileGuard           *guard.FileGuard
+	fileRepo            repo.FileRepo
+	fileSearch          *search.FileSearch
+	fileMapper          *FileMapper
+	taskCache           *cache.TaskCache
+	diffSvc             *SnapshotDiffService
+	blobSvc             *BlobService
+	dynamicWatermarkSvc *DynamicWatermarkService
+	mosaicClient        *client.MosaicClient
+	s3                  *infra.S3Manager
+	config              *config.Config
 }
 
 func NewSnapshotService() *SnapshotService {
 	return &SnapshotService{
-		snapshotRepo:   repo.NewSnapshotRepo(),
-		snapshotCache:  cache.NewSnapshotCache(),
-		snapshotMapper: NewSnapshotMapper(),
-		fileCache:      cache.NewFileCache(),
-		fileGuard:      guard.NewFileGuard(),
-		fileSearch:     search.NewFileSearch(),
-		fileMapper:     NewFileMapper(),
-		fileRepo:       repo.NewFileRepo(),
-		taskCache:      cache.NewTaskCache(),
-		config:         config.GetConfig(),
+		snapshotRepo:        repo.NewSnapshotRepo(),
+		snapshotCache:       cache.NewSnapshotCache(),
+		snapshotMapper:      NewSnapshotMapper(),
+		fileCache:           cache.NewFileCache(),
+		fileGuard:           guard.NewFileGuard(),
+		fileSearch:          search.NewFileSearch(),
+		fileMapper:          NewFileMapper(),
+		fileRepo:            repo.NewFileRepo(),
+		taskCache:           cache.NewTaskCache(),
+		diffSvc:             NewSnapshotDiffService(),
+		blobSvc:             NewBlobService(),
+		dynamicWatermarkSvc: NewDynamicWatermarkService(),
+		mosaicClient:        client.NewMosaicClient(),
+		s3:                  infra.NewS3Manager(),
+		config:              config.GetConfig(),
 	}
 }
 
@@ -59,6 +73,10 @@ type SnapshotListOptions struct {
 	Size      uint
 	SortBy    string
 	SortOrder string
+	/* Optional, matched case-insensitively */
+	Label *string
+	/* Optional, keeps only the labelled versions, or only the unlabelled ones */
+	IsLabelled *bool
 }
 
 type Snapshot struct {
@@ -73,6 +91,9 @@ type Snapshot struct {
 	Watermark  *Download `json:"watermark,omitempty"`
 	Thumbnail  *Download `json:"thumbnail,omitempty"`
 	Language   *string   `json:"language,omitempty"`
+	Label      *string   `json:"label,omitempty"`
+	Comment    *string   `json:"comment,omitempty"`
+	UserID     *string   `json:"userId,omitempty"`
 	Status     string    `json:"status,omitempty"`
 	IsActive   bool      `json:"isActive"`
 	Task       *TaskInfo `json:"task,omitempty"`
@@ -86,9 +107,10 @@ type TaskInfo struct {
 }
 
 type Download struct {
-	Extension string      `json:"extension,omitempty"`
-	Size      *int64      `json:"size,omitempty"`
-	Image     *ImageProps `json:"image,omitempty"`
+	Extension   string      `json:"extension,omitempty"`
+	Size        *int64      `json:"size,omitempty"`
+	Image       *ImageProps `json:"image,omitempty"`
+	ContentType string      `json:"contentType,omitempty"`
 }
 
 type Thumbnail struct {
@@ -120,7 +142,7 @@ func (svc *SnapshotService) List(fileID string, opts SnapshotListOptions, userID
 	if err != nil {
 		return nil, err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionOwner); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityManageVersions); err != nil {
 		return nil, err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -132,19 +154,12 @@ func (svc *SnapshotService) List(fileID string, opts SnapshotListOptions, userID
 	if opts.SortOrder == "" {
 		opts.SortOrder = SortOrderAsc
 	}
-	ids, err := svc.snapshotRepo.GetIDsForFile(fileID)
+	/* Loaded along with the mappings, which hold the labels and comments */
+	snapshots, err := svc.snapshotRepo.FindAllForFile(fileID)
 	if err != nil {
 		return nil, err
 	}
-	var snapshots []model.Snapshot
-	for _, id := range ids {
-		var s model.Snapshot
-		s, err := svc.snapshotCache.Get(id)
-		if err != nil {
-			return nil, err
-		}
-		snapshots = append(snapshots, s)
-	}
+	snapshots = svc.doFiltering(snapshots, opts)
 	sorted := svc.doSorting(snapshots, opts.SortBy, opts.SortOrder)
 	paged, totalElements, totalPages := svc.doPagination(sorted, opts.Page, opts.Size)
 	mapped := NewSnapshotMapper().mapMany(paged, *file.GetSnapshotID())
@@ -157,6 +172,20 @@ func (svc *SnapshotService) List(fileID string, opts SnapshotListOptions, userID
 	}, nil
 }
 
+func (svc *SnapshotService) doFiltering(data []model.Snapshot, opts SnapshotListOptions) []model.Snapshot {
+	res := make([]model.Snapshot, 0)
+	for _, s := range data {
+		if opts.IsLabelled != nil && (s.GetLabel() != nil) != *opts.IsLabelled {
+			continue
+		}
+		if opts.Label != nil && (s.GetLabel() == nil || !strings.EqualFold(*s.GetLabel(), strings.TrimSpace(*opts.Label))) {
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
 func (svc *SnapshotService) doSorting(data []model.Snapshot, sortBy string, sortOrder string) []model.Snapshot {
 	if sortBy == SortByVersion {
 		sort.Slice(data, func(i, j int) bool {
@@ -220,7 +249,7 @@ func (svc *SnapshotService) Activate(id string, opts SnapshotActivateOptions, us
 	if err != nil {
 		return nil, err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionOwner); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityManageVersions); err != nil {
 		return nil, err
 	}
 	if _, err := svc.snapshotCache.Get(id); err != nil {
@@ -244,6 +273,94 @@ func (svc *SnapshotService) Activate(id string, opts SnapshotActivateOptions, us
 	return res, nil
 }
 
+type SnapshotPatchLabelOptions struct {
+	FileID string `json:"fileId" validate:"required"`
+	/* Clears the label when empty */
+	Label *string `json:"label" validate:"omitempty,max=64"`
+}
+
+func (svc *SnapshotService) PatchLabel(id string, opts SnapshotPatchLabelOptions, userID string) (*Snapshot, error) {
+	file, err := svc.findForEdit(id, opts.FileID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := svc.snapshotRepo.UpdateMapping(id, file.GetID(), repo.SnapshotMappingUpdateOptions{
+		Fields: []string{repo.SnapshotMappingFieldLabel},
+		Label:  normalizeSnapshotLabel(opts.Label),
+	}); err != nil {
+		return nil, err
+	}
+	return svc.findForFile(id, file)
+}
+
+type SnapshotPatchCommentOptions struct {
+	FileID string `json:"fileId" validate:"required"`
+	/* Clears the comment when empty */
+	Comment *string `json:"comment" validate:"omitempty,max=1000"`
+}
+
+func (svc *SnapshotService) PatchComment(id string, opts SnapshotPatchCommentOptions, userID string) (*Snapshot, error) {
+	file, err := svc.findForEdit(id, opts.FileID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := svc.snapshotRepo.UpdateMapping(id, file.GetID(), repo.SnapshotMappingUpdateOptions{
+		Fields:  []string{repo.SnapshotMappingFieldComment},
+		Comment: normalizeSnapshotComment(opts.Comment),
+	}); err != nil {
+		return nil, err
+	}
+	return svc.findForFile(id, file)
+}
+
+/*
+The snapshot must belong to the file, the file is what permissions are granted
+on. Labels and comments are edited on the mapping, so copies of the file that
+share the snapshot keep their own.
+*/
+func (svc *SnapshotService) findForEdit(id string, fileID string, userID string) (model.File, error) {
+	file, err := svc.fileCache.Get(fileID)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityComment); err != nil {
+		return nil, err
+	}
+	ids, err := svc.snapshotRepo.GetIDsForFile(file.GetID())
+	if err != nil {
+		return nil, err
+	}
+	if !helper.Includes(ids, id) {
+		return nil, errorpkg.NewSnapshotNotFoundError(nil)
+	}
+	return file, nil
+}
+
+func (svc *SnapshotService) findForFile(id string, file model.File) (*Snapshot, error) {
+	snapshot, err := svc.snapshotRepo.FindForFile(id, file.GetID())
+	if err != nil {
+		return nil, err
+	}
+	res := svc.snapshotMapper.mapOne(snapshot)
+	res.IsActive = file.GetSnapshotID() != nil && *file.GetSnapshotID() == snapshot.GetID()
+	return res, nil
+}
+
+/* Blank labels and comments are the same as none */
+func normalizeSnapshotLabel(label *string) *string {
+	if label == nil || strings.TrimSpace(*label) == "" {
+		return nil
+	}
+	return helper.ToPtr(strings.TrimSpace(*label))
+}
+
+func normalizeSnapshotComment(comment *string) *string {
+	if comment == nil || strings.TrimSpace(*comment) == "" {
+		return nil
+	}
+	return comment
+}
+
 type SnapshotDetachOptions struct {
 	FileID string `json:"fileID" validate:"required"`
 }
@@ -253,10 +370,11 @@ func (svc *SnapshotService) Detach(id string, opts SnapshotDetachOptions, userID
 	if err != nil {
 		return err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionOwner); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityManageVersions); err != nil {
 		return err
 	}
-	if _, err := svc.snapshotCache.Get(id); err != nil {
+	snapshot, err := svc.snapshotCache.Get(id)
+	if err != nil {
 		return err
 	}
 	if err := svc.snapshotRepo.Detach(id, file.GetID()); err != nil {
@@ -267,6 +385,9 @@ func (svc *SnapshotService) Detach(id string, opts SnapshotDetachOptions, userID
 		return err
 	}
 	if associationCount == 0 {
+		if err := svc.deleteObjects(snapshot); err != nil {
+			return err
+		}
 		if err := svc.snapshotRepo.Delete(id); err != nil {
 			return err
 		}
@@ -277,6 +398,89 @@ func (svc *SnapshotService) Detach(id string, opts SnapshotDetachOptions, userID
 	return nil
 }
 
+/* Deletes the snapshots among these that no file refers to anymore, along with their S3 objects */
+func (svc *SnapshotService) deleteUnreferenced(ids []string) error {
+	for _, id := range ids {
+		associationCount, err := svc.snapshotRepo.CountAssociations(id)
+		if err != nil {
+			return err
+		}
+		if associationCount > 0 {
+			continue
+		}
+		snapshot, err := svc.snapshotRepo.Find(id)
+		if err != nil {
+			if errorpkg.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if err := svc.deleteObjects(snapshot); err != nil {
+			return err
+		}
+		if err := svc.snapshotRepo.Delete(id); err != nil {
+			return err
+		}
+		if err := svc.snapshotCache.Delete(id); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}
+	return nil
+}
+
+/*
+Removes the S3 objects of a snapshot no file refers to anymore, including its
+mosaic, its watermarked downloads and the diffs it's part of. An original in the blob store is only
+released, other snapshots might refer to it. Objects that can't be removed
+are only logged, the snapshot is gone either way.
+*/
+func (svc *SnapshotService) deleteObjects(snapshot model.Snapshot) error {
+	keys := make(map[string]bool)
+	if snapshot.GetBlobID() != nil {
+		if err := svc.blobSvc.Release(*snapshot.GetBlobID()); err != nil {
+			log.GetLogger().Error(err)
+		}
+		/* The preview of a PDF is the original itself, so it goes with the blob */
+		if snapshot.HasOriginal() {
+			keys[snapshot.GetOriginal().Bucket+"/"+snapshot.GetOriginal().Key] = true
+		}
+		/* The artifacts sit next to the blobs in the shared bucket, under the ID of the snapshot */
+		if err := svc.s3.RemoveObjectsWithPrefix(snapshot.GetID()+"/", svc.config.S3.BlobBucket); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}
+	for _, o := range []*model.S3Object{
+		snapshot.GetOriginal(),
+		snapshot.GetPreview(),
+		snapshot.GetText(),
+		snapshot.GetOCR(),
+		snapshot.GetEntities(),
+		snapshot.GetWatermark(),
+		snapshot.GetThumbnail(),
+	} {
+		/* The preview of a PDF is the original itself */
+		if o == nil || keys[o.Bucket+"/"+o.Key] {
+			continue
+		}
+		keys[o.Bucket+"/"+o.Key] = true
+		if err := svc.s3.RemoveObject(o.Key, o.Bucket, minio.RemoveObjectOptions{}); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}
+	if err := svc.dynamicWatermarkSvc.DeleteAll(snapshot); err != nil {
+		log.GetLogger().Error(err)
+	}
+	if snapshot.HasMosaic() {
+		if err := svc.mosaicClient.Delete(client.MosaicDeleteOptions{
+			S3Key:    filepath.FromSlash(snapshot.GetID()),
+			S3Bucket: snapshot.GetMosaic().Bucket,
+		}); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}
+	return svc.diffSvc.DeleteAllForSnapshot(snapshot.GetID())
+}
+
 type SnapshotPatchOptions struct {
 	Options   client.PipelineRunOptions `json:"options"`
 	Fields    []string                  `json:"fields"`
@@ -330,6 +534,14 @@ func (svc *SnapshotService) Patch(id string, opts SnapshotPatchOptions) (*Snapsh
 	return svc.snapshotMapper.mapOne(snapshot), nil
 }
 
+/* What the snapshot adds to the size of the files it's mapped to */
+func originalSize(snapshot model.Snapshot) int64 {
+	if snapshot.HasOriginal() && snapshot.GetOriginal().Size != nil {
+		return *snapshot.GetOriginal().Size
+	}
+	return 0
+}
+
 func (svc *SnapshotService) IsTaskPending(snapshot model.Snapshot) (*bool, error) {
 	return isTaskPending(snapshot, svc.taskCache)
 }
@@ -363,6 +575,9 @@ func (mp *SnapshotMapper) mapOne(m model.Snapshot) *Snapshot {
 		Version:    m.GetVersion(),
 		Status:     m.GetStatus(),
 		Language:   m.GetLanguage(),
+		Label:      m.GetLabel(),
+		Comment:    m.GetComment(),
+		UserID:     m.GetUserID(),
 		CreateTime: m.GetCreateTime(),
 		UpdateTime: m.GetUpdateTime(),
 	}
@@ -422,8 +637,9 @@ type ImageProps struct {
 
 func (mp *SnapshotMapper) mapS3Object(o *model.S3Object) *Download {
 	download := &Download{
-		Extension: filepath.Ext(o.Key),
-		Size:      o.Size,
+		Extension:   o.GetExtension(),
+		Size:        o.Size,
+		ContentType: o.ContentType,
 	}
 	if o.Image != nil {
 		download.Image = &ImageProps{
@@ -13,6 +13,7 @@ package service
 import (
 	"voltaserve/cache"
 	"voltaserve/guard"
+	"voltaserve/log"
 	"voltaserve/model"
 	"voltaserve/repo"
 )
@@ -24,6 +25,7 @@ type StorageService struct {
 	fileRepo       repo.FileRepo
 	fileCache      *cache.FileCache
 	fileGuard      *guard.FileGuard
+	outboxSvc      *OutboxService
 	storageMapper  *storageMapper
 }
 
@@ -35,14 +37,20 @@ func NewStorageService() *StorageService {
 		fileRepo:       repo.NewFileRepo(),
 		fileCache:      cache.NewFileCache(),
 		fileGuard:      guard.NewFileGuard(),
+		outboxSvc:      NewOutboxService(),
 		storageMapper:  newStorageMapper(),
 	}
 }
 
+/*
+Bytes is the logical usage, what the quota is charged with, originals shared
+by several snapshots count for each of them. PhysicalBytes counts them once.
+*/
 type StorageUsage struct {
-	Bytes      int64 `json:"bytes"`
-	MaxBytes   int64 `json:"maxBytes"`
-	Percentage int   `json:"percentage"`
+	Bytes         int64 `json:"bytes"`
+	PhysicalBytes int64 `json:"physicalBytes"`
+	MaxBytes      int64 `json:"maxBytes"`
+	Percentage    int   `json:"percentage"`
 }
 
 func (svc *StorageService) GetAccountUsage(userID string) (*StorageUsage, error) {
@@ -63,6 +71,7 @@ func (svc *StorageService) GetAccountUsage(userID string) (*StorageUsage, error)
 	}
 	var maxBytes int64 = 0
 	var b int64 = 0
+	rootIDs := []string{}
 	for _, w := range workspaces {
 		root, err := svc.fileCache.Get(w.GetRootID())
 		if err != nil {
@@ -74,8 +83,17 @@ func (svc *StorageService) GetAccountUsage(userID string) (*StorageUsage, error)
 		}
 		b = b + size
 		maxBytes = maxBytes + w.GetStorageCapacity()
+		rootIDs = append(rootIDs, root.GetID())
 	}
-	return svc.storageMapper.mapStorageUsage(b, maxBytes), nil
+	/* Across all workspaces at once, as they can share originals */
+	var physicalBytes int64 = 0
+	if len(rootIDs) > 0 {
+		physicalBytes, err = svc.fileRepo.GetPhysicalSize(rootIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return svc.storageMapper.mapStorageUsage(b, physicalBytes, maxBytes), nil
 }
 
 func (svc *StorageService) GetWorkspaceUsage(workspaceID string, userID string) (*StorageUsage, error) {
@@ -90,14 +108,18 @@ func (svc *StorageService) GetWorkspaceUsage(workspaceID string, userID string)
 	if err != nil {
 		return nil, err
 	}
-	if err = svc.fileGuard.Authorize(userID, root, model.PermissionViewer); err != nil {
+	if err = svc.fileGuard.Authorize(userID, root, model.CapabilityRead); err != nil {
 		return nil, err
 	}
 	size, err := svc.fileRepo.GetSize(root.GetID())
 	if err != nil {
 		return nil, err
 	}
-	return svc.storageMapper.mapStorageUsage(size, workspace.GetStorageCapacity()), nil
+	physicalSize, err := svc.fileRepo.GetPhysicalSize([]string{root.GetID()})
+	if err != nil {
+		return nil, err
+	}
+	return svc.storageMapper.mapStorageUsage(size, physicalSize, workspace.GetStorageCapacity()), nil
 }
 
 func (svc *StorageService) GetFileUsage(fileID string, userID string) (*StorageUsage, error) {
@@ -105,18 +127,64 @@ func (svc *StorageService) GetFileUsage(fileID string, userID string) (*StorageU
 	if err != nil {
 		return nil, err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityRead); err != nil {
 		return nil, err
 	}
 	size, err := svc.fileRepo.GetSize(file.GetID())
 	if err != nil {
 		return nil, err
 	}
+	physicalSize, err := svc.fileRepo.GetPhysicalSize([]string{file.GetID()})
+	if err != nil {
+		return nil, err
+	}
 	workspace, err := svc.workspaceCache.Get(file.GetWorkspaceID())
 	if err != nil {
 		return nil, err
 	}
-	return svc.storageMapper.mapStorageUsage(size, workspace.GetStorageCapacity()), nil
+	return svc.storageMapper.mapStorageUsage(size, physicalSize, workspace.GetStorageCapacity()), nil
+}
+
+/*
+Recomputes the sizes and counts of every file from scratch, they are
+maintained incrementally otherwise. Meant to be run when they drifted, or
+once after upgrading from a version that didn't have them.
+*/
+func (svc *StorageService) RepairAggregates() error {
+	ids, err := svc.workspaceRepo.GetIDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		count, eventIDs, err := svc.fileRepo.RecomputeAggregates(id)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			log.GetLogger().Infow("repaired aggregates", "workspace", id, "count", count)
+		}
+		/* Cache the repaired values */
+		svc.outboxSvc.Dispatch(eventIDs...)
+	}
+	return nil
+}
+
+/*
+Adds the pending changes to the sizes and counts of the files and their
+ancestors, batch after batch until there are none left.
+*/
+func (svc *StorageService) FoldAggregates() error {
+	for {
+		count, eventIDs, err := svc.fileRepo.FoldAggregateDeltas()
+		if err != nil {
+			return err
+		}
+		/* Cache the new values */
+		svc.outboxSvc.Dispatch(eventIDs...)
+		if count < repo.FileAggregateFoldBatchSize {
+			return nil
+		}
+	}
 }
 
 type storageMapper struct {
@@ -126,10 +194,11 @@ func newStorageMapper() *storageMapper {
 	return &storageMapper{}
 }
 
-func (mp *storageMapper) mapStorageUsage(byteCount int64, maxBytes int64) *StorageUsage {
+func (mp *storageMapper) mapStorageUsage(byteCount int64, physicalByteCount int64, maxBytes int64) *StorageUsage {
 	res := StorageUsage{
-		Bytes:    byteCount,
-		MaxBytes: maxBytes,
+		Bytes:         byteCount,
+		PhysicalBytes: physicalByteCount,
+		MaxBytes:      maxBytes,
 	}
 	if maxBytes != 0 {
 		res.Percentage = int(byteCount * 100 / maxBytes)
@@ -11,29 +11,64 @@
 package service
 
 import (
+	"errors"
+	"fmt"
+	"runtime/debug"
 	"sort"
 	"time"
 	"voltaserve/cache"
+	"voltaserve/client"
 	"voltaserve/errorpkg"
 	"voltaserve/helper"
+	"voltaserve/infra"
+	"voltaserve/log"
 	"voltaserve/model"
 	"voltaserve/repo"
 	"voltaserve/search"
 )
 
 type TaskService struct {
-	taskMapper *taskMapper
-	taskCache  *cache.TaskCache
-	taskSearch *search.TaskSearch
-	taskRepo   repo.TaskRepo
+	taskMapper     *taskMapper
+	taskCache      *cache.TaskCache
+	taskSearch     *search.TaskSearch
+	taskRepo       repo.TaskRepo
+	pipelineClient *client.PipelineClient
+	redis          *infra.RedisManager
 }
 
+/*
+Set in the payload of the tasks the API runs itself, e.g. copying a folder,
+rather than a pipeline of the conversion service.
+*/
+const TaskPayloadOperation = "operation"
+
+const (
+	TaskOperationCopy    = "copy"
+	TaskOperationMove    = "move"
+	TaskOperationDelete  = "delete"
+	TaskOperationExtract = "extract"
+)
+
+/* Long enough for any operation to notice it got canceled */
+const taskCancelTTL = 24 * time.Hour
+
+/*
+Operations renew their heartbeat while they run, a running operation without
+one was interrupted, e.g. by a restart, and gets reaped.
+*/
+const (
+	taskHeartbeatInterval = 30 * time.Second
+	taskHeartbeatTTL      = 2 * time.Minute
+)
+
 func NewTaskService() *TaskService {
 	return &TaskService{
-		taskMapper: newTaskMapper(),
-		taskCache:  cache.NewTaskCache(),
-		taskSearch: search.NewTaskSearch(),
-		taskRepo:   repo.NewTaskRepo(),
+		taskMapper:     newTaskMapper(),
+		taskCache:      cache.NewTaskCache(),
+		taskSearch:     search.NewTaskSearch(),
+		taskRepo:       repo.NewTaskRepo(),
+		pipelineClient: client.NewPipelineClient(),
+		redis:          infra.NewRedisManager(),
 	}
 }
 
@@ -77,6 +112,7 @@ func (svc *TaskService) Create(opts TaskCreateOptions) (*Task, error) {
 	return res, nil
 }
 
+/* The payload is merged into the task's one, an empty value removes the entry */
 type TaskPatchOptions struct {
 	Fields          []string          `json:"fields"`
 	Name            *string           `json:"name"`
@@ -122,7 +158,19 @@ func (svc *TaskService) Patch(id string, opts TaskPatchOptions) (*Task, error) {
 		task.SetStatus(*opts.Status)
 	}
 	if helper.Includes(opts.Fields, TaskFieldPayload) {
-		task.SetPayload(opts.Payload)
+		/* Merge so patching one entry doesn't drop the others, e.g. fileId */
+		payload := task.GetPayload()
+		if payload == nil {
+			payload = make(map[string]string)
+		}
+		for k, v := range opts.Payload {
+			if v == "" {
+				delete(payload, k)
+			} else {
+				payload[k] = v
+			}
+		}
+		task.SetPayload(payload)
 	}
 	if err := svc.saveAndSync(task); err != nil {
 		return nil, err
@@ -306,6 +354,217 @@ func (svc *TaskService) Dismiss(id string, userID string) error {
 	return svc.deleteAndSync(id)
 }
 
+/*
+Asks the conversion service to stop the task's pipeline, the conversion
+service deletes the task once the pipeline is stopped. Operations run by the
+API stop at their next checkpoint, and delete the task themselves.
+*/
+func (svc *TaskService) Cancel(id string, userID string) error {
+	task, err := svc.taskCache.Get(id)
+	if err != nil {
+		return err
+	}
+	if task.GetUserID() != userID {
+		return errorpkg.NewTaskBelongsToAnotherUserError(nil)
+	}
+	if task.GetStatus() == model.TaskStatusError {
+		return errorpkg.NewTaskHasFailedError(nil)
+	}
+	if task.GetPayload()[TaskPayloadOperation] != "" {
+		if _, err := svc.redis.SetNX(svc.cancelKey(id), time.Now().UTC().Format(time.RFC3339), taskCancelTTL); err != nil {
+			return err
+		}
+	} else if err := svc.pipelineClient.Cancel(&client.PipelineCancelOptions{TaskID: id}); err != nil {
+		return err
+	}
+	task.SetName("Canceling.")
+	if err := svc.saveAndSync(task); err != nil {
+		return err
+	}
+	return nil
+}
+
+/* Tells whether the cancellation of an operation run by the API was requested */
+func (svc *TaskService) IsCanceled(id string) bool {
+	_, err := svc.redis.Get(svc.cancelKey(id))
+	return err == nil
+}
+
+func (svc *TaskService) cancelKey(id string) string {
+	return "task:" + id + ":cancel"
+}
+
+func (svc *TaskService) heartbeatKey(id string) string {
+	return "task:" + id + ":heartbeat"
+}
+
+/* Marks the operations that stopped without finishing as failed, so they can be dismissed */
+func (svc *TaskService) ReapOrphaned() error {
+	tasks, err := svc.taskRepo.FindRunningOperations()
+	if err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		if _, err := svc.redis.Get(svc.heartbeatKey(t.GetID())); err == nil {
+			continue
+		}
+		svc.fail(t.GetID(), errors.New("the operation was interrupted"))
+		if err := svc.redis.Delete(svc.cancelKey(t.GetID())); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}
+	return nil
+}
+
+var errTaskCanceled = errors.New("task canceled")
+
+/*
+Runs an operation in the background, the returned task reports its progress.
+The task is deleted when the operation succeeds or gets canceled, and kept
+with the error when it fails, until dismissed.
+*/
+func (svc *TaskService) runOperation(name string, operation string, userID string, payload map[string]string, fn func(progress *taskProgress) error) (*Task, error) {
+	if payload == nil {
+		payload = make(map[string]string)
+	}
+	payload[TaskPayloadOperation] = operation
+	task, err := svc.insertAndSync(repo.TaskInsertOptions{
+		ID:         helper.NewID(),
+		Name:       name,
+		Percentage: helper.ToPtr(0),
+		UserID:     userID,
+		Status:     model.TaskStatusRunning,
+		Payload:    payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+	res, err := svc.taskMapper.mapOne(task)
+	if err != nil {
+		return nil, err
+	}
+	if err := svc.redis.SetEx(svc.heartbeatKey(task.GetID()), "1", taskHeartbeatTTL); err != nil {
+		return nil, err
+	}
+	go func(task model.Task) {
+		stop := svc.beat(task.GetID())
+		err := svc.call(fn, &taskProgress{taskSvc: svc, task: task})
+		stop()
+		if err == nil || errors.Is(err, errTaskCanceled) {
+			if err := svc.deleteAndSync(task.GetID()); err != nil {
+				log.GetLogger().Error(err)
+			}
+		} else {
+			svc.fail(task.GetID(), err)
+		}
+		for _, key := range []string{svc.cancelKey(task.GetID()), svc.heartbeatKey(task.GetID())} {
+			if err := svc.redis.Delete(key); err != nil {
+				log.GetLogger().Error(err)
+			}
+		}
+	}(task)
+	return res, nil
+}
+
+/* A panic fails the task rather than the whole API */
+func (svc *TaskService) call(fn func(progress *taskProgress) error, progress *taskProgress) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.GetLogger().Errorw("operation panicked", "task", progress.task.GetID(), "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("unexpected error: %v", r)
+		}
+	}()
+	return fn(progress)
+}
+
+/* Renews the heartbeat of the task until the returned function is called */
+func (svc *TaskService) beat(id string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(taskHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := svc.redis.SetEx(svc.heartbeatKey(id), "1", taskHeartbeatTTL); err != nil {
+					log.GetLogger().Error(err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+/* Reloads the task before saving the error, not to undo changes made since it started */
+func (svc *TaskService) fail(id string, err error) {
+	task, findErr := svc.taskRepo.Find(id)
+	if findErr != nil {
+		log.GetLogger().Error(findErr)
+		return
+	}
+	value := err.Error()
+	task.SetError(&value)
+	task.SetStatus(model.TaskStatusError)
+	if err := svc.saveAndSync(task); err != nil {
+		log.GetLogger().Error(err)
+	}
+}
+
+/* Reports the progress of an operation to its task, a nil progress is a no-op */
+type taskProgress struct {
+	taskSvc    *TaskService
+	task       model.Task
+	total      int
+	done       int
+	percentage int
+}
+
+func (p *taskProgress) setTotal(total int) {
+	if p == nil {
+		return
+	}
+	p.total = total
+}
+
+/* Records that count more items are done, returns errTaskCanceled if the task got canceled */
+func (p *taskProgress) advance(count int) error {
+	if p == nil {
+		return nil
+	}
+	if p.taskSvc.IsCanceled(p.task.GetID()) {
+		return errTaskCanceled
+	}
+	p.done += count
+	if p.total == 0 {
+		return nil
+	}
+	/* Only save when the percentage changes, to avoid a write per item */
+	percentage := min(p.done*100/p.total, 100)
+	if percentage != p.percentage {
+		p.percentage = percentage
+		if err := p.taskSvc.updatePercentage(p.task.GetID(), percentage); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}
+	return nil
+}
+
+func (svc *TaskService) updatePercentage(id string, percentage int) error {
+	if err := svc.taskRepo.UpdatePercentage(id, percentage); err != nil {
+		return err
+	}
+	task, err := svc.taskCache.Refresh(id)
+	if err != nil {
+		return err
+	}
+	if err := svc.taskSearch.Update([]model.Task{task}); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (svc *TaskService) Delete(id string) error {
 	return svc.deleteAndSync(id)
 }
@@ -0,0 +1,243 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"time"
+	"voltaserve/cache"
+	"voltaserve/config"
+	"voltaserve/errorpkg"
+	"voltaserve/guard"
+	"voltaserve/log"
+	"voltaserve/model"
+	"voltaserve/repo"
+)
+
+/*
+TrashService manages the files deleted with FileService.Delete, they can be
+restored until they are purged, either explicitly or once the retention
+period is over.
+*/
+type TrashService struct {
+	fileRepo       repo.FileRepo
+	fileCache      *cache.FileCache
+	fileGuard      *guard.FileGuard
+	fileMapper     *FileMapper
+	workspaceCache *cache.WorkspaceCache
+	workspaceGuard *guard.WorkspaceGuard
+	snapshotRepo   repo.SnapshotRepo
+	snapshotCache  *cache.SnapshotCache
+	snapshotSvc    *SnapshotService
+	outboxSvc      *OutboxService
+	config         *config.Config
+}
+
+func NewTrashService() *TrashService {
+	return &TrashService{
+		fileRepo:       repo.NewFileRepo(),
+		fileCache:      cache.NewFileCache(),
+		fileGuard:      guard.NewFileGuard(),
+		fileMapper:     NewFileMapper(),
+		workspaceCache: cache.NewWorkspaceCache(),
+		workspaceGuard: guard.NewWorkspaceGuard(),
+		snapshotRepo:   repo.NewSnapshotRepo(),
+		snapshotCache:  cache.NewSnapshotCache(),
+		snapshotSvc:    NewSnapshotService(),
+		outboxSvc:      NewOutboxService(),
+		config:         config.GetConfig(),
+	}
+}
+
+type TrashRestoreOptions struct {
+	IDs []string `json:"ids" validate:"required"`
+	/* Where to restore to when the original parent is gone, trashed or not writable */
+	TargetID *string `json:"targetId,omitempty"`
+}
+
+func (svc *TrashService) List(workspaceID string, userID string) ([]*File, error) {
+	workspace, err := svc.workspaceCache.Get(workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.workspaceGuard.Authorize(userID, workspace, model.PermissionViewer); err != nil {
+		return nil, err
+	}
+	trash, err := svc.fileRepo.FindTrash(workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	var authorized []model.File
+	for _, f := range trash {
+		if svc.fileGuard.IsAuthorized(userID, f, model.CapabilityRead) {
+			authorized = append(authorized, f)
+		}
+	}
+	res, err := svc.fileMapper.mapMany(authorized, userID)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (svc *TrashService) Restore(opts TrashRestoreOptions, userID string) ([]*File, error) {
+	var res []*File
+	for _, id := range opts.IDs {
+		file, err := svc.findTrashed(id, userID)
+		if err != nil {
+			return nil, err
+		}
+		var target model.File
+		if opts.TargetID != nil {
+			target, err = svc.findTarget(*opts.TargetID, file, userID)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			target, err = svc.findTarget(*file.GetTrashParentID(), file, userID)
+			if err != nil {
+				return nil, errorpkg.NewRestoreTargetRequiredError(file)
+			}
+		}
+		eventIDs, err := svc.fileRepo.Restore(file.GetID(), target.GetID())
+		if err != nil {
+			return nil, err
+		}
+		/* Index and cache the restored tree */
+		svc.outboxSvc.Dispatch(eventIDs...)
+		file, err = svc.fileCache.Get(file.GetID())
+		if err != nil {
+			return nil, err
+		}
+		mapped, err := svc.fileMapper.mapOne(file, userID)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, mapped)
+	}
+	return res, nil
+}
+
+/* Purges a file from the trash, it can't be restored afterwards */
+func (svc *TrashService) Purge(id string, userID string) error {
+	file, err := svc.findTrashed(id, userID)
+	if err != nil {
+		return err
+	}
+	return svc.purge(file)
+}
+
+/* Purges everything in the workspace's trash the user owns */
+func (svc *TrashService) Empty(workspaceID string, userID string) error {
+	workspace, err := svc.workspaceCache.Get(workspaceID)
+	if err != nil {
+		return err
+	}
+	if err = svc.workspaceGuard.Authorize(userID, workspace, model.PermissionViewer); err != nil {
+		return err
+	}
+	trash, err := svc.fileRepo.FindTrash(workspaceID)
+	if err != nil {
+		return err
+	}
+	for _, f := range trash {
+		if !svc.fileGuard.IsAuthorized(userID, f, model.CapabilityDelete) {
+			continue
+		}
+		if err = svc.purge(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Purges the files that have been in the trash for longer than the retention period */
+func (svc *TrashService) PurgeExpired() error {
+	before := time.Now().UTC().
+		Add(-time.Duration(svc.config.Limits.TrashRetentionDays) * 24 * time.Hour).
+		Format(time.RFC3339)
+	trash, err := svc.fileRepo.FindTrashBefore(before)
+	if err != nil {
+		return err
+	}
+	for _, f := range trash {
+		if err := svc.purge(f); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}
+	return nil
+}
+
+func (svc *TrashService) findTrashed(id string, userID string) (model.File, error) {
+	file, err := svc.fileCache.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if !svc.fileGuard.IsAuthorized(userID, file, model.CapabilityRead) {
+		return nil, errorpkg.NewFileNotFoundError(nil)
+	}
+	if file.GetTrashParentID() == nil {
+		return nil, errorpkg.NewFileNotInTrashError(file)
+	}
+	if !svc.fileGuard.IsAuthorized(userID, file, model.CapabilityDelete) {
+		return nil, errorpkg.NewFilePermissionError(userID, file, model.CapabilityDelete)
+	}
+	return file, nil
+}
+
+func (svc *TrashService) findTarget(id string, file model.File, userID string) (model.File, error) {
+	target, err := svc.fileCache.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.fileGuard.Authorize(userID, target, model.CapabilityUpload); err != nil {
+		return nil, err
+	}
+	if target.GetType() != model.FileTypeFolder {
+		return nil, errorpkg.NewFileIsNotAFolderError(target)
+	}
+	if target.GetWorkspaceID() != file.GetWorkspaceID() {
+		return nil, errorpkg.NewFileNotFoundError(nil)
+	}
+	children, err := svc.fileRepo.FindChildren(target.GetID())
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		if child.GetName() == file.GetName() {
+			return nil, errorpkg.NewFileWithSimilarNameExistsError()
+		}
+	}
+	return target, nil
+}
+
+func (svc *TrashService) purge(file model.File) error {
+	eventIDs, err := svc.fileRepo.DeleteTree(file.GetID())
+	if err != nil {
+		return err
+	}
+	svc.outboxSvc.Dispatch(eventIDs...)
+	danglingSnapshots, err := svc.snapshotRepo.FindAllDangling()
+	if err != nil {
+		return err
+	}
+	for _, s := range danglingSnapshots {
+		if err := svc.snapshotSvc.deleteObjects(s); err != nil {
+			return err
+		}
+		if err := svc.snapshotCache.Delete(s.GetID()); err != nil {
+			return err
+		}
+	}
+	if err = svc.snapshotRepo.DeleteAllDangling(); err != nil {
+		return err
+	}
+	return nil
+}
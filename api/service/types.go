@@ -11,14 +11,11 @@
 package service
 
 import (
-	"bytes"
-	"voltaserve/infra"
 	"voltaserve/model"
 )
 
 type DownloadResult struct {
-	RangeInterval *infra.RangeInterval
-	Buffer        *bytes.Buffer
-	File          model.File
-	Snapshot      model.Snapshot
+	File     model.File
+	Snapshot model.Snapshot
+	Object   *model.S3Object
 }
@@ -0,0 +1,490 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"path/filepath"
+	"strings"
+	"time"
+	"voltaserve/cache"
+	"voltaserve/config"
+	"voltaserve/errorpkg"
+	"voltaserve/guard"
+	"voltaserve/helper"
+	"voltaserve/infra"
+	"voltaserve/log"
+	"voltaserve/model"
+	"voltaserve/repo"
+
+	"github.com/minio/minio-go/v7"
+)
+
+/* S3 rejects parts smaller than this, except for the last one */
+const UploadMinChunkSize = 5 * 1024 * 1024
+
+/* Long enough for a slow chunk to reach S3, short enough to recover from a crash */
+const uploadLockTTL = 10 * time.Minute
+
+type UploadService struct {
+	uploadRepo     repo.UploadRepo
+	snapshotRepo   repo.SnapshotRepo
+	uploadMapper   *uploadMapper
+	fileCache      *cache.FileCache
+	fileGuard      *guard.FileGuard
+	fileSvc        *FileService
+	workspaceCache *cache.WorkspaceCache
+	workspaceSvc   *WorkspaceService
+	s3             *infra.S3Manager
+	redis          *infra.RedisManager
+	config         *config.Config
+}
+
+func NewUploadService() *UploadService {
+	return &UploadService{
+		uploadRepo:     repo.NewUploadRepo(),
+		snapshotRepo:   repo.NewSnapshotRepo(),
+		uploadMapper:   newUploadMapper(),
+		fileCache:      cache.NewFileCache(),
+		fileGuard:      guard.NewFileGuard(),
+		fileSvc:        NewFileService(),
+		workspaceCache: cache.NewWorkspaceCache(),
+		workspaceSvc:   NewWorkspaceService(),
+		s3:             infra.NewS3Manager(),
+		redis:          infra.NewRedisManager(),
+		config:         config.GetConfig(),
+	}
+}
+
+type Upload struct {
+	ID          string  `json:"id"`
+	WorkspaceID string  `json:"workspaceId"`
+	ParentID    *string `json:"parentId,omitempty"`
+	FileID      *string `json:"fileId,omitempty"`
+	Name        string  `json:"name"`
+	Size        int64   `json:"size"`
+	Offset      int64   `json:"offset"`
+	ExpireTime  string  `json:"expireTime"`
+	CreateTime  string  `json:"createTime"`
+	UpdateTime  *string `json:"updateTime,omitempty"`
+}
+
+type UploadCreateOptions struct {
+	Name        string  `json:"name" validate:"required,max=255"`
+	Size        int64   `json:"size" validate:"required,min=1"`
+	WorkspaceID string  `json:"workspaceId"`
+	ParentID    *string `json:"parentId,omitempty"`
+	/* When set, the upload becomes a new version of this file */
+	FileID *string `json:"fileId,omitempty"`
+}
+
+func (svc *UploadService) Create(opts UploadCreateOptions, userID string) (*Upload, error) {
+	var workspaceID string
+	var parentID *string
+	if opts.FileID != nil {
+		file, err := svc.fileCache.Get(*opts.FileID)
+		if err != nil {
+			return nil, err
+		}
+		if err = svc.fileGuard.Authorize(userID, file, model.CapabilityUpload); err != nil {
+			return nil, err
+		}
+		if file.GetType() != model.FileTypeFile {
+			return nil, errorpkg.NewFileIsNotAFileError(file)
+		}
+		workspaceID = file.GetWorkspaceID()
+	} else {
+		if opts.WorkspaceID == "" {
+			return nil, errorpkg.NewMissingQueryParamError("workspace_id")
+		}
+		workspaceID = opts.WorkspaceID
+		if opts.ParentID == nil || *opts.ParentID == "" {
+			workspace, err := svc.workspaceSvc.Find(workspaceID, userID)
+			if err != nil {
+				return nil, err
+			}
+			parentID = &workspace.RootID
+		} else {
+			parentID = opts.ParentID
+		}
+		if err := svc.fileSvc.validateParent(*parentID, userID); err != nil {
+			return nil, err
+		}
+	}
+	if err := svc.checkSpace(workspaceID, opts.Size); err != nil {
+		return nil, err
+	}
+	workspace, err := svc.workspaceCache.Get(workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	snapshotID := helper.NewID()
+	key := snapshotID + "/original" + strings.ToLower(filepath.Ext(opts.Name))
+	s3UploadID, err := svc.s3.NewMultipartUpload(key, workspace.GetBucket(), minio.PutObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	upload, err := svc.uploadRepo.Insert(repo.UploadInsertOptions{
+		ID:          helper.NewID(),
+		UserID:      userID,
+		WorkspaceID: workspaceID,
+		ParentID:    parentID,
+		FileID:      opts.FileID,
+		Name:        opts.Name,
+		Size:        opts.Size,
+		Bucket:      workspace.GetBucket(),
+		Key:         key,
+		SnapshotID:  snapshotID,
+		S3UploadID:  s3UploadID,
+		ExpireTime: time.Now().
+			Add(time.Duration(svc.config.Limits.UploadSessionHours) * time.Hour).
+			UTC().
+			Format(time.RFC3339),
+	})
+	if err != nil {
+		if err := svc.s3.AbortMultipartUpload(key, workspace.GetBucket(), s3UploadID); err != nil {
+			log.GetLogger().Error(err)
+		}
+		return nil, err
+	}
+	return svc.uploadMapper.mapOne(upload), nil
+}
+
+func (svc *UploadService) Find(id string, userID string) (*Upload, error) {
+	upload, err := svc.find(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	return svc.uploadMapper.mapOne(upload), nil
+}
+
+type UploadAppendOptions struct {
+	Offset int64
+	Data   []byte
+	/* Optional, formatted as '<algorithm> <base64 digest>', e.g. 'sha256 n4bQ...' */
+	Checksum string
+}
+
+/* Writes a chunk at the given offset, which must be the current offset of the upload */
+func (svc *UploadService) Append(id string, opts UploadAppendOptions, userID string) (*Upload, error) {
+	upload, err := svc.find(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := svc.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	/* Re-read under the lock, the offset might have moved since */
+	upload, err = svc.uploadRepo.Find(upload.GetID())
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(opts.Data))
+	if err := validateUploadChunk(upload.GetOffset(), upload.GetSize(), opts.Offset, size); err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return svc.uploadMapper.mapOne(upload), nil
+	}
+	if opts.Checksum != "" {
+		if err := svc.verifyChecksum(opts.Data, opts.Checksum); err != nil {
+			return nil, err
+		}
+	}
+	parts, err := upload.GetParts()
+	if err != nil {
+		return nil, err
+	}
+	partNumber := len(parts) + 1
+	part, err := svc.s3.PutObjectPart(upload.GetKey(), upload.GetBucket(), upload.GetS3UploadID(), partNumber, bytes.NewReader(opts.Data), size)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := svc.uploadRepo.Append(upload.GetID(), opts.Offset, model.UploadPart{
+		Number: partNumber,
+		ETag:   part.ETag,
+		Size:   size,
+	})
+	if err != nil {
+		return nil, err
+	}
+	upload, err = svc.uploadRepo.Find(upload.GetID())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errorpkg.NewUploadOffsetMismatchError(upload.GetOffset(), opts.Offset)
+	}
+	return svc.uploadMapper.mapOne(upload), nil
+}
+
+/*
+The chunk starts where the upload is at and doesn't go past its size, only the
+last chunk can be smaller than what S3 accepts for a part. An empty chunk is
+fine, it changes nothing.
+*/
+func validateUploadChunk(uploadOffset int64, uploadSize int64, offset int64, size int64) error {
+	if offset != uploadOffset {
+		return errorpkg.NewUploadOffsetMismatchError(uploadOffset, offset)
+	}
+	if size == 0 {
+		return nil
+	}
+	if offset+size > uploadSize {
+		return errorpkg.NewUploadChunkExceedsSizeError()
+	}
+	if offset+size < uploadSize && size < UploadMinChunkSize {
+		return errorpkg.NewUploadChunkTooSmallError(UploadMinChunkSize)
+	}
+	return nil
+}
+
+/* Assembles the parts and creates the snapshot, creating the file first if needed */
+func (svc *UploadService) Finalize(id string, userID string) (*File, error) {
+	upload, err := svc.find(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := svc.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	upload, err = svc.uploadRepo.Find(upload.GetID())
+	if err != nil {
+		return nil, err
+	}
+	if upload.GetOffset() != upload.GetSize() {
+		return nil, errorpkg.NewUploadIncompleteError(upload)
+	}
+	/* The file might have been trashed, or its permissions changed, since the upload started */
+	if upload.GetFileID() != nil {
+		file, err := svc.fileCache.Get(*upload.GetFileID())
+		if err != nil {
+			return nil, err
+		}
+		if err = svc.fileGuard.Authorize(userID, file, model.CapabilityUpload); err != nil {
+			return nil, err
+		}
+	}
+	/* Other uploads might have been finalized in the meantime */
+	ok, err := svc.workspaceSvc.HasEnoughSpaceForByteSize(upload.GetWorkspaceID(), upload.GetSize())
+	if err != nil {
+		return nil, err
+	}
+	if !*ok {
+		return nil, errorpkg.NewStorageLimitExceededError()
+	}
+	/* A previous attempt might have assembled the object already, or even created the file */
+	if upload.GetCompleteTime() == nil {
+		parts, err := upload.GetParts()
+		if err != nil {
+			return nil, err
+		}
+		var completeParts []minio.CompletePart
+		for _, p := range parts {
+			completeParts = append(completeParts, minio.CompletePart{PartNumber: p.Number, ETag: p.ETag})
+		}
+		if err := svc.s3.CompleteMultipartUpload(upload.GetKey(), upload.GetBucket(), upload.GetS3UploadID(), completeParts); err != nil {
+			return nil, err
+		}
+		if err := svc.uploadRepo.MarkComplete(upload.GetID()); err != nil {
+			return nil, err
+		}
+	}
+	var fileID string
+	if upload.GetFileID() != nil {
+		fileID = *upload.GetFileID()
+	} else {
+		file, err := svc.fileSvc.Create(FileCreateOptions{
+			WorkspaceID: upload.GetWorkspaceID(),
+			Name:        upload.GetName(),
+			Type:        model.FileTypeFile,
+			ParentID:    upload.GetParentID(),
+		}, userID)
+		if err != nil {
+			return nil, err
+		}
+		if err := svc.uploadRepo.UpdateFileID(upload.GetID(), file.ID); err != nil {
+			return nil, err
+		}
+		fileID = file.ID
+	}
+	res, err := svc.fileSvc.StoreS3Object(fileID, upload.GetSnapshotID(), model.S3Object{
+		Bucket: upload.GetBucket(),
+		Key:    upload.GetKey(),
+		Size:   helper.ToPtr(upload.GetSize()),
+	}, FileStoreOptions{}, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := svc.uploadRepo.Delete(upload.GetID()); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (svc *UploadService) Delete(id string, userID string) error {
+	upload, err := svc.find(id, userID)
+	if err != nil {
+		return err
+	}
+	unlock, err := svc.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return svc.delete(upload)
+}
+
+/* Aborts uploads that were neither finalized nor deleted before they expired */
+func (svc *UploadService) PurgeExpired() error {
+	uploads, err := svc.uploadRepo.FindExpired()
+	if err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		if err := svc.purge(upload); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}
+	return nil
+}
+
+/* Skips uploads that a request is still appending to or finalizing */
+func (svc *UploadService) purge(upload model.Upload) error {
+	unlock, err := svc.lock(upload.GetID())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	/* Finalize might have consumed it before we got the lock */
+	upload, err = svc.uploadRepo.Find(upload.GetID())
+	if err != nil {
+		return err
+	}
+	return svc.delete(upload)
+}
+
+func (svc *UploadService) delete(upload model.Upload) error {
+	if upload.GetCompleteTime() != nil {
+		/* The parts were assembled already, the object is left behind unless a snapshot owns it */
+		if _, err := svc.snapshotRepo.Find(upload.GetSnapshotID()); errorpkg.IsNotFound(err) {
+			svc.removeObject(upload)
+		} else if err != nil {
+			return err
+		}
+	} else if err := svc.s3.AbortMultipartUpload(upload.GetKey(), upload.GetBucket(), upload.GetS3UploadID()); err != nil {
+		/* The multipart upload might be gone already, the row must go anyway */
+		log.GetLogger().Error(err)
+	}
+	if err := svc.uploadRepo.Delete(upload.GetID()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (svc *UploadService) find(id string, userID string) (model.Upload, error) {
+	upload, err := svc.uploadRepo.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	/* Uploads are private to whoever started them */
+	if upload.GetUserID() != userID {
+		return nil, errorpkg.NewUploadNotFoundError(nil)
+	}
+	return upload, nil
+}
+
+func (svc *UploadService) checkSpace(workspaceID string, size int64) error {
+	pending, err := svc.uploadRepo.GetPendingSizeForWorkspace(workspaceID)
+	if err != nil {
+		return err
+	}
+	ok, err := svc.workspaceSvc.HasEnoughSpaceForByteSize(workspaceID, pending+size)
+	if err != nil {
+		return err
+	}
+	if !*ok {
+		return errorpkg.NewStorageLimitExceededError()
+	}
+	return nil
+}
+
+func (svc *UploadService) lock(id string) (func(), error) {
+	key := "upload:" + id + ":lock"
+	ok, err := svc.redis.SetNX(key, "1", uploadLockTTL)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errorpkg.NewUploadLockedError()
+	}
+	return func() {
+		if err := svc.redis.Delete(key); err != nil {
+			log.GetLogger().Error(err)
+		}
+	}, nil
+}
+
+func (svc *UploadService) verifyChecksum(data []byte, checksum string) error {
+	algorithm, digest, _ := strings.Cut(checksum, " ")
+	var h hash.Hash
+	switch strings.ToLower(algorithm) {
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	case "md5":
+		h = md5.New()
+	default:
+		return errorpkg.NewUploadChecksumAlgorithmNotSupportedError(algorithm)
+	}
+	h.Write(data)
+	if base64.StdEncoding.EncodeToString(h.Sum(nil)) != digest {
+		return errorpkg.NewUploadChecksumMismatchError()
+	}
+	return nil
+}
+
+func (svc *UploadService) removeObject(upload model.Upload) {
+	if err := svc.s3.RemoveObject(upload.GetKey(), upload.GetBucket(), minio.RemoveObjectOptions{}); err != nil {
+		log.GetLogger().Error(err)
+	}
+}
+
+type uploadMapper struct{}
+
+func newUploadMapper() *uploadMapper {
+	return &uploadMapper{}
+}
+
+func (mp *uploadMapper) mapOne(m model.Upload) *Upload {
+	return &Upload{
+		ID:          m.GetID(),
+		WorkspaceID: m.GetWorkspaceID(),
+		ParentID:    m.GetParentID(),
+		FileID:      m.GetFileID(),
+		Name:        m.GetName(),
+		Size:        m.GetSize(),
+		Offset:      m.GetOffset(),
+		ExpireTime:  m.GetExpireTime(),
+		CreateTime:  m.GetCreateTime(),
+		UpdateTime:  m.GetUpdateTime(),
+	}
+}
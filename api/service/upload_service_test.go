@@ -0,0 +1,55 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"errors"
+	"testing"
+	"voltaserve/errorpkg"
+)
+
+func TestValidateUploadChunk(t *testing.T) {
+	const size = 2*UploadMinChunkSize + 100
+	for _, tc := range []struct {
+		name         string
+		uploadOffset int64
+		offset       int64
+		chunkSize    int64
+		code         string
+	}{
+		{name: "first chunk", uploadOffset: 0, offset: 0, chunkSize: UploadMinChunkSize},
+		{name: "middle chunk", uploadOffset: UploadMinChunkSize, offset: UploadMinChunkSize, chunkSize: UploadMinChunkSize},
+		{name: "last chunk smaller than a part", uploadOffset: 2 * UploadMinChunkSize, offset: 2 * UploadMinChunkSize, chunkSize: 100},
+		{name: "whole upload in one chunk", uploadOffset: 0, offset: 0, chunkSize: size},
+		{name: "empty chunk", uploadOffset: UploadMinChunkSize, offset: UploadMinChunkSize, chunkSize: 0},
+		{name: "empty chunk of a complete upload", uploadOffset: size, offset: size, chunkSize: 0},
+		{name: "chunk behind the offset", uploadOffset: UploadMinChunkSize, offset: 0, chunkSize: UploadMinChunkSize, code: "upload_offset_mismatch"},
+		{name: "chunk ahead of the offset", uploadOffset: 0, offset: UploadMinChunkSize, chunkSize: UploadMinChunkSize, code: "upload_offset_mismatch"},
+		{name: "empty chunk at the wrong offset", uploadOffset: 0, offset: 1, chunkSize: 0, code: "upload_offset_mismatch"},
+		{name: "chunk past the size", uploadOffset: 2 * UploadMinChunkSize, offset: 2 * UploadMinChunkSize, chunkSize: 101, code: "upload_chunk_exceeds_size"},
+		{name: "chunk after completion", uploadOffset: size, offset: size, chunkSize: 1, code: "upload_chunk_exceeds_size"},
+		{name: "middle chunk smaller than a part", uploadOffset: 0, offset: 0, chunkSize: UploadMinChunkSize - 1, code: "upload_chunk_too_small"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateUploadChunk(tc.uploadOffset, size, tc.offset, tc.chunkSize)
+			if tc.code == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			var errorResponse *errorpkg.ErrorResponse
+			if !errors.As(err, &errorResponse) || errorResponse.Code != tc.code {
+				t.Fatalf("expected %s, got %v", tc.code, err)
+			}
+		})
+	}
+}
@@ -12,6 +12,8 @@ package service
 
 import (
 	"bytes"
+	"strconv"
+	"time"
 	"voltaserve/cache"
 	"voltaserve/client"
 	"voltaserve/errorpkg"
@@ -26,34 +28,36 @@ import (
 )
 
 type WatermarkService struct {
-	workspaceCache  *cache.WorkspaceCache
-	snapshotCache   *cache.SnapshotCache
-	snapshotRepo    repo.SnapshotRepo
-	snapshotSvc     *SnapshotService
-	userRepo        repo.UserRepo
-	fileCache       *cache.FileCache
-	fileGuard       *guard.FileGuard
-	taskSvc         *TaskService
-	s3              *infra.S3Manager
-	watermarkClient *client.WatermarkClient
-	pipelineClient  *client.PipelineClient
-	fileIdent       *infra.FileIdentifier
+	workspaceCache        *cache.WorkspaceCache
+	watermarkTemplateRepo repo.WatermarkTemplateRepo
+	snapshotCache         *cache.SnapshotCache
+	snapshotRepo          repo.SnapshotRepo
+	snapshotSvc           *SnapshotService
+	userRepo              repo.UserRepo
+	fileCache             *cache.FileCache
+	fileGuard             *guard.FileGuard
+	taskSvc               *TaskService
+	s3                    *infra.S3Manager
+	watermarkClient       *client.WatermarkClient
+	pipelineClient        *client.PipelineClient
+	fileIdent             *infra.FileIdentifier
 }
 
 func NewWatermarkService() *WatermarkService {
 	return &WatermarkService{
-		workspaceCache:  cache.NewWorkspaceCache(),
-		snapshotCache:   cache.NewSnapshotCache(),
-		snapshotRepo:    repo.NewSnapshotRepo(),
-		snapshotSvc:     NewSnapshotService(),
-		userRepo:        repo.NewUserRepo(),
-		fileCache:       cache.NewFileCache(),
-		fileGuard:       guard.NewFileGuard(),
-		taskSvc:         NewTaskService(),
-		s3:              infra.NewS3Manager(),
-		watermarkClient: client.NewWatermarkClient(),
-		pipelineClient:  client.NewPipelineClient(),
-		fileIdent:       infra.NewFileIdentifier(),
+		workspaceCache:        cache.NewWorkspaceCache(),
+		watermarkTemplateRepo: repo.NewWatermarkTemplateRepo(),
+		snapshotCache:         cache.NewSnapshotCache(),
+		snapshotRepo:          repo.NewSnapshotRepo(),
+		snapshotSvc:           NewSnapshotService(),
+		userRepo:              repo.NewUserRepo(),
+		fileCache:             cache.NewFileCache(),
+		fileGuard:             guard.NewFileGuard(),
+		taskSvc:               NewTaskService(),
+		s3:                    infra.NewS3Manager(),
+		watermarkClient:       client.NewWatermarkClient(),
+		pipelineClient:        client.NewPipelineClient(),
+		fileIdent:             infra.NewFileIdentifier(),
 	}
 }
 
@@ -62,7 +66,7 @@ func (svc *WatermarkService) Create(id string, userID string) error {
 	if err != nil {
 		return err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionEditor); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityUpload); err != nil {
 		return err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -87,6 +91,10 @@ func (svc *WatermarkService) Create(id string, userID string) error {
 	if err != nil {
 		return err
 	}
+	payload, err := svc.payload(user, workspace, file)
+	if err != nil {
+		return err
+	}
 	task, err := svc.taskSvc.insertAndSync(repo.TaskInsertOptions{
 		ID:              helper.NewID(),
 		Name:            "Waiting.",
@@ -104,27 +112,54 @@ func (svc *WatermarkService) Create(id string, userID string) error {
 		return err
 	}
 	if err := svc.pipelineClient.Run(&client.PipelineRunOptions{
-		PipelineID: helper.ToPtr(client.PipelineWatermark),
-		TaskID:     task.GetID(),
-		SnapshotID: snapshot.GetID(),
-		Bucket:     snapshot.GetOriginal().Bucket,
-		Key:        snapshot.GetOriginal().Key,
-		Payload: map[string]string{
-			"workspace": workspace.GetName(),
-			"user":      user.GetEmail(),
-		},
+		PipelineID:  helper.ToPtr(client.PipelineWatermark),
+		TaskID:      task.GetID(),
+		SnapshotID:  snapshot.GetID(),
+		Bucket:      snapshot.GetOriginal().Bucket,
+		Key:         snapshot.GetOriginal().Key,
+		ContentType: snapshot.GetOriginal().ContentType,
+		Extension:   snapshot.GetOriginal().GetExtension(),
+		Payload:     payload,
+		Priority:    client.PipelinePriorityInteractive,
+		UserID:      userID,
+		WorkspaceID: file.GetWorkspaceID(),
 	}); err != nil {
 		return err
 	}
 	return nil
 }
 
+/* Without a template the watermark shows the workspace's name and the user's email */
+func (svc *WatermarkService) payload(user model.User, workspace model.Workspace, file model.File) (map[string]string, error) {
+	res := map[string]string{
+		"workspace": workspace.GetName(),
+		"user":      user.GetEmail(),
+	}
+	if workspace.GetWatermarkTemplateID() == nil {
+		return res, nil
+	}
+	template, err := svc.watermarkTemplateRepo.Find(*workspace.GetWatermarkTemplateID())
+	if err != nil {
+		return nil, err
+	}
+	res["text"] = renderWatermarkText(template, user, workspace, file, time.Now())
+	res["color"] = template.GetColor()
+	res["opacity"] = strconv.FormatFloat(template.GetOpacity(), 'f', -1, 64)
+	res["angle"] = strconv.FormatFloat(template.GetAngle(), 'f', -1, 64)
+	res["position"] = template.GetPosition()
+	res["tiled"] = strconv.FormatBool(template.IsTiled())
+	if template.GetFontSize() != nil {
+		res["fontSize"] = strconv.FormatFloat(*template.GetFontSize(), 'f', -1, 64)
+	}
+	return res, nil
+}
+
 func (svc *WatermarkService) Delete(id string, userID string) error {
 	file, err := svc.fileCache.Get(id)
 	if err != nil {
 		return err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionOwner); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityManageVersions); err != nil {
 		return err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -201,7 +236,7 @@ func (svc *WatermarkService) GetInfo(id string, userID string) (*WatermarkInfo,
 	if err != nil {
 		return nil, err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityRead); err != nil {
 		return nil, err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
@@ -236,7 +271,7 @@ func (svc *WatermarkService) DownloadWatermarkBuffer(id string, userID string) (
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	if err = svc.fileGuard.Authorize(userID, file, model.PermissionViewer); err != nil {
+	if err = svc.fileGuard.Authorize(userID, file, model.CapabilityRead); err != nil {
 		return nil, nil, nil, err
 	}
 	if file.GetType() != model.FileTypeFile || file.GetSnapshotID() == nil {
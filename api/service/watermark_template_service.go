@@ -0,0 +1,309 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"voltaserve/cache"
+	"voltaserve/errorpkg"
+	"voltaserve/guard"
+	"voltaserve/helper"
+	"voltaserve/model"
+	"voltaserve/repo"
+)
+
+const (
+	watermarkTemplateDefaultColor    = "#808080"
+	watermarkTemplateDefaultOpacity  = 0.25
+	watermarkTemplateDefaultAngle    = 45
+	watermarkTemplateDefaultPosition = model.WatermarkPositionCenter
+)
+
+var watermarkPlaceholderRegex = regexp.MustCompile(`\{[^{}]*\}`)
+
+type WatermarkTemplateService struct {
+	watermarkTemplateRepo   repo.WatermarkTemplateRepo
+	watermarkTemplateMapper *watermarkTemplateMapper
+	workspaceCache          *cache.WorkspaceCache
+	workspaceGuard          *guard.WorkspaceGuard
+}
+
+func NewWatermarkTemplateService() *WatermarkTemplateService {
+	return &WatermarkTemplateService{
+		watermarkTemplateRepo:   repo.NewWatermarkTemplateRepo(),
+		watermarkTemplateMapper: newWatermarkTemplateMapper(),
+		workspaceCache:          cache.NewWorkspaceCache(),
+		workspaceGuard:          guard.NewWorkspaceGuard(),
+	}
+}
+
+type WatermarkTemplate struct {
+	ID             string   `json:"id"`
+	WorkspaceID    string   `json:"workspaceId"`
+	Name           string   `json:"name"`
+	Text           string   `json:"text"`
+	Classification *string  `json:"classification,omitempty"`
+	FontSize       *float64 `json:"fontSize,omitempty"`
+	Color          string   `json:"color"`
+	Opacity        float64  `json:"opacity"`
+	Angle          float64  `json:"angle"`
+	Position       string   `json:"position"`
+	Tiled          bool     `json:"tiled"`
+	CreateTime     string   `json:"createTime"`
+	UpdateTime     *string  `json:"updateTime,omitempty"`
+}
+
+type WatermarkTemplateCreateOptions struct {
+	WorkspaceID    string   `json:"workspaceId" validate:"required"`
+	Name           string   `json:"name" validate:"required,max=255"`
+	Text           string   `json:"text" validate:"required,max=1000"`
+	Classification *string  `json:"classification,omitempty" validate:"omitempty,max=255"`
+	FontSize       *float64 `json:"fontSize,omitempty" validate:"omitempty,gt=0,max=500"`
+	Color          *string  `json:"color,omitempty" validate:"omitempty,hexcolor"`
+	Opacity        *float64 `json:"opacity,omitempty" validate:"omitempty,gt=0,max=1"`
+	Angle          *float64 `json:"angle,omitempty" validate:"omitempty,min=-360,max=360"`
+	Position       *string  `json:"position,omitempty" validate:"omitempty,oneof=center top bottom left right top_left top_right bottom_left bottom_right"`
+	Tiled          *bool    `json:"tiled,omitempty"`
+}
+
+func (svc *WatermarkTemplateService) Create(opts WatermarkTemplateCreateOptions, userID string) (*WatermarkTemplate, error) {
+	workspace, err := svc.workspaceCache.Get(opts.WorkspaceID)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.workspaceGuard.Authorize(userID, workspace, model.PermissionOwner); err != nil {
+		return nil, err
+	}
+	if err = svc.validateText(opts.Text); err != nil {
+		return nil, err
+	}
+	insertOpts := repo.WatermarkTemplateInsertOptions{
+		ID:             helper.NewID(),
+		WorkspaceID:    workspace.GetID(),
+		Name:           opts.Name,
+		Text:           opts.Text,
+		Classification: opts.Classification,
+		FontSize:       opts.FontSize,
+		Color:          watermarkTemplateDefaultColor,
+		Opacity:        watermarkTemplateDefaultOpacity,
+		Angle:          watermarkTemplateDefaultAngle,
+		Position:       watermarkTemplateDefaultPosition,
+		Tiled:          true,
+	}
+	if opts.Color != nil {
+		insertOpts.Color = *opts.Color
+	}
+	if opts.Opacity != nil {
+		insertOpts.Opacity = *opts.Opacity
+	}
+	if opts.Angle != nil {
+		insertOpts.Angle = *opts.Angle
+	}
+	if opts.Position != nil {
+		insertOpts.Position = *opts.Position
+	}
+	if opts.Tiled != nil {
+		insertOpts.Tiled = *opts.Tiled
+	}
+	template, err := svc.watermarkTemplateRepo.Insert(insertOpts)
+	if err != nil {
+		return nil, err
+	}
+	return svc.watermarkTemplateMapper.mapOne(template), nil
+}
+
+func (svc *WatermarkTemplateService) Find(id string, userID string) (*WatermarkTemplate, error) {
+	template, err := svc.findAuthorized(id, userID, model.PermissionViewer)
+	if err != nil {
+		return nil, err
+	}
+	return svc.watermarkTemplateMapper.mapOne(template), nil
+}
+
+func (svc *WatermarkTemplateService) List(workspaceID string, userID string) ([]*WatermarkTemplate, error) {
+	workspace, err := svc.workspaceCache.Get(workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.workspaceGuard.Authorize(userID, workspace, model.PermissionViewer); err != nil {
+		return nil, err
+	}
+	templates, err := svc.watermarkTemplateRepo.FindByWorkspace(workspace.GetID())
+	if err != nil {
+		return nil, err
+	}
+	return svc.watermarkTemplateMapper.mapMany(templates), nil
+}
+
+/* Only the fields that are set are changed, an empty classification or font size clears it */
+type WatermarkTemplatePatchOptions struct {
+	Name           *string  `json:"name,omitempty" validate:"omitempty,min=1,max=255"`
+	Text           *string  `json:"text,omitempty" validate:"omitempty,min=1,max=1000"`
+	Classification *string  `json:"classification,omitempty" validate:"omitempty,max=255"`
+	FontSize       *float64 `json:"fontSize,omitempty" validate:"omitempty,min=0,max=500"`
+	Color          *string  `json:"color,omitempty" validate:"omitempty,hexcolor"`
+	Opacity        *float64 `json:"opacity,omitempty" validate:"omitempty,gt=0,max=1"`
+	Angle          *float64 `json:"angle,omitempty" validate:"omitempty,min=-360,max=360"`
+	Position       *string  `json:"position,omitempty" validate:"omitempty,oneof=center top bottom left right top_left top_right bottom_left bottom_right"`
+	Tiled          *bool    `json:"tiled,omitempty"`
+}
+
+func (svc *WatermarkTemplateService) Patch(id string, opts WatermarkTemplatePatchOptions, userID string) (*WatermarkTemplate, error) {
+	template, err := svc.findAuthorized(id, userID, model.PermissionOwner)
+	if err != nil {
+		return nil, err
+	}
+	updateOpts := repo.WatermarkTemplateUpdateOptions{
+		Name:           template.GetName(),
+		Text:           template.GetText(),
+		Classification: template.GetClassification(),
+		FontSize:       template.GetFontSize(),
+		Color:          template.GetColor(),
+		Opacity:        template.GetOpacity(),
+		Angle:          template.GetAngle(),
+		Position:       template.GetPosition(),
+		Tiled:          template.IsTiled(),
+	}
+	if opts.Name != nil {
+		updateOpts.Name = *opts.Name
+	}
+	if opts.Text != nil {
+		if err = svc.validateText(*opts.Text); err != nil {
+			return nil, err
+		}
+		updateOpts.Text = *opts.Text
+	}
+	if opts.Classification != nil {
+		if *opts.Classification == "" {
+			updateOpts.Classification = nil
+		} else {
+			updateOpts.Classification = opts.Classification
+		}
+	}
+	if opts.FontSize != nil {
+		if *opts.FontSize == 0 {
+			updateOpts.FontSize = nil
+		} else {
+			updateOpts.FontSize = opts.FontSize
+		}
+	}
+	if opts.Color != nil {
+		updateOpts.Color = *opts.Color
+	}
+	if opts.Opacity != nil {
+		updateOpts.Opacity = *opts.Opacity
+	}
+	if opts.Angle != nil {
+		updateOpts.Angle = *opts.Angle
+	}
+	if opts.Position != nil {
+		updateOpts.Position = *opts.Position
+	}
+	if opts.Tiled != nil {
+		updateOpts.Tiled = *opts.Tiled
+	}
+	if template, err = svc.watermarkTemplateRepo.Update(template.GetID(), updateOpts); err != nil {
+		return nil, err
+	}
+	return svc.watermarkTemplateMapper.mapOne(template), nil
+}
+
+func (svc *WatermarkTemplateService) Delete(id string, userID string) error {
+	template, err := svc.findAuthorized(id, userID, model.PermissionOwner)
+	if err != nil {
+		return err
+	}
+	if err = svc.watermarkTemplateRepo.Delete(template.GetID()); err != nil {
+		return err
+	}
+	/* The workspace might have been using the template */
+	if _, err = svc.workspaceCache.Refresh(template.GetWorkspaceID()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (svc *WatermarkTemplateService) findAuthorized(id string, userID string, permission string) (model.WatermarkTemplate, error) {
+	template, err := svc.watermarkTemplateRepo.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	workspace, err := svc.workspaceCache.Get(template.GetWorkspaceID())
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.workspaceGuard.Authorize(userID, workspace, permission); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+/* Rejects unknown placeholders, so that a typo doesn't end up printed on every page */
+func (svc *WatermarkTemplateService) validateText(text string) error {
+	for _, placeholder := range watermarkPlaceholderRegex.FindAllString(text, -1) {
+		if !slices.Contains(model.WatermarkPlaceholders, placeholder) {
+			return errorpkg.NewInvalidWatermarkTemplateError("unknown placeholder " + placeholder)
+		}
+	}
+	return nil
+}
+
+/* Replaces the placeholders of the template's text, dates and times are in UTC */
+func renderWatermarkText(template model.WatermarkTemplate, user model.User, workspace model.Workspace, file model.File, now time.Time) string {
+	classification := ""
+	if template.GetClassification() != nil {
+		classification = *template.GetClassification()
+	}
+	return strings.NewReplacer(
+		model.WatermarkPlaceholderUserEmail, user.GetEmail(),
+		model.WatermarkPlaceholderUserName, user.GetFullName(),
+		model.WatermarkPlaceholderWorkspaceName, workspace.GetName(),
+		model.WatermarkPlaceholderFileName, file.GetName(),
+		model.WatermarkPlaceholderDate, now.UTC().Format("2006-01-02"),
+		model.WatermarkPlaceholderTime, now.UTC().Format("15:04 UTC"),
+		model.WatermarkPlaceholderClassification, classification,
+	).Replace(template.GetText())
+}
+
+type watermarkTemplateMapper struct{}
+
+func newWatermarkTemplateMapper() *watermarkTemplateMapper {
+	return &watermarkTemplateMapper{}
+}
+
+func (mp *watermarkTemplateMapper) mapOne(m model.WatermarkTemplate) *WatermarkTemplate {
+	return &WatermarkTemplate{
+		ID:             m.GetID(),
+		WorkspaceID:    m.GetWorkspaceID(),
+		Name:           m.GetName(),
+		Text:           m.GetText(),
+		Classification: m.GetClassification(),
+		FontSize:       m.GetFontSize(),
+		Color:          m.GetColor(),
+		Opacity:        m.GetOpacity(),
+		Angle:          m.GetAngle(),
+		Position:       m.GetPosition(),
+		Tiled:          m.IsTiled(),
+		CreateTime:     m.GetCreateTime(),
+		UpdateTime:     m.GetUpdateTime(),
+	}
+}
+
+func (mp *watermarkTemplateMapper) mapMany(data []model.WatermarkTemplate) []*WatermarkTemplate {
+	res := make([]*WatermarkTemplate, 0)
+	for _, m := range data {
+		res = append(res, mp.mapOne(m))
+	}
+	return res
+}
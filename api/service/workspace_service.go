@@ -28,45 +28,54 @@ import (
 )
 
 type WorkspaceService struct {
-	workspaceRepo   repo.WorkspaceRepo
-	workspaceCache  *cache.WorkspaceCache
-	workspaceGuard  *guard.WorkspaceGuard
-	workspaceSearch *search.WorkspaceSearch
-	workspaceMapper *workspaceMapper
-	fileRepo        repo.FileRepo
-	fileCache       *cache.FileCache
-	fileGuard       *guard.FileGuard
-	fileMapper      *FileMapper
-	s3              *infra.S3Manager
-	config          *config.Config
+	workspaceRepo         repo.WorkspaceRepo
+	watermarkTemplateRepo repo.WatermarkTemplateRepo
+	workspaceCache        *cache.WorkspaceCache
+	workspaceGuard        *guard.WorkspaceGuard
+	workspaceSearch       *search.WorkspaceSearch
+	workspaceMapper       *workspaceMapper
+	fileRepo              repo.FileRepo
+	snapshotRepo          repo.SnapshotRepo
+	snapshotSvc           *SnapshotService
+	fileCache             *cache.FileCache
+	fileGuard             *guard.FileGuard
+	fileMapper            *FileMapper
+	s3                    *infra.S3Manager
+	config                *config.Config
 }
 
 func NewWorkspaceService() *WorkspaceService {
 	return &WorkspaceService{
-		workspaceRepo:   repo.NewWorkspaceRepo(),
-		workspaceCache:  cache.NewWorkspaceCache(),
-		workspaceSearch: search.NewWorkspaceSearch(),
-		workspaceGuard:  guard.NewWorkspaceGuard(),
-		workspaceMapper: newWorkspaceMapper(),
-		fileRepo:        repo.NewFileRepo(),
-		fileCache:       cache.NewFileCache(),
-		fileGuard:       guard.NewFileGuard(),
-		fileMapper:      NewFileMapper(),
-		s3:              infra.NewS3Manager(),
-		config:          config.GetConfig(),
+		workspaceRepo:         repo.NewWorkspaceRepo(),
+		watermarkTemplateRepo: repo.NewWatermarkTemplateRepo(),
+		workspaceCache:        cache.NewWorkspaceCache(),
+		workspaceSearch:       search.NewWorkspaceSearch(),
+		workspaceGuard:        guard.NewWorkspaceGuard(),
+		workspaceMapper:       newWorkspaceMapper(),
+		fileRepo:              repo.NewFileRepo(),
+		snapshotRepo:          repo.NewSnapshotRepo(),
+		snapshotSvc:           NewSnapshotService(),
+		fileCache:             cache.NewFileCache(),
+		fileGuard:             guard.NewFileGuard(),
+		fileMapper:            NewFileMapper(),
+		s3:                    infra.NewS3Manager(),
+		config:                config.GetConfig(),
 	}
 }
 
 type Workspace struct {
-	ID              string       `json:"id"`
-	Image           *string      `json:"image,omitempty"`
-	Name            string       `json:"name"`
-	RootID          string       `json:"rootId,omitempty"`
-	StorageCapacity int64        `json:"storageCapacity"`
-	Permission      string       `json:"permission"`
-	Organization    Organization `json:"organization"`
-	CreateTime      string       `json:"createTime"`
-	UpdateTime      *string      `json:"updateTime,omitempty"`
+	ID                  string                 `json:"id"`
+	Image               *string                `json:"image,omitempty"`
+	Name                string                 `json:"name"`
+	RootID              string                 `json:"rootId,omitempty"`
+	StorageCapacity     int64                  `json:"storageCapacity"`
+	RetentionPolicy     *model.RetentionPolicy `json:"retentionPolicy,omitempty"`
+	WatermarkTemplateID *string                `json:"watermarkTemplateId,omitempty"`
+	IsWatermarkEnforced bool                   `json:"isWatermarkEnforced"`
+	Permission          string                 `json:"permission"`
+	Organization        Organization           `json:"organization"`
+	CreateTime          string                 `json:"createTime"`
+	UpdateTime          *string                `json:"updateTime,omitempty"`
 }
 
 type WorkspaceCreateOptions struct {
@@ -111,7 +120,8 @@ func (svc *WorkspaceService) Create(opts WorkspaceCreateOptions, userID string)
 	if err != nil {
 		return nil, err
 	}
-	if err := svc.fileRepo.GrantUserPermission(root.GetID(), userID, model.PermissionOwner); err != nil {
+	/* The root has neither ancestors nor descendants, so no events to dispatch */
+	if _, _, err := svc.fileRepo.GrantUserPermission(root.GetID(), userID, model.PermissionOwner); err != nil {
 		return nil, err
 	}
 	if _, err := svc.fileCache.Refresh(root.GetID()); err != nil {
@@ -256,6 +266,63 @@ func (svc *WorkspaceService) PatchStorageCapacity(id string, storageCapacity int
 	return res, nil
 }
 
+/* Old versions are pruned by the retention job, a nil or empty policy keeps them all */
+func (svc *WorkspaceService) PatchRetentionPolicy(id string, policy *model.RetentionPolicy, userID string) (*Workspace, error) {
+	workspace, err := svc.workspaceCache.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.workspaceGuard.Authorize(userID, workspace, model.PermissionOwner); err != nil {
+		return nil, err
+	}
+	if workspace, err = svc.workspaceRepo.UpdateRetentionPolicy(id, policy); err != nil {
+		return nil, err
+	}
+	if err = svc.sync(workspace); err != nil {
+		return nil, err
+	}
+	res, err := svc.workspaceMapper.mapOne(workspace, userID)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+/*
+Files of the workspace get watermarked with the template, or the default text
+without one. When enforced, users who can't upload versions of a file can
+only download the watermarked rendition.
+*/
+func (svc *WorkspaceService) PatchWatermarkSettings(id string, templateID *string, enforced bool, userID string) (*Workspace, error) {
+	workspace, err := svc.workspaceCache.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = svc.workspaceGuard.Authorize(userID, workspace, model.PermissionOwner); err != nil {
+		return nil, err
+	}
+	if templateID != nil {
+		template, err := svc.watermarkTemplateRepo.Find(*templateID)
+		if err != nil {
+			return nil, err
+		}
+		if template.GetWorkspaceID() != workspace.GetID() {
+			return nil, errorpkg.NewWatermarkTemplateNotFoundError(nil)
+		}
+	}
+	if workspace, err = svc.workspaceRepo.UpdateWatermarkSettings(id, templateID, enforced); err != nil {
+		return nil, err
+	}
+	if err = svc.sync(workspace); err != nil {
+		return nil, err
+	}
+	res, err := svc.workspaceMapper.mapOne(workspace, userID)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 func (svc *WorkspaceService) Delete(id string, userID string) error {
 	workspace, err := svc.workspaceCache.Get(id)
 	if err != nil {
@@ -267,9 +334,18 @@ func (svc *WorkspaceService) Delete(id string, userID string) error {
 	if workspace, err = svc.workspaceRepo.Find(id); err != nil {
 		return err
 	}
+	/* Collected beforehand, deleting the workspace deletes its files along with their mappings */
+	snapshotIDs, err := svc.snapshotRepo.GetIDsByWorkspace(id)
+	if err != nil {
+		return err
+	}
 	if err = svc.workspaceRepo.Delete(id); err != nil {
 		return err
 	}
+	/* The blobs and their artifacts live in the shared bucket, which outlives the workspace */
+	if err = svc.snapshotSvc.deleteUnreferenced(snapshotIDs); err != nil {
+		return err
+	}
 	if err = svc.workspaceSearch.Delete([]string{workspace.GetID()}); err != nil {
 		return err
 	}
@@ -295,7 +371,16 @@ func (svc *WorkspaceService) HasEnoughSpaceForByteSize(id string, byteSize int64
 	if err != nil {
 		return nil, err
 	}
-	expectedUsage := usage + byteSize
+	trashUsage, err := svc.fileRepo.GetTrashSize(id)
+	if err != nil {
+		return nil, err
+	}
+	/* The sizes of the folders lag behind until the pending changes are folded */
+	pendingUsage, err := svc.fileRepo.GetPendingSize(id)
+	if err != nil {
+		return nil, err
+	}
+	expectedUsage := usage + trashUsage + pendingUsage + byteSize
 	if expectedUsage > workspace.GetStorageCapacity() {
 		return helper.ToPtr(false), err
 	}
@@ -432,13 +517,16 @@ func (mp *workspaceMapper) mapOne(m model.Workspace, userID string) (*Workspace,
 		return nil, err
 	}
 	res := &Workspace{
-		ID:              m.GetID(),
-		Name:            m.GetName(),
-		RootID:          m.GetRootID(),
-		StorageCapacity: m.GetStorageCapacity(),
-		Organization:    *o,
-		CreateTime:      m.GetCreateTime(),
-		UpdateTime:      m.GetUpdateTime(),
+		ID:                  m.GetID(),
+		Name:                m.GetName(),
+		RootID:              m.GetRootID(),
+		StorageCapacity:     m.GetStorageCapacity(),
+		RetentionPolicy:     m.GetRetentionPolicy(),
+		WatermarkTemplateID: m.GetWatermarkTemplateID(),
+		IsWatermarkEnforced: m.IsWatermarkEnforced(),
+		Organization:        *o,
+		CreateTime:          m.GetCreateTime(),
+		UpdateTime:          m.GetUpdateTime(),
 	}
 	res.Permission = ""
 	for _, p := range m.GetUserPermissions() {
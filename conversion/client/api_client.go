@@ -54,6 +54,22 @@ type PipelineRunOptions struct {
 	Bucket     string            `json:"bucket"`
 	Key        string            `json:"key"`
 	Payload    map[string]string `json:"payload,omitempty"`
+	Priority   string            `json:"priority,omitempty" validate:"omitempty,oneof=interactive bulk"`
+	UserID     string            `json:"userId,omitempty"`
+	/* Workspaces get their turn before users do, so a busy workspace doesn't hold up the others */
+	WorkspaceID string `json:"workspaceId,omitempty"`
+	/* Detected from the content by the API when the file was stored, the key's extension is only a hint */
+	ContentType string `json:"contentType,omitempty"`
+	Extension   string `json:"extension,omitempty"`
+}
+
+const (
+	PipelinePriorityInteractive = "interactive"
+	PipelinePriorityBulk        = "bulk"
+)
+
+type PipelineCancelOptions struct {
+	TaskID string `json:"taskId" validate:"required"`
 }
 
 type SnapshotPatchOptions struct {
@@ -76,6 +92,7 @@ const (
 	SnapshotStatusProcessing = "processing"
 	SnapshotStatusReady      = "ready"
 	SnapshotStatusError      = "error"
+	SnapshotStatusCanceled   = "canceled"
 )
 
 const (
@@ -93,10 +110,11 @@ const (
 )
 
 type S3Object struct {
-	Bucket string      `json:"bucket"`
-	Key    string      `json:"key"`
-	Size   *int64      `json:"size,omitempty"`
-	Image  *ImageProps `json:"image,omitempty"`
+	Bucket      string      `json:"bucket"`
+	Key         string      `json:"key"`
+	Size        *int64      `json:"size,omitempty"`
+	Image       *ImageProps `json:"image,omitempty"`
+	ContentType string      `json:"contentType,omitempty"`
 }
 
 type ImageProps struct {
@@ -123,6 +141,53 @@ func (cl *APIClient) PatchSnapshot(opts SnapshotPatchOptions) error {
 	return nil
 }
 
+type SnapshotDiffPatchOptions struct {
+	Fields  []string             `json:"fields"`
+	Status  *string              `json:"status"`
+	Text    *S3Object            `json:"text"`
+	Summary *SnapshotDiffSummary `json:"summary"`
+	Pages   []SnapshotDiffPage   `json:"pages"`
+}
+
+type SnapshotDiffSummary struct {
+	LinesAdded   int `json:"linesAdded"`
+	LinesRemoved int `json:"linesRemoved"`
+	PageCount    int `json:"pageCount"`
+	PagesChanged int `json:"pagesChanged"`
+}
+
+type SnapshotDiffPage struct {
+	Number  int       `json:"number"`
+	Changed float64   `json:"changed"`
+	Image   *S3Object `json:"image,omitempty"`
+}
+
+const (
+	SnapshotDiffFieldStatus  = "status"
+	SnapshotDiffFieldText    = "text"
+	SnapshotDiffFieldSummary = "summary"
+	SnapshotDiffFieldPages   = "pages"
+)
+
+func (cl *APIClient) PatchSnapshotDiff(id string, opts SnapshotDiffPatchOptions) error {
+	body, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PATCH", fmt.Sprintf("%s/v2/snapshot_diffs/%s?api_key=%s", cl.config.APIURL, id, cl.config.Security.APIKey), bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return nil
+}
+
 type TaskCreateOptions struct {
 	Name            string       `json:"name"`
 	Error           *string      `json:"error,omitempty"`
@@ -163,6 +228,7 @@ func (cl *APIClient) CreateTask(opts TaskCreateOptions) error {
 	return nil
 }
 
+/* The payload is merged into the task's one, an empty value removes the entry */
 type TaskPatchOptions struct {
 	Fields          []string          `json:"fields"`
 	Name            *string           `json:"name"`
@@ -184,6 +250,12 @@ const (
 	TaskFieldPayload         = "payload"
 )
 
+const (
+	TaskPayloadAttempt     = "attempt"
+	TaskPayloadContentType = "contentType"
+	TaskPayloadMismatch    = "mismatch"
+)
+
 func (cl *APIClient) PatchTask(id string, opts TaskPatchOptions) error {
 	body, err := json.Marshal(opts)
 	if err != nil {
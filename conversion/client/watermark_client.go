@@ -33,12 +33,14 @@ func NewWatermarkClient() *WatermarkClient {
 	}
 }
 
+/* The fields left empty fall back to the defaults of the watermark service */
 type WatermarkCreateOptions struct {
 	Path     string
 	S3Key    string
 	S3Bucket string
 	Category string
 	Values   []string
+	Fields   map[string]string
 }
 
 func (cl *WatermarkClient) Create(opts WatermarkCreateOptions) error {
@@ -76,6 +78,11 @@ func (cl *WatermarkClient) Create(opts WatermarkCreateOptions) error {
 	if err = mw.WriteField("values", base64.StdEncoding.EncodeToString(values)); err != nil {
 		return err
 	}
+	for key, value := range opts.Fields {
+		if err = mw.WriteField(key, value); err != nil {
+			return err
+		}
+	}
 	if err := mw.Close(); err != nil {
 		return err
 	}
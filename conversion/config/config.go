@@ -11,6 +11,8 @@
 package config
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"strconv"
 )
@@ -24,6 +26,11 @@ type Config struct {
 	Security     SecurityConfig
 	Limits       LimitsConfig
 	S3           S3Config
+	Redis        RedisConfig
+	Queue        QueueConfig
+	Retry        RetryConfig
+	/* Pipelines running an external command, registered alongside the built-in ones */
+	ExternalPipelines []ExternalPipelineConfig
 }
 
 type SecurityConfig struct {
@@ -45,6 +52,57 @@ type S3Config struct {
 	Secure    bool
 }
 
+type RedisConfig struct {
+	Address  string
+	Password string
+	DB       int
+}
+
+type QueueConfig struct {
+	Type                     string
+	VisibilityTimeoutSeconds int
+	InteractiveWeight        int
+	BulkWeight               int
+}
+
+type RetryConfig struct {
+	MaxAttempts           int
+	InitialBackoffSeconds int
+	MaxBackoffSeconds     int
+}
+
+/*
+Options, args and output paths are Go templates. Options and output paths
+can only use .Input, .OutputDir and .SnapshotID, options are passed first,
+followed by the args. Args can also use .Bucket, .Key and the entries of
+.Payload listed in PayloadFields. With EndOfOptions, "--" is passed between
+options and args, so values coming from users can't be taken for options,
+this needs a command that understands "--". Without it, payload values
+starting with "-" are refused.
+*/
+type ExternalPipelineConfig struct {
+	ID            string                         `json:"id"`
+	Extensions    []string                       `json:"extensions"`
+	MIMETypes     []string                       `json:"mimeTypes"`
+	Priority      int                            `json:"priority"`
+	Command       string                         `json:"command"`
+	Options       []string                       `json:"options"`
+	EndOfOptions  bool                           `json:"endOfOptions"`
+	Args          []string                       `json:"args"`
+	PayloadFields []string                       `json:"payloadFields"`
+	Outputs       []ExternalPipelineOutputConfig `json:"outputs"`
+}
+
+type ExternalPipelineOutputConfig struct {
+	Path  string `json:"path"`
+	Field string `json:"field"`
+}
+
+const (
+	QueueTypeRedis  = "redis"
+	QueueTypeMemory = "memory"
+)
+
 var config *Config
 
 func GetConfig() *Config {
@@ -60,6 +118,10 @@ func GetConfig() *Config {
 		readSecurity(config)
 		readS3(config)
 		readLimits(config)
+		readRedis(config)
+		readQueue(config)
+		readRetry(config)
+		readExternalPipelines(config)
 	}
 	return config
 }
@@ -119,3 +181,91 @@ func readLimits(config *Config) {
 		config.Limits.MultipartBodyLengthLimitMB = int(v)
 	}
 }
+
+func readRedis(config *Config) {
+	config.Redis.Address = os.Getenv("REDIS_ADDRESS")
+	config.Redis.Password = os.Getenv("REDIS_PASSWORD")
+	if len(os.Getenv("REDIS_DB")) > 0 {
+		v, err := strconv.ParseInt(os.Getenv("REDIS_DB"), 10, 32)
+		if err != nil {
+			panic(err)
+		}
+		config.Redis.DB = int(v)
+	}
+}
+
+func readQueue(config *Config) {
+	config.Queue.Type = QueueTypeRedis
+	if len(os.Getenv("QUEUE_TYPE")) > 0 {
+		config.Queue.Type = os.Getenv("QUEUE_TYPE")
+	}
+	config.Queue.VisibilityTimeoutSeconds = 60
+	if len(os.Getenv("QUEUE_VISIBILITY_TIMEOUT_SECONDS")) > 0 {
+		v, err := strconv.ParseInt(os.Getenv("QUEUE_VISIBILITY_TIMEOUT_SECONDS"), 10, 32)
+		if err != nil {
+			panic(err)
+		}
+		/* Jobs are kept alive every third of the timeout, it can't be shorter than that */
+		if v < 3 {
+			panic(fmt.Errorf("QUEUE_VISIBILITY_TIMEOUT_SECONDS must be at least 3, got %d", v))
+		}
+		config.Queue.VisibilityTimeoutSeconds = int(v)
+	}
+	config.Queue.InteractiveWeight = 4
+	if len(os.Getenv("QUEUE_INTERACTIVE_WEIGHT")) > 0 {
+		v, err := strconv.ParseInt(os.Getenv("QUEUE_INTERACTIVE_WEIGHT"), 10, 32)
+		if err != nil {
+			panic(err)
+		}
+		config.Queue.InteractiveWeight = int(v)
+	}
+	config.Queue.BulkWeight = 1
+	if len(os.Getenv("QUEUE_BULK_WEIGHT")) > 0 {
+		v, err := strconv.ParseInt(os.Getenv("QUEUE_BULK_WEIGHT"), 10, 32)
+		if err != nil {
+			panic(err)
+		}
+		config.Queue.BulkWeight = int(v)
+	}
+}
+
+func readRetry(config *Config) {
+	config.Retry.MaxAttempts = 3
+	if len(os.Getenv("RETRY_MAX_ATTEMPTS")) > 0 {
+		v, err := strconv.ParseInt(os.Getenv("RETRY_MAX_ATTEMPTS"), 10, 32)
+		if err != nil {
+			panic(err)
+		}
+		config.Retry.MaxAttempts = int(v)
+	}
+	config.Retry.InitialBackoffSeconds = 10
+	if len(os.Getenv("RETRY_INITIAL_BACKOFF_SECONDS")) > 0 {
+		v, err := strconv.ParseInt(os.Getenv("RETRY_INITIAL_BACKOFF_SECONDS"), 10, 32)
+		if err != nil {
+			panic(err)
+		}
+		config.Retry.InitialBackoffSeconds = int(v)
+	}
+	config.Retry.MaxBackoffSeconds = 300
+	if len(os.Getenv("RETRY_MAX_BACKOFF_SECONDS")) > 0 {
+		v, err := strconv.ParseInt(os.Getenv("RETRY_MAX_BACKOFF_SECONDS"), 10, 32)
+		if err != nil {
+			panic(err)
+		}
+		config.Retry.MaxBackoffSeconds = int(v)
+	}
+}
+
+func readExternalPipelines(config *Config) {
+	path := os.Getenv("EXTERNAL_PIPELINES_PATH")
+	if len(path) == 0 {
+		return
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(b, &config.ExternalPipelines); err != nil {
+		panic(err)
+	}
+}
@@ -61,3 +61,13 @@ func NewInvalidAPIKeyError() *ErrorResponse {
 		nil,
 	)
 }
+
+func NewDeadLetterNotFoundError(err error) *ErrorResponse {
+	return NewErrorResponse(
+		"dead_letter_not_found",
+		http.StatusNotFound,
+		"Dead letter not found.",
+		"The pipeline is not in the dead-letter list.",
+		err,
+	)
+}
@@ -31,3 +31,8 @@ func GetUserFriendlyMessage(code string, fallback string) string {
 	}
 	return res
 }
+
+func HasUserFriendlyMessage(code string) bool {
+	_, ok := messages[code]
+	return ok
+}
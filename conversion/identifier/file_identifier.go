@@ -17,199 +17,175 @@ import (
 	"strings"
 )
 
-type FileIdentifier struct {
+var PDFExtensions = []string{
+	".pdf",
 }
 
-func NewFileIdentifier() *FileIdentifier {
-	return &FileIdentifier{}
+var OfficeExtensions = []string{
+	".xls",
+	".doc",
+	".ppt",
+	".xlsx",
+	".docx",
+	".pptx",
+	".odt",
+	".ott",
+	".ods",
+	".ots",
+	".odp",
+	".otp",
+	".odg",
+	".otg",
+	".odf",
+	".odc",
+	".rtf",
 }
 
-func (fi *FileIdentifier) IsPDF(path string) bool {
-	return strings.ToLower(filepath.Ext(path)) == ".pdf"
+var PlainTextExtensions = []string{
+	".txt",
+	".html",
+	".js",
+	".jsx",
+	".ts",
+	".tsx",
+	".css",
+	".sass",
+	".scss",
+	".go",
+	".py",
+	".rb",
+	".java",
+	".c",
+	".h",
+	".cpp",
+	".hpp",
+	".json",
+	".yml",
+	".yaml",
+	".toml",
+	".md",
 }
 
-func (fi *FileIdentifier) IsOffice(path string) bool {
-	extensions := []string{
-		".xls",
-		".doc",
-		".ppt",
-		".xlsx",
-		".docx",
-		".pptx",
-		".odt",
-		".ott",
-		".ods",
-		".ots",
-		".odp",
-		".otp",
-		".odg",
-		".otg",
-		".odf",
-		".odc",
-		".rtf",
-	}
-	extension := filepath.Ext(path)
+var ImageExtensions = []string{
+	".xpm",
+	".png",
+	".jpg",
+	".jpeg",
+	".jp2",
+	".gif",
+	".webp",
+	".tiff",
+	".bmp",
+	".ico",
+	".heif",
+	".heic",
+	".xcf",
+	".svg",
+}
+
+var NonAlphaChannelImageExtensions = []string{
+	".jpg",
+	".jpeg",
+	".gif",
+	".tiff",
+	".bmp",
+}
+
+var VideoExtensions = []string{
+	".ogv",
+	".mpeg",
+	".mov",
+	".mqv",
+	".mp4",
+	".webm",
+	".3gp",
+	".3g2",
+	".avi",
+	".flv",
+	".mkv",
+	".asf",
+	".m4v",
+}
+
+var AudioExtensions = []string{
+	".oga",
+	".ogg",
+	".mp3",
+	".flac",
+	".midi",
+	".ape",
+	".mpc",
+	".amr",
+	".wav",
+	".aiff",
+	".au",
+	".aac",
+	".voc",
+	".m4a",
+	".qcp",
+}
+
+var GLBExtensions = []string{
+	".glb",
+}
+
+var ZIPExtensions = []string{
+	".zip",
+	".zipx",
+}
+
+/* Compares the path's extension case-insensitively */
+func HasExtension(path string, extensions []string) bool {
+	extension := strings.ToLower(filepath.Ext(path))
 	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
+		if extension == v {
 			return true
 		}
 	}
 	return false
 }
 
+type FileIdentifier struct {
+}
+
+func NewFileIdentifier() *FileIdentifier {
+	return &FileIdentifier{}
+}
+
+func (fi *FileIdentifier) IsPDF(path string) bool {
+	return HasExtension(path, PDFExtensions)
+}
+
+func (fi *FileIdentifier) IsOffice(path string) bool {
+	return HasExtension(path, OfficeExtensions)
+}
+
 func (fi *FileIdentifier) IsPlainText(path string) bool {
-	extensions := []string{
-		".txt",
-		".html",
-		".js",
-		"jsx",
-		".ts",
-		".tsx",
-		".css",
-		".sass",
-		".scss",
-		".go",
-		".py",
-		".rb",
-		".java",
-		".c",
-		".h",
-		".cpp",
-		".hpp",
-		".json",
-		".yml",
-		".yaml",
-		".toml",
-		".md",
-	}
-	extension := filepath.Ext(path)
-	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
-			return true
-		}
-	}
-	return false
+	return HasExtension(path, PlainTextExtensions)
 }
 
 func (fi *FileIdentifier) IsImage(path string) bool {
-	extensions := []string{
-		".xpm",
-		".png",
-		".jpg",
-		".jpeg",
-		".jp2",
-		".gif",
-		".webp",
-		".tiff",
-		".bmp",
-		".ico",
-		".heif",
-		".xcf",
-		".svg",
-	}
-	extension := filepath.Ext(path)
-	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
-			return true
-		}
-	}
-	return false
+	return HasExtension(path, ImageExtensions)
 }
 
 func (fi *FileIdentifier) IsNonAlphaChannelImage(path string) bool {
-	extensions := []string{
-		".jpg",
-		".jpeg",
-		".gif",
-		".tiff",
-		".bmp",
-	}
-	extension := filepath.Ext(path)
-	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
-			return true
-		}
-	}
-	return false
+	return HasExtension(path, NonAlphaChannelImageExtensions)
 }
 
 func (fi *FileIdentifier) IsVideo(path string) bool {
-	extensions := []string{
-		".ogv",
-		".mpeg",
-		".mov",
-		".mqv",
-		".mp4",
-		".webm",
-		".3gp",
-		".3g2",
-		".avi",
-		".flv",
-		".mkv",
-		".asf",
-		".m4v",
-	}
-	extension := filepath.Ext(path)
-	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
-			return true
-		}
-	}
-	return false
+	return HasExtension(path, VideoExtensions)
 }
 
 func (fi *FileIdentifier) IsAudio(path string) bool {
-	extensions := []string{
-		".oga",
-		".ogg",
-		".mp3",
-		".flac",
-		".midi",
-		".ape",
-		".mpc",
-		".amr",
-		".wav",
-		".aiff",
-		".au",
-		".aac",
-		"voc",
-		".m4a",
-		".qcp",
-	}
-	extension := filepath.Ext(path)
-	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
-			return true
-		}
-	}
-	return false
+	return HasExtension(path, AudioExtensions)
 }
 
 func (fi *FileIdentifier) IsGLB(path string) bool {
-	extensions := []string{
-		".glb",
-	}
-	extension := filepath.Ext(path)
-	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
-			return true
-		}
-	}
-	return false
+	return HasExtension(path, GLBExtensions)
 }
 
 func (fi *FileIdentifier) IsZIP(path string) bool {
-	extensions := []string{
-		".zip",
-		".zipx",
-	}
-	extension := filepath.Ext(path)
-	for _, v := range extensions {
-		if strings.ToLower(extension) == v {
-			return true
-		}
-	}
-	return false
+	return HasExtension(path, ZIPExtensions)
 }
 
 type GLTF struct {
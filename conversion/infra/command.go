@@ -12,16 +12,19 @@ package infra
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"os"
 	"os/exec"
-	"sync"
+	"path/filepath"
+	"syscall"
 	"time"
 	"voltaserve/config"
 	"voltaserve/helper"
 )
 
-var commandMutex sync.Mutex
+/* External commands are heavy, run them one at a time */
+var commandSemaphore = make(chan struct{}, 1)
 
 type Command struct {
 	config *config.Config
@@ -38,54 +41,63 @@ func (r *Command) RunWithConsoleOutput(name string, arg ...string) error {
 	return cmd.Run()
 }
 
-func (r *Command) Exec(name string, arg ...string) error {
-	commandMutex.Lock()
-	defer commandMutex.Unlock()
-
-	timeout := time.Duration(r.config.Limits.ExternalCommandTimeoutSeconds) * time.Second
-	cmd := exec.Command(name, arg...)
-
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
+func (r *Command) Exec(ctx context.Context, name string, arg ...string) error {
+	_, err := r.run(ctx, name, arg...)
+	return err
+}
 
-	if err := cmd.Start(); err != nil {
-		return err
-	}
-	timer := time.AfterFunc(timeout, func() {
-		_ = cmd.Process.Kill()
-	})
-	if err := cmd.Wait(); err != nil {
-		if stderr.Len() > 0 {
-			return errors.New(stderr.String())
-		} else {
-			return err
-		}
+func (r *Command) ReadOutput(ctx context.Context, name string, arg ...string) (*string, error) {
+	res, err := r.run(ctx, name, arg...)
+	if err != nil {
+		return nil, err
 	}
-	timer.Stop()
-	return nil
+	return helper.ToPtr(string(res)), nil
 }
 
-func (r *Command) ReadOutput(name string, arg ...string) (*string, error) {
-	commandMutex.Lock()
-	defer commandMutex.Unlock()
+/*
+Runs the command in its own process group, so when the context is canceled
+or the timeout expires, children like soffice.bin are killed along with it.
+*/
+func (r *Command) run(ctx context.Context, name string, arg ...string) ([]byte, error) {
+	select {
+	case commandSemaphore <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-commandSemaphore }()
+
+	start := time.Now()
+	outcome := MetricOutcomeFailed
+	defer func() { CommandDuration.ObserveDuration(start, filepath.Base(name), outcome) }()
 
 	timeout := time.Duration(r.config.Limits.ExternalCommandTimeoutSeconds) * time.Second
-	cmd := exec.Command(name, arg...)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	var stdout bytes.Buffer
 	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	res, err := cmd.Output()
-	if err != nil {
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.Canceled) {
+			outcome = MetricOutcomeCanceled
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		if stderr.Len() > 0 {
 			return nil, errors.New(stderr.String())
 		} else {
 			return nil, err
 		}
 	}
-	timer := time.AfterFunc(timeout, func() {
-		_ = cmd.Process.Kill()
-	})
-	timer.Stop()
-	return helper.ToPtr(string(res)), nil
+	outcome = MetricOutcomeSucceeded
+	return stdout.Bytes(), nil
 }
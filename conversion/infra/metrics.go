@@ -0,0 +1,112 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package infra
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	MetricOutcomeSucceeded = "succeeded"
+	MetricOutcomeFailed    = "failed"
+	MetricOutcomeCanceled  = "canceled"
+)
+
+/* From a fraction of a second for a thumbnail to ten minutes for a long video */
+var MetricDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+/* Only the service's own metrics, not the ones of the Go runtime */
+var metricsRegistry = prometheus.NewRegistry()
+
+func GetMetricsRegistry() *prometheus.Registry {
+	return metricsRegistry
+}
+
+var (
+	PipelineDuration = NewHistogram(
+		"conversion_pipeline_duration_seconds",
+		"Duration of pipeline runs.",
+		MetricDurationBuckets,
+		"pipeline", "outcome",
+	)
+	PipelineRuns = NewCounter(
+		"conversion_pipeline_runs_total",
+		"Number of pipeline runs, each attempt counts as one run.",
+		"pipeline", "outcome",
+	)
+	CommandDuration = NewHistogram(
+		"conversion_command_duration_seconds",
+		"Duration of external commands.",
+		MetricDurationBuckets,
+		"command", "outcome",
+	)
+)
+
+type Counter struct {
+	vec *prometheus.CounterVec
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	metricsRegistry.MustRegister(vec)
+	return &Counter{vec: vec}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.vec.WithLabelValues(labelValues...).Inc()
+}
+
+type Histogram struct {
+	vec *prometheus.HistogramVec
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+	metricsRegistry.MustRegister(vec)
+	return &Histogram{vec: vec}
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.vec.WithLabelValues(labelValues...).Observe(value)
+}
+
+func (h *Histogram) ObserveDuration(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+/* The value is read when scraped, so it's always up to date */
+type GaugeFunc struct {
+	name string
+	desc *prometheus.Desc
+	fn   func() (float64, error)
+}
+
+func NewGaugeFunc(name string, help string, fn func() (float64, error)) *GaugeFunc {
+	g := &GaugeFunc{name: name, desc: prometheus.NewDesc(name, help, nil, nil), fn: fn}
+	metricsRegistry.MustRegister(g)
+	return g
+}
+
+func (g *GaugeFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *GaugeFunc) Collect(ch chan<- prometheus.Metric) {
+	v, err := g.fn()
+	if err != nil {
+		/* Better leave the series out than expose a wrong value */
+		GetLogger().Errorw(err.Error(), "metric", g.name)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, v)
+}
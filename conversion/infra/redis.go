@@ -0,0 +1,72 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package infra
+
+import (
+	"context"
+	"strings"
+	"voltaserve/config"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisManager struct {
+	config config.RedisConfig
+	client redis.UniversalClient
+}
+
+func NewRedisManager() *RedisManager {
+	return &RedisManager{
+		config: config.GetConfig().Redis,
+	}
+}
+
+func (mgr *RedisManager) GetClient() (redis.UniversalClient, error) {
+	if err := mgr.Connect(); err != nil {
+		return nil, err
+	}
+	return mgr.client, nil
+}
+
+func (mgr *RedisManager) Close() error {
+	if mgr.client != nil {
+		if err := mgr.client.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mgr *RedisManager) Connect() error {
+	if mgr.client != nil {
+		return nil
+	}
+	addresses := strings.Split(mgr.config.Address, ";")
+	var client redis.UniversalClient
+	if len(addresses) > 1 {
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    addresses,
+			Password: mgr.config.Password,
+		})
+	} else {
+		client = redis.NewClient(&redis.Options{
+			Addr:     mgr.config.Address,
+			Password: mgr.config.Password,
+			DB:       mgr.config.DB,
+		})
+	}
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		_ = client.Close()
+		return err
+	}
+	mgr.client = client
+	return nil
+}
@@ -55,6 +55,9 @@ func main() {
 		BodyLimit:    int(helper.MegabyteToByte(cfg.Limits.MultipartBodyLengthLimitMB)),
 	})
 
+	metricsRouter := router.NewMetricsRouter()
+	metricsRouter.AppendRoutes(app)
+
 	v2 := app.Group("v2")
 
 	healthRouter := router.NewHealthRouter()
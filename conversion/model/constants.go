@@ -20,4 +20,5 @@ const (
 	PipelineWatermark  = "watermark"
 	PipelineGLB        = "glb"
 	PipelineZIP        = "zip"
+	PipelineDiff       = "diff"
 )
@@ -10,12 +10,15 @@
 
 package model
 
-import "voltaserve/client"
+import (
+	"context"
+	"voltaserve/client"
+)
 
 type Pipeline interface {
-	Run(client.PipelineRunOptions) error
+	Run(context.Context, client.PipelineRunOptions) error
 }
 
 type Builder interface {
-	Build(client.PipelineRunOptions) error
+	Build(context.Context, client.PipelineRunOptions) error
 }
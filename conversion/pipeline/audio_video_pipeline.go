@@ -11,6 +11,7 @@
 package pipeline
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"voltaserve/client"
@@ -41,14 +42,14 @@ func NewAudioVideoPipeline() model.Pipeline {
 	}
 }
 
-func (p *audioVideoPipeline) Run(opts client.PipelineRunOptions) error {
-	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + filepath.Ext(opts.Key))
+func (p *audioVideoPipeline) Run(ctx context.Context, opts client.PipelineRunOptions) error {
+	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + inputExtension(opts))
 	if err := p.s3.GetFile(opts.Key, inputPath, opts.Bucket, minio.GetObjectOptions{}); err != nil {
 		return err
 	}
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
@@ -61,7 +62,7 @@ func (p *audioVideoPipeline) Run(opts client.PipelineRunOptions) error {
 		return err
 	}
 	// Here we intentionally ignore the error, as the media file may contain just audio
-	p.createThumbnail(inputPath, opts)
+	p.createThumbnail(ctx, inputPath, opts)
 	if err := p.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
 		Fields: []string{client.TaskFieldName},
 		Name:   helper.ToPtr("Saving preview."),
@@ -81,20 +82,20 @@ func (p *audioVideoPipeline) Run(opts client.PipelineRunOptions) error {
 	return nil
 }
 
-func (p *audioVideoPipeline) createThumbnail(inputPath string, opts client.PipelineRunOptions) error {
+func (p *audioVideoPipeline) createThumbnail(ctx context.Context, inputPath string, opts client.PipelineRunOptions) error {
 	tmpPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + ".png")
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
 		}
 	}(tmpPath)
-	if err := p.videoProc.Thumbnail(inputPath, 0, p.config.Limits.ImagePreviewMaxHeight, tmpPath); err != nil {
+	if err := p.videoProc.Thumbnail(ctx, inputPath, 0, p.config.Limits.ImagePreviewMaxHeight, tmpPath); err != nil {
 		return err
 	}
-	props, err := p.imageProc.MeasureImage(tmpPath)
+	props, err := p.imageProc.MeasureImage(ctx, tmpPath)
 	if err != nil {
 		return err
 	}
@@ -130,9 +131,10 @@ func (p *audioVideoPipeline) saveOriginalAsPreview(inputPath string, opts client
 		Options: opts,
 		Fields:  []string{client.SnapshotFieldPreview},
 		Preview: &client.S3Object{
-			Bucket: opts.Bucket,
-			Key:    opts.Key,
-			Size:   helper.ToPtr(stat.Size()),
+			Bucket:      opts.Bucket,
+			Key:         opts.Key,
+			Size:        helper.ToPtr(stat.Size()),
+			ContentType: opts.ContentType,
 		},
 	}); err != nil {
 		return err
@@ -0,0 +1,264 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"voltaserve/client"
+	"voltaserve/helper"
+	"voltaserve/infra"
+	"voltaserve/model"
+	"voltaserve/processor"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	DiffPayloadID               = "diffId"
+	DiffPayloadBaseSnapshotID   = "baseSnapshotId"
+	DiffPayloadText             = "text"
+	DiffPayloadBaseText         = "baseText"
+	DiffPayloadPreview          = "preview"
+	DiffPayloadBasePreview      = "basePreview"
+	DiffPayloadBaseBucket       = "baseBucket"
+	diffPageDPI                 = 72
+	diffMaxPages                = 50
+	diffPageChangedRatioEpsilon = 0.0001
+)
+
+type diffPipeline struct {
+	pdfProc   *processor.PDFProcessor
+	diffProc  *processor.DiffProcessor
+	s3        *infra.S3Manager
+	apiClient *client.APIClient
+}
+
+func NewDiffPipeline() model.Pipeline {
+	return &diffPipeline{
+		pdfProc:   processor.NewPDFProcessor(),
+		diffProc:  processor.NewDiffProcessor(),
+		s3:        infra.NewS3Manager(),
+		apiClient: client.NewAPIClient(),
+	}
+}
+
+/*
+Compares the snapshot with the base snapshot given in the payload, the text
+objects line by line and the PDF previews page by page. The results are
+stored next to the snapshot and reported on the diff, not the snapshot.
+*/
+func (p *diffPipeline) Run(ctx context.Context, opts client.PipelineRunOptions) error {
+	id := opts.Payload[DiffPayloadID]
+	if id == "" {
+		return errors.New("diff ID is missing from the payload")
+	}
+	if err := p.apiClient.PatchSnapshotDiff(id, client.SnapshotDiffPatchOptions{
+		Fields: []string{client.SnapshotDiffFieldStatus},
+		Status: helper.ToPtr(client.SnapshotStatusProcessing),
+	}); err != nil {
+		return err
+	}
+	res, err := p.compare(ctx, opts)
+	if err != nil {
+		if err := p.apiClient.PatchSnapshotDiff(id, client.SnapshotDiffPatchOptions{
+			Fields: []string{client.SnapshotDiffFieldStatus},
+			Status: helper.ToPtr(client.SnapshotStatusError),
+		}); err != nil {
+			infra.GetLogger().Error(err)
+		}
+		return err
+	}
+	res.Fields = []string{
+		client.SnapshotDiffFieldStatus,
+		client.SnapshotDiffFieldText,
+		client.SnapshotDiffFieldSummary,
+		client.SnapshotDiffFieldPages,
+	}
+	res.Status = helper.ToPtr(client.SnapshotStatusReady)
+	if err := p.apiClient.PatchSnapshotDiff(id, *res); err != nil {
+		return err
+	}
+	if err := p.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
+		Fields: []string{client.TaskFieldName, client.TaskFieldStatus},
+		Name:   helper.ToPtr("Done."),
+		Status: helper.ToPtr(client.TaskStatusSuccess),
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *diffPipeline) compare(ctx context.Context, opts client.PipelineRunOptions) (*client.SnapshotDiffPatchOptions, error) {
+	res := &client.SnapshotDiffPatchOptions{Summary: &client.SnapshotDiffSummary{}}
+	prefix := opts.SnapshotID + "/diff/" + opts.Payload[DiffPayloadBaseSnapshotID]
+	if opts.Payload[DiffPayloadText] != "" || opts.Payload[DiffPayloadBaseText] != "" {
+		if err := p.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
+			Fields: []string{client.TaskFieldName},
+			Name:   helper.ToPtr("Comparing text."),
+		}); err != nil {
+			return nil, err
+		}
+		text, err := p.compareText(opts, prefix+"/text.diff")
+		if err != nil {
+			return nil, err
+		}
+		if text != nil {
+			res.Text = text.object
+			res.Summary.LinesAdded = text.added
+			res.Summary.LinesRemoved = text.removed
+		}
+	}
+	if opts.Payload[DiffPayloadPreview] != "" || opts.Payload[DiffPayloadBasePreview] != "" {
+		if err := p.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
+			Fields: []string{client.TaskFieldName},
+			Name:   helper.ToPtr("Comparing pages."),
+		}); err != nil {
+			return nil, err
+		}
+		pages, err := p.comparePages(ctx, opts, prefix)
+		if err != nil {
+			return nil, err
+		}
+		res.Pages = pages
+		res.Summary.PageCount = len(pages)
+		for _, page := range pages {
+			if page.Changed > diffPageChangedRatioEpsilon {
+				res.Summary.PagesChanged++
+			}
+		}
+	}
+	return res, nil
+}
+
+type textComparison struct {
+	object  *client.S3Object
+	added   int
+	removed int
+}
+
+/* Returns nil when the texts are the same */
+func (p *diffPipeline) compareText(opts client.PipelineRunOptions, key string) (*textComparison, error) {
+	base, err := p.readText(opts.Payload[DiffPayloadBaseText], p.baseBucket(opts))
+	if err != nil {
+		return nil, err
+	}
+	current, err := p.readText(opts.Payload[DiffPayloadText], opts.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	diff := p.diffProc.Text(base, current, opts.Payload[DiffPayloadBaseSnapshotID], opts.SnapshotID)
+	if diff.Unified == "" {
+		return nil, nil
+	}
+	if err := p.s3.PutText(key, diff.Unified, "text/x-diff", opts.Bucket, minio.PutObjectOptions{}); err != nil {
+		return nil, err
+	}
+	return &textComparison{
+		object: &client.S3Object{
+			Bucket:      opts.Bucket,
+			Key:         key,
+			Size:        helper.ToPtr(int64(len(diff.Unified))),
+			ContentType: "text/x-diff",
+		},
+		added:   diff.LinesAdded,
+		removed: diff.LinesRemoved,
+	}, nil
+}
+
+/* Older callers leave the base bucket out, both snapshots were in the same bucket then */
+func (p *diffPipeline) baseBucket(opts client.PipelineRunOptions) string {
+	if opts.Payload[DiffPayloadBaseBucket] != "" {
+		return opts.Payload[DiffPayloadBaseBucket]
+	}
+	return opts.Bucket
+}
+
+/* A snapshot without a text object reads as empty */
+func (p *diffPipeline) readText(key string, bucket string) (string, error) {
+	if key == "" {
+		return "", nil
+	}
+	return p.s3.GetText(key, bucket, minio.GetObjectOptions{})
+}
+
+func (p *diffPipeline) comparePages(ctx context.Context, opts client.PipelineRunOptions, prefix string) ([]client.SnapshotDiffPage, error) {
+	dir := filepath.FromSlash(os.TempDir() + "/" + helper.NewID())
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	defer func(path string) {
+		if err := os.RemoveAll(path); err != nil {
+			infra.GetLogger().Error(err)
+		}
+	}(dir)
+	basePages, err := p.rasterize(ctx, opts.Payload[DiffPayloadBasePreview], p.baseBucket(opts), filepath.Join(dir, "base"))
+	if err != nil {
+		return nil, err
+	}
+	pages, err := p.rasterize(ctx, opts.Payload[DiffPayloadPreview], opts.Bucket, filepath.Join(dir, "current"))
+	if err != nil {
+		return nil, err
+	}
+	var res []client.SnapshotDiffPage
+	for i := 0; i < max(len(basePages), len(pages)); i++ {
+		var basePath, path string
+		if i < len(basePages) {
+			basePath = basePages[i]
+		}
+		if i < len(pages) {
+			path = pages[i]
+		}
+		outputPath := filepath.Join(dir, fmt.Sprintf("diff-%d.png", i+1))
+		changed, err := p.diffProc.Image(basePath, path, outputPath)
+		if err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("%s/page-%d.png", prefix, i+1)
+		if err := p.s3.PutFile(key, outputPath, "image/png", opts.Bucket, minio.PutObjectOptions{}); err != nil {
+			return nil, err
+		}
+		stat, err := os.Stat(outputPath)
+		if err != nil {
+			return nil, err
+		}
+		page := client.SnapshotDiffPage{
+			Number:  i + 1,
+			Changed: changed,
+			Image: &client.S3Object{
+				Bucket:      opts.Bucket,
+				Key:         key,
+				Size:        helper.ToPtr(stat.Size()),
+				ContentType: "image/png",
+			},
+		}
+		res = append(res, page)
+	}
+	return res, nil
+}
+
+/* A snapshot without a PDF preview has no pages */
+func (p *diffPipeline) rasterize(ctx context.Context, key string, bucket string, dir string) ([]string, error) {
+	if key == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	inputPath := filepath.Join(dir, "input.pdf")
+	if err := p.s3.GetFile(key, inputPath, bucket, minio.GetObjectOptions{}); err != nil {
+		return nil, err
+	}
+	return p.pdfProc.Rasterize(ctx, inputPath, diffPageDPI, diffMaxPages, dir)
+}
@@ -11,46 +11,62 @@
 package pipeline
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 	"voltaserve/client"
 	"voltaserve/errorpkg"
 	"voltaserve/helper"
-	"voltaserve/identifier"
-	"voltaserve/model"
+	"voltaserve/infra"
 )
 
+/* Running again won't make a pipeline appear, whatever the retry policy says */
+var ErrNoMatchingPipeline = errors.New("no matching pipeline found")
+
 type Dispatcher struct {
-	pipelineIdentifier *identifier.PipelineIdentifier
-	pdfPipeline        model.Pipeline
-	imagePipeline      model.Pipeline
-	officePipeline     model.Pipeline
-	audioVideoPipeline model.Pipeline
-	insightsPipeline   model.Pipeline
-	mosaicPipeline     model.Pipeline
-	watermarkPipeline  model.Pipeline
-	glbPipeline        model.Pipeline
-	zipPipeline        model.Pipeline
-	apiClient          *client.APIClient
+	registry  *Registry
+	apiClient *client.APIClient
 }
 
 func NewDispatcher() *Dispatcher {
 	return &Dispatcher{
-		pipelineIdentifier: identifier.NewPipelineIdentifier(),
-		pdfPipeline:        NewPDFPipeline(),
-		imagePipeline:      NewImagePipeline(),
-		officePipeline:     NewOfficePipeline(),
-		audioVideoPipeline: NewAudioVideoPipeline(),
-		insightsPipeline:   NewInsightsPipeline(),
-		mosaicPipeline:     NewMosaicPipeline(),
-		watermarkPipeline:  NewWatermarkPipeline(),
-		glbPipeline:        NewGLBPipeline(),
-		zipPipeline:        NewZIPPipeline(),
-		apiClient:          client.NewAPIClient(),
+		registry:  NewDefaultRegistry(),
+		apiClient: client.NewAPIClient(),
+	}
+}
+
+func (d *Dispatcher) GetRetryPolicy(opts client.PipelineRunOptions) RetryPolicy {
+	if reg, ok := d.registry.Resolve(opts); ok {
+		return reg.RetryPolicy
 	}
+	return NewDefaultRetryPolicy()
 }
 
-func (d *Dispatcher) Dispatch(opts client.PipelineRunOptions) error {
-	if err := d.apiClient.PatchSnapshot(client.SnapshotPatchOptions{
+/*
+Runs the matching pipeline, on failure the snapshot and task are left
+as they are, the caller decides between Defer and Fail.
+*/
+func (d *Dispatcher) Dispatch(ctx context.Context, opts client.PipelineRunOptions, attempt int) error {
+	payload := map[string]string{client.TaskPayloadAttempt: strconv.Itoa(attempt)}
+	mismatch := isMismatch(opts)
+	if opts.ContentType != "" {
+		payload[client.TaskPayloadContentType] = opts.ContentType
+	}
+	/* Clears the note left by an earlier attempt, unless it still applies */
+	payload[client.TaskPayloadMismatch] = ""
+	if mismatch {
+		payload[client.TaskPayloadMismatch] = fmt.Sprintf(
+			"The file extension '%s' doesn't match its content, which was detected as '%s'.",
+			filepath.Ext(opts.Key),
+			opts.ContentType,
+		)
+	}
+	opts = d.identify(opts, mismatch)
+	if err := d.patchSnapshot(client.SnapshotPatchOptions{
 		Options: opts,
 		Fields:  []string{client.SnapshotFieldStatus},
 		Status:  helper.ToPtr(client.SnapshotStatusProcessing),
@@ -58,77 +74,145 @@ func (d *Dispatcher) Dispatch(opts client.PipelineRunOptions) error {
 		return err
 	}
 	if err := d.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
-		Name:   helper.ToPtr("Processing."),
-		Fields: []string{client.TaskFieldStatus},
-		Status: helper.ToPtr(client.TaskStatusRunning),
+		Name:    helper.ToPtr("Processing."),
+		Fields:  []string{client.TaskFieldName, client.TaskFieldStatus, client.TaskFieldError, client.TaskFieldPayload},
+		Status:  helper.ToPtr(client.TaskStatusRunning),
+		Payload: payload,
 	}); err != nil {
 		return err
 	}
-	id := d.pipelineIdentifier.Identify(opts)
+	var id string
+	start := time.Now()
 	var err error
-	if id == model.PipelinePDF {
-		err = d.pdfPipeline.Run(opts)
-	} else if id == model.PipelineOffice {
-		err = d.officePipeline.Run(opts)
-	} else if id == model.PipelineImage {
-		err = d.imagePipeline.Run(opts)
-	} else if id == model.PipelineAudioVideo {
-		err = d.audioVideoPipeline.Run(opts)
-	} else if id == model.PipelineInsights {
-		err = d.insightsPipeline.Run(opts)
-	} else if id == model.PipelineMoasic {
-		err = d.mosaicPipeline.Run(opts)
-	} else if id == model.PipelineWatermark {
-		err = d.watermarkPipeline.Run(opts)
-	} else if id == model.PipelineGLB {
-		err = d.glbPipeline.Run(opts)
-	} else if id == model.PipelineZIP {
-		err = d.zipPipeline.Run(opts)
+	if reg, ok := d.registry.Resolve(opts); ok {
+		id = reg.ID
+		err = reg.Pipeline.Run(ctx, opts)
 	} else {
-		if err := d.apiClient.PatchSnapshot(client.SnapshotPatchOptions{
-			Options: opts,
-			Fields:  []string{client.SnapshotFieldStatus},
-			Status:  helper.ToPtr(client.SnapshotStatusError),
-		}); err != nil {
-			return err
-		}
-		err = errors.New("no matching pipeline found")
-		if err := d.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
-			Fields: []string{client.TaskFieldStatus, client.TaskFieldError},
-			Status: helper.ToPtr(client.TaskStatusError),
-			Error:  helper.ToPtr(errorpkg.GetUserFriendlyMessage(err.Error(), errorpkg.FallbackMessage)),
-		}); err != nil {
-			return err
-		}
-		return err
+		err = ErrNoMatchingPipeline
 	}
+	d.observe(ctx, id, start, err)
 	if err != nil {
-		if err := d.apiClient.PatchSnapshot(client.SnapshotPatchOptions{
-			Options: opts,
-			Fields:  []string{client.SnapshotFieldStatus},
-			Status:  helper.ToPtr(client.SnapshotStatusError),
-		}); err != nil {
-			return err
-		}
-		if err := d.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
-			Fields: []string{client.TaskFieldStatus, client.TaskFieldError},
-			Status: helper.ToPtr(client.TaskStatusError),
-			Error:  helper.ToPtr(errorpkg.GetUserFriendlyMessage(err.Error(), errorpkg.FallbackMessage)),
-		}); err != nil {
-			return err
-		}
 		return err
-	} else {
-		if err := d.apiClient.PatchSnapshot(client.SnapshotPatchOptions{
-			Options: opts,
-			Fields:  []string{client.SnapshotFieldStatus, client.SnapshotFieldTaskID},
-			Status:  helper.ToPtr(client.SnapshotStatusReady),
-		}); err != nil {
-			return err
-		}
-		if err := d.apiClient.DeletTask(opts.TaskID); err != nil {
-			return err
-		}
+	}
+	if err := d.patchSnapshot(client.SnapshotPatchOptions{
+		Options: opts,
+		Fields:  []string{client.SnapshotFieldStatus, client.SnapshotFieldTaskID},
+		Status:  helper.ToPtr(client.SnapshotStatusReady),
+	}); err != nil {
+		return err
+	}
+	if err := d.apiClient.DeletTask(opts.TaskID); err != nil {
+		return err
+	}
+	return nil
+}
+
+/*
+The API detects the content when the file is stored, the key's extension
+only counts when it didn't or when the content agrees with it.
+*/
+func isMismatch(opts client.PipelineRunOptions) bool {
+	return opts.ContentType != "" && opts.Extension != strings.ToLower(filepath.Ext(opts.Key))
+}
+
+/*
+Makes the pipeline see the file as what its content says it is, unless no
+pipeline handles that, then the extension is given a chance.
+*/
+func (d *Dispatcher) identify(opts client.PipelineRunOptions, mismatch bool) client.PipelineRunOptions {
+	res := opts
+	res.ContentType, _, _ = strings.Cut(opts.ContentType, ";")
+	if _, ok := d.registry.Resolve(res); !ok && mismatch {
+		res.Extension = ""
+	}
+	return res
+}
+
+func (d *Dispatcher) observe(ctx context.Context, id string, start time.Time, err error) {
+	if id == "" {
+		id = "none"
+	}
+	outcome := infra.MetricOutcomeSucceeded
+	if ctx.Err() != nil {
+		outcome = infra.MetricOutcomeCanceled
+	} else if err != nil {
+		outcome = infra.MetricOutcomeFailed
+	}
+	infra.PipelineDuration.ObserveDuration(start, id, outcome)
+	infra.PipelineRuns.Inc(id, outcome)
+}
+
+/* Reports that the pipeline failed and will be attempted again */
+func (d *Dispatcher) Defer(opts client.PipelineRunOptions, attempt int, cause error) error {
+	if err := d.patchSnapshot(client.SnapshotPatchOptions{
+		Options: opts,
+		Fields:  []string{client.SnapshotFieldStatus},
+		Status:  helper.ToPtr(client.SnapshotStatusWaiting),
+	}); err != nil {
+		return err
+	}
+	if err := d.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
+		Name:    helper.ToPtr("Waiting for retry."),
+		Fields:  []string{client.TaskFieldName, client.TaskFieldStatus, client.TaskFieldError, client.TaskFieldPayload},
+		Status:  helper.ToPtr(client.TaskStatusWaiting),
+		Error:   helper.ToPtr(errorpkg.GetUserFriendlyMessage(cause.Error(), errorpkg.FallbackMessage)),
+		Payload: map[string]string{client.TaskPayloadAttempt: strconv.Itoa(attempt)},
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+/* Reports that the pipeline failed for good */
+func (d *Dispatcher) Fail(opts client.PipelineRunOptions, attempt int, cause error) error {
+	if err := d.patchSnapshot(client.SnapshotPatchOptions{
+		Options: opts,
+		Fields:  []string{client.SnapshotFieldStatus},
+		Status:  helper.ToPtr(client.SnapshotStatusError),
+	}); err != nil {
+		return err
+	}
+	if err := d.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
+		Fields:  []string{client.TaskFieldStatus, client.TaskFieldError, client.TaskFieldPayload},
+		Status:  helper.ToPtr(client.TaskStatusError),
+		Error:   helper.ToPtr(errorpkg.GetUserFriendlyMessage(cause.Error(), errorpkg.FallbackMessage)),
+		Payload: map[string]string{client.TaskPayloadAttempt: strconv.Itoa(attempt)},
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+/*
+Marks the snapshot canceled, it keeps whatever was produced before the
+cancellation, which may be nothing.
+*/
+func (d *Dispatcher) Cancel(opts client.PipelineRunOptions) error {
+	if err := d.patchSnapshot(client.SnapshotPatchOptions{
+		Options: opts,
+		Fields:  []string{client.SnapshotFieldStatus, client.SnapshotFieldTaskID},
+		Status:  helper.ToPtr(client.SnapshotStatusCanceled),
+	}); err != nil {
+		return err
+	}
+	if err := d.apiClient.DeletTask(opts.TaskID); err != nil {
+		return err
+	}
+	return nil
+}
+
+/* Detached pipelines report through their own artifacts, so the snapshot is left alone */
+func (d *Dispatcher) patchSnapshot(opts client.SnapshotPatchOptions) error {
+	if reg, ok := d.registry.Resolve(opts.Options); ok && reg.Detached {
 		return nil
 	}
+	return d.apiClient.PatchSnapshot(opts)
+}
+
+/* Temporary input files get the extension matching their content */
+func inputExtension(opts client.PipelineRunOptions) string {
+	if opts.Extension != "" {
+		return opts.Extension
+	}
+	return filepath.Ext(opts.Key)
 }
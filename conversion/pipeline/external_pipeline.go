@@ -0,0 +1,285 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"voltaserve/client"
+	"voltaserve/config"
+	"voltaserve/helper"
+	"voltaserve/identifier"
+	"voltaserve/infra"
+	"voltaserve/model"
+	"voltaserve/processor"
+
+	"github.com/minio/minio-go/v7"
+)
+
+/* Snapshot fields an external pipeline can produce */
+var externalPipelineFields = []string{
+	client.SnapshotFieldPreview,
+	client.SnapshotFieldText,
+	client.SnapshotFieldOCR,
+	client.SnapshotFieldEntities,
+	client.SnapshotFieldThumbnail,
+}
+
+type externalPipeline struct {
+	config    config.ExternalPipelineConfig
+	cmd       *infra.Command
+	imageProc *processor.ImageProcessor
+	s3        *infra.S3Manager
+	apiClient *client.APIClient
+	fileIdent *identifier.FileIdentifier
+}
+
+/* What options and output paths can use, none of it comes from users */
+type externalPipelineOptionData struct {
+	Input      string
+	OutputDir  string
+	SnapshotID string
+}
+
+type externalPipelineArgData struct {
+	Input      string
+	OutputDir  string
+	SnapshotID string
+	Bucket     string
+	Key        string
+	/* Only the fields the pipeline asked for */
+	Payload map[string]string
+}
+
+func NewExternalPipeline(cfg config.ExternalPipelineConfig) model.Pipeline {
+	return &externalPipeline{
+		config:    cfg,
+		cmd:       infra.NewCommand(),
+		imageProc: processor.NewImageProcessor(),
+		s3:        infra.NewS3Manager(),
+		apiClient: client.NewAPIClient(),
+		fileIdent: identifier.NewFileIdentifier(),
+	}
+}
+
+/* Catches configuration mistakes at startup rather than when the first file comes in */
+func ValidateExternalPipeline(cfg config.ExternalPipelineConfig) error {
+	if cfg.Command == "" {
+		return fmt.Errorf("external pipeline '%s' has no command", cfg.ID)
+	}
+	/* Rendering with placeholders tells templates using what they aren't allowed to */
+	optionData := externalPipelineOptionData{}
+	argData := externalPipelineArgData{Payload: allowedPayload(nil, cfg.PayloadFields)}
+	for _, option := range cfg.Options {
+		if _, err := renderTemplate(option, optionData); err != nil {
+			return fmt.Errorf("external pipeline '%s': %w", cfg.ID, err)
+		}
+	}
+	for _, arg := range cfg.Args {
+		if _, err := renderTemplate(arg, argData); err != nil {
+			return fmt.Errorf("external pipeline '%s': %w", cfg.ID, err)
+		}
+	}
+	for _, output := range cfg.Outputs {
+		if _, err := renderTemplate(output.Path, optionData); err != nil {
+			return fmt.Errorf("external pipeline '%s': %w", cfg.ID, err)
+		}
+		supported := false
+		for _, field := range externalPipelineFields {
+			if output.Field == field {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("external pipeline '%s' can't produce snapshot field '%s'", cfg.ID, output.Field)
+		}
+	}
+	return nil
+}
+
+func (p *externalPipeline) Run(ctx context.Context, opts client.PipelineRunOptions) error {
+	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + inputExtension(opts))
+	if err := p.s3.GetFile(opts.Key, inputPath, opts.Bucket, minio.GetObjectOptions{}); err != nil {
+		return err
+	}
+	defer func(path string) {
+		_, err := os.Stat(path)
+		if err == nil {
+			if err := os.Remove(path); err != nil {
+				infra.GetLogger().Error(err)
+			}
+		}
+	}(inputPath)
+	outputDir := filepath.FromSlash(os.TempDir() + "/" + helper.NewID())
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return err
+	}
+	defer func(path string) {
+		if err := os.RemoveAll(path); err != nil {
+			infra.GetLogger().Error(err)
+		}
+	}(outputDir)
+	data := externalPipelineOptionData{
+		Input:      inputPath,
+		OutputDir:  outputDir,
+		SnapshotID: opts.SnapshotID,
+	}
+	args, err := p.args(data, opts)
+	if err != nil {
+		return err
+	}
+	if err := p.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
+		Fields: []string{client.TaskFieldName},
+		Name:   helper.ToPtr(fmt.Sprintf("Running %s.", filepath.Base(p.config.Command))),
+	}); err != nil {
+		return err
+	}
+	if err := p.cmd.Exec(ctx, p.config.Command, args...); err != nil {
+		return err
+	}
+	if err := p.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
+		Fields: []string{client.TaskFieldName},
+		Name:   helper.ToPtr("Saving outputs."),
+	}); err != nil {
+		return err
+	}
+	if err := p.saveOutputs(ctx, data, opts); err != nil {
+		return err
+	}
+	if err := p.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
+		Fields: []string{client.TaskFieldName, client.TaskFieldStatus},
+		Name:   helper.ToPtr("Done."),
+		Status: helper.ToPtr(client.TaskStatusSuccess),
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+/* Options, then "--" if the command understands it, then args */
+func (p *externalPipeline) args(data externalPipelineOptionData, opts client.PipelineRunOptions) ([]string, error) {
+	res := make([]string, 0, len(p.config.Options)+len(p.config.Args)+1)
+	for _, option := range p.config.Options {
+		v, err := renderTemplate(option, data)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	if p.config.EndOfOptions {
+		res = append(res, "--")
+	}
+	payload := allowedPayload(opts.Payload, p.config.PayloadFields)
+	if !p.config.EndOfOptions {
+		/* Nothing tells the command where options end, so a user can't start one */
+		for field, value := range payload {
+			if strings.HasPrefix(value, "-") {
+				return nil, fmt.Errorf("external pipeline '%s' payload field '%s' can't start with '-'", p.config.ID, field)
+			}
+		}
+	}
+	argData := externalPipelineArgData{
+		Input:      data.Input,
+		OutputDir:  data.OutputDir,
+		SnapshotID: data.SnapshotID,
+		Bucket:     opts.Bucket,
+		Key:        opts.Key,
+		Payload:    payload,
+	}
+	for _, arg := range p.config.Args {
+		v, err := renderTemplate(arg, argData)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+/* Fields missing from the payload are empty, other fields aren't there at all */
+func allowedPayload(payload map[string]string, fields []string) map[string]string {
+	res := make(map[string]string, len(fields))
+	for _, field := range fields {
+		res[field] = payload[field]
+	}
+	return res
+}
+
+func (p *externalPipeline) saveOutputs(ctx context.Context, data externalPipelineOptionData, opts client.PipelineRunOptions) error {
+	if len(p.config.Outputs) == 0 {
+		return nil
+	}
+	patch := client.SnapshotPatchOptions{Options: opts}
+	for _, output := range p.config.Outputs {
+		path, err := renderTemplate(output.Path, data)
+		if err != nil {
+			return err
+		}
+		if rel, err := filepath.Rel(data.OutputDir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("external pipeline '%s' output '%s' is outside of the output directory", p.config.ID, path)
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("external pipeline '%s' did not produce '%s'", p.config.ID, path)
+			}
+			return err
+		}
+		s3Object := &client.S3Object{
+			Bucket: opts.Bucket,
+			Key:    opts.SnapshotID + "/" + output.Field + filepath.Ext(path),
+			Size:   helper.ToPtr(stat.Size()),
+		}
+		if p.fileIdent.IsImage(path) {
+			props, err := p.imageProc.MeasureImage(ctx, path)
+			if err != nil {
+				return err
+			}
+			s3Object.Image = props
+		}
+		if err := p.s3.PutFile(s3Object.Key, path, helper.DetectMimeFromFile(path), s3Object.Bucket, minio.PutObjectOptions{}); err != nil {
+			return err
+		}
+		patch.Fields = append(patch.Fields, output.Field)
+		switch output.Field {
+		case client.SnapshotFieldPreview:
+			patch.Preview = s3Object
+		case client.SnapshotFieldText:
+			patch.Text = s3Object
+		case client.SnapshotFieldOCR:
+			patch.OCR = s3Object
+		case client.SnapshotFieldEntities:
+			patch.Entities = s3Object
+		case client.SnapshotFieldThumbnail:
+			patch.Thumbnail = s3Object
+		}
+	}
+	return p.apiClient.PatchSnapshot(patch)
+}
+
+func renderTemplate(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -11,6 +11,7 @@
 package pipeline
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"voltaserve/client"
@@ -41,14 +42,14 @@ func NewGLBPipeline() model.Pipeline {
 	}
 }
 
-func (p *glbPipeline) Run(opts client.PipelineRunOptions) error {
-	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + filepath.Ext(opts.Key))
+func (p *glbPipeline) Run(ctx context.Context, opts client.PipelineRunOptions) error {
+	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + inputExtension(opts))
 	if err := p.s3.GetFile(opts.Key, inputPath, opts.Bucket, minio.GetObjectOptions{}); err != nil {
 		return err
 	}
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
@@ -60,7 +61,7 @@ func (p *glbPipeline) Run(opts client.PipelineRunOptions) error {
 	}); err != nil {
 		return err
 	}
-	if err := p.createThumbnail(inputPath, opts); err != nil {
+	if err := p.createThumbnail(ctx, inputPath, opts); err != nil {
 		return err
 	}
 	stat, err := os.Stat(inputPath)
@@ -71,9 +72,10 @@ func (p *glbPipeline) Run(opts client.PipelineRunOptions) error {
 		Options: opts,
 		Fields:  []string{client.SnapshotFieldPreview},
 		Preview: &client.S3Object{
-			Bucket: opts.Bucket,
-			Key:    opts.Key,
-			Size:   helper.ToPtr(stat.Size()),
+			Bucket:      opts.Bucket,
+			Key:         opts.Key,
+			Size:        helper.ToPtr(stat.Size()),
+			ContentType: opts.ContentType,
 		},
 	}); err != nil {
 		return err
@@ -81,20 +83,20 @@ func (p *glbPipeline) Run(opts client.PipelineRunOptions) error {
 	return nil
 }
 
-func (p *glbPipeline) createThumbnail(inputPath string, opts client.PipelineRunOptions) error {
+func (p *glbPipeline) createThumbnail(ctx context.Context, inputPath string, opts client.PipelineRunOptions) error {
 	tmpPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + ".jpeg")
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
 		}
 	}(tmpPath)
-	if err := p.glbProc.Thumbnail(inputPath, p.config.Limits.ImagePreviewMaxWidth, p.config.Limits.ImagePreviewMaxHeight, "rgb(255,255,255)", tmpPath); err != nil {
+	if err := p.glbProc.Thumbnail(ctx, inputPath, p.config.Limits.ImagePreviewMaxWidth, p.config.Limits.ImagePreviewMaxHeight, "rgb(255,255,255)", tmpPath); err != nil {
 		return err
 	}
-	props, err := p.imageProc.MeasureImage(tmpPath)
+	props, err := p.imageProc.MeasureImage(ctx, tmpPath)
 	if err != nil {
 		return err
 	}
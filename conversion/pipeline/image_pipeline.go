@@ -11,6 +11,7 @@
 package pipeline
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"voltaserve/client"
@@ -42,14 +43,14 @@ func NewImagePipeline() model.Pipeline {
 	}
 }
 
-func (p *imagePipeline) Run(opts client.PipelineRunOptions) error {
-	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + filepath.Ext(opts.Key))
+func (p *imagePipeline) Run(ctx context.Context, opts client.PipelineRunOptions) error {
+	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + inputExtension(opts))
 	if err := p.s3.GetFile(opts.Key, inputPath, opts.Bucket, minio.GetObjectOptions{}); err != nil {
 		return err
 	}
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
@@ -61,7 +62,7 @@ func (p *imagePipeline) Run(opts client.PipelineRunOptions) error {
 	}); err != nil {
 		return err
 	}
-	imageProps, err := p.measureImageDimensions(inputPath, opts)
+	imageProps, err := p.measureImageDimensions(ctx, inputPath, opts)
 	if err != nil {
 		return err
 	}
@@ -73,7 +74,7 @@ func (p *imagePipeline) Run(opts client.PipelineRunOptions) error {
 		}); err != nil {
 			return err
 		}
-		jpegPath, err := p.convertTIFFToJPEG(inputPath, *imageProps, opts)
+		jpegPath, err := p.convertTIFFToJPEG(ctx, inputPath, *imageProps, opts)
 		if err != nil {
 			return err
 		}
@@ -90,7 +91,7 @@ func (p *imagePipeline) Run(opts client.PipelineRunOptions) error {
 	}); err != nil {
 		return err
 	}
-	if err := p.createThumbnail(imagePath, opts); err != nil {
+	if err := p.createThumbnail(ctx, imagePath, opts); err != nil {
 		return err
 	}
 	if err := p.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
@@ -103,8 +104,8 @@ func (p *imagePipeline) Run(opts client.PipelineRunOptions) error {
 	return nil
 }
 
-func (p *imagePipeline) measureImageDimensions(inputPath string, opts client.PipelineRunOptions) (*client.ImageProps, error) {
-	imageProps, err := p.imageProc.MeasureImage(inputPath)
+func (p *imagePipeline) measureImageDimensions(ctx context.Context, inputPath string, opts client.PipelineRunOptions) (*client.ImageProps, error) {
+	imageProps, err := p.imageProc.MeasureImage(ctx, inputPath)
 	if err != nil {
 		return nil, err
 	}
@@ -116,10 +117,11 @@ func (p *imagePipeline) measureImageDimensions(inputPath string, opts client.Pip
 		Options: opts,
 		Fields:  []string{client.SnapshotFieldOriginal},
 		Original: &client.S3Object{
-			Bucket: opts.Bucket,
-			Key:    opts.Key,
-			Size:   helper.ToPtr(stat.Size()),
-			Image:  imageProps,
+			Bucket:      opts.Bucket,
+			Key:         opts.Key,
+			Size:        helper.ToPtr(stat.Size()),
+			Image:       imageProps,
+			ContentType: opts.ContentType,
 		},
 	}); err != nil {
 		return nil, err
@@ -127,16 +129,16 @@ func (p *imagePipeline) measureImageDimensions(inputPath string, opts client.Pip
 	return imageProps, nil
 }
 
-func (p *imagePipeline) createThumbnail(inputPath string, opts client.PipelineRunOptions) error {
+func (p *imagePipeline) createThumbnail(ctx context.Context, inputPath string, opts client.PipelineRunOptions) error {
 	tmpPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + ".png")
-	isAvailable, err := p.imageProc.Thumbnail(inputPath, tmpPath)
+	isAvailable, err := p.imageProc.Thumbnail(ctx, inputPath, tmpPath)
 	if err != nil {
 		return err
 	}
 	if *isAvailable {
 		defer func(path string) {
 			_, err := os.Stat(path)
-			if os.IsExist(err) {
+			if err == nil {
 				if err := os.Remove(path); err != nil {
 					infra.GetLogger().Error(err)
 				}
@@ -145,7 +147,7 @@ func (p *imagePipeline) createThumbnail(inputPath string, opts client.PipelineRu
 	} else {
 		tmpPath = inputPath
 	}
-	props, err := p.imageProc.MeasureImage(tmpPath)
+	props, err := p.imageProc.MeasureImage(ctx, tmpPath)
 	if err != nil {
 		return err
 	}
@@ -172,14 +174,14 @@ func (p *imagePipeline) createThumbnail(inputPath string, opts client.PipelineRu
 	return nil
 }
 
-func (p *imagePipeline) convertTIFFToJPEG(inputPath string, imageProps client.ImageProps, opts client.PipelineRunOptions) (*string, error) {
+func (p *imagePipeline) convertTIFFToJPEG(ctx context.Context, inputPath string, imageProps client.ImageProps, opts client.PipelineRunOptions) (*string, error) {
 	jpegPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + ".jpg")
-	if err := p.imageProc.ConvertImage(inputPath, jpegPath); err != nil {
+	if err := p.imageProc.ConvertImage(ctx, inputPath, jpegPath); err != nil {
 		return nil, err
 	}
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
@@ -217,9 +219,10 @@ func (p *imagePipeline) saveOriginalAsPreview(inputPath string, opts client.Pipe
 		Options: opts,
 		Fields:  []string{client.SnapshotFieldPreview},
 		Preview: &client.S3Object{
-			Bucket: opts.Bucket,
-			Key:    opts.Key,
-			Size:   helper.ToPtr(stat.Size()),
+			Bucket:      opts.Bucket,
+			Key:         opts.Key,
+			Size:        helper.ToPtr(stat.Size()),
+			ContentType: opts.ContentType,
 		},
 	}); err != nil {
 		return err
@@ -11,6 +11,7 @@
 package pipeline
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"os"
@@ -47,17 +48,17 @@ func NewInsightsPipeline() model.Pipeline {
 	}
 }
 
-func (p *insightsPipeline) Run(opts client.PipelineRunOptions) error {
+func (p *insightsPipeline) Run(ctx context.Context, opts client.PipelineRunOptions) error {
 	if opts.Payload == nil || opts.Payload["language"] == "" {
 		return errors.New("language is undefined")
 	}
-	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + filepath.Ext(opts.Key))
+	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + inputExtension(opts))
 	if err := p.s3.GetFile(opts.Key, inputPath, opts.Bucket, minio.GetObjectOptions{}); err != nil {
 		return err
 	}
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
@@ -69,7 +70,7 @@ func (p *insightsPipeline) Run(opts client.PipelineRunOptions) error {
 	}); err != nil {
 		return err
 	}
-	text, err := p.createText(inputPath, opts)
+	text, err := p.createText(ctx, inputPath, opts)
 	if err != nil {
 		return err
 	}
@@ -92,23 +93,23 @@ func (p *insightsPipeline) Run(opts client.PipelineRunOptions) error {
 	return nil
 }
 
-func (p *insightsPipeline) createText(inputPath string, opts client.PipelineRunOptions) (*string, error) {
+func (p *insightsPipeline) createText(ctx context.Context, inputPath string, opts client.PipelineRunOptions) (*string, error) {
 	/* Generate PDF/A */
 	var pdfPath string
-	if p.fileIdent.IsImage(opts.Key) {
+	if p.fileIdent.IsImage(inputPath) {
 		/* Get DPI */
-		dpi, err := p.imageProc.DPIFromImage(inputPath)
+		dpi, err := p.imageProc.DPIFromImage(ctx, inputPath)
 		if err != nil {
 			dpi = helper.ToPtr(72)
 		}
 		/* Remove alpha channel */
-		noAlphaImagePath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + filepath.Ext(opts.Key))
-		if err := p.imageProc.RemoveAlphaChannel(inputPath, noAlphaImagePath); err != nil {
+		noAlphaImagePath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + inputExtension(opts))
+		if err := p.imageProc.RemoveAlphaChannel(ctx, inputPath, noAlphaImagePath); err != nil {
 			return nil, err
 		}
 		defer func(path string) {
 			_, err := os.Stat(path)
-			if os.IsExist(err) {
+			if err == nil {
 				if err := os.Remove(path); err != nil {
 					infra.GetLogger().Error(err)
 				}
@@ -116,12 +117,12 @@ func (p *insightsPipeline) createText(inputPath string, opts client.PipelineRunO
 		}(noAlphaImagePath)
 		/* Convert to PDF/A */
 		pdfPath = filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + ".pdf")
-		if err := p.ocrProc.SearchablePDFFromFile(noAlphaImagePath, opts.Payload["language"], *dpi, pdfPath); err != nil {
+		if err := p.ocrProc.SearchablePDFFromFile(ctx, noAlphaImagePath, opts.Payload["language"], *dpi, pdfPath); err != nil {
 			return nil, err
 		}
 		defer func(path string) {
 			_, err := os.Stat(path)
-			if os.IsExist(err) {
+			if err == nil {
 				if err := os.Remove(path); err != nil {
 					infra.GetLogger().Error(err)
 				}
@@ -147,13 +148,13 @@ func (p *insightsPipeline) createText(inputPath string, opts client.PipelineRunO
 		}); err != nil {
 			return nil, err
 		}
-	} else if p.fileIdent.IsPDF(opts.Key) || p.fileIdent.IsOffice(opts.Key) || p.fileIdent.IsPlainText(opts.Key) {
+	} else if p.fileIdent.IsPDF(inputPath) || p.fileIdent.IsOffice(inputPath) || p.fileIdent.IsPlainText(inputPath) {
 		pdfPath = inputPath
 	} else {
 		return nil, errors.New("unsupported file type")
 	}
 	/* Extract text */
-	text, err := p.pdfProc.TextFromPDF(pdfPath)
+	text, err := p.pdfProc.TextFromPDF(ctx, pdfPath)
 	if text == nil || err != nil {
 		return nil, err
 	}
@@ -11,6 +11,7 @@
 package pipeline
 
 import (
+	"context"
 	"errors"
 	"os"
 	"path/filepath"
@@ -42,14 +43,14 @@ func NewMosaicPipeline() model.Pipeline {
 	}
 }
 
-func (p *mosaicPipeline) Run(opts client.PipelineRunOptions) error {
-	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + filepath.Ext(opts.Key))
+func (p *mosaicPipeline) Run(ctx context.Context, opts client.PipelineRunOptions) error {
+	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + inputExtension(opts))
 	if err := p.s3.GetFile(opts.Key, inputPath, opts.Bucket, minio.GetObjectOptions{}); err != nil {
 		return err
 	}
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
@@ -75,7 +76,7 @@ func (p *mosaicPipeline) Run(opts client.PipelineRunOptions) error {
 }
 
 func (p *mosaicPipeline) create(inputPath string, opts client.PipelineRunOptions) error {
-	if p.fileIdent.IsImage(opts.Key) {
+	if p.fileIdent.IsImage(inputPath) {
 		if _, err := p.mosaicClient.Create(client.MosaicCreateOptions{
 			Path:     inputPath,
 			S3Key:    filepath.FromSlash(opts.SnapshotID),
@@ -11,6 +11,7 @@
 package pipeline
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"voltaserve/client"
@@ -43,14 +44,14 @@ func NewOfficePipeline() model.Pipeline {
 	}
 }
 
-func (p *officePipeline) Run(opts client.PipelineRunOptions) error {
-	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + filepath.Ext(opts.Key))
+func (p *officePipeline) Run(ctx context.Context, opts client.PipelineRunOptions) error {
+	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + inputExtension(opts))
 	if err := p.s3.GetFile(opts.Key, inputPath, opts.Bucket, minio.GetObjectOptions{}); err != nil {
 		return err
 	}
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
@@ -62,11 +63,11 @@ func (p *officePipeline) Run(opts client.PipelineRunOptions) error {
 	}); err != nil {
 		return err
 	}
-	pdfKey, err := p.convertToPDF(inputPath, opts)
+	pdfKey, err := p.convertToPDF(ctx, inputPath, opts)
 	if err != nil {
 		return err
 	}
-	if err := p.pdfPipeline.Run(client.PipelineRunOptions{
+	if err := p.pdfPipeline.Run(ctx, client.PipelineRunOptions{
 		Bucket:     opts.Bucket,
 		Key:        *pdfKey,
 		SnapshotID: opts.SnapshotID,
@@ -76,25 +77,17 @@ func (p *officePipeline) Run(opts client.PipelineRunOptions) error {
 	return nil
 }
 
-func (p *officePipeline) convertToPDF(inputPath string, opts client.PipelineRunOptions) (*string, error) {
+func (p *officePipeline) convertToPDF(ctx context.Context, inputPath string, opts client.PipelineRunOptions) (*string, error) {
 	outputDir := filepath.FromSlash(os.TempDir() + "/" + helper.NewID())
-	outputPath, err := p.officeProc.PDF(inputPath, outputDir)
-	if err != nil {
-		return nil, err
-	}
-	defer func(path string) {
-		_, err := os.Stat(path)
-		if os.IsExist(err) {
-			if err := os.Remove(path); err != nil {
-				infra.GetLogger().Error(err)
-			}
-		}
-	}(*outputPath)
 	defer func(path string) {
 		if err := os.RemoveAll(path); err != nil {
 			infra.GetLogger().Error(err)
 		}
 	}(outputDir)
+	outputPath, err := p.officeProc.PDF(ctx, inputPath, outputDir)
+	if err != nil {
+		return nil, err
+	}
 	stat, err := os.Stat(*outputPath)
 	if err != nil {
 		return nil, err
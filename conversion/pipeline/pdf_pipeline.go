@@ -11,6 +11,7 @@
 package pipeline
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"voltaserve/client"
@@ -44,14 +45,14 @@ func NewPDFPipeline() model.Pipeline {
 	}
 }
 
-func (p *pdfPipeline) Run(opts client.PipelineRunOptions) error {
-	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + filepath.Ext(opts.Key))
+func (p *pdfPipeline) Run(ctx context.Context, opts client.PipelineRunOptions) error {
+	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + inputExtension(opts))
 	if err := p.s3.GetFile(opts.Key, inputPath, opts.Bucket, minio.GetObjectOptions{}); err != nil {
 		return err
 	}
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
@@ -63,7 +64,7 @@ func (p *pdfPipeline) Run(opts client.PipelineRunOptions) error {
 	}); err != nil {
 		return err
 	}
-	if err := p.createThumbnail(inputPath, opts); err != nil {
+	if err := p.createThumbnail(ctx, inputPath, opts); err != nil {
 		return err
 	}
 	if err := p.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
@@ -81,7 +82,7 @@ func (p *pdfPipeline) Run(opts client.PipelineRunOptions) error {
 	}); err != nil {
 		return err
 	}
-	if err := p.extractText(inputPath, opts); err != nil {
+	if err := p.extractText(ctx, inputPath, opts); err != nil {
 		return err
 	}
 	if err := p.apiClient.PatchTask(opts.TaskID, client.TaskPatchOptions{
@@ -94,20 +95,20 @@ func (p *pdfPipeline) Run(opts client.PipelineRunOptions) error {
 	return nil
 }
 
-func (p *pdfPipeline) createThumbnail(inputPath string, opts client.PipelineRunOptions) error {
+func (p *pdfPipeline) createThumbnail(ctx context.Context, inputPath string, opts client.PipelineRunOptions) error {
 	tmpPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + ".png")
-	if err := p.pdfProc.Thumbnail(inputPath, 0, p.config.Limits.ImagePreviewMaxHeight, tmpPath); err != nil {
+	if err := p.pdfProc.Thumbnail(ctx, inputPath, 0, p.config.Limits.ImagePreviewMaxHeight, tmpPath); err != nil {
 		return err
 	}
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
 		}
 	}(tmpPath)
-	props, err := p.imageProc.MeasureImage(tmpPath)
+	props, err := p.imageProc.MeasureImage(ctx, tmpPath)
 	if err != nil {
 		return err
 	}
@@ -134,8 +135,8 @@ func (p *pdfPipeline) createThumbnail(inputPath string, opts client.PipelineRunO
 	return nil
 }
 
-func (p *pdfPipeline) extractText(inputPath string, opts client.PipelineRunOptions) error {
-	text, err := p.pdfProc.TextFromPDF(inputPath)
+func (p *pdfPipeline) extractText(ctx context.Context, inputPath string, opts client.PipelineRunOptions) error {
+	text, err := p.pdfProc.TextFromPDF(ctx, inputPath)
 	if err != nil {
 		infra.GetLogger().Named(infra.StrPipeline).Errorw(err.Error())
 	}
@@ -169,9 +170,10 @@ func (p *pdfPipeline) saveOriginalAsPreview(inputPath string, opts client.Pipeli
 		Options: opts,
 		Fields:  []string{client.SnapshotFieldPreview},
 		Preview: &client.S3Object{
-			Bucket: opts.Bucket,
-			Key:    opts.Key,
-			Size:   helper.ToPtr(stat.Size()),
+			Bucket:      opts.Bucket,
+			Key:         opts.Key,
+			Size:        helper.ToPtr(stat.Size()),
+			ContentType: opts.ContentType,
 		},
 	}); err != nil {
 		return err
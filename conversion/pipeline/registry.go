@@ -0,0 +1,229 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package pipeline
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"voltaserve/client"
+	"voltaserve/config"
+	"voltaserve/identifier"
+	"voltaserve/model"
+)
+
+type Registration struct {
+	ID       string
+	Pipeline model.Pipeline
+	/* Matched against the key's extension, lowercase with the leading dot */
+	Extensions []string
+	/* Matched against the MIME type, a trailing '*' matches a prefix, e.g. 'image/*' */
+	MIMETypes []string
+	/* When several pipelines match, the highest priority wins */
+	Priority    int
+	RetryPolicy RetryPolicy
+	/* Produces artifacts of its own, the dispatcher leaves the snapshot's status alone */
+	Detached bool
+}
+
+/*
+Registry picks the pipeline for a file. Pipelines without extensions and
+MIME types, like mosaic, only run when requested by ID.
+*/
+type Registry struct {
+	registrations []*Registration
+	byID          map[string]*Registration
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		byID: make(map[string]*Registration),
+	}
+}
+
+/* Registers the built-in pipelines and those declared in the configuration */
+func NewDefaultRegistry() *Registry {
+	r := NewRegistry()
+	defaults := NewDefaultRetryPolicy()
+	/* These pipelines call other services, give them more room for outages */
+	external := defaults
+	external.MaxAttempts = defaults.MaxAttempts * 2
+	for _, reg := range []Registration{
+		{
+			ID:          model.PipelinePDF,
+			Pipeline:    NewPDFPipeline(),
+			Extensions:  identifier.PDFExtensions,
+			MIMETypes:   []string{"application/pdf"},
+			RetryPolicy: defaults,
+		},
+		{
+			ID:          model.PipelineOffice,
+			Pipeline:    NewOfficePipeline(),
+			Extensions:  append(append([]string{}, identifier.OfficeExtensions...), identifier.PlainTextExtensions...),
+			RetryPolicy: defaults,
+		},
+		{
+			ID:          model.PipelineImage,
+			Pipeline:    NewImagePipeline(),
+			Extensions:  identifier.ImageExtensions,
+			RetryPolicy: defaults,
+		},
+		{
+			ID:          model.PipelineAudioVideo,
+			Pipeline:    NewAudioVideoPipeline(),
+			Extensions:  append(append([]string{}, identifier.AudioExtensions...), identifier.VideoExtensions...),
+			RetryPolicy: defaults,
+		},
+		{
+			ID:          model.PipelineGLB,
+			Pipeline:    NewGLBPipeline(),
+			Extensions:  identifier.GLBExtensions,
+			MIMETypes:   []string{"model/gltf-binary"},
+			RetryPolicy: defaults,
+		},
+		{
+			ID:          model.PipelineZIP,
+			Pipeline:    NewZIPPipeline(),
+			Extensions:  identifier.ZIPExtensions,
+			MIMETypes:   []string{"application/zip"},
+			RetryPolicy: defaults,
+		},
+		{
+			ID:          model.PipelineInsights,
+			Pipeline:    NewInsightsPipeline(),
+			RetryPolicy: external,
+		},
+		{
+			ID:          model.PipelineMoasic,
+			Pipeline:    NewMosaicPipeline(),
+			RetryPolicy: external,
+		},
+		{
+			ID:          model.PipelineWatermark,
+			Pipeline:    NewWatermarkPipeline(),
+			RetryPolicy: external,
+		},
+		{
+			ID:          model.PipelineDiff,
+			Pipeline:    NewDiffPipeline(),
+			RetryPolicy: defaults,
+			Detached:    true,
+		},
+	} {
+		if err := r.Register(reg); err != nil {
+			panic(err)
+		}
+	}
+	for _, cfg := range config.GetConfig().ExternalPipelines {
+		if err := ValidateExternalPipeline(cfg); err != nil {
+			panic(err)
+		}
+		if err := r.Register(Registration{
+			ID:          cfg.ID,
+			Pipeline:    NewExternalPipeline(cfg),
+			Extensions:  cfg.Extensions,
+			MIMETypes:   cfg.MIMETypes,
+			Priority:    cfg.Priority,
+			RetryPolicy: defaults,
+		}); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+func (r *Registry) Register(reg Registration) error {
+	if reg.ID == "" {
+		return fmt.Errorf("pipeline ID is required")
+	}
+	if _, ok := r.byID[reg.ID]; ok {
+		return fmt.Errorf("pipeline '%s' is already registered", reg.ID)
+	}
+	extensions := make([]string, 0, len(reg.Extensions))
+	for _, e := range reg.Extensions {
+		e = strings.ToLower(e)
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		extensions = append(extensions, e)
+	}
+	reg.Extensions = extensions
+	r.registrations = append(r.registrations, &reg)
+	r.byID[reg.ID] = &reg
+	return nil
+}
+
+func (r *Registry) Get(id string) (*Registration, bool) {
+	reg, ok := r.byID[id]
+	return reg, ok
+}
+
+/*
+Returns the pipeline requested by ID, otherwise the one with the highest
+priority handling the key's extension or MIME type. On a tie, the one
+registered first wins.
+*/
+func (r *Registry) Resolve(opts client.PipelineRunOptions) (*Registration, bool) {
+	if opts.PipelineID != nil {
+		return r.Get(*opts.PipelineID)
+	}
+	extension := strings.ToLower(inputExtension(opts))
+	mimeType := opts.ContentType
+	if mimeType == "" || opts.Extension == "" {
+		mimeType = r.mimeType(extension)
+	}
+	var res *Registration
+	for _, reg := range r.registrations {
+		if !reg.matchesExtension(extension) && !reg.matchesMIMEType(mimeType) {
+			continue
+		}
+		if res == nil || reg.Priority > res.Priority {
+			res = reg
+		}
+	}
+	return res, res != nil
+}
+
+func (r *Registry) mimeType(extension string) string {
+	if extension == "" {
+		return ""
+	}
+	mimeType, _, _ := strings.Cut(mime.TypeByExtension(extension), ";")
+	return mimeType
+}
+
+func (reg *Registration) matchesExtension(extension string) bool {
+	if extension == "" {
+		return false
+	}
+	for _, e := range reg.Extensions {
+		if e == extension {
+			return true
+		}
+	}
+	return false
+}
+
+func (reg *Registration) matchesMIMEType(mimeType string) bool {
+	if mimeType == "" {
+		return false
+	}
+	for _, m := range reg.MIMETypes {
+		if prefix, ok := strings.CutSuffix(m, "*"); ok {
+			if strings.HasPrefix(mimeType, prefix) {
+				return true
+			}
+		} else if m == mimeType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package pipeline
+
+import (
+	"errors"
+	"time"
+	"voltaserve/config"
+	"voltaserve/errorpkg"
+)
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	IsRetryable    func(error) bool
+}
+
+func NewDefaultRetryPolicy() RetryPolicy {
+	cfg := config.GetConfig().Retry
+	return RetryPolicy{
+		MaxAttempts:    cfg.MaxAttempts,
+		InitialBackoff: time.Duration(cfg.InitialBackoffSeconds) * time.Second,
+		MaxBackoff:     time.Duration(cfg.MaxBackoffSeconds) * time.Second,
+		IsRetryable:    IsTransientError,
+	}
+}
+
+/* Returns how long to wait before the next attempt, doubling after each one */
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+		if backoff >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+func (p RetryPolicy) ShouldRetry(err error, attempt int) bool {
+	if errors.Is(err, ErrNoMatchingPipeline) {
+		return false
+	}
+	return attempt < p.MaxAttempts && p.IsRetryable(err)
+}
+
+/*
+Errors that have a user-friendly message describe a problem with the file
+itself (unsupported type, empty text...), running again won't fix them.
+*/
+func IsTransientError(err error) bool {
+	return !errorpkg.HasUserFriendlyMessage(err.Error())
+}
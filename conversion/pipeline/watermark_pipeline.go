@@ -11,6 +11,7 @@
 package pipeline
 
 import (
+	"context"
 	"errors"
 	"os"
 	"path/filepath"
@@ -42,14 +43,14 @@ func NewWatermarkPipeline() model.Pipeline {
 	}
 }
 
-func (p *watermarkPipeline) Run(opts client.PipelineRunOptions) error {
-	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + filepath.Ext(opts.Key))
+func (p *watermarkPipeline) Run(ctx context.Context, opts client.PipelineRunOptions) error {
+	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + inputExtension(opts))
 	if err := p.s3.GetFile(opts.Key, inputPath, opts.Bucket, minio.GetObjectOptions{}); err != nil {
 		return err
 	}
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
@@ -76,11 +77,11 @@ func (p *watermarkPipeline) Run(opts client.PipelineRunOptions) error {
 
 func (p *watermarkPipeline) create(inputPath string, opts client.PipelineRunOptions) error {
 	var category string
-	if p.fileIdent.IsImage(opts.Key) {
+	if p.fileIdent.IsImage(inputPath) {
 		category = "image"
-	} else if p.fileIdent.IsPDF(opts.Key) {
+	} else if p.fileIdent.IsPDF(inputPath) {
 		category = "document"
-	} else if p.fileIdent.IsOffice(opts.Key) || p.fileIdent.IsPlainText(opts.Key) {
+	} else if p.fileIdent.IsOffice(inputPath) || p.fileIdent.IsPlainText(inputPath) {
 		category = "document"
 	} else {
 		return errors.New("unsupported file type")
@@ -89,8 +90,8 @@ func (p *watermarkPipeline) create(inputPath string, opts client.PipelineRunOpti
 	if err != nil {
 		return err
 	}
-	key := filepath.FromSlash(opts.SnapshotID + "/watermark" + filepath.Ext(opts.Key))
-	if err := p.watermarkClient.Create(client.WatermarkCreateOptions{
+	key := filepath.FromSlash(opts.SnapshotID + "/watermark" + inputExtension(opts))
+	createOpts := client.WatermarkCreateOptions{
 		Path:     inputPath,
 		S3Key:    key,
 		S3Bucket: opts.Bucket,
@@ -99,7 +100,28 @@ func (p *watermarkPipeline) create(inputPath string, opts client.PipelineRunOpti
 			opts.Payload["workspace"],
 			opts.Payload["user"],
 		},
-	}); err != nil {
+	}
+	/* A template's text replaces the default lines, it carries its own date if any */
+	if text, ok := opts.Payload["text"]; ok {
+		createOpts.Values = nil
+		createOpts.Fields = map[string]string{
+			"text":      text,
+			"timestamp": "false",
+		}
+		for payloadKey, field := range map[string]string{
+			"color":    "color",
+			"opacity":  "opacity",
+			"angle":    "angle",
+			"position": "position",
+			"tiled":    "tiled",
+			"fontSize": "font_size",
+		} {
+			if value, ok := opts.Payload[payloadKey]; ok {
+				createOpts.Fields[field] = value
+			}
+		}
+	}
+	if err := p.watermarkClient.Create(createOpts); err != nil {
 		return err
 	}
 	if err := p.apiClient.PatchSnapshot(client.SnapshotPatchOptions{
@@ -11,6 +11,7 @@
 package pipeline
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"voltaserve/client"
@@ -43,14 +44,14 @@ func NewZIPPipeline() model.Pipeline {
 	}
 }
 
-func (p *zipPipeline) Run(opts client.PipelineRunOptions) error {
-	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + filepath.Ext(opts.Key))
+func (p *zipPipeline) Run(ctx context.Context, opts client.PipelineRunOptions) error {
+	inputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + inputExtension(opts))
 	if err := p.s3.GetFile(opts.Key, inputPath, opts.Bucket, minio.GetObjectOptions{}); err != nil {
 		return err
 	}
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
@@ -73,7 +74,7 @@ func (p *zipPipeline) Run(opts client.PipelineRunOptions) error {
 				infra.GetLogger().Error(err)
 			}
 		}(tmpDir)
-		if err := p.zipProc.Extract(inputPath, tmpDir); err != nil {
+		if err := p.zipProc.Extract(ctx, inputPath, tmpDir); err != nil {
 			return err
 		}
 		gltfPath, err := helper.FindFileWithExtension(tmpDir, ".gltf")
@@ -90,11 +91,11 @@ func (p *zipPipeline) Run(opts client.PipelineRunOptions) error {
 		}); err != nil {
 			return err
 		}
-		glbKey, err := p.convertToGLB(*gltfPath, opts)
+		glbKey, err := p.convertToGLB(ctx, *gltfPath, opts)
 		if err != nil {
 			return err
 		}
-		if err := p.glbPipeline.Run(client.PipelineRunOptions{
+		if err := p.glbPipeline.Run(ctx, client.PipelineRunOptions{
 			Bucket:     opts.Bucket,
 			Key:        *glbKey,
 			SnapshotID: opts.SnapshotID,
@@ -106,14 +107,14 @@ func (p *zipPipeline) Run(opts client.PipelineRunOptions) error {
 	return nil
 }
 
-func (p *zipPipeline) convertToGLB(inputPath string, opts client.PipelineRunOptions) (*string, error) {
+func (p *zipPipeline) convertToGLB(ctx context.Context, inputPath string, opts client.PipelineRunOptions) (*string, error) {
 	outputPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + ".glb")
-	if err := p.gltfProc.ToGLB(inputPath, outputPath); err != nil {
+	if err := p.gltfProc.ToGLB(ctx, inputPath, outputPath); err != nil {
 		return nil, err
 	}
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
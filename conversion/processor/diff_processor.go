@@ -0,0 +1,355 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package processor
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"strings"
+)
+
+const (
+	/* Lines of unchanged text shown around each change */
+	diffContextLines = 3
+	/* Beyond this many edits the texts are considered rewritten rather than edited */
+	diffMaxEdits = 2000
+	/* Channel difference, out of 0xffff, below which a pixel counts as unchanged */
+	diffPixelThreshold = 0x1000
+)
+
+type DiffProcessor struct{}
+
+func NewDiffProcessor() *DiffProcessor {
+	return &DiffProcessor{}
+}
+
+type TextDiff struct {
+	Unified      string
+	LinesAdded   int
+	LinesRemoved int
+}
+
+const (
+	lineEqual  = ' '
+	lineDelete = '-'
+	lineInsert = '+'
+)
+
+type lineEdit struct {
+	op   byte
+	text string
+	/* Zero-based positions in the base and current text before this edit */
+	basePos int
+	pos     int
+}
+
+/* Produces a unified diff going from the base text to the current one */
+func (p *DiffProcessor) Text(base string, current string, baseName string, name string) TextDiff {
+	edits := diffLines(splitLines(base), splitLines(current))
+	res := TextDiff{}
+	for _, e := range edits {
+		switch e.op {
+		case lineInsert:
+			res.LinesAdded++
+		case lineDelete:
+			res.LinesRemoved++
+		}
+	}
+	if res.LinesAdded == 0 && res.LinesRemoved == 0 {
+		return res
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", baseName, name))
+	for _, hunk := range hunks(edits) {
+		writeHunk(&sb, hunk)
+	}
+	res.Unified = sb.String()
+	return res
+}
+
+/*
+Compares two rendered pages and writes an image where changed pixels are red
+and the rest of the current page is faded, a missing page is compared against
+a blank one. Returns the ratio of changed pixels.
+*/
+func (p *DiffProcessor) Image(basePath string, path string, outputPath string) (float64, error) {
+	base, err := decodePNG(basePath)
+	if err != nil {
+		return 0, err
+	}
+	current, err := decodePNG(path)
+	if err != nil {
+		return 0, err
+	}
+	bounds := image.Rect(0, 0,
+		max(base.Bounds().Dx(), current.Bounds().Dx()),
+		max(base.Bounds().Dy(), current.Bounds().Dy()),
+	)
+	if bounds.Empty() {
+		return 0, nil
+	}
+	output := image.NewRGBA(bounds)
+	changed := 0
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			r1, g1, b1 := pixelAt(base, x, y)
+			r2, g2, b2 := pixelAt(current, x, y)
+			if channelDiff(r1, r2) > diffPixelThreshold ||
+				channelDiff(g1, g2) > diffPixelThreshold ||
+				channelDiff(b1, b2) > diffPixelThreshold {
+				output.Set(x, y, color.RGBA{R: 0xff, A: 0xff})
+				changed++
+			} else {
+				/* Luminance, scaled down to 8 bits and faded toward white */
+				l := (299*r2 + 587*g2 + 114*b2) / 1000 >> 8
+				v := uint8(0xff - (0xff-l)/4)
+				output.Set(x, y, color.RGBA{R: v, G: v, B: v, A: 0xff})
+			}
+		}
+	}
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err := png.Encode(f, output); err != nil {
+		return 0, err
+	}
+	return float64(changed) / float64(bounds.Dx()*bounds.Dy()), nil
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n"), "\n")
+}
+
+/*
+Myers' algorithm on the part that differs once the common prefix and suffix are
+trimmed. When the texts need more than diffMaxEdits edits, everything in
+between is reported as removed then added.
+*/
+func diffLines(base []string, current []string) []lineEdit {
+	prefix := 0
+	for prefix < len(base) && prefix < len(current) && base[prefix] == current[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(base)-prefix && suffix < len(current)-prefix &&
+		base[len(base)-1-suffix] == current[len(current)-1-suffix] {
+		suffix++
+	}
+	a := base[prefix : len(base)-suffix]
+	b := current[prefix : len(current)-suffix]
+	ops, ok := myers(a, b)
+	if !ok {
+		ops = make([]byte, 0, len(a)+len(b))
+		for range a {
+			ops = append(ops, lineDelete)
+		}
+		for range b {
+			ops = append(ops, lineInsert)
+		}
+	}
+	res := make([]lineEdit, 0, prefix+len(ops)+suffix)
+	basePos, pos := 0, 0
+	add := func(op byte) {
+		e := lineEdit{op: op, basePos: basePos, pos: pos}
+		switch op {
+		case lineEqual:
+			e.text = base[basePos]
+			basePos++
+			pos++
+		case lineDelete:
+			e.text = base[basePos]
+			basePos++
+		case lineInsert:
+			e.text = current[pos]
+			pos++
+		}
+		res = append(res, e)
+	}
+	for i := 0; i < prefix; i++ {
+		add(lineEqual)
+	}
+	for _, op := range ops {
+		add(op)
+	}
+	for i := 0; i < suffix; i++ {
+		add(lineEqual)
+	}
+	return res
+}
+
+/* Returns the edit script, or false if it needs more than diffMaxEdits edits */
+func myers(a []string, b []string) ([]byte, bool) {
+	n, m := len(a), len(b)
+	limit := min(n+m, diffMaxEdits)
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	/* trace[d] holds the furthest reaching x for diagonals -d..d after d edits */
+	var trace [][]int
+	found := false
+	for d := 0; d <= limit && !found; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+	if !found {
+		return nil, false
+	}
+	furthest := func(d int, k int) int {
+		if d < 0 {
+			return 0
+		}
+		return trace[d][k+d]
+	}
+	var ops []byte
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && furthest(d-1, k-1) < furthest(d-1, k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := furthest(d-1, prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, lineEqual)
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, lineInsert)
+			} else {
+				ops = append(ops, lineDelete)
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops, true
+}
+
+/* Groups changes that are close enough to share their context */
+func hunks(edits []lineEdit) [][]lineEdit {
+	var res [][]lineEdit
+	i := 0
+	for i < len(edits) {
+		if edits[i].op == lineEqual {
+			i++
+			continue
+		}
+		start := max(0, i-diffContextLines)
+		end := i
+		for j := i; j < len(edits); {
+			if edits[j].op != lineEqual {
+				end = j
+				j++
+				continue
+			}
+			run := j
+			for run < len(edits) && edits[run].op == lineEqual {
+				run++
+			}
+			if run == len(edits) || run-j > 2*diffContextLines {
+				break
+			}
+			j = run
+		}
+		stop := min(len(edits), end+1+diffContextLines)
+		res = append(res, edits[start:stop])
+		i = stop
+	}
+	return res
+}
+
+func writeHunk(sb *strings.Builder, hunk []lineEdit) {
+	baseCount, count := 0, 0
+	for _, e := range hunk {
+		if e.op != lineInsert {
+			baseCount++
+		}
+		if e.op != lineDelete {
+			count++
+		}
+	}
+	/* An empty range points at the line before it */
+	baseStart, start := hunk[0].basePos, hunk[0].pos
+	if baseCount > 0 {
+		baseStart++
+	}
+	if count > 0 {
+		start++
+	}
+	sb.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", baseStart, baseCount, start, count))
+	for _, e := range hunk {
+		sb.WriteByte(e.op)
+		sb.WriteString(e.text)
+		sb.WriteByte('\n')
+	}
+}
+
+/* A missing path decodes to an empty image */
+func decodePNG(path string) (image.Image, error) {
+	if path == "" {
+		return image.NewRGBA(image.Rectangle{}), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+/* Outside the image reads as white paper */
+func pixelAt(img image.Image, x int, y int) (uint32, uint32, uint32) {
+	bounds := img.Bounds()
+	if x >= bounds.Dx() || y >= bounds.Dy() {
+		return 0xffff, 0xffff, 0xffff
+	}
+	r, g, b, a := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+	/* Composite over white */
+	return r + 0xffff - a, g + 0xffff - a, b + 0xffff - a
+}
+
+func channelDiff(a uint32, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
@@ -11,6 +11,7 @@
 package processor
 
 import (
+	"context"
 	"fmt"
 	"voltaserve/config"
 	"voltaserve/infra"
@@ -30,8 +31,8 @@ func NewGLBProcessor() *GLBProcessor {
 	}
 }
 
-func (p *GLBProcessor) Thumbnail(inputPath string, width int, height int, color string, outputPath string) error {
-	if err := infra.NewCommand().Exec("screenshot-glb", "-i", inputPath, "-o", outputPath, "--width", fmt.Sprintf("%d", width), "--height", fmt.Sprintf("%d", height), "--color", color); err != nil {
+func (p *GLBProcessor) Thumbnail(ctx context.Context, inputPath string, width int, height int, color string, outputPath string) error {
+	if err := infra.NewCommand().Exec(ctx, "screenshot-glb", "-i", inputPath, "-o", outputPath, "--width", fmt.Sprintf("%d", width), "--height", fmt.Sprintf("%d", height), "--color", color); err != nil {
 		return err
 	}
 	return nil
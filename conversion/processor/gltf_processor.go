@@ -11,6 +11,7 @@
 package processor
 
 import (
+	"context"
 	"voltaserve/infra"
 )
 
@@ -24,8 +25,8 @@ func NewGLTFProcessor() *GLTFProcessor {
 	}
 }
 
-func (p *GLTFProcessor) ToGLB(inputPath string, outputPath string) error {
-	if err := p.cmd.Exec("gltf-pipeline", "-i", inputPath, "-o", outputPath); err != nil {
+func (p *GLTFProcessor) ToGLB(ctx context.Context, inputPath string, outputPath string) error {
+	if err := p.cmd.Exec(ctx, "gltf-pipeline", "-i", inputPath, "-o", outputPath); err != nil {
 		return err
 	}
 	return nil
@@ -11,6 +11,7 @@
 package processor
 
 import (
+	"context"
 	"strconv"
 	"strings"
 	"voltaserve/client"
@@ -34,18 +35,18 @@ func NewImageProcessor() *ImageProcessor {
 	}
 }
 
-func (p *ImageProcessor) Thumbnail(inputPath string, outputPath string) (*bool, error) {
-	props, err := p.MeasureImage(inputPath)
+func (p *ImageProcessor) Thumbnail(ctx context.Context, inputPath string, outputPath string) (*bool, error) {
+	props, err := p.MeasureImage(ctx, inputPath)
 	if err != nil {
 		return nil, err
 	}
 	if props.Width > p.config.Limits.ImagePreviewMaxWidth || props.Height > p.config.Limits.ImagePreviewMaxHeight {
 		if props.Width > props.Height {
-			if err := p.ResizeImage(inputPath, p.config.Limits.ImagePreviewMaxWidth, 0, outputPath); err != nil {
+			if err := p.ResizeImage(ctx, inputPath, p.config.Limits.ImagePreviewMaxWidth, 0, outputPath); err != nil {
 				return nil, err
 			}
 		} else {
-			if err := p.ResizeImage(inputPath, 0, p.config.Limits.ImagePreviewMaxHeight, outputPath); err != nil {
+			if err := p.ResizeImage(ctx, inputPath, 0, p.config.Limits.ImagePreviewMaxHeight, outputPath); err != nil {
 				return nil, err
 			}
 		}
@@ -54,8 +55,8 @@ func (p *ImageProcessor) Thumbnail(inputPath string, outputPath string) (*bool,
 	return helper.ToPtr(false), nil
 }
 
-func (p *ImageProcessor) MeasureImage(inputPath string) (*client.ImageProps, error) {
-	size, err := infra.NewCommand().ReadOutput("identify", "-format", "%w,%h", inputPath)
+func (p *ImageProcessor) MeasureImage(ctx context.Context, inputPath string) (*client.ImageProps, error) {
+	size, err := infra.NewCommand().ReadOutput(ctx, "identify", "-format", "%w,%h", inputPath)
 	if err != nil {
 		return nil, err
 	}
@@ -74,7 +75,7 @@ func (p *ImageProcessor) MeasureImage(inputPath string) (*client.ImageProps, err
 	}, nil
 }
 
-func (p *ImageProcessor) ResizeImage(inputPath string, width int, height int, outputPath string) error {
+func (p *ImageProcessor) ResizeImage(ctx context.Context, inputPath string, width int, height int, outputPath string) error {
 	var widthStr string
 	if width == 0 {
 		widthStr = ""
@@ -87,28 +88,28 @@ func (p *ImageProcessor) ResizeImage(inputPath string, width int, height int, ou
 	} else {
 		heightStr = strconv.FormatInt(int64(height), 10)
 	}
-	if err := infra.NewCommand().Exec("convert", "-resize", widthStr+"x"+heightStr, inputPath, outputPath); err != nil {
+	if err := infra.NewCommand().Exec(ctx, "convert", "-resize", widthStr+"x"+heightStr, inputPath, outputPath); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (p *ImageProcessor) ConvertImage(inputPath string, outputPath string) error {
-	if err := infra.NewCommand().Exec("convert", inputPath, outputPath); err != nil {
+func (p *ImageProcessor) ConvertImage(ctx context.Context, inputPath string, outputPath string) error {
+	if err := infra.NewCommand().Exec(ctx, "convert", inputPath, outputPath); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (p *ImageProcessor) RemoveAlphaChannel(inputPath string, outputPath string) error {
-	if err := infra.NewCommand().Exec("convert", inputPath, "-alpha", "off", outputPath); err != nil {
+func (p *ImageProcessor) RemoveAlphaChannel(ctx context.Context, inputPath string, outputPath string) error {
+	if err := infra.NewCommand().Exec(ctx, "convert", inputPath, "-alpha", "off", outputPath); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (p *ImageProcessor) DPIFromImage(inputPath string) (*int, error) {
-	output, err := infra.NewCommand().ReadOutput("exiftool", "-S", "-s", "-ImageWidth", "-ImageHeight", "-XResolution", "-YResolution", "-ResolutionUnit", inputPath)
+func (p *ImageProcessor) DPIFromImage(ctx context.Context, inputPath string) (*int, error) {
+	output, err := infra.NewCommand().ReadOutput(ctx, "exiftool", "-S", "-s", "-ImageWidth", "-ImageHeight", "-XResolution", "-YResolution", "-ResolutionUnit", inputPath)
 	if err != nil {
 		return nil, err
 	}
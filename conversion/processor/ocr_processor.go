@@ -11,6 +11,7 @@
 package processor
 
 import (
+	"context"
 	"fmt"
 	"voltaserve/config"
 	"voltaserve/infra"
@@ -30,8 +31,8 @@ func NewOCRProcessor() *OCRProcessor {
 	}
 }
 
-func (p *OCRProcessor) SearchablePDFFromFile(inputPath string, language string, dpi int, outputPath string) error {
-	if err := infra.NewCommand().Exec(
+func (p *OCRProcessor) SearchablePDFFromFile(ctx context.Context, inputPath string, language string, dpi int, outputPath string) error {
+	if err := infra.NewCommand().Exec(ctx,
 		"ocrmypdf",
 		inputPath,
 		"--rotate-pages",
@@ -11,6 +11,7 @@
 package processor
 
 import (
+	"context"
 	"os"
 	"path"
 	"path/filepath"
@@ -32,8 +33,8 @@ func NewOfficeProcessor() *OfficeProcessor {
 	}
 }
 
-func (p *OfficeProcessor) PDF(inputPath string, outputDir string) (*string, error) {
-	if err := infra.NewCommand().Exec("soffice", "--headless", "--convert-to", "pdf", "--outdir", outputDir, inputPath); err != nil {
+func (p *OfficeProcessor) PDF(ctx context.Context, inputPath string, outputDir string) (*string, error) {
+	if err := infra.NewCommand().Exec(ctx, "soffice", "--headless", "--convert-to", "pdf", "--outdir", outputDir, inputPath); err != nil {
 		return nil, err
 	}
 	if _, err := os.Stat(inputPath); err != nil {
@@ -11,9 +11,11 @@
 package processor
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"voltaserve/config"
@@ -35,19 +37,19 @@ func NewPDFProcessor() *PDFProcessor {
 	}
 }
 
-func (p *PDFProcessor) TextFromPDF(inputPath string) (*string, error) {
+func (p *PDFProcessor) TextFromPDF(ctx context.Context, inputPath string) (*string, error) {
 	tmpPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + ".txt")
-	if err := infra.NewCommand().Exec("pdftotext", inputPath, tmpPath); err != nil {
-		return nil, err
-	}
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
 		}
 	}(tmpPath)
+	if err := infra.NewCommand().Exec(ctx, "pdftotext", inputPath, tmpPath); err != nil {
+		return nil, err
+	}
 	b, err := os.ReadFile(tmpPath)
 	if err != nil {
 		return nil, err
@@ -55,7 +57,7 @@ func (p *PDFProcessor) TextFromPDF(inputPath string) (*string, error) {
 	return helper.ToPtr(strings.TrimSpace(string(b))), nil
 }
 
-func (p *PDFProcessor) Thumbnail(inputPath string, width int, height int, outputPath string) error {
+func (p *PDFProcessor) Thumbnail(ctx context.Context, inputPath string, width int, height int, outputPath string) error {
 	var widthStr string
 	if width == 0 {
 		widthStr = ""
@@ -68,8 +70,22 @@ func (p *PDFProcessor) Thumbnail(inputPath string, width int, height int, output
 	} else {
 		heightStr = strconv.FormatInt(int64(height), 10)
 	}
-	if err := infra.NewCommand().Exec("convert", "-thumbnail", widthStr+"x"+heightStr, "-background", "white", "-alpha", "remove", "-flatten", fmt.Sprintf("%s[0]", inputPath), outputPath); err != nil {
+	if err := infra.NewCommand().Exec(ctx, "convert", "-thumbnail", widthStr+"x"+heightStr, "-background", "white", "-alpha", "remove", "-flatten", fmt.Sprintf("%s[0]", inputPath), outputPath); err != nil {
 		return err
 	}
 	return nil
 }
+
+/* Renders up to the given number of pages as PNG files, returned in page order */
+func (p *PDFProcessor) Rasterize(ctx context.Context, inputPath string, dpi int, pageCount int, outputDir string) ([]string, error) {
+	if err := infra.NewCommand().Exec(ctx, "pdftoppm", "-r", strconv.Itoa(dpi), "-l", strconv.Itoa(pageCount), "-png", inputPath, filepath.Join(outputDir, "page")); err != nil {
+		return nil, err
+	}
+	/* pdftoppm pads page numbers to the same width, so names sort in page order */
+	res, err := filepath.Glob(filepath.Join(outputDir, "page-*.png"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(res)
+	return res, nil
+}
@@ -11,6 +11,7 @@
 package processor
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"voltaserve/config"
@@ -32,20 +33,20 @@ func NewVideoProcessor() *VideoProcessor {
 	}
 }
 
-func (p *VideoProcessor) Thumbnail(inputPath string, width int, height int, outputPath string) error {
+func (p *VideoProcessor) Thumbnail(ctx context.Context, inputPath string, width int, height int, outputPath string) error {
 	tmpPath := filepath.FromSlash(os.TempDir() + "/" + helper.NewID() + ".png")
-	if err := infra.NewCommand().Exec("ffmpeg", "-i", inputPath, "-frames:v", "1", tmpPath); err != nil {
-		return err
-	}
 	defer func(path string) {
 		_, err := os.Stat(path)
-		if os.IsExist(err) {
+		if err == nil {
 			if err := os.Remove(path); err != nil {
 				infra.GetLogger().Error(err)
 			}
 		}
 	}(tmpPath)
-	if err := p.imageProc.ResizeImage(tmpPath, width, height, outputPath); err != nil {
+	if err := infra.NewCommand().Exec(ctx, "ffmpeg", "-i", inputPath, "-frames:v", "1", tmpPath); err != nil {
+		return err
+	}
+	if err := p.imageProc.ResizeImage(ctx, tmpPath, width, height, outputPath); err != nil {
 		return err
 	}
 	return nil
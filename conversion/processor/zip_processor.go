@@ -11,6 +11,7 @@
 package processor
 
 import (
+	"context"
 	"voltaserve/infra"
 )
 
@@ -24,8 +25,8 @@ func NewZIPProcessor() *ZIPProcessor {
 	}
 }
 
-func (p *ZIPProcessor) Extract(inputPath string, outputDir string) error {
-	if err := p.cmd.Exec("unzip", inputPath, "-d", outputDir); err != nil {
+func (p *ZIPProcessor) Extract(ctx context.Context, inputPath string, outputDir string) error {
+	if err := p.cmd.Exec(ctx, "unzip", inputPath, "-d", outputDir); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,47 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package router
+
+import (
+	"voltaserve/infra"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type MetricsRouter struct {
+	handler fiber.Handler
+}
+
+func NewMetricsRouter() *MetricsRouter {
+	return &MetricsRouter{
+		handler: adaptor.HTTPHandler(promhttp.HandlerFor(infra.GetMetricsRegistry(), promhttp.HandlerOpts{})),
+	}
+}
+
+func (r *MetricsRouter) AppendRoutes(g fiber.Router) {
+	g.Get("metrics", r.GetMetrics)
+}
+
+// GetMetrics godoc
+//
+//	@Summary		Get Metrics
+//	@Description	Get Metrics in the Prometheus text exposition format
+//	@Tags			Metrics
+//	@Id				get_metrics
+//	@Produce		plain
+//	@Success		200	{string}	string
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/metrics [get]
+func (r *MetricsRouter) GetMetrics(c *fiber.Ctx) error {
+	return r.handler(c)
+}
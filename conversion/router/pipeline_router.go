@@ -11,6 +11,7 @@
 package router
 
 import (
+	"errors"
 	"voltaserve/client"
 	"voltaserve/config"
 	"voltaserve/errorpkg"
@@ -38,6 +39,9 @@ func NewPipelineRouter(opts NewPipelineRouterOptions) *PipelineRouter {
 
 func (r *PipelineRouter) AppendRoutes(g fiber.Router) {
 	g.Post("pipelines/run", r.Run)
+	g.Post("pipelines/cancel", r.Cancel)
+	g.Get("pipelines/dead_letters", r.ListDeadLetters)
+	g.Post("pipelines/dead_letters/:id/redrive", r.Redrive)
 }
 
 // Create godoc
@@ -61,6 +65,102 @@ func (r *PipelineRouter) Run(c *fiber.Ctx) error {
 	if err := validator.New().Struct(opts); err != nil {
 		return errorpkg.NewRequestBodyValidationError(err)
 	}
-	r.scheduler.SchedulePipeline(opts)
+	if err := r.scheduler.SchedulePipeline(opts); err != nil {
+		return err
+	}
+	return c.SendStatus(200)
+}
+
+// Cancel godoc
+//
+//	@Summary		Cancel
+//	@Description	Cancel
+//	@Tags			Pipelines
+//	@Id				pipelines_cancel
+//	@Accept			json
+//	@Produce		json
+//	@Param			api_key	query	string							true	"API Key"
+//	@Param			body	body	client.PipelineCancelOptions	true	"Body"
+//	@Success		200
+//	@Failure		400	{object}	errorpkg.ErrorResponse
+//	@Failure		401	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/pipelines/cancel [post]
+func (r *PipelineRouter) Cancel(c *fiber.Ctx) error {
+	if err := r.checkAPIKey(c); err != nil {
+		return err
+	}
+	opts := new(client.PipelineCancelOptions)
+	if err := c.BodyParser(opts); err != nil {
+		return err
+	}
+	if err := validator.New().Struct(opts); err != nil {
+		return errorpkg.NewRequestBodyValidationError(err)
+	}
+	if err := r.scheduler.CancelPipeline(opts.TaskID); err != nil {
+		return err
+	}
 	return c.SendStatus(200)
 }
+
+// ListDeadLetters godoc
+//
+//	@Summary		List Dead Letters
+//	@Description	List Dead Letters
+//	@Tags			Pipelines
+//	@Id				pipelines_list_dead_letters
+//	@Produce		json
+//	@Param			api_key	query		string	true	"API Key"
+//	@Success		200		{array}		runtime.DeadLetter
+//	@Failure		401		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/pipelines/dead_letters [get]
+func (r *PipelineRouter) ListDeadLetters(c *fiber.Ctx) error {
+	if err := r.checkAPIKey(c); err != nil {
+		return err
+	}
+	res, err := r.scheduler.ListDeadPipelines()
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+// Redrive godoc
+//
+//	@Summary		Redrive
+//	@Description	Redrive
+//	@Tags			Pipelines
+//	@Id				pipelines_redrive
+//	@Produce		json
+//	@Param			api_key	query		string	true	"API Key"
+//	@Param			id		path		string	true	"ID"
+//	@Success		200		{object}	runtime.Job
+//	@Failure		401		{object}	errorpkg.ErrorResponse
+//	@Failure		404		{object}	errorpkg.ErrorResponse
+//	@Failure		500		{object}	errorpkg.ErrorResponse
+//	@Router			/pipelines/dead_letters/{id}/redrive [post]
+func (r *PipelineRouter) Redrive(c *fiber.Ctx) error {
+	if err := r.checkAPIKey(c); err != nil {
+		return err
+	}
+	res, err := r.scheduler.RedrivePipeline(c.Params("id"))
+	if errors.Is(err, runtime.ErrDeadLetterNotFound) {
+		return errorpkg.NewDeadLetterNotFoundError(err)
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(res)
+}
+
+func (r *PipelineRouter) checkAPIKey(c *fiber.Ctx) error {
+	apiKey := c.Query("api_key")
+	if apiKey == "" {
+		return errorpkg.NewMissingQueryParamError("api_key")
+	}
+	if apiKey != r.config.Security.APIKey {
+		return errorpkg.NewInvalidAPIKeyError()
+	}
+	return nil
+}
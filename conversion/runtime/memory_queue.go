@@ -0,0 +1,237 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package runtime
+
+import (
+	"sync"
+	"time"
+	"voltaserve/client"
+	"voltaserve/config"
+)
+
+/* Not durable, jobs are lost on restart. Meant for development only. */
+type memoryQueue struct {
+	/* Priority to ring of workspaces, the workspace at the front is served next */
+	rings      map[string][]*memoryQueueWorkspace
+	processing map[string]*memoryQueueEntry
+	dead       map[string]*DeadLetter
+	canceled   map[string]bool
+	ticks      int64
+	config     config.QueueConfig
+	mu         sync.Mutex
+}
+
+/* Ring of user lanes, the lane at the front is served next */
+type memoryQueueWorkspace struct {
+	workspaceID string
+	lanes       []*memoryQueueLane
+}
+
+type memoryQueueLane struct {
+	userID string
+	jobs   []*Job
+}
+
+type memoryQueueEntry struct {
+	job      *Job
+	deadline time.Time
+}
+
+func NewMemoryQueue(cfg config.QueueConfig) Queue {
+	return &memoryQueue{
+		rings:      make(map[string][]*memoryQueueWorkspace),
+		processing: make(map[string]*memoryQueueEntry),
+		dead:       make(map[string]*DeadLetter),
+		canceled:   make(map[string]bool),
+		config:     cfg,
+	}
+}
+
+func (q *memoryQueue) Enqueue(opts client.PipelineRunOptions) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job := newJob(opts)
+	q.push(job, false)
+	return job, nil
+}
+
+func (q *memoryQueue) Dequeue() (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.ticks++
+	for _, priority := range priorityOrder(q.ticks, q.config) {
+		ring := q.rings[priority]
+		if len(ring) == 0 {
+			continue
+		}
+		workspace := ring[0]
+		lane := workspace.lanes[0]
+		job := lane.jobs[0]
+		lane.jobs = lane.jobs[1:]
+		workspace.lanes = workspace.lanes[1:]
+		if len(lane.jobs) > 0 {
+			workspace.lanes = append(workspace.lanes, lane)
+		}
+		q.rings[priority] = ring[1:]
+		if len(workspace.lanes) > 0 {
+			q.rings[priority] = append(q.rings[priority], workspace)
+		}
+		job.Attempts++
+		q.processing[job.ID] = &memoryQueueEntry{
+			job:      job,
+			deadline: time.Now().Add(q.visibilityTimeout()),
+		}
+		return job, nil
+	}
+	return nil, nil
+}
+
+/* Adds the job to its lane, at the front if it's due before the others */
+func (q *memoryQueue) push(job *Job, front bool) {
+	priority := job.Options.Priority
+	var workspace *memoryQueueWorkspace
+	for _, w := range q.rings[priority] {
+		if w.workspaceID == job.Options.WorkspaceID {
+			workspace = w
+			break
+		}
+	}
+	if workspace == nil {
+		workspace = &memoryQueueWorkspace{workspaceID: job.Options.WorkspaceID}
+		q.rings[priority] = append(q.rings[priority], workspace)
+	}
+	for _, lane := range workspace.lanes {
+		if lane.userID == job.Options.UserID {
+			if front {
+				lane.jobs = append([]*Job{job}, lane.jobs...)
+			} else {
+				lane.jobs = append(lane.jobs, job)
+			}
+			return
+		}
+	}
+	workspace.lanes = append(workspace.lanes, &memoryQueueLane{
+		userID: job.Options.UserID,
+		jobs:   []*Job{job},
+	})
+}
+
+func (q *memoryQueue) visibilityTimeout() time.Duration {
+	return time.Duration(q.config.VisibilityTimeoutSeconds) * time.Second
+}
+
+func (q *memoryQueue) Extend(job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if entry, ok := q.processing[job.ID]; ok {
+		entry.deadline = time.Now().Add(q.visibilityTimeout())
+	}
+	return nil
+}
+
+func (q *memoryQueue) Ack(job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.processing, job.ID)
+	return nil
+}
+
+func (q *memoryQueue) Retry(job *Job, delay time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.processing[job.ID] = &memoryQueueEntry{
+		job:      job,
+		deadline: time.Now().Add(delay),
+	}
+	return nil
+}
+
+func (q *memoryQueue) Bury(job *Job, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.processing, job.ID)
+	q.dead[job.ID] = newDeadLetter(job, reason)
+	return nil
+}
+
+func (q *memoryQueue) ListDead() ([]*DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	res := make([]*DeadLetter, 0, len(q.dead))
+	for _, d := range q.dead {
+		res = append(res, d)
+	}
+	sortDeadLetters(res)
+	return res, nil
+}
+
+func (q *memoryQueue) Redrive(id string) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	d, ok := q.dead[id]
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+	delete(q.dead, id)
+	job := d.Job
+	job.Attempts = 0
+	q.push(&job, false)
+	return &job, nil
+}
+
+func (q *memoryQueue) Cancel(taskID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.canceled[taskID] = true
+	return nil
+}
+
+func (q *memoryQueue) IsCanceled(taskID string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.canceled[taskID], nil
+}
+
+func (q *memoryQueue) ClearCanceled(taskID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.canceled, taskID)
+	return nil
+}
+
+func (q *memoryQueue) Recover() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	count := 0
+	now := time.Now()
+	for id, entry := range q.processing {
+		if entry.deadline.Before(now) {
+			delete(q.processing, id)
+			q.push(entry.job, true)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (q *memoryQueue) Len() (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var count int64
+	for _, ring := range q.rings {
+		for _, workspace := range ring {
+			for _, lane := range workspace.lanes {
+				count += int64(len(lane.jobs))
+			}
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+	"voltaserve/client"
+	"voltaserve/config"
+	"voltaserve/helper"
+)
+
+type Job struct {
+	ID       string                    `json:"id"`
+	Options  client.PipelineRunOptions `json:"options"`
+	Attempts int                       `json:"attempts"`
+}
+
+type DeadLetter struct {
+	Job      Job    `json:"job"`
+	Error    string `json:"error"`
+	FailTime string `json:"failTime"`
+}
+
+/*
+Queue holds pipeline jobs until a worker acknowledges them. A dequeued job
+stays invisible to other workers for the visibility timeout, if it's not
+acknowledged or extended in time, Recover puts it back in the queue. This
+gives at-least-once delivery, pipelines must tolerate running twice.
+
+All workers share the queue. Jobs are kept in one lane per priority,
+workspace and user. Dequeue goes round-robin over the workspaces of a
+priority, then over the users of the workspace, so neither a workspace nor
+a user with thousands of uploads starves the others. Priorities are interleaved
+according to their weights, interactive jobs go first most of the time
+without starving bulk ones.
+*/
+type Queue interface {
+	Enqueue(opts client.PipelineRunOptions) (*Job, error)
+	// Dequeue returns nil when the queue is empty, the job's attempts include this one.
+	Dequeue() (*Job, error)
+	Extend(job *Job) error
+	Ack(job *Job) error
+	// Retry makes the job visible again once the delay has elapsed.
+	Retry(job *Job, delay time.Duration) error
+	// Bury moves the job to the dead-letter list.
+	Bury(job *Job, reason string) error
+	ListDead() ([]*DeadLetter, error)
+	// Redrive moves a dead job back to the queue with its attempts reset.
+	Redrive(id string) (*Job, error)
+	// Cancel flags the task's pipeline as canceled, whether it's queued or running.
+	Cancel(taskID string) error
+	IsCanceled(taskID string) (bool, error)
+	ClearCanceled(taskID string) error
+	Recover() (int, error)
+	Len() (int64, error)
+}
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+func newDeadLetter(job *Job, reason string) *DeadLetter {
+	return &DeadLetter{
+		Job:      *job,
+		Error:    reason,
+		FailTime: time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+func NewQueue(cfg config.QueueConfig) (Queue, error) {
+	switch cfg.Type {
+	case config.QueueTypeRedis:
+		return NewRedisQueue(cfg), nil
+	case config.QueueTypeMemory:
+		return NewMemoryQueue(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown queue type '%s'", cfg.Type)
+	}
+}
+
+func sortDeadLetters(data []*DeadLetter) {
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].FailTime < data[j].FailTime
+	})
+}
+
+var queuePriorities = []string{client.PipelinePriorityInteractive, client.PipelinePriorityBulk}
+
+/* Jobs without a user or workspace share a single lane */
+const queueAnonymous = "_"
+
+func newJob(opts client.PipelineRunOptions) *Job {
+	if opts.Priority == "" {
+		opts.Priority = client.PipelinePriorityBulk
+	}
+	if opts.UserID == "" {
+		opts.UserID = queueAnonymous
+	}
+	if opts.WorkspaceID == "" {
+		opts.WorkspaceID = queueAnonymous
+	}
+	return &Job{ID: helper.NewID(), Options: opts}
+}
+
+/* Returns the priorities in the order the n-th dequeue should try them */
+func priorityOrder(n int64, cfg config.QueueConfig) []string {
+	total := int64(cfg.InteractiveWeight + cfg.BulkWeight)
+	if total <= 0 || n%total < int64(cfg.InteractiveWeight) {
+		return queuePriorities
+	}
+	return []string{client.PipelinePriorityBulk, client.PipelinePriorityInteractive}
+}
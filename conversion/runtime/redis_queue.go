@@ -0,0 +1,561 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+	"voltaserve/client"
+	"voltaserve/config"
+	"voltaserve/infra"
+
+	"github.com/redis/go-redis/v9"
+)
+
+/*
+All keys share the same hash tag so the scripts below can run
+atomically on a Redis cluster. Every key a script touches is passed in
+KEYS, the ones that depend on the queue's content are read beforehand and
+checked again by the script.
+*/
+const (
+	redisQueueKeyProcessing = "{conversion}:pipeline:processing"
+	redisQueueKeyJobs       = "{conversion}:pipeline:jobs"
+	/* How many times each job was dequeued, counted when it's claimed so a crash doesn't reset it */
+	redisQueueKeyAttempts = "{conversion}:pipeline:attempts"
+	redisQueueKeyDead     = "{conversion}:pipeline:dead"
+	redisQueueKeyCanceled = "{conversion}:pipeline:canceled:"
+	redisQueueKeyTicks    = "{conversion}:pipeline:ticks"
+	/* List of the non-empty workspace rings of a priority, followed by the priority */
+	redisQueueKeyRing = "{conversion}:pipeline:ring:"
+	/* List of the non-empty lanes of a workspace, followed by the priority and workspace ID */
+	redisQueueKeyWorkspace = "{conversion}:pipeline:workspace:"
+	/* List of job IDs, followed by the priority, workspace ID and user ID */
+	redisQueueKeyLane = "{conversion}:pipeline:lane:"
+	/* Single list the queue used before it had lanes, drained into them by Recover */
+	redisQueueKeyLegacyPending = "{conversion}:pipeline:pending"
+)
+
+/* Long enough for a queued or delayed job to be picked up and skipped */
+const redisQueueCanceledTTL = 24 * time.Hour
+
+/* How many times Dequeue reads the fronts again when another worker got there first */
+const redisQueueDequeueTries = 5
+
+/*
+Jobs are pushed to the left of their lane and popped from the right. A lane
+is added to the back of its workspace's ring when it stops being empty, and
+the workspace's ring to the back of the priority's ring.
+*/
+const redisQueuePushLua = `
+local function push(lane, workspace, ring, id, front)
+	local length
+	if front then
+		length = redis.call('RPUSH', lane, id)
+	else
+		length = redis.call('LPUSH', lane, id)
+	end
+	if length == 1 then
+		if redis.call('RPUSH', workspace, lane) == 1 then
+			redis.call('RPUSH', ring, workspace)
+		end
+	end
+end
+`
+
+/*
+KEYS[1] jobs hash, KEYS[2] lane, KEYS[3] workspace ring, KEYS[4] ring
+ARGV[1] job ID, ARGV[2] job payload
+*/
+var redisQueueEnqueueScript = redis.NewScript(redisQueuePushLua + `
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+push(KEYS[2], KEYS[3], KEYS[4], ARGV[1], false)
+return 1
+`)
+
+/*
+Pops a job from the lane at the front of the workspace at the front of the
+ring, then moves both to the back of their ring unless they are now empty.
+Returns false when the fronts aren't the ones that were read anymore, or
+when the workspace ring was empty, it's dropped then.
+
+KEYS[1] processing sorted set, KEYS[2] jobs hash, KEYS[3] attempts hash,
+KEYS[4] ring, KEYS[5] workspace ring, KEYS[6] lane
+ARGV[1] deadline in Unix milliseconds
+*/
+var redisQueueDequeueScript = redis.NewScript(`
+if redis.call('LINDEX', KEYS[4], 0) ~= KEYS[5] then
+	return false
+end
+local lane = redis.call('LINDEX', KEYS[5], 0)
+if not lane then
+	redis.call('LPOP', KEYS[4])
+	return false
+end
+if lane ~= KEYS[6] then
+	return false
+end
+local id = redis.call('RPOP', KEYS[6])
+redis.call('LPOP', KEYS[5])
+if redis.call('LLEN', KEYS[6]) > 0 then
+	redis.call('RPUSH', KEYS[5], KEYS[6])
+end
+redis.call('LPOP', KEYS[4])
+if redis.call('LLEN', KEYS[5]) > 0 then
+	redis.call('RPUSH', KEYS[4], KEYS[5])
+end
+if not id then
+	return false
+end
+redis.call('ZADD', KEYS[1], ARGV[1], id)
+local attempts = redis.call('HINCRBY', KEYS[3], id, 1)
+local value = redis.call('HGET', KEYS[2], id)
+if not value then
+	value = ''
+end
+return {id, value, tostring(attempts)}
+`)
+
+/*
+Puts an expired job back at the front of its lane, unless it was
+acknowledged or extended in the meantime.
+
+KEYS[1] processing sorted set, KEYS[2] lane, KEYS[3] workspace ring, KEYS[4] ring
+ARGV[1] job ID, ARGV[2] now in Unix milliseconds
+*/
+var redisQueueRecoverScript = redis.NewScript(redisQueuePushLua + `
+local deadline = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not deadline or tonumber(deadline) > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+push(KEYS[2], KEYS[3], KEYS[4], ARGV[1], true)
+return 1
+`)
+
+/*
+Moves a job from the pending list of older versions to its lane.
+
+KEYS[1] legacy pending list, KEYS[2] lane, KEYS[3] workspace ring, KEYS[4] ring
+ARGV[1] job ID
+*/
+var redisQueueDrainScript = redis.NewScript(redisQueuePushLua + `
+if redis.call('LREM', KEYS[1], 1, ARGV[1]) == 0 then
+	return 0
+end
+push(KEYS[2], KEYS[3], KEYS[4], ARGV[1], false)
+return 1
+`)
+
+/*
+KEYS[1] jobs hash, KEYS[2] lane, KEYS[3] workspace ring, KEYS[4] ring,
+KEYS[5] dead-letter hash, KEYS[6] attempts hash
+ARGV[1] job ID, ARGV[2] job payload
+*/
+var redisQueueRedriveScript = redis.NewScript(redisQueuePushLua + `
+if redis.call('HDEL', KEYS[5], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HDEL', KEYS[6], ARGV[1])
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+push(KEYS[2], KEYS[3], KEYS[4], ARGV[1], false)
+return 1
+`)
+
+type redisQueue struct {
+	redis  *infra.RedisManager
+	config config.QueueConfig
+}
+
+func NewRedisQueue(cfg config.QueueConfig) Queue {
+	return &redisQueue{
+		redis:  infra.NewRedisManager(),
+		config: cfg,
+	}
+}
+
+func (q *redisQueue) Enqueue(opts client.PipelineRunOptions) (*Job, error) {
+	rdb, err := q.redis.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	job := newJob(opts)
+	value, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	if err := redisQueueEnqueueScript.Run(
+		context.Background(),
+		rdb,
+		append([]string{redisQueueKeyJobs}, q.pushKeys(job)...),
+		job.ID,
+		value,
+	).Err(); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (q *redisQueue) Dequeue() (*Job, error) {
+	rdb, err := q.redis.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	ticks, err := rdb.Incr(context.Background(), redisQueueKeyTicks).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < redisQueueDequeueTries; i++ {
+		keys, err := q.fronts(rdb, priorityOrder(ticks, q.config))
+		if err != nil {
+			return nil, err
+		}
+		if keys == nil {
+			return nil, nil
+		}
+		res, err := redisQueueDequeueScript.Run(
+			context.Background(),
+			rdb,
+			append([]string{redisQueueKeyProcessing, redisQueueKeyJobs, redisQueueKeyAttempts}, keys...),
+			q.deadline(),
+		).StringSlice()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return q.claimed(res)
+	}
+	return nil, nil
+}
+
+/*
+Returns the ring, workspace ring and lane at the front of the first
+priority that has jobs, or nil when there are none.
+*/
+func (q *redisQueue) fronts(rdb redis.UniversalClient, priorities []string) ([]string, error) {
+	for _, priority := range priorities {
+		ring := redisQueueKeyRing + priority
+		workspace, err := rdb.LIndex(context.Background(), ring, 0).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		lane, err := rdb.LIndex(context.Background(), workspace, 0).Result()
+		if errors.Is(err, redis.Nil) {
+			/* Let the script drop the empty workspace ring */
+			lane = redisQueueKeyLane
+		} else if err != nil {
+			return nil, err
+		}
+		return []string{ring, workspace, lane}, nil
+	}
+	return nil, nil
+}
+
+func (q *redisQueue) claimed(res []string) (*Job, error) {
+	id, value := res[0], res[1]
+	attempts, err := strconv.Atoi(res[2])
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		/* The job's payload is gone, there is nothing left to run */
+		if err := q.Ack(&Job{ID: id}); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	job := new(Job)
+	if err := json.Unmarshal([]byte(value), job); err != nil {
+		return nil, err
+	}
+	job.Attempts = attempts
+	return job, nil
+}
+
+func (q *redisQueue) Extend(job *Job) error {
+	rdb, err := q.redis.GetClient()
+	if err != nil {
+		return err
+	}
+	return rdb.ZAddXX(context.Background(), redisQueueKeyProcessing, redis.Z{
+		Score:  float64(q.deadline()),
+		Member: job.ID,
+	}).Err()
+}
+
+func (q *redisQueue) Ack(job *Job) error {
+	rdb, err := q.redis.GetClient()
+	if err != nil {
+		return err
+	}
+	_, err = rdb.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.ZRem(context.Background(), redisQueueKeyProcessing, job.ID)
+		pipe.HDel(context.Background(), redisQueueKeyJobs, job.ID)
+		pipe.HDel(context.Background(), redisQueueKeyAttempts, job.ID)
+		return nil
+	})
+	return err
+}
+
+func (q *redisQueue) Retry(job *Job, delay time.Duration) error {
+	rdb, err := q.redis.GetClient()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = rdb.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.HSet(context.Background(), redisQueueKeyJobs, job.ID, value)
+		pipe.ZAdd(context.Background(), redisQueueKeyProcessing, redis.Z{
+			Score:  float64(time.Now().Add(delay).UnixMilli()),
+			Member: job.ID,
+		})
+		return nil
+	})
+	return err
+}
+
+func (q *redisQueue) Bury(job *Job, reason string) error {
+	rdb, err := q.redis.GetClient()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(newDeadLetter(job, reason))
+	if err != nil {
+		return err
+	}
+	_, err = rdb.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.HSet(context.Background(), redisQueueKeyDead, job.ID, value)
+		pipe.ZRem(context.Background(), redisQueueKeyProcessing, job.ID)
+		pipe.HDel(context.Background(), redisQueueKeyJobs, job.ID)
+		pipe.HDel(context.Background(), redisQueueKeyAttempts, job.ID)
+		return nil
+	})
+	return err
+}
+
+func (q *redisQueue) ListDead() ([]*DeadLetter, error) {
+	rdb, err := q.redis.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	values, err := rdb.HVals(context.Background(), redisQueueKeyDead).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*DeadLetter, 0, len(values))
+	for _, v := range values {
+		d := new(DeadLetter)
+		if err := json.Unmarshal([]byte(v), d); err != nil {
+			return nil, err
+		}
+		res = append(res, d)
+	}
+	sortDeadLetters(res)
+	return res, nil
+}
+
+func (q *redisQueue) Redrive(id string) (*Job, error) {
+	rdb, err := q.redis.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	value, err := rdb.HGet(context.Background(), redisQueueKeyDead, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := new(DeadLetter)
+	if err := json.Unmarshal([]byte(value), d); err != nil {
+		return nil, err
+	}
+	job := d.Job
+	job.Attempts = 0
+	b, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	moved, err := redisQueueRedriveScript.Run(
+		context.Background(),
+		rdb,
+		append(append([]string{redisQueueKeyJobs}, q.pushKeys(&job)...), redisQueueKeyDead, redisQueueKeyAttempts),
+		job.ID,
+		b,
+	).Int()
+	if err != nil {
+		return nil, err
+	}
+	if moved == 0 {
+		return nil, ErrDeadLetterNotFound
+	}
+	return &job, nil
+}
+
+func (q *redisQueue) Cancel(taskID string) error {
+	rdb, err := q.redis.GetClient()
+	if err != nil {
+		return err
+	}
+	return rdb.Set(context.Background(), redisQueueKeyCanceled+taskID, 1, redisQueueCanceledTTL).Err()
+}
+
+func (q *redisQueue) IsCanceled(taskID string) (bool, error) {
+	rdb, err := q.redis.GetClient()
+	if err != nil {
+		return false, err
+	}
+	count, err := rdb.Exists(context.Background(), redisQueueKeyCanceled+taskID).Result()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (q *redisQueue) ClearCanceled(taskID string) error {
+	rdb, err := q.redis.GetClient()
+	if err != nil {
+		return err
+	}
+	return rdb.Del(context.Background(), redisQueueKeyCanceled+taskID).Err()
+}
+
+/* Also moves the jobs left in the pending list of older versions to their lanes */
+func (q *redisQueue) Recover() (int, error) {
+	rdb, err := q.redis.GetClient()
+	if err != nil {
+		return 0, err
+	}
+	if err := q.drainLegacy(rdb); err != nil {
+		return 0, err
+	}
+	ids, err := rdb.ZRangeByScore(context.Background(), redisQueueKeyProcessing, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, id := range ids {
+		job, err := q.find(rdb, id)
+		if err != nil {
+			return count, err
+		}
+		if job == nil {
+			if err := q.Ack(&Job{ID: id}); err != nil {
+				return count, err
+			}
+			continue
+		}
+		recovered, err := redisQueueRecoverScript.Run(
+			context.Background(),
+			rdb,
+			append([]string{redisQueueKeyProcessing}, q.pushKeys(job)...),
+			id,
+			time.Now().UnixMilli(),
+		).Int()
+		if err != nil {
+			return count, err
+		}
+		count += recovered
+	}
+	return count, nil
+}
+
+func (q *redisQueue) drainLegacy(rdb redis.UniversalClient) error {
+	ids, err := rdb.LRange(context.Background(), redisQueueKeyLegacyPending, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	/* The oldest jobs are on the right */
+	for i := len(ids) - 1; i >= 0; i-- {
+		job, err := q.find(rdb, ids[i])
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			if err := rdb.LRem(context.Background(), redisQueueKeyLegacyPending, 1, ids[i]).Err(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := redisQueueDrainScript.Run(
+			context.Background(),
+			rdb,
+			append([]string{redisQueueKeyLegacyPending}, q.pushKeys(job)...),
+			job.ID,
+		).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Returns nil when the job's payload is gone */
+func (q *redisQueue) find(rdb redis.UniversalClient, id string) (*Job, error) {
+	value, err := rdb.HGet(context.Background(), redisQueueKeyJobs, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job := new(Job)
+	if err := json.Unmarshal([]byte(value), job); err != nil {
+		return nil, err
+	}
+	/* Jobs enqueued by older versions have no priority, user or workspace */
+	job.Options = newJob(job.Options).Options
+	return job, nil
+}
+
+/* Jobs being processed or waiting for a retry are in the jobs hash too */
+func (q *redisQueue) Len() (int64, error) {
+	rdb, err := q.redis.GetClient()
+	if err != nil {
+		return 0, err
+	}
+	var jobs, processing *redis.IntCmd
+	if _, err := rdb.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		jobs = pipe.HLen(context.Background(), redisQueueKeyJobs)
+		processing = pipe.ZCard(context.Background(), redisQueueKeyProcessing)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return max(jobs.Val()-processing.Val(), 0), nil
+}
+
+/* The lane, workspace ring and ring the job goes to */
+func (q *redisQueue) pushKeys(job *Job) []string {
+	workspace := redisQueueKeyWorkspace + job.Options.Priority + ":" + job.Options.WorkspaceID
+	return []string{
+		redisQueueKeyLane + job.Options.Priority + ":" + job.Options.WorkspaceID + ":" + job.Options.UserID,
+		workspace,
+		redisQueueKeyRing + job.Options.Priority,
+	}
+}
+
+func (q *redisQueue) deadline() int64 {
+	return time.Now().Add(time.Duration(q.config.VisibilityTimeoutSeconds) * time.Second).UnixMilli()
+}
@@ -11,8 +11,13 @@
 package runtime
 
 import (
+	"context"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
+	"voltaserve/config"
+	"voltaserve/helper"
 	"voltaserve/pipeline"
 
 	"voltaserve/client"
@@ -20,9 +25,12 @@ import (
 )
 
 type Scheduler struct {
-	pipelineQueue       [][]client.PipelineRunOptions
+	queue               Queue
+	visibilityTimeout   time.Duration
 	pipelineWorkerCount int
-	activePipelineCount int
+	activePipelineCount int32
+	running             map[string]context.CancelFunc
+	runningMu           sync.Mutex
 	apiClient           *client.APIClient
 }
 
@@ -41,73 +49,254 @@ func NewDefaultSchedulerOptions() SchedulerOptions {
 }
 
 func NewScheduler(opts SchedulerOptions) *Scheduler {
-	return &Scheduler{
-		pipelineQueue:       make([][]client.PipelineRunOptions, opts.PipelineWorkerCount),
+	cfg := config.GetConfig()
+	queue, err := NewQueue(cfg.Queue)
+	if err != nil {
+		panic(err)
+	}
+	s := &Scheduler{
+		queue:               queue,
+		visibilityTimeout:   time.Duration(cfg.Queue.VisibilityTimeoutSeconds) * time.Second,
 		pipelineWorkerCount: opts.PipelineWorkerCount,
+		running:             make(map[string]context.CancelFunc),
 		apiClient:           client.NewAPIClient(),
 	}
+	s.registerMetrics()
+	return s
+}
+
+func (s *Scheduler) registerMetrics() {
+	infra.NewGaugeFunc("conversion_queue_depth", "Number of pipelines waiting in the queue.", func() (float64, error) {
+		count, err := s.queue.Len()
+		return float64(count), err
+	})
+	infra.NewGaugeFunc("conversion_active_workers", "Number of pipeline workers running a pipeline.", func() (float64, error) {
+		return float64(atomic.LoadInt32(&s.activePipelineCount)), nil
+	})
+	infra.NewGaugeFunc("conversion_workers", "Number of pipeline workers.", func() (float64, error) {
+		return float64(s.pipelineWorkerCount), nil
+	})
 }
 
 func (s *Scheduler) Start() {
 	infra.GetLogger().Named(infra.StrScheduler).Infow("🚀  launching", "type", "pipeline", "count", s.pipelineWorkerCount)
+	s.recoverPipelines()
 	for i := 0; i < s.pipelineWorkerCount; i++ {
 		go s.pipelineWorker(i)
 	}
+	go s.pipelineRecovery()
 	go s.pipelineQueueStatus()
 	go s.pipelineWorkerStatus()
 }
 
-func (s *Scheduler) SchedulePipeline(opts *client.PipelineRunOptions) {
-	index := s.choosePipeline()
-	infra.GetLogger().Named(infra.StrScheduler).Infow("👉  choosing", "pipeline", index)
-	s.pipelineQueue[index] = append(s.pipelineQueue[index], *opts)
-}
-
-/* Choose the pipeline with the least number of items in the queue */
-func (s *Scheduler) choosePipeline() int {
-	index := 0
-	length := len(s.pipelineQueue[0])
-	for i := 0; i < s.pipelineWorkerCount; i++ {
-		if len(s.pipelineQueue[i]) < length {
-			index = i
-			length = len(s.pipelineQueue[i])
-		}
+/* Returns only once the pipeline is durably enqueued */
+func (s *Scheduler) SchedulePipeline(opts *client.PipelineRunOptions) error {
+	job, err := s.queue.Enqueue(*opts)
+	if err != nil {
+		return err
 	}
-	return index
+	infra.GetLogger().Named(infra.StrScheduler).Infow("👉  enqueued", "job", job.ID, "bucket", opts.Bucket, "key", opts.Key)
+	return nil
 }
 
 func (s *Scheduler) pipelineWorker(index int) {
 	dispatcher := pipeline.NewDispatcher()
-	s.pipelineQueue[index] = make([]client.PipelineRunOptions, 0)
 	infra.GetLogger().Named(infra.StrPipeline).Infow("⚙️  running", "worker", index)
 	for {
-		if len(s.pipelineQueue[index]) > 0 {
-			s.activePipelineCount++
-			opts := s.pipelineQueue[index][0]
-			infra.GetLogger().Named(infra.StrPipeline).Infow("🔨  working", "worker", index, "bucket", opts.Bucket, "key", opts.Key)
-			start := time.Now()
-			err := dispatcher.Dispatch(opts)
-			elapsed := time.Since(start)
-			if err == nil {
-				infra.GetLogger().Named(infra.StrPipeline).Infow("🎉  succeeded", "worker", index, "elapsed", elapsed, "bucket", opts.Bucket, "key", opts.Key)
-			} else {
-				infra.GetLogger().Named(infra.StrPipeline).Errorw("⛈️  failed", "worker", index, "elapsed", elapsed, "bucket", opts.Bucket, "key", opts.Key, "error", err.Error())
-			}
-			s.pipelineQueue[index] = s.pipelineQueue[index][1:]
-			s.activePipelineCount--
-		} else {
+		job, err := s.queue.Dequeue()
+		if err != nil {
+			infra.GetLogger().Named(infra.StrPipeline).Errorw(err.Error(), "worker", index)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if job == nil {
 			time.Sleep(500 * time.Millisecond)
+			continue
 		}
+		atomic.AddInt32(&s.activePipelineCount, 1)
+		s.runJob(dispatcher, index, job)
+		atomic.AddInt32(&s.activePipelineCount, -1)
+	}
+}
+
+func (s *Scheduler) runJob(dispatcher *pipeline.Dispatcher, index int, job *Job) {
+	opts := job.Options
+	if canceled, err := s.queue.IsCanceled(opts.TaskID); err != nil {
+		infra.GetLogger().Named(infra.StrPipeline).Errorw(err.Error(), "worker", index, "job", job.ID)
+	} else if canceled {
+		s.handleCancellation(dispatcher, job)
+		return
+	}
+	infra.GetLogger().Named(infra.StrPipeline).Infow("🔨  working", "worker", index, "job", job.ID, "attempt", job.Attempts, "bucket", opts.Bucket, "key", opts.Key)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.runningMu.Lock()
+	s.running[opts.TaskID] = cancel
+	s.runningMu.Unlock()
+	stop := s.keepAlive(job, cancel)
+	start := time.Now()
+	err := dispatcher.Dispatch(ctx, opts, job.Attempts)
+	elapsed := time.Since(start)
+	close(stop)
+	s.runningMu.Lock()
+	delete(s.running, opts.TaskID)
+	s.runningMu.Unlock()
+	if err == nil {
+		infra.GetLogger().Named(infra.StrPipeline).Infow("🎉  succeeded", "worker", index, "job", job.ID, "elapsed", elapsed, "bucket", opts.Bucket, "key", opts.Key)
+		if err := s.queue.Ack(job); err != nil {
+			infra.GetLogger().Named(infra.StrPipeline).Errorw(err.Error(), "worker", index, "job", job.ID)
+		}
+	} else if ctx.Err() != nil {
+		infra.GetLogger().Named(infra.StrPipeline).Infow("🛑  canceled", "worker", index, "job", job.ID, "elapsed", elapsed, "bucket", opts.Bucket, "key", opts.Key)
+		s.handleCancellation(dispatcher, job)
+	} else {
+		infra.GetLogger().Named(infra.StrPipeline).Errorw("⛈️  failed", "worker", index, "job", job.ID, "attempt", job.Attempts, "elapsed", elapsed, "bucket", opts.Bucket, "key", opts.Key, "error", err.Error())
+		s.handleFailure(dispatcher, job, err)
+	}
+}
+
+/* Schedules another attempt if the retry policy allows it, otherwise buries the job */
+func (s *Scheduler) handleFailure(dispatcher *pipeline.Dispatcher, job *Job, cause error) {
+	policy := dispatcher.GetRetryPolicy(job.Options)
+	if policy.ShouldRetry(cause, job.Attempts) {
+		delay := policy.Backoff(job.Attempts)
+		if err := dispatcher.Defer(job.Options, job.Attempts, cause); err != nil {
+			infra.GetLogger().Named(infra.StrScheduler).Errorw(err.Error(), "job", job.ID)
+		}
+		if err := s.queue.Retry(job, delay); err != nil {
+			infra.GetLogger().Named(infra.StrScheduler).Errorw(err.Error(), "job", job.ID)
+			return
+		}
+		infra.GetLogger().Named(infra.StrScheduler).Infow("🔁  retrying", "job", job.ID, "attempt", job.Attempts, "delay", delay)
+	} else {
+		if err := dispatcher.Fail(job.Options, job.Attempts, cause); err != nil {
+			infra.GetLogger().Named(infra.StrScheduler).Errorw(err.Error(), "job", job.ID)
+		}
+		if err := s.queue.Bury(job, cause.Error()); err != nil {
+			infra.GetLogger().Named(infra.StrScheduler).Errorw(err.Error(), "job", job.ID)
+			return
+		}
+		infra.GetLogger().Named(infra.StrScheduler).Infow("🪦  dead", "job", job.ID, "attempt", job.Attempts)
+	}
+}
+
+func (s *Scheduler) handleCancellation(dispatcher *pipeline.Dispatcher, job *Job) {
+	if err := dispatcher.Cancel(job.Options); err != nil {
+		infra.GetLogger().Named(infra.StrScheduler).Errorw(err.Error(), "job", job.ID)
+	}
+	if err := s.queue.Ack(job); err != nil {
+		infra.GetLogger().Named(infra.StrScheduler).Errorw(err.Error(), "job", job.ID)
+	}
+	if err := s.queue.ClearCanceled(job.Options.TaskID); err != nil {
+		infra.GetLogger().Named(infra.StrScheduler).Errorw(err.Error(), "job", job.ID)
+	}
+}
+
+/*
+Cancels the task's pipeline, a running one is stopped right away on this
+instance, or at its next keep-alive on another one. A queued one is
+skipped when dequeued.
+*/
+func (s *Scheduler) CancelPipeline(taskID string) error {
+	if err := s.queue.Cancel(taskID); err != nil {
+		return err
+	}
+	s.runningMu.Lock()
+	cancel, ok := s.running[taskID]
+	s.runningMu.Unlock()
+	if ok {
+		cancel()
+	}
+	infra.GetLogger().Named(infra.StrScheduler).Infow("🛑  canceling", "task", taskID)
+	return nil
+}
+
+func (s *Scheduler) ListDeadPipelines() ([]*DeadLetter, error) {
+	return s.queue.ListDead()
+}
+
+/* Puts a dead pipeline back in the queue, it starts over from the first attempt */
+func (s *Scheduler) RedrivePipeline(id string) (*Job, error) {
+	job, err := s.queue.Redrive(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.apiClient.PatchSnapshot(client.SnapshotPatchOptions{
+		Options: job.Options,
+		Fields:  []string{client.SnapshotFieldStatus},
+		Status:  helper.ToPtr(client.SnapshotStatusWaiting),
+	}); err != nil {
+		return nil, err
+	}
+	if err := s.apiClient.PatchTask(job.Options.TaskID, client.TaskPatchOptions{
+		Name:   helper.ToPtr("Waiting."),
+		Fields: []string{client.TaskFieldName, client.TaskFieldStatus, client.TaskFieldError},
+		Status: helper.ToPtr(client.TaskStatusWaiting),
+	}); err != nil {
+		return nil, err
+	}
+	infra.GetLogger().Named(infra.StrScheduler).Infow("👉  redriven", "job", job.ID)
+	return job, nil
+}
+
+/*
+Extends the job's visibility timeout until the returned channel is closed,
+cancels the job if it was canceled through another instance.
+*/
+func (s *Scheduler) keepAlive(job *Job, cancel context.CancelFunc) chan struct{} {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.visibilityTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := s.queue.Extend(job); err != nil {
+					infra.GetLogger().Named(infra.StrScheduler).Errorw(err.Error(), "job", job.ID)
+				}
+				if canceled, err := s.queue.IsCanceled(job.Options.TaskID); err != nil {
+					infra.GetLogger().Named(infra.StrScheduler).Errorw(err.Error(), "job", job.ID)
+				} else if canceled {
+					cancel()
+				}
+			}
+		}
+	}()
+	return stop
+}
+
+/*
+Puts back in the queue jobs whose worker stopped extending them, e.g. after
+a crash, and jobs whose retry delay has elapsed.
+*/
+func (s *Scheduler) pipelineRecovery() {
+	for {
+		time.Sleep(5 * time.Second)
+		s.recoverPipelines()
+	}
+}
+
+func (s *Scheduler) recoverPipelines() {
+	count, err := s.queue.Recover()
+	if err != nil {
+		infra.GetLogger().Named(infra.StrScheduler).Errorw(err.Error())
+		return
+	}
+	if count > 0 {
+		infra.GetLogger().Named(infra.StrScheduler).Infow("♻️  recovered", "type", "pipeline", "count", count)
 	}
 }
 
 func (s *Scheduler) pipelineQueueStatus() {
-	previous := -1
+	var previous int64 = -1
 	for {
 		time.Sleep(5 * time.Second)
-		sum := 0
-		for i := 0; i < s.pipelineWorkerCount; i++ {
-			sum += len(s.pipelineQueue[i])
+		sum, err := s.queue.Len()
+		if err != nil {
+			infra.GetLogger().Named(infra.StrQueueStatus).Errorw(err.Error())
+			continue
 		}
 		if sum != previous {
 			if sum == 0 {
@@ -121,16 +310,17 @@ func (s *Scheduler) pipelineQueueStatus() {
 }
 
 func (s *Scheduler) pipelineWorkerStatus() {
-	previous := -1
+	var previous int32 = -1
 	for {
 		time.Sleep(3 * time.Second)
-		if previous != s.activePipelineCount {
-			if s.activePipelineCount == 0 {
+		active := atomic.LoadInt32(&s.activePipelineCount)
+		if previous != active {
+			if active == 0 {
 				infra.GetLogger().Named(infra.StrWorkerStatus).Infow("🌤️  all idle", "type", "pipeline")
 			} else {
-				infra.GetLogger().Named(infra.StrWorkerStatus).Infow("🔥  active", "type", "pipeline", "count", s.activePipelineCount)
+				infra.GetLogger().Named(infra.StrWorkerStatus).Infow("🔥  active", "type", "pipeline", "count", active)
 			}
 		}
-		previous = s.activePipelineCount
+		previous = active
 	}
 }
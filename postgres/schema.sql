@@ -45,26 +45,62 @@ CREATE TABLE IF NOT EXISTS workspace
     storage_capacity          bigint NOT NULL,
     root_id                   text UNIQUE,
     bucket                    text UNIQUE NOT NULL,
+    retention_policy          jsonb,
+    watermark_template_id     text,
+    watermark_enforced        boolean NOT NULL DEFAULT false,
     create_time               text NOT NULL DEFAULT (to_json(now())#>>'{}'),
     update_time               text ON UPDATE (to_json(now())#>>'{}')
 );
 
+ALTER TABLE workspace ADD COLUMN IF NOT EXISTS retention_policy jsonb;
+ALTER TABLE workspace ADD COLUMN IF NOT EXISTS watermark_template_id text;
+ALTER TABLE workspace ADD COLUMN IF NOT EXISTS watermark_enforced boolean NOT NULL DEFAULT false;
+
 CREATE INDEX IF NOT EXISTS workspace_organization_id_idx ON workspace (organization_id);
 
 CREATE TABLE IF NOT EXISTS "file"
 (
-    id           text PRIMARY KEY,
-    name         text NOT NULL,
-    type         text NOT NULL,
-    parent_id    text,
-    workspace_id text REFERENCES workspace (id) ON DELETE CASCADE,
-    snapshot_id  text,
-    create_time  text NOT NULL DEFAULT (to_json(now())#>>'{}'),
-    update_time  text ON UPDATE (to_json(now())#>>'{}')
+    id              text PRIMARY KEY,
+    name            text NOT NULL,
+    type            text NOT NULL,
+    parent_id       text,
+    workspace_id    text REFERENCES workspace (id) ON DELETE CASCADE,
+    snapshot_id     text,
+    trash_time      text,
+    trash_parent_id text,
+    size            bigint NOT NULL DEFAULT 0,
+    file_count      bigint NOT NULL DEFAULT 0,
+    folder_count    bigint NOT NULL DEFAULT 0,
+    inherit_permissions boolean NOT NULL DEFAULT true,
+    create_time     text NOT NULL DEFAULT (to_json(now())#>>'{}'),
+    update_time     text ON UPDATE (to_json(now())#>>'{}')
 );
 
+ALTER TABLE "file" ADD COLUMN IF NOT EXISTS trash_time text;
+ALTER TABLE "file" ADD COLUMN IF NOT EXISTS trash_parent_id text;
+-- Existing rows start at zero, run the API with -repair-aggregates once to fill them in
+ALTER TABLE "file" ADD COLUMN IF NOT EXISTS size bigint NOT NULL DEFAULT 0;
+ALTER TABLE "file" ADD COLUMN IF NOT EXISTS file_count bigint NOT NULL DEFAULT 0;
+ALTER TABLE "file" ADD COLUMN IF NOT EXISTS folder_count bigint NOT NULL DEFAULT 0;
+ALTER TABLE "file" ADD COLUMN IF NOT EXISTS inherit_permissions boolean NOT NULL DEFAULT true;
+
 CREATE INDEX IF NOT EXISTS file_parent_id_idx ON "file" (parent_id);
 CREATE INDEX IF NOT EXISTS file_workspace_id_idx ON "file" (workspace_id);
+CREATE INDEX IF NOT EXISTS file_trash_time_idx ON "file" (trash_time);
+
+-- Changes to the sizes and counts of the files, waiting to be added to the files and their ancestors
+CREATE TABLE IF NOT EXISTS file_aggregate_delta
+(
+    id           uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    file_id      text NOT NULL,
+    size         bigint NOT NULL DEFAULT 0,
+    file_count   bigint NOT NULL DEFAULT 0,
+    folder_count bigint NOT NULL DEFAULT 0,
+    create_time  text NOT NULL DEFAULT (to_json(now())#>>'{}')
+);
+
+CREATE INDEX IF NOT EXISTS file_aggregate_delta_file_id_idx ON file_aggregate_delta (file_id);
+CREATE INDEX IF NOT EXISTS file_aggregate_delta_create_time_idx ON file_aggregate_delta (create_time);
 
 CREATE TABLE IF NOT EXISTS "snapshot"
 (
@@ -81,18 +117,30 @@ CREATE TABLE IF NOT EXISTS "snapshot"
   language    text,
   status      text,
   task_id     text,
+  blob_id     text,
+  user_id     text REFERENCES "user" (id) ON DELETE SET NULL,
   create_time text NOT NULL DEFAULT (to_json(now())#>>'{}'),
   update_time text ON UPDATE (to_json(now())#>>'{}')
 );
 
+ALTER TABLE snapshot ADD COLUMN IF NOT EXISTS blob_id text;
+ALTER TABLE snapshot ADD COLUMN IF NOT EXISTS user_id text REFERENCES "user" (id) ON DELETE SET NULL;
+
 CREATE TABLE IF NOT EXISTS snapshot_file
 (
     snapshot_id text REFERENCES snapshot (id) ON DELETE CASCADE,
     file_id     text REFERENCES file (id) ON DELETE CASCADE,
+    label       text,
+    comment     text,
     create_time text NOT NULL DEFAULT (to_json(now())#>>'{}'),
     PRIMARY KEY (snapshot_id, file_id)
 );
 
+ALTER TABLE snapshot_file ADD COLUMN IF NOT EXISTS label text;
+ALTER TABLE snapshot_file ADD COLUMN IF NOT EXISTS comment text;
+
+CREATE INDEX IF NOT EXISTS snapshot_blob_id_idx ON snapshot (blob_id);
+
 CREATE INDEX IF NOT EXISTS snapshot_file_snapshot_id_idx ON snapshot_file (snapshot_id);
 CREATE INDEX IF NOT EXISTS snapshot_file_file_id_idx ON snapshot_file (file_id);
 
@@ -118,16 +166,34 @@ CREATE TABLE IF NOT EXISTS group_user
 CREATE INDEX IF NOT EXISTS group_user_group_id_idx ON group_user (group_id);
 CREATE INDEX IF NOT EXISTS group_user_user_id_idx ON group_user (user_id);
 
+CREATE TABLE IF NOT EXISTS role
+(
+    id              text PRIMARY KEY,
+    name            text NOT NULL,
+    organization_id text NOT NULL REFERENCES organization (id) ON DELETE CASCADE,
+    capabilities    jsonb NOT NULL,
+    create_time     text NOT NULL DEFAULT (to_json(now())#>>'{}'),
+    update_time     text ON UPDATE (to_json(now())#>>'{}'),
+    UNIQUE (organization_id, name)
+);
+
+-- Editing the labels and comments of the versions became a capability of its own
+UPDATE role SET capabilities = capabilities || '["comment"]'::jsonb
+WHERE capabilities ? 'manage_versions' AND NOT capabilities ? 'comment';
+
 CREATE TABLE IF NOT EXISTS userpermission
 (
     id          text PRIMARY KEY,
     user_id     text REFERENCES "user" (id) ON DELETE CASCADE,
     resource_id text,
     permission  text NOT NULL,
+    is_inheritable boolean NOT NULL DEFAULT true,
     create_time text NOT NULL DEFAULT (to_json(now())#>>'{}'),
     UNIQUE (user_id, resource_id)
 );
 
+ALTER TABLE userpermission ADD COLUMN IF NOT EXISTS is_inheritable boolean NOT NULL DEFAULT true;
+
 CREATE INDEX IF NOT EXISTS userpermission_user_id_idx ON userpermission (user_id);
 CREATE INDEX IF NOT EXISTS userpermission_resource_id_idx ON userpermission (resource_id);
 
@@ -137,13 +203,70 @@ CREATE TABLE IF NOT EXISTS grouppermission
     group_id    text REFERENCES "group" (id) ON DELETE CASCADE,
     resource_id text,
     permission  text NOT NULL,
+    is_inheritable boolean NOT NULL DEFAULT true,
     create_time text NOT NULL DEFAULT (to_json(now())#>>'{}'),
     UNIQUE (group_id, resource_id)
 );
 
+ALTER TABLE grouppermission ADD COLUMN IF NOT EXISTS is_inheritable boolean NOT NULL DEFAULT true;
+
 CREATE INDEX IF NOT EXISTS grouppermission_group_id_idx ON grouppermission (group_id);
 CREATE INDEX IF NOT EXISTS grouppermission_resource_id_idx ON grouppermission (resource_id);
 
+-- Migrations that can't be written to run more than once
+CREATE TABLE IF NOT EXISTS migration
+(
+    id          text PRIMARY KEY,
+    create_time text NOT NULL DEFAULT (to_json(now())#>>'{}')
+);
+
+-- Before the grants were inherited, sharing a file granted 'viewer' on its ancestors up to the
+-- workspace's root and the permission on every file of its tree. The 'viewer' grants of the
+-- ancestors, the ones some child has no 'viewer' grant below, stop being passed down, and the
+-- grants the files inherit the same from their parent are dropped. Run the API with
+-- -sync-file-cache once afterwards, the files are cached along with their grants.
+UPDATE userpermission p SET is_inheritable = false
+WHERE p.permission = 'viewer'
+  AND NOT EXISTS (SELECT 1 FROM migration WHERE id = 'inherited_permissions')
+  AND EXISTS (
+    SELECT 1 FROM "file" c WHERE c.parent_id = p.resource_id
+    AND NOT EXISTS (
+      SELECT 1 FROM userpermission cp
+      WHERE cp.user_id = p.user_id AND cp.resource_id = c.id AND cp.permission = 'viewer'
+    )
+  );
+
+DELETE FROM userpermission p
+WHERE p.is_inheritable
+  AND NOT EXISTS (SELECT 1 FROM migration WHERE id = 'inherited_permissions')
+  AND EXISTS (
+    SELECT 1 FROM "file" c INNER JOIN userpermission pp ON pp.resource_id = c.parent_id
+    WHERE c.id = p.resource_id AND c.inherit_permissions
+      AND pp.user_id = p.user_id AND pp.permission = p.permission AND pp.is_inheritable
+  );
+
+UPDATE grouppermission p SET is_inheritable = false
+WHERE p.permission = 'viewer'
+  AND NOT EXISTS (SELECT 1 FROM migration WHERE id = 'inherited_permissions')
+  AND EXISTS (
+    SELECT 1 FROM "file" c WHERE c.parent_id = p.resource_id
+    AND NOT EXISTS (
+      SELECT 1 FROM grouppermission cp
+      WHERE cp.group_id = p.group_id AND cp.resource_id = c.id AND cp.permission = 'viewer'
+    )
+  );
+
+DELETE FROM grouppermission p
+WHERE p.is_inheritable
+  AND NOT EXISTS (SELECT 1 FROM migration WHERE id = 'inherited_permissions')
+  AND EXISTS (
+    SELECT 1 FROM "file" c INNER JOIN grouppermission pp ON pp.resource_id = c.parent_id
+    WHERE c.id = p.resource_id AND c.inherit_permissions
+      AND pp.group_id = p.group_id AND pp.permission = p.permission AND pp.is_inheritable
+  );
+
+INSERT INTO migration (id) VALUES ('inherited_permissions') ON CONFLICT DO NOTHING;
+
 CREATE TABLE IF NOT EXISTS invitation
 (
   id              text PRIMARY KEY,
@@ -184,3 +307,131 @@ CREATE TABLE IF NOT EXISTS task
   create_time       text NOT NULL DEFAULT (to_json(now())#>>'{}'),
   update_time       text ON UPDATE (to_json(now())#>>'{}')
 );
+
+CREATE TABLE IF NOT EXISTS upload
+(
+  id            text PRIMARY KEY,
+  user_id       text NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+  workspace_id  text NOT NULL REFERENCES workspace (id) ON DELETE CASCADE,
+  parent_id     text REFERENCES file (id) ON DELETE CASCADE,
+  file_id       text REFERENCES file (id) ON DELETE CASCADE,
+  name          text NOT NULL,
+  size          bigint NOT NULL,
+  byte_offset   bigint NOT NULL DEFAULT 0,
+  bucket        text NOT NULL,
+  key           text NOT NULL,
+  snapshot_id   text NOT NULL,
+  s3_upload_id  text NOT NULL,
+  parts         jsonb,
+  complete_time text,
+  expire_time   text NOT NULL,
+  create_time   text NOT NULL DEFAULT (to_json(now())#>>'{}'),
+  update_time   text ON UPDATE (to_json(now())#>>'{}')
+);
+
+ALTER TABLE upload ADD COLUMN IF NOT EXISTS complete_time text;
+
+CREATE INDEX IF NOT EXISTS upload_user_id_idx ON upload (user_id);
+CREATE INDEX IF NOT EXISTS upload_workspace_id_idx ON upload (workspace_id);
+CREATE INDEX IF NOT EXISTS upload_expire_time_idx ON upload (expire_time);
+
+CREATE TABLE IF NOT EXISTS watermark_template
+(
+  id              text PRIMARY KEY,
+  workspace_id    text NOT NULL REFERENCES workspace (id) ON DELETE CASCADE,
+  name            text NOT NULL,
+  text            text NOT NULL,
+  classification  text,
+  font_size       double precision,
+  color           text NOT NULL,
+  opacity         double precision NOT NULL,
+  angle           double precision NOT NULL,
+  position        text NOT NULL,
+  tiled           boolean NOT NULL,
+  create_time     text NOT NULL DEFAULT (to_json(now())#>>'{}'),
+  update_time     text ON UPDATE (to_json(now())#>>'{}')
+);
+
+CREATE INDEX IF NOT EXISTS watermark_template_workspace_id_idx ON watermark_template (workspace_id);
+
+CREATE TABLE IF NOT EXISTS share_link
+(
+  id              text PRIMARY KEY,
+  file_id         text NOT NULL REFERENCES file (id) ON DELETE CASCADE,
+  user_id         text NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+  token_hash      text NOT NULL UNIQUE,
+  password_hash   text,
+  mode            text NOT NULL,
+  max_downloads   bigint,
+  download_count  bigint NOT NULL DEFAULT 0,
+  expire_time     text NOT NULL,
+  revoke_time     text,
+  create_time     text NOT NULL DEFAULT (to_json(now())#>>'{}'),
+  update_time     text ON UPDATE (to_json(now())#>>'{}')
+);
+
+CREATE INDEX IF NOT EXISTS share_link_file_id_idx ON share_link (file_id);
+
+CREATE TABLE IF NOT EXISTS share_link_access
+(
+  id             text PRIMARY KEY,
+  share_link_id  text NOT NULL REFERENCES share_link (id) ON DELETE CASCADE,
+  file_id        text,
+  action         text NOT NULL,
+  ip             text NOT NULL,
+  user_agent     text NOT NULL,
+  create_time    text NOT NULL DEFAULT (to_json(now())#>>'{}')
+);
+
+CREATE INDEX IF NOT EXISTS share_link_access_share_link_id_idx ON share_link_access (share_link_id);
+
+CREATE TABLE IF NOT EXISTS outbox
+(
+  id            text PRIMARY KEY,
+  type          text NOT NULL,
+  payload       jsonb NOT NULL,
+  attempts      int NOT NULL DEFAULT 0,
+  last_error    text,
+  claim_time    text,
+  process_time  text,
+  retry_time    text,
+  dead_time     text,
+  create_time   text NOT NULL DEFAULT (to_json(now())#>>'{}')
+);
+
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS retry_time text;
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS dead_time text;
+
+CREATE INDEX IF NOT EXISTS outbox_process_time_idx ON outbox (process_time);
+
+CREATE TABLE IF NOT EXISTS snapshot_diff
+(
+  id                text PRIMARY KEY,
+  snapshot_id       text NOT NULL REFERENCES snapshot (id) ON DELETE CASCADE,
+  base_snapshot_id  text NOT NULL REFERENCES snapshot (id) ON DELETE CASCADE,
+  status            text NOT NULL,
+  task_id           text,
+  text              jsonb,
+  summary           jsonb,
+  pages             jsonb,
+  metadata          jsonb,
+  create_time       text NOT NULL DEFAULT (to_json(now())#>>'{}'),
+  update_time       text ON UPDATE (to_json(now())#>>'{}'),
+  UNIQUE (snapshot_id, base_snapshot_id)
+);
+
+CREATE INDEX IF NOT EXISTS snapshot_diff_base_snapshot_id_idx ON snapshot_diff (base_snapshot_id);
+
+CREATE TABLE IF NOT EXISTS blob
+(
+  id           text PRIMARY KEY,
+  checksum     text NOT NULL,
+  extension    text NOT NULL,
+  bucket       text NOT NULL,
+  key          text NOT NULL,
+  size         bigint NOT NULL,
+  ref_count    bigint NOT NULL DEFAULT 1,
+  create_time  text NOT NULL DEFAULT (to_json(now())#>>'{}'),
+  update_time  text ON UPDATE (to_json(now())#>>'{}'),
+  UNIQUE (checksum, extension)
+);
@@ -17,6 +17,7 @@ import { encodeQuery } from '@/lib/helpers/query'
 import { Group } from './group'
 import { PermissionType } from './permission'
 import { Snapshot } from './snapshot'
+import { Task } from './task'
 
 export enum FileType {
   File = 'file',
@@ -306,7 +307,7 @@ export default class FileAPI {
       url: `/files`,
       method: 'DELETE',
       body: JSON.stringify(options),
-    })
+    }) as Promise<Task>
   }
 
   static async move(id: string, options: MoveOptions) {
@@ -314,7 +315,7 @@ export default class FileAPI {
       url: `/files/${id}/move`,
       method: 'POST',
       body: JSON.stringify(options),
-    })
+    }) as Promise<Task>
   }
 
   static async copy(id: string, options: CopyOptions) {
@@ -322,7 +323,7 @@ export default class FileAPI {
       url: `/files/${id}/copy`,
       method: 'POST',
       body: JSON.stringify(options),
-    })
+    }) as Promise<Task>
   }
 
   static useGet(
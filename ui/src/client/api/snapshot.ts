@@ -35,6 +35,7 @@ export enum Status {
   Processing = 'processing',
   Ready = 'ready',
   Error = 'error',
+  Canceled = 'canceled',
 }
 
 export type List = {
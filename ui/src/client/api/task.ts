@@ -78,6 +78,28 @@ export default class TaskAPI {
     )
   }
 
+  static async get(id: string, showError = true) {
+    return apiFetcher({
+      url: `/tasks/${id}`,
+      method: 'GET',
+      showError,
+    }) as Promise<Task | undefined>
+  }
+
+  // Resolves once the task is gone, i.e. it succeeded or got canceled
+  static async waitFor(id: string, interval = 1000) {
+    for (;;) {
+      const task = await this.get(id, false)
+      if (!task) {
+        return
+      }
+      if (task.status === Status.Error) {
+        throw new Error(task.error)
+      }
+      await new Promise((resolve) => setTimeout(resolve, interval))
+    }
+  }
+
   static async list(options?: ListOptions) {
     return apiFetcher({
       url: `/tasks?${this.paramsFromListOptions(options)}`,
@@ -22,6 +22,7 @@ import {
 } from '@chakra-ui/react'
 import cx from 'classnames'
 import FileAPI from '@/client/api/file'
+import TaskAPI from '@/client/api/task'
 import { useAppDispatch, useAppSelector } from '@/store/hook'
 import { copyModalDidClose, selectionUpdated } from '@/store/ui/files'
 import FileBrowse from './file-browse'
@@ -32,6 +33,7 @@ const FileCopy = () => {
   const isModalOpen = useAppSelector((state) => state.ui.files.isCopyModalOpen)
   const selection = useAppSelector((state) => state.ui.files.selection)
   const mutateList = useAppSelector((state) => state.ui.files.mutate)
+  const mutateTasks = useAppSelector((state) => state.ui.tasks.mutateList)
   const [isLoading, setIsLoading] = useState(false)
   const [targetId, setTargetId] = useState<string>()
 
@@ -41,18 +43,23 @@ const FileCopy = () => {
     }
     try {
       setIsLoading(true)
-      await FileAPI.copy(targetId, {
+      const task = await FileAPI.copy(targetId, {
         ids: selection,
       })
-      if (fileId === targetId) {
-        mutateList?.()
-      }
+      mutateTasks?.(await TaskAPI.list())
       dispatch(selectionUpdated([]))
       dispatch(copyModalDidClose())
+      TaskAPI.waitFor(task.id)
+        .then(() => {
+          if (fileId === targetId) {
+            mutateList?.()
+          }
+        })
+        .catch(() => {})
     } finally {
       setIsLoading(false)
     }
-  }, [targetId, fileId, selection, dispatch, mutateList])
+  }, [targetId, fileId, selection, dispatch, mutateList, mutateTasks])
 
   return (
     <Modal
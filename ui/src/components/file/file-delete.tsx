@@ -23,6 +23,7 @@ import {
 } from '@chakra-ui/react'
 import cx from 'classnames'
 import FileAPI from '@/client/api/file'
+import TaskAPI from '@/client/api/task'
 import { useAppSelector } from '@/store/hook'
 import { deleteModalDidClose, selectionUpdated } from '@/store/ui/files'
 
@@ -34,19 +35,23 @@ const FileDelete = () => {
     (state) => state.ui.files.isDeleteModalOpen,
   )
   const mutateList = useAppSelector((state) => state.ui.files.mutate)
+  const mutateTasks = useAppSelector((state) => state.ui.tasks.mutateList)
   const [isLoading, setIsLoading] = useState(false)
 
   const handleDelete = useCallback(async () => {
     try {
       setIsLoading(true)
-      await FileAPI.delete({ ids: selection })
-      mutateList?.()
+      const task = await FileAPI.delete({ ids: selection })
+      mutateTasks?.(await TaskAPI.list())
       dispatch(selectionUpdated([]))
       dispatch(deleteModalDidClose())
+      TaskAPI.waitFor(task.id)
+        .then(() => mutateList?.())
+        .catch(() => mutateList?.())
     } finally {
       setIsLoading(false)
     }
-  }, [selection, fileId, dispatch, mutateList])
+  }, [selection, fileId, dispatch, mutateList, mutateTasks])
 
   return (
     <Modal
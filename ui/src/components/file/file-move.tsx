@@ -22,6 +22,7 @@ import {
 } from '@chakra-ui/react'
 import cx from 'classnames'
 import FileAPI from '@/client/api/file'
+import TaskAPI from '@/client/api/task'
 import { useAppDispatch, useAppSelector } from '@/store/hook'
 import { moveModalDidClose, selectionUpdated } from '@/store/ui/files'
 import FileBrowse from './file-browse'
@@ -32,6 +33,7 @@ const FileMove = () => {
   const selection = useAppSelector((state) => state.ui.files.selection)
   const isModalOpen = useAppSelector((state) => state.ui.files.isMoveModalOpen)
   const mutateList = useAppSelector((state) => state.ui.files.mutate)
+  const mutateTasks = useAppSelector((state) => state.ui.tasks.mutateList)
   const [isLoading, setIsLoading] = useState(false)
   const [targetId, setTargetId] = useState<string>()
 
@@ -41,14 +43,17 @@ const FileMove = () => {
     }
     try {
       setIsLoading(true)
-      await FileAPI.move(targetId, { ids: selection })
-      mutateList?.()
+      const task = await FileAPI.move(targetId, { ids: selection })
+      mutateTasks?.(await TaskAPI.list())
       dispatch(selectionUpdated([]))
       dispatch(moveModalDidClose())
+      TaskAPI.waitFor(task.id)
+        .then(() => mutateList?.())
+        .catch(() => mutateList?.())
     } finally {
       setIsLoading(false)
     }
-  }, [targetId, fileId, selection, dispatch, mutateList])
+  }, [targetId, fileId, selection, dispatch, mutateList, mutateTasks])
 
   return (
     <Modal
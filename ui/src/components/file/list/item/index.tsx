@@ -120,7 +120,9 @@ const ListItem = ({
       navigate(`/workspace/${file.workspaceId}/file/${file.id}`)
     } else if (
       file.type === 'file' &&
-      ((file.snapshot?.preview && file.snapshot?.status === Status.Ready) ||
+      ((file.snapshot?.preview &&
+        (file.snapshot?.status === Status.Ready ||
+          file.snapshot?.status === Status.Canceled)) ||
         file.snapshot?.mosaic)
     ) {
       window.open(`/file/${file.id}`, '_blank')?.focus()
@@ -19,6 +19,7 @@ import {
 } from '@dnd-kit/core'
 import cx from 'classnames'
 import FileAPI, { FileType } from '@/client/api/file'
+import TaskAPI from '@/client/api/task'
 import store from '@/store/configure-store'
 import { useAppDispatch, useAppSelector } from '@/store/hook'
 import { hiddenUpdated, selectionUpdated } from '@/store/ui/files'
@@ -81,9 +82,10 @@ const ListDraggableDroppable = ({
         dispatch(hiddenUpdated(idsToMove))
         setIsLoading(true)
         try {
-          await FileAPI.move(file.id, { ids: idsToMove })
-          mutateList?.()
+          const task = await FileAPI.move(file.id, { ids: idsToMove })
+          await TaskAPI.waitFor(task.id)
         } finally {
+          mutateList?.()
           setIsLoading(false)
           dispatch(hiddenUpdated([]))
           dispatch(selectionUpdated([]))
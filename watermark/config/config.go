@@ -0,0 +1,143 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package config
+
+import (
+	"os"
+	"strconv"
+)
+
+type Config struct {
+	Port      int
+	Limits    LimitsConfig
+	S3        S3Config
+	Watermark WatermarkConfig
+}
+
+type LimitsConfig struct {
+	MultipartBodyLengthLimitMB int
+}
+
+type S3Config struct {
+	URL       string
+	AccessKey string
+	SecretKey string
+	Region    string
+	Secure    bool
+}
+
+/* Defaults applied when a request doesn't specify its own */
+type WatermarkConfig struct {
+	Text      string
+	Timestamp bool
+	Color     string
+	Opacity   float64
+	Angle     float64
+	Tiled     bool
+	Position  string
+	/* Zero fits the text to the page */
+	FontSize float64
+}
+
+var config *Config
+
+func GetConfig() *Config {
+	if config == nil {
+		port, err := strconv.Atoi(os.Getenv("PORT"))
+		if err != nil {
+			panic(err)
+		}
+		config = &Config{
+			Port: port,
+		}
+		readS3(config)
+		readLimits(config)
+		readWatermark(config)
+	}
+	return config
+}
+
+func readS3(config *Config) {
+	config.S3.URL = os.Getenv("S3_URL")
+	config.S3.AccessKey = os.Getenv("S3_ACCESS_KEY")
+	config.S3.SecretKey = os.Getenv("S3_SECRET_KEY")
+	config.S3.Region = os.Getenv("S3_REGION")
+	if len(os.Getenv("S3_SECURE")) > 0 {
+		v, err := strconv.ParseBool(os.Getenv("S3_SECURE"))
+		if err != nil {
+			panic(err)
+		}
+		config.S3.Secure = v
+	}
+}
+
+func readLimits(config *Config) {
+	if len(os.Getenv("LIMITS_MULTIPART_BODY_LENGTH_LIMIT_MB")) > 0 {
+		v, err := strconv.ParseInt(os.Getenv("LIMITS_MULTIPART_BODY_LENGTH_LIMIT_MB"), 10, 32)
+		if err != nil {
+			panic(err)
+		}
+		config.Limits.MultipartBodyLengthLimitMB = int(v)
+	}
+}
+
+func readWatermark(config *Config) {
+	config.Watermark = WatermarkConfig{
+		Timestamp: true,
+		Color:     "#808080",
+		Opacity:   0.25,
+		Angle:     45,
+		Tiled:     true,
+		Position:  "center",
+	}
+	config.Watermark.Text = os.Getenv("WATERMARK_TEXT")
+	if len(os.Getenv("WATERMARK_TIMESTAMP")) > 0 {
+		v, err := strconv.ParseBool(os.Getenv("WATERMARK_TIMESTAMP"))
+		if err != nil {
+			panic(err)
+		}
+		config.Watermark.Timestamp = v
+	}
+	if len(os.Getenv("WATERMARK_COLOR")) > 0 {
+		config.Watermark.Color = os.Getenv("WATERMARK_COLOR")
+	}
+	if len(os.Getenv("WATERMARK_OPACITY")) > 0 {
+		v, err := strconv.ParseFloat(os.Getenv("WATERMARK_OPACITY"), 64)
+		if err != nil {
+			panic(err)
+		}
+		config.Watermark.Opacity = v
+	}
+	if len(os.Getenv("WATERMARK_ANGLE")) > 0 {
+		v, err := strconv.ParseFloat(os.Getenv("WATERMARK_ANGLE"), 64)
+		if err != nil {
+			panic(err)
+		}
+		config.Watermark.Angle = v
+	}
+	if len(os.Getenv("WATERMARK_TILED")) > 0 {
+		v, err := strconv.ParseBool(os.Getenv("WATERMARK_TILED"))
+		if err != nil {
+			panic(err)
+		}
+		config.Watermark.Tiled = v
+	}
+	if len(os.Getenv("WATERMARK_POSITION")) > 0 {
+		config.Watermark.Position = os.Getenv("WATERMARK_POSITION")
+	}
+	if len(os.Getenv("WATERMARK_FONT_SIZE")) > 0 {
+		v, err := strconv.ParseFloat(os.Getenv("WATERMARK_FONT_SIZE"), 64)
+		if err != nil {
+			panic(err)
+		}
+		config.Watermark.FontSize = v
+	}
+}
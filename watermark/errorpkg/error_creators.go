@@ -0,0 +1,87 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package errorpkg
+
+import (
+	"fmt"
+	"net/http"
+)
+
+func NewInternalServerError(err error) *ErrorResponse {
+	return NewErrorResponse(
+		"internal_server_error",
+		http.StatusInternalServerError,
+		"Internal server error.",
+		MsgSomethingWentWrong,
+		err,
+	)
+}
+
+func NewResourceNotFoundError(err error) *ErrorResponse {
+	return &ErrorResponse{
+		Code:        "resource_not_found",
+		Status:      http.StatusNotFound,
+		Message:     "Resource not found.",
+		UserMessage: "The requested resource could not be found.",
+		MoreInfo:    err.Error(),
+		Err:         err,
+	}
+}
+
+func NewMissingFormParamError(param string) *ErrorResponse {
+	return NewErrorResponse(
+		"missing_form_param",
+		http.StatusBadRequest,
+		fmt.Sprintf("Missing form param '%s'.", param),
+		MsgInvalidRequest,
+		nil,
+	)
+}
+
+func NewInvalidFormParamError(param string, err error) *ErrorResponse {
+	return NewErrorResponse(
+		"invalid_form_param",
+		http.StatusBadRequest,
+		fmt.Sprintf("Invalid form param '%s'.", param),
+		MsgInvalidRequest,
+		err,
+	)
+}
+
+func NewUnsupportedFileTypeError(err error) *ErrorResponse {
+	return NewErrorResponse(
+		"unsupported_file_type",
+		http.StatusBadRequest,
+		"Unsupported file type.",
+		GetUserFriendlyMessage("unsupported file type", FallbackMessage),
+		err,
+	)
+}
+
+func NewTextIsEmptyError() *ErrorResponse {
+	return NewErrorResponse(
+		"text_is_empty",
+		http.StatusBadRequest,
+		"Text is empty.",
+		GetUserFriendlyMessage("text is empty", FallbackMessage),
+		nil,
+	)
+}
+
+func NewDocumentIsEncryptedError() *ErrorResponse {
+	return NewErrorResponse(
+		"document_is_encrypted",
+		http.StatusBadRequest,
+		"Document is encrypted.",
+		GetUserFriendlyMessage("document is encrypted", FallbackMessage),
+		nil,
+	)
+}
@@ -0,0 +1,27 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package errorpkg
+
+var messages = map[string]string{
+	"unsupported file type": "Unsupported file type.",
+	"text is empty":         "Text is empty.",
+	"document is encrypted": "Encrypted documents cannot be watermarked.",
+}
+
+const FallbackMessage = "An error occurred while processing the file."
+
+func GetUserFriendlyMessage(code string, fallback string) string {
+	res, ok := messages[code]
+	if !ok {
+		return fallback
+	}
+	return res
+}
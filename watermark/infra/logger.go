@@ -0,0 +1,32 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package infra
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var logger *zap.SugaredLogger
+
+func GetLogger() *zap.SugaredLogger {
+	if logger == nil {
+		config := zap.NewDevelopmentConfig()
+		config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		config.DisableCaller = true
+		if l, err := config.Build(); err != nil {
+			panic(err)
+		} else {
+			logger = l.Sugar()
+		}
+	}
+	return logger
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package infra
+
+import (
+	"context"
+	"voltaserve/config"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type S3Manager struct {
+	config config.S3Config
+	client *minio.Client
+}
+
+func NewS3Manager() *S3Manager {
+	mgr := new(S3Manager)
+	mgr.config = config.GetConfig().S3
+	return mgr
+}
+
+func (mgr *S3Manager) PutFile(objectName string, filePath string, contentType string, bucketName string, opts minio.PutObjectOptions) error {
+	if mgr.client == nil {
+		if err := mgr.Connect(); err != nil {
+			return err
+		}
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	opts.ContentType = contentType
+	if _, err := mgr.client.FPutObject(context.Background(), bucketName, objectName, filePath, opts); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mgr *S3Manager) Connect() error {
+	client, err := minio.New(mgr.config.URL, &minio.Options{
+		Creds:  credentials.NewStaticV4(mgr.config.AccessKey, mgr.config.SecretKey, ""),
+		Secure: mgr.config.Secure,
+	})
+	if err != nil {
+		return err
+	}
+	mgr.client = client
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package router
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strconv"
+	"voltaserve/errorpkg"
+	"voltaserve/helper"
+	"voltaserve/infra"
+	"voltaserve/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type WatermarkRouter struct {
+	watermarkSvc *service.WatermarkService
+}
+
+func NewWatermarkRouter() *WatermarkRouter {
+	return &WatermarkRouter{
+		watermarkSvc: service.NewWatermarkService(),
+	}
+}
+
+func (r *WatermarkRouter) AppendRoutes(g fiber.Router) {
+	g.Post("/", r.Create)
+}
+
+// Create godoc
+//
+//	@Summary		Create Watermark
+//	@Description	Stamp an image or every page of a PDF, and upload the result to S3
+//	@Tags			Watermarks
+//	@Id				watermarks_create
+//	@Accept			multipart/form-data
+//	@Param			file		formData	file	true	"File to upload"
+//	@Param			s3_key		formData	string	true	"S3 Key"
+//	@Param			s3_bucket	formData	string	true	"S3 Bucket"
+//	@Param			category	formData	string	true	"Category (image or document)"
+//	@Param			values		formData	string	false	"Base64 of a JSON array of strings, the workspace then the user"
+//	@Param			workspace	formData	string	false	"Workspace, ignored when values is set"
+//	@Param			username	formData	string	false	"User, ignored when values is set"
+//	@Param			date_time	formData	string	false	"Timestamp, the current time is used by default"
+//	@Param			text		formData	string	false	"Custom text"
+//	@Param			color		formData	string	false	"Color, like #808080"
+//	@Param			opacity		formData	number	false	"Opacity, between 0 and 1"
+//	@Param			angle		formData	number	false	"Angle in degrees, counterclockwise"
+//	@Param			tiled		formData	boolean	false	"Repeat the text over the whole page"
+//	@Param			position	formData	string	false	"Where a single stamp goes, like center or top_left"
+//	@Param			font_size	formData	number	false	"Font size in points, the text is fitted to the page by default"
+//	@Param			timestamp	formData	boolean	false	"Add the current time when date_time isn't set"
+//	@Success		200
+//	@Failure		400	{object}	errorpkg.ErrorResponse
+//	@Failure		500	{object}	errorpkg.ErrorResponse
+//	@Router			/watermarks [post]
+func (r *WatermarkRouter) Create(c *fiber.Ctx) error {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return err
+	}
+	headers := form.File["file"]
+	if len(headers) == 0 {
+		return errorpkg.NewMissingFormParamError("file")
+	}
+	opts, err := r.parseOptions(form)
+	if err != nil {
+		return err
+	}
+	fh := headers[0]
+	opts.Path = filepath.Join(os.TempDir(), helper.NewID()+filepath.Ext(fh.Filename))
+	defer func() {
+		if err := os.Remove(opts.Path); err != nil {
+			infra.GetLogger().Error(err)
+		}
+	}()
+	if err := c.SaveFile(fh, opts.Path); err != nil {
+		return err
+	}
+	if err := r.watermarkSvc.Create(*opts); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func (r *WatermarkRouter) parseOptions(form *multipart.Form) (*service.WatermarkCreateOptions, error) {
+	value := func(key string) *string {
+		if v := form.Value[key]; len(v) > 0 {
+			return &v[0]
+		}
+		return nil
+	}
+	opts := &service.WatermarkCreateOptions{}
+	for key, dst := range map[string]*string{
+		"s3_key":    &opts.S3Key,
+		"s3_bucket": &opts.S3Bucket,
+		"category":  &opts.Category,
+	} {
+		v := value(key)
+		if v == nil || *v == "" {
+			return nil, errorpkg.NewMissingFormParamError(key)
+		}
+		*dst = *v
+	}
+	if v := value("values"); v != nil && *v != "" {
+		b, err := base64.StdEncoding.DecodeString(*v)
+		if err != nil {
+			return nil, errorpkg.NewInvalidFormParamError("values", err)
+		}
+		if err := json.Unmarshal(b, &opts.Values); err != nil {
+			return nil, errorpkg.NewInvalidFormParamError("values", err)
+		}
+	}
+	if v := value("workspace"); v != nil {
+		opts.Workspace = *v
+	}
+	if v := value("username"); v != nil {
+		opts.Username = *v
+	}
+	if v := value("date_time"); v != nil {
+		opts.DateTime = *v
+	}
+	opts.Text = value("text")
+	opts.Color = value("color")
+	opts.Position = value("position")
+	for key, dst := range map[string]**float64{
+		"opacity":   &opts.Opacity,
+		"angle":     &opts.Angle,
+		"font_size": &opts.FontSize,
+	} {
+		if v := value(key); v != nil && *v != "" {
+			f, err := strconv.ParseFloat(*v, 64)
+			if err != nil {
+				return nil, errorpkg.NewInvalidFormParamError(key, err)
+			}
+			*dst = &f
+		}
+	}
+	for key, dst := range map[string]**bool{
+		"tiled":     &opts.Tiled,
+		"timestamp": &opts.Timestamp,
+	} {
+		if v := value(key); v != nil && *v != "" {
+			b, err := strconv.ParseBool(*v)
+			if err != nil {
+				return nil, errorpkg.NewInvalidFormParamError(key, err)
+			}
+			*dst = &b
+		}
+	}
+	return opts, nil
+}
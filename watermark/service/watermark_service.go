@@ -0,0 +1,189 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package service
+
+import (
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"voltaserve/config"
+	"voltaserve/errorpkg"
+	"voltaserve/helper"
+	"voltaserve/infra"
+	"voltaserve/stamper"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	CategoryImage    = "image"
+	CategoryDocument = "document"
+)
+
+type WatermarkService struct {
+	s3     *infra.S3Manager
+	config *config.Config
+}
+
+func NewWatermarkService() *WatermarkService {
+	return &WatermarkService{
+		s3:     infra.NewS3Manager(),
+		config: config.GetConfig(),
+	}
+}
+
+/*
+The text lines come either from Values, in the order workspace then user, or
+from Workspace and Username, followed by Text which can span several lines.
+The remaining fields override the defaults of the configuration when set.
+*/
+type WatermarkCreateOptions struct {
+	Path      string
+	S3Key     string
+	S3Bucket  string
+	Category  string
+	Values    []string
+	Workspace string
+	Username  string
+	DateTime  string
+	Text      *string
+	Color     *string
+	Opacity   *float64
+	Angle     *float64
+	Tiled     *bool
+	Position  *string
+	FontSize  *float64
+	Timestamp *bool
+}
+
+func (svc *WatermarkService) Create(opts WatermarkCreateOptions) error {
+	stamperOpts, err := svc.stamperOptions(opts)
+	if err != nil {
+		return err
+	}
+	outputPath := filepath.Join(os.TempDir(), helper.NewID()+filepath.Ext(opts.Path))
+	defer func() {
+		if _, err := os.Stat(outputPath); err == nil {
+			if err := os.Remove(outputPath); err != nil {
+				infra.GetLogger().Error(err)
+			}
+		}
+	}()
+	switch opts.Category {
+	case CategoryImage:
+		if err := stamper.StampImage(opts.Path, outputPath, *stamperOpts); err != nil {
+			if errors.Is(err, image.ErrFormat) || errors.Is(err, stamper.ErrImageTooLarge) {
+				return errorpkg.NewUnsupportedFileTypeError(err)
+			}
+			return err
+		}
+	case CategoryDocument:
+		if helper.DetectMimeFromFile(opts.Path) != "application/pdf" {
+			return errorpkg.NewUnsupportedFileTypeError(nil)
+		}
+		if err := stamper.StampPDF(opts.Path, outputPath, *stamperOpts); err != nil {
+			if errors.Is(err, stamper.ErrEncrypted) {
+				return errorpkg.NewDocumentIsEncryptedError()
+			}
+			return err
+		}
+	default:
+		return errorpkg.NewInvalidFormParamError("category", nil)
+	}
+	if err := svc.s3.PutFile(opts.S3Key, outputPath, helper.DetectMimeFromFile(outputPath), opts.S3Bucket, minio.PutObjectOptions{}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (svc *WatermarkService) stamperOptions(opts WatermarkCreateOptions) (*stamper.Options, error) {
+	defaults := svc.config.Watermark
+	var lines []string
+	if len(opts.Values) > 0 {
+		lines = append(lines, opts.Values...)
+	} else {
+		lines = append(lines, opts.Workspace, opts.Username)
+	}
+	text := defaults.Text
+	if opts.Text != nil {
+		text = *opts.Text
+	}
+	lines = append(lines, strings.Split(text, "\n")...)
+	timestamp := defaults.Timestamp
+	if opts.Timestamp != nil {
+		timestamp = *opts.Timestamp
+	}
+	if opts.DateTime != "" {
+		lines = append(lines, opts.DateTime)
+	} else if timestamp {
+		lines = append(lines, time.Now().UTC().Format("2006-01-02 15:04:05 UTC"))
+	}
+	res := &stamper.Options{
+		Lines:    stamper.CleanLines(lines),
+		Opacity:  defaults.Opacity,
+		Angle:    defaults.Angle,
+		Tiled:    defaults.Tiled,
+		Position: defaults.Position,
+		FontSize: defaults.FontSize,
+	}
+	if len(res.Lines) == 0 {
+		return nil, errorpkg.NewTextIsEmptyError()
+	}
+	colorValue := defaults.Color
+	if opts.Color != nil {
+		colorValue = *opts.Color
+	}
+	c, err := stamper.ParseColor(colorValue)
+	if err != nil {
+		return nil, errorpkg.NewInvalidFormParamError("color", err)
+	}
+	res.Color = c
+	if opts.Opacity != nil {
+		if *opts.Opacity < 0 || *opts.Opacity > 1 {
+			return nil, errorpkg.NewInvalidFormParamError("opacity", nil)
+		}
+		res.Opacity = *opts.Opacity
+	}
+	if opts.Angle != nil {
+		res.Angle = *opts.Angle
+	}
+	if opts.Tiled != nil {
+		res.Tiled = *opts.Tiled
+	}
+	if opts.Position != nil {
+		if !isPosition(*opts.Position) {
+			return nil, errorpkg.NewInvalidFormParamError("position", nil)
+		}
+		res.Position = *opts.Position
+	}
+	if opts.FontSize != nil {
+		if *opts.FontSize < 0 {
+			return nil, errorpkg.NewInvalidFormParamError("font_size", nil)
+		}
+		res.FontSize = *opts.FontSize
+	}
+	return res, nil
+}
+
+func isPosition(position string) bool {
+	switch position {
+	case stamper.PositionCenter, stamper.PositionTop, stamper.PositionBottom,
+		stamper.PositionLeft, stamper.PositionRight,
+		stamper.PositionTopLeft, stamper.PositionTopRight,
+		stamper.PositionBottomLeft, stamper.PositionBottomRight:
+		return true
+	default:
+		return false
+	}
+}
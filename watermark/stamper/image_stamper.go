@@ -0,0 +1,180 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package stamper
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/vector"
+	_ "golang.org/x/image/webp"
+)
+
+var ErrImageTooLarge = errors.New("image is too large")
+
+const (
+	/* Bounds the memory needed to decode and rasterize */
+	maxImagePixels = 50000000
+	/* In points */
+	letterWidth = 612
+)
+
+/*
+Stamps the image at inputPath and writes it to outputPath in the same format.
+Formats without an encoder, like WebP, are written as PNG.
+*/
+func StampImage(inputPath string, outputPath string, opts Options) error {
+	block, err := NewTextBlock(opts.Lines)
+	if err != nil {
+		return err
+	}
+	img, format, err := decodeImage(inputPath)
+	if err != nil {
+		return err
+	}
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	width, height := float64(rgba.Bounds().Dx()), float64(rgba.Bounds().Dy())
+	z := vector.NewRasterizer(rgba.Bounds().Dx(), rgba.Bounds().Dy())
+	/* Images have no physical size, they are sized like a Letter page */
+	pointSize := min(width, height) / letterWidth
+	for _, m := range layout(block, width, height, opts.Angle, pointSize, opts) {
+		rasterize(z, block, m, height)
+	}
+	c := opts.Color
+	c.A = uint8(clamp(opts.Opacity, 0, 1) * 255)
+	z.Draw(rgba, rgba.Bounds(), image.NewUniform(c), image.Point{})
+	return encodeImage(outputPath, rgba, format)
+}
+
+func decodeImage(path string) (image.Image, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, "", ErrImageTooLarge
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	return image.Decode(f)
+}
+
+/* Adds the outlines to the rasterizer, flipping y since images grow downwards */
+func rasterize(z *vector.Rasterizer, block *TextBlock, m Matrix, height float64) {
+	pt := func(p Point) (float32, float32) {
+		q := m.Apply(p)
+		return float32(q.X), float32(height - q.Y)
+	}
+	started := false
+	for _, s := range block.Segments {
+		switch s.Op {
+		case OpMoveTo:
+			if started {
+				z.ClosePath()
+			}
+			started = true
+			z.MoveTo(pt(s.Points[0]))
+		case OpLineTo:
+			z.LineTo(pt(s.Points[0]))
+		case OpQuadTo:
+			bx, by := pt(s.Points[0])
+			cx, cy := pt(s.Points[1])
+			z.QuadTo(bx, by, cx, cy)
+		case OpCubeTo:
+			bx, by := pt(s.Points[0])
+			cx, cy := pt(s.Points[1])
+			dx, dy := pt(s.Points[2])
+			z.CubeTo(bx, by, cx, cy, dx, dy)
+		}
+	}
+	if started {
+		z.ClosePath()
+	}
+}
+
+func encodeImage(path string, img image.Image, format string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(f, img, &jpeg.Options{Quality: 90})
+	case "gif":
+		err = gif.Encode(f, img, nil)
+	case "bmp":
+		err = bmp.Encode(f, img)
+	case "tiff":
+		err = tiff.Encode(f, img, &tiff.Options{Compression: tiff.Deflate})
+	default:
+		err = png.Encode(f, img)
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func clamp(v float64, lo float64, hi float64) float64 {
+	return max(lo, min(hi, v))
+}
+
+/* Parses colors like "#808080" or "#888" */
+func ParseColor(s string) (color.NRGBA, error) {
+	if len(s) > 0 && s[0] == '#' {
+		s = s[1:]
+	}
+	hex := func(c byte) (uint8, bool) {
+		switch {
+		case c >= '0' && c <= '9':
+			return c - '0', true
+		case c >= 'a' && c <= 'f':
+			return c - 'a' + 10, true
+		case c >= 'A' && c <= 'F':
+			return c - 'A' + 10, true
+		}
+		return 0, false
+	}
+	var v []uint8
+	for i := 0; i < len(s); i++ {
+		d, ok := hex(s[i])
+		if !ok {
+			return color.NRGBA{}, errors.New("invalid color")
+		}
+		v = append(v, d)
+	}
+	switch len(v) {
+	case 3:
+		return color.NRGBA{R: v[0] * 17, G: v[1] * 17, B: v[2] * 17, A: 255}, nil
+	case 6:
+		return color.NRGBA{R: v[0]<<4 | v[1], G: v[2]<<4 | v[3], B: v[4]<<4 | v[5], A: 255}, nil
+	default:
+		return color.NRGBA{}, errors.New("invalid color")
+	}
+}
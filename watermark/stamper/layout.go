@@ -0,0 +1,141 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package stamper
+
+import (
+	"image/color"
+	"math"
+)
+
+const (
+	PositionCenter      = "center"
+	PositionTop         = "top"
+	PositionBottom      = "bottom"
+	PositionLeft        = "left"
+	PositionRight       = "right"
+	PositionTopLeft     = "top_left"
+	PositionTopRight    = "top_right"
+	PositionBottomLeft  = "bottom_left"
+	PositionBottomRight = "bottom_right"
+)
+
+type Options struct {
+	Lines   []string
+	Color   color.NRGBA
+	Opacity float64
+	/* Degrees, counterclockwise */
+	Angle float64
+	Tiled bool
+	/* Where a single stamp goes, ignored when tiled */
+	Position string
+	/* In points, zero fits the text to the page */
+	FontSize float64
+}
+
+/* Maps (x, y) to (A*x + C*y + E, B*x + D*y + F), like a PDF matrix */
+type Matrix struct {
+	A, B, C, D, E, F float64
+}
+
+func (m Matrix) Apply(p Point) Point {
+	return Point{
+		X: m.A*p.X + m.C*p.Y + m.E,
+		Y: m.B*p.X + m.D*p.Y + m.F,
+	}
+}
+
+const (
+	/* A single stamp covers at most this fraction of the page */
+	singleCoverage = 0.8
+	/* Distance between a positioned stamp and the edges, as a fraction of the short side */
+	singleMargin = 0.05
+	/* Tiles span this fraction of the page's short side */
+	tileWidthRatio = 0.4
+	/* Keeps short text from producing huge tiles */
+	tileMaxHeightRatio = 0.15
+	tileGapX           = 0.5
+	tileGapY           = 1.5
+)
+
+/*
+Returns where to draw the block on a page of the given size, in a coordinate
+system where y grows upwards, as one matrix per copy of the block. A point is
+pointSize units of the page.
+*/
+func layout(block *TextBlock, width float64, height float64, angle float64, pointSize float64, opts Options) []Matrix {
+	rad := angle * math.Pi / 180
+	cos, sin := math.Cos(rad), math.Sin(rad)
+	at := func(x float64, y float64, scale float64) Matrix {
+		return Matrix{A: scale * cos, B: scale * sin, C: -scale * sin, D: scale * cos, E: x, F: y}
+	}
+	if block.Width <= 0 || block.Height <= 0 || width <= 0 || height <= 0 {
+		return nil
+	}
+	/* Outlines are at textSize, so this gives text of the requested size */
+	fixedScale := opts.FontSize * pointSize / textSize
+	short := min(width, height)
+	if !opts.Tiled {
+		rotatedWidth := block.Width*math.Abs(cos) + block.Height*math.Abs(sin)
+		rotatedHeight := block.Width*math.Abs(sin) + block.Height*math.Abs(cos)
+		scale := fixedScale
+		if scale <= 0 {
+			scale = singleCoverage * min(width/rotatedWidth, height/rotatedHeight)
+		}
+		halfWidth, halfHeight := rotatedWidth*scale/2, rotatedHeight*scale/2
+		margin := singleMargin * short
+		x, y := width/2, height/2
+		switch opts.Position {
+		case PositionLeft, PositionTopLeft, PositionBottomLeft:
+			x = margin + halfWidth
+		case PositionRight, PositionTopRight, PositionBottomRight:
+			x = width - margin - halfWidth
+		}
+		switch opts.Position {
+		case PositionTop, PositionTopLeft, PositionTopRight:
+			y = height - margin - halfHeight
+		case PositionBottom, PositionBottomLeft, PositionBottomRight:
+			y = margin + halfHeight
+		}
+		return []Matrix{at(x, y, scale)}
+	}
+	scale := fixedScale
+	if scale <= 0 {
+		scale = min(tileWidthRatio*short/block.Width, tileMaxHeightRatio*short/block.Height)
+	}
+	stepX := block.Width * scale * (1 + tileGapX)
+	stepY := block.Height * scale * (1 + tileGapY)
+	/* Tiles are laid out on a grid aligned with the text, covering the page's circumcircle */
+	radius := math.Hypot(width, height) / 2
+	reach := math.Hypot(block.Width, block.Height) * scale / 2
+	cols := int(math.Ceil((radius+reach)/stepX)) + 1
+	rows := int(math.Ceil((radius+reach)/stepY)) + 1
+	var res []Matrix
+	for j := -rows; j <= rows; j++ {
+		offset := 0.0
+		if j%2 != 0 {
+			offset = stepX / 2
+		}
+		for i := -cols; i <= cols; i++ {
+			u := float64(i)*stepX + offset
+			v := float64(j) * stepY
+			x := width/2 + u*cos - v*sin
+			y := height/2 + u*sin + v*cos
+			/* Skip tiles that can't touch the page */
+			dx := max(0, -x, x-width)
+			dy := max(0, -y, y-height)
+			if math.Hypot(dx, dy) > reach {
+				continue
+			}
+			res = append(res, at(x, y, scale))
+		}
+	}
+	return res
+}
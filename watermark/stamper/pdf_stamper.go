@@ -0,0 +1,312 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package stamper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+var ErrEncrypted = errors.New("document is encrypted")
+
+/*
+Stamps every page of the PDF at inputPath and writes it to outputPath. The
+text is drawn as vector outlines in a form XObject. The document is written
+from scratch, so nothing of the original file survives as is, and unused
+objects like the revisions of earlier incremental updates are dropped.
+*/
+func StampPDF(inputPath string, outputPath string, opts Options) error {
+	block, err := NewTextBlock(opts.Lines)
+	if err != nil {
+		return err
+	}
+	ctx, err := readPDF(inputPath)
+	if err != nil {
+		return err
+	}
+	if ctx.PageCount == 0 {
+		return errors.New("document has no pages")
+	}
+	opacity := clamp(opts.Opacity, 0, 1)
+	gs := types.Dict{
+		"Type": types.Name("ExtGState"),
+		"ca":   types.Float(opacity),
+		"CA":   types.Float(opacity),
+	}
+	gsRef, err := ctx.IndRefForNewObject(gs)
+	if err != nil {
+		return err
+	}
+	formRef, err := newForm(ctx, block, opts)
+	if err != nil {
+		return err
+	}
+	/* Isolates the page's content, so the watermark is drawn with a clean state */
+	openRef, err := newContentStream(ctx, []byte("q\n"))
+	if err != nil {
+		return err
+	}
+	/* Pages of the same size share their watermark stream */
+	streams := make(map[string]*types.IndirectRef)
+	for i := 1; i <= ctx.PageCount; i++ {
+		page, _, attrs, err := ctx.PageDict(i, false)
+		if err != nil {
+			return err
+		}
+		resources, err := pageResources(ctx, attrs.Resources)
+		if err != nil {
+			return err
+		}
+		gsName := uniqueName(resources, "ExtGState", "VsWmGS")
+		formName := uniqueName(resources, "XObject", "VsWmFm")
+		box := pageBox(attrs)
+		rotate := ((attrs.Rotate % 360) + 360) % 360
+		key := fmt.Sprintf("%s %s %s %s %d %s %s",
+			formatNumber(box.LL.X), formatNumber(box.LL.Y), formatNumber(box.UR.X), formatNumber(box.UR.Y),
+			rotate, gsName, formName)
+		stream, ok := streams[key]
+		if !ok {
+			if stream, err = newPageStream(ctx, block, box, rotate, gsName, formName, opts); err != nil {
+				return err
+			}
+			streams[key] = stream
+		}
+		contents, err := pageContents(ctx, page)
+		if err != nil {
+			return err
+		}
+		page["Contents"] = append(append(types.Array{*openRef}, contents...), *stream)
+		resources["ExtGState"].(types.Dict)[gsName] = *gsRef
+		resources["XObject"].(types.Dict)[formName] = *formRef
+		page["Resources"] = resources
+	}
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := api.WriteContext(ctx, f); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func readPDF(path string) (*model.Context, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	conf := model.NewDefaultConfiguration()
+	conf.Cmd = model.ADDWATERMARKS
+	conf.ValidationMode = model.ValidationRelaxed
+	ctx, err := api.ReadValidateAndOptimize(f, conf)
+	if err != nil {
+		if errors.Is(err, pdfcpu.ErrWrongPassword) || errors.Is(err, pdfcpu.ErrUnknownEncryption) {
+			return nil, ErrEncrypted
+		}
+		return nil, err
+	}
+	/* Documents readable without password are still refused, writing them would drop their protection */
+	if ctx.E != nil {
+		return nil, ErrEncrypted
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+/* The crop box when there is one, it's what viewers show */
+func pageBox(attrs *model.InheritedPageAttrs) types.Rectangle {
+	/* US Letter is the default when the media box is missing */
+	res := types.Rectangle{LL: types.Point{X: 0, Y: 0}, UR: types.Point{X: 612, Y: 792}}
+	if attrs.MediaBox != nil && attrs.MediaBox.Width() > 0 && attrs.MediaBox.Height() > 0 {
+		res = *attrs.MediaBox
+	}
+	if attrs.CropBox != nil {
+		crop := types.Rectangle{
+			LL: types.Point{X: max(attrs.CropBox.LL.X, res.LL.X), Y: max(attrs.CropBox.LL.Y, res.LL.Y)},
+			UR: types.Point{X: min(attrs.CropBox.UR.X, res.UR.X), Y: min(attrs.CropBox.UR.Y, res.UR.Y)},
+		}
+		if crop.Width() > 0 && crop.Height() > 0 {
+			res = crop
+		}
+	}
+	return res
+}
+
+/* A copy of the resources, with the categories the watermark uses resolved and copied too */
+func pageResources(ctx *model.Context, resources types.Dict) (types.Dict, error) {
+	res := types.Dict{}
+	for k, v := range resources {
+		res[k] = v
+	}
+	for _, category := range []string{"ExtGState", "XObject"} {
+		d, err := ctx.DereferenceDict(res[category])
+		if err != nil {
+			return nil, err
+		}
+		entries := types.Dict{}
+		for k, v := range d {
+			entries[k] = v
+		}
+		res[category] = entries
+	}
+	return res, nil
+}
+
+func pageContents(ctx *model.Context, page types.Dict) (types.Array, error) {
+	obj, found := page.Find("Contents")
+	if !found || obj == nil {
+		return nil, nil
+	}
+	resolved, err := ctx.Dereference(obj)
+	if err != nil {
+		return nil, err
+	}
+	if a, ok := resolved.(types.Array); ok {
+		return a, nil
+	}
+	return types.Array{obj}, nil
+}
+
+/* Returns a name that isn't used yet in the given resource category */
+func uniqueName(resources types.Dict, category string, prefix string) string {
+	existing, _ := resources[category].(types.Dict)
+	name := prefix
+	for i := 1; ; i++ {
+		if _, ok := existing[name]; !ok {
+			return name
+		}
+		name = fmt.Sprintf("%s%d", prefix, i)
+	}
+}
+
+func newContentStream(ctx *model.Context, data []byte) (*types.IndirectRef, error) {
+	sd, err := ctx.NewStreamDictForBuf(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := sd.Encode(); err != nil {
+		return nil, err
+	}
+	return ctx.IndRefForNewObject(*sd)
+}
+
+func newForm(ctx *model.Context, block *TextBlock, opts Options) (*types.IndirectRef, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s %s rg\n",
+		formatNumber(float64(opts.Color.R)/255),
+		formatNumber(float64(opts.Color.G)/255),
+		formatNumber(float64(opts.Color.B)/255))
+	num := formatNumber
+	var current Point
+	started := false
+	for _, s := range block.Segments {
+		p := s.Points
+		switch s.Op {
+		case OpMoveTo:
+			if started {
+				buf.WriteString("h\n")
+			}
+			started = true
+			fmt.Fprintf(&buf, "%s %s m\n", num(p[0].X), num(p[0].Y))
+			current = p[0]
+		case OpLineTo:
+			fmt.Fprintf(&buf, "%s %s l\n", num(p[0].X), num(p[0].Y))
+			current = p[0]
+		case OpQuadTo:
+			/* PDF only has cubic curves, raise the degree */
+			c1 := Point{X: current.X + 2*(p[0].X-current.X)/3, Y: current.Y + 2*(p[0].Y-current.Y)/3}
+			c2 := Point{X: p[1].X + 2*(p[0].X-p[1].X)/3, Y: p[1].Y + 2*(p[0].Y-p[1].Y)/3}
+			fmt.Fprintf(&buf, "%s %s %s %s %s %s c\n", num(c1.X), num(c1.Y), num(c2.X), num(c2.Y), num(p[1].X), num(p[1].Y))
+			current = p[1]
+		case OpCubeTo:
+			fmt.Fprintf(&buf, "%s %s %s %s %s %s c\n", num(p[0].X), num(p[0].Y), num(p[1].X), num(p[1].Y), num(p[2].X), num(p[2].Y))
+			current = p[2]
+		}
+	}
+	if started {
+		buf.WriteString("h\nf\n")
+	}
+	sd, err := ctx.NewStreamDictForBuf(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	/* Leaves room for glyphs that extend past their advance */
+	padX, padY := block.Width/2+textSize, block.Height/2+textSize
+	sd.InsertName("Type", "XObject")
+	sd.InsertName("Subtype", "Form")
+	sd.Insert("BBox", types.Array{types.Float(-padX), types.Float(-padY), types.Float(padX), types.Float(padY)})
+	sd.Insert("Resources", types.Dict{})
+	if err := sd.Encode(); err != nil {
+		return nil, err
+	}
+	return ctx.IndRefForNewObject(*sd)
+}
+
+func newPageStream(ctx *model.Context, block *TextBlock, box types.Rectangle, rotate int, gsName string, formName string, opts Options) (*types.IndirectRef, error) {
+	var buf bytes.Buffer
+	buf.WriteString("Q\nq\n")
+	fmt.Fprintf(&buf, "/%s gs\n", gsName)
+	/* The page is turned clockwise when displayed, compensate so the angle is as seen */
+	pageOpts := opts
+	pageOpts.Position = rotatePosition(opts.Position, rotate)
+	for _, m := range layout(block, box.Width(), box.Height(), opts.Angle+float64(rotate), 1, pageOpts) {
+		fmt.Fprintf(&buf, "q %s %s %s %s %s %s cm /%s Do Q\n",
+			formatNumber(m.A), formatNumber(m.B), formatNumber(m.C), formatNumber(m.D),
+			formatNumber(m.E+box.LL.X), formatNumber(m.F+box.LL.Y), formName)
+	}
+	buf.WriteString("Q\n")
+	return newContentStream(ctx, buf.Bytes())
+}
+
+/* Maps a position as seen to the page's own space, for pages turned clockwise by rotate */
+func rotatePosition(position string, rotate int) string {
+	next := map[string]string{
+		PositionTop:         PositionLeft,
+		PositionLeft:        PositionBottom,
+		PositionBottom:      PositionRight,
+		PositionRight:       PositionTop,
+		PositionTopLeft:     PositionBottomLeft,
+		PositionBottomLeft:  PositionBottomRight,
+		PositionBottomRight: PositionTopRight,
+		PositionTopRight:    PositionTopLeft,
+	}
+	for i := 0; i < rotate/90; i++ {
+		if v, ok := next[position]; ok {
+			position = v
+		}
+	}
+	return position
+}
+
+/* Short decimal notation, content streams don't accept exponents */
+func formatNumber(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 4, 64)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
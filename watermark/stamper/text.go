@@ -0,0 +1,169 @@
+// Copyright 2023 Anass Bouassaba.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the GNU Affero General Public License v3.0 only, included in the file
+// licenses/AGPL.txt.
+
+package stamper
+
+import (
+	"strings"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+type Point struct {
+	X float64
+	Y float64
+}
+
+const (
+	OpMoveTo = iota
+	OpLineTo
+	OpQuadTo
+	OpCubeTo
+)
+
+type PathSegment struct {
+	Op     int
+	Points [3]Point
+}
+
+/*
+TextBlock holds the outlines of centered lines of text, in a coordinate
+system where the block is centered on the origin and y grows upwards.
+*/
+type TextBlock struct {
+	Segments []PathSegment
+	Width    float64
+	Height   float64
+}
+
+/* Outlines are computed at this size, then scaled to the target */
+const textSize = 100
+
+var (
+	textFont     *sfnt.Font
+	textFontErr  error
+	textFontOnce sync.Once
+)
+
+func getFont() (*sfnt.Font, error) {
+	textFontOnce.Do(func() {
+		textFont, textFontErr = sfnt.Parse(goregular.TTF)
+	})
+	return textFont, textFontErr
+}
+
+func NewTextBlock(lines []string) (*TextBlock, error) {
+	f, err := getFont()
+	if err != nil {
+		return nil, err
+	}
+	var buf sfnt.Buffer
+	ppem := fixed.I(textSize)
+	metrics, err := f.Metrics(&buf, ppem, font.HintingNone)
+	if err != nil {
+		return nil, err
+	}
+	ascent := toFloat(metrics.Ascent)
+	lineHeight := toFloat(metrics.Height)
+	widths := make([]float64, len(lines))
+	block := &TextBlock{Height: lineHeight * float64(len(lines))}
+	for i, line := range lines {
+		if widths[i], err = lineWidth(f, &buf, line, ppem); err != nil {
+			return nil, err
+		}
+		block.Width = max(block.Width, widths[i])
+	}
+	for i, line := range lines {
+		/* Glyph outlines are y down, relative to the baseline */
+		originX := -widths[i] / 2
+		originY := -block.Height/2 + float64(i)*lineHeight + ascent
+		prev := sfnt.GlyphIndex(0)
+		for j, r := range line {
+			x, err := f.GlyphIndex(&buf, r)
+			if err != nil {
+				return nil, err
+			}
+			if j > 0 {
+				if kern, err := f.Kern(&buf, prev, x, ppem, font.HintingNone); err == nil {
+					originX += toFloat(kern)
+				}
+			}
+			segments, err := f.LoadGlyph(&buf, x, ppem, nil)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range segments {
+				seg := PathSegment{Op: int(s.Op)}
+				for k := range s.Args {
+					seg.Points[k] = Point{
+						X: originX + toFloat(s.Args[k].X),
+						Y: -(originY + toFloat(s.Args[k].Y)),
+					}
+				}
+				block.Segments = append(block.Segments, seg)
+			}
+			advance, err := f.GlyphAdvance(&buf, x, ppem, font.HintingNone)
+			if err != nil {
+				return nil, err
+			}
+			originX += toFloat(advance)
+			prev = x
+		}
+	}
+	return block, nil
+}
+
+func lineWidth(f *sfnt.Font, buf *sfnt.Buffer, line string, ppem fixed.Int26_6) (float64, error) {
+	var res float64
+	prev := sfnt.GlyphIndex(0)
+	for i, r := range line {
+		x, err := f.GlyphIndex(buf, r)
+		if err != nil {
+			return 0, err
+		}
+		if i > 0 {
+			if kern, err := f.Kern(buf, prev, x, ppem, font.HintingNone); err == nil {
+				res += toFloat(kern)
+			}
+		}
+		advance, err := f.GlyphAdvance(buf, x, ppem, font.HintingNone)
+		if err != nil {
+			return 0, err
+		}
+		res += toFloat(advance)
+		prev = x
+	}
+	return res, nil
+}
+
+/* Drops blank lines and control characters the font can't draw */
+func CleanLines(lines []string) []string {
+	var res []string
+	for _, line := range lines {
+		line = strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f {
+				return -1
+			}
+			return r
+		}, line)
+		if line = strings.TrimSpace(line); line != "" {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+func toFloat(v fixed.Int26_6) float64 {
+	return float64(v) / 64
+}
@@ -207,7 +207,7 @@ export class FileAPI {
   }
 
   async copy(id: string, options: FileCopyOptions): Promise<File[]> {
-    const response = await fetch(`${API_URL}/v2/files/${id}/copy`, {
+    const response = await fetch(`${API_URL}/v2/files/${id}/copy?wait=true`, {
       method: 'POST',
       headers: {
         'Authorization': `Bearer ${this.token.access_token}`,
@@ -221,7 +221,7 @@ export class FileAPI {
   }
 
   async move(id: string, options: FileMoveOptions): Promise<void> {
-    const response = await fetch(`${API_URL}/v2/files/${id}/move`, {
+    const response = await fetch(`${API_URL}/v2/files/${id}/move?wait=true`, {
       method: 'POST',
       headers: {
         'Authorization': `Bearer ${this.token.access_token}`,
@@ -249,7 +249,7 @@ export class FileAPI {
   }
 
   async delete(id: string): Promise<void> {
-    const response = await fetch(`${API_URL}/v2/files`, {
+    const response = await fetch(`${API_URL}/v2/files?wait=true`, {
       method: 'DELETE',
       headers: {
         'Authorization': `Bearer ${this.token.access_token}`,